@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// Accept errors (e.g. running out of file descriptors) are retried after
+	// a delay doubling from minAcceptRetry up to maxAcceptRetry, instead of
+	// spinning.
+	minAcceptRetry = 5 * time.Millisecond
+	maxAcceptRetry = time.Second
+
+	// fdPerConn is the number of file descriptors a proxied connection
+	// uses: the player's and the backend's.
+	fdPerConn = 2
+
+	// fdReserve is kept free for listeners, HTTP clients and servers, log
+	// files and the like.
+	fdReserve = 128
+
+	// overflowLogInterval limits how often refused connections over the
+	// -max-connections cap are logged.
+	overflowLogInterval = 10 * time.Second
+)
+
+// connSlots caps the number of connections handled at once across all
+// listeners (-max-connections). Connections beyond it are closed right away
+// rather than spawning more goroutines.
+type connSlots struct {
+	sem chan struct{}
+
+	overflow    atomic.Int64 // refused since the last log line
+	lastWarning atomic.Int64 // unix nanoseconds
+}
+
+func newConnSlots(n int) *connSlots {
+	return &connSlots{sem: make(chan struct{}, n)}
+}
+
+// tryAcquire takes a slot if one is free.
+func (s *connSlots) tryAcquire() bool {
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *connSlots) release() {
+	<-s.sem
+}
+
+// inUse returns the number of slots taken.
+func (s *connSlots) inUse() int {
+	return len(s.sem)
+}
+
+// refuse records a connection turned away for lack of a slot, logging at
+// most once per overflowLogInterval.
+func (s *connSlots) refuse(remote string) {
+	tracker.refused.Add(1)
+	n := s.overflow.Add(1)
+	now := time.Now().UnixNano()
+	last := s.lastWarning.Load()
+	if now-last >= int64(overflowLogInterval) && s.lastWarning.CompareAndSwap(last, now) {
+		s.overflow.Add(-n)
+		warnf("[tcp] Connection limit of %d reached: refused %d connection(s), latest from %s", cap(s.sem), n, remote)
+	}
+}
+
+// acceptLoop hands connections accepted on ln to handleConnection until ln
+// is closed.
+func acceptLoop(ln net.Listener, cfg Config) {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			// Draining for shutdown
+			return
+		}
+		if err != nil {
+			delay = min(max(delay*2, minAcceptRetry), maxAcceptRetry)
+			if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				warnf("[tcp] Accept error: %v (raise the open file limit or lower -max-connections); retrying in %s", err, delay)
+			} else {
+				warnf("[tcp] Accept error: %v; retrying in %s", err, delay)
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		if cfg.ConnSlots != nil && !cfg.ConnSlots.tryAcquire() {
+			cfg.ConnSlots.refuse(conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		go func() {
+			if cfg.ConnSlots != nil {
+				defer cfg.ConnSlots.release()
+			}
+			handleConnection(conn, cfg.reloaded())
+		}()
+	}
+}
+
+// checkFileDescriptors warns when the open file limit leaves no headroom
+// for maxConns proxied connections (0 = unlimited).
+func checkFileDescriptors(maxConns int) {
+	limit, ok := fileDescriptorLimit()
+	if !ok {
+		return
+	}
+	if limit <= fdReserve {
+		warnf("The open file limit is only %d; raise it (ulimit -n) to proxy connections reliably", limit)
+		return
+	}
+	fits := (limit - fdReserve) / fdPerConn
+	switch {
+	case maxConns == 0 && fits < 1000:
+		warnf("The open file limit of %d fits about %d connections; set -max-connections or raise the limit (ulimit -n)", limit, fits)
+	case maxConns > 0 && uint64(maxConns) > fits:
+		warnf("-max-connections %d exceeds the about %d connections the open file limit of %d fits; raise the limit (ulimit -n)", maxConns, fits, limit)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats (-auth-access-log-format).
+const (
+	accessLogCommon = "common"
+	accessLogJSON   = "json"
+)
+
+// accessLog records every request to the multiauth server (-auth-access-log)
+// in Common Log Format or as JSON lines, apart from the application log, for
+// log analysis tools.
+type accessLog struct {
+	path    string // "stdout" or a file appended to
+	format  string
+	trusted []netip.Prefix // -auth-trusted-proxies, for the requester address
+	now     func() time.Time
+
+	mu sync.Mutex
+	w  io.Writer
+	f  *os.File // nil for stdout
+}
+
+func newAccessLog(path, format string, trusted []netip.Prefix) (*accessLog, error) {
+	if format != accessLogCommon && format != accessLogJSON {
+		return nil, fmt.Errorf("unknown format %q (expected common or json)", format)
+	}
+	l := &accessLog{path: path, format: format, trusted: trusted, now: time.Now}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reopen (re)opens the log file, so it can be rotated: move it away, then
+// send SIGHUP.
+func (l *accessLog) reopen() error {
+	if l.path == "stdout" {
+		l.mu.Lock()
+		l.w = os.Stdout
+		l.mu.Unlock()
+		return nil
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.w, l.f = f, f
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// accessEntry is one request, and the JSON format's line.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration_ms"`
+	Username  string    `json:"username,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// accessRecorder captures the status and size of a response.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// wrap logs every request h serves.
+func (l *accessLog) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := l.now()
+		rec := &accessRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		l.write(accessEntry{
+			Time:      start,
+			Remote:    requesterIP(r, l.trusted),
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    rec.status,
+			Bytes:     rec.bytes,
+			Duration:  float64(l.now().Sub(start).Microseconds()) / 1000,
+			Username:  r.URL.Query().Get("username"),
+			UserAgent: r.UserAgent(),
+		})
+	})
+}
+
+func (l *accessLog) write(e accessEntry) {
+	var line []byte
+	if l.format == accessLogJSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		remote, size := e.Remote, "-"
+		if remote == "" {
+			remote = "-"
+		}
+		if e.Bytes > 0 {
+			size = fmt.Sprint(e.Bytes)
+		}
+		request := strings.NewReplacer(`"`, `\"`, "\n", `\n`).Replace(e.Method + " " + e.URI + " " + e.Proto)
+		line = fmt.Appendf(nil, "%s - - [%s] \"%s\" %d %s\n", remote, e.Time.Format("02/Jan/2006:15:04:05 -0700"), request, e.Status, size)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(line); err != nil {
+		warnf("[auth] writing the access log: %v", err)
+	}
+}
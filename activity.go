@@ -0,0 +1,191 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// authFeedSize is how many recent auth outcomes are kept for the dashboard.
+	authFeedSize = 50
+
+	// trafficInterval is how often transfer rates are sampled.
+	trafficInterval = 5 * time.Second
+
+	// trafficHistorySize is how many traffic samples are kept (10 minutes).
+	trafficHistorySize = 120
+)
+
+// authEvent is one hasJoined outcome, as shown in the dashboard feed.
+type authEvent struct {
+	Time     time.Time `json:"time"`
+	Username string    `json:"username"`
+	Result   string    `json:"result"`             // "success", "failed", "blocked", "banned", "throttled", "replayed" or "not_whitelisted"
+	Upstream string    `json:"upstream,omitempty"` // winning upstream on success
+}
+
+// upstreamStatus is the last observed state of one session server.
+type upstreamStatus struct {
+	Name       string    `json:"name"`
+	LastSeen   time.Time `json:"last_seen"`
+	LastStatus int       `json:"last_status"`
+	LastError  string    `json:"last_error,omitempty"`
+	LatencyMs  int64     `json:"latency_ms"`
+	Successes  int64     `json:"successes"`
+	Failures   int64     `json:"failures"` // errors only; 204s are normal
+}
+
+// backendStatus is the last observed dial result for a backend.
+type backendStatus struct {
+	Addr        string    `json:"addr"`
+	Up          bool      `json:"up"`
+	LastDial    time.Time `json:"last_dial"`
+	LastError   string    `json:"last_error,omitempty"`
+	LatencyMs   int64     `json:"latency_ms"`
+	DialsOK     int64     `json:"dials_ok"`
+	DialsFailed int64     `json:"dials_failed"`
+}
+
+// trafficSample is the average transfer rate over one sampling interval.
+type trafficSample struct {
+	Time   time.Time `json:"time"`
+	InBps  int64     `json:"in_bps"`  // client → backend
+	OutBps int64     `json:"out_bps"` // backend → client
+	Conns  int       `json:"conns"`
+}
+
+// activityLog collects the recent history shown by the admin dashboard.
+type activityLog struct {
+	mu        sync.Mutex
+	authFeed  []authEvent
+	upstreams map[string]*upstreamStatus
+	backends  map[string]*backendStatus
+	traffic   []trafficSample
+}
+
+// activity is the process-wide activity log.
+var activity = newActivityLog()
+
+func newActivityLog() *activityLog {
+	return &activityLog{
+		upstreams: make(map[string]*upstreamStatus),
+		backends:  make(map[string]*backendStatus),
+	}
+}
+
+// recordAuth appends an auth outcome to the feed.
+func (a *activityLog) recordAuth(ev authEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.authFeed = append(a.authFeed, ev)
+	if len(a.authFeed) > authFeedSize {
+		a.authFeed = a.authFeed[len(a.authFeed)-authFeedSize:]
+	}
+}
+
+// recordUpstream updates the health of a session server from one response.
+func (a *activityLog) recordUpstream(result authResult) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.upstreams[result.Server]
+	if !ok {
+		u = &upstreamStatus{Name: result.Server}
+		a.upstreams[result.Server] = u
+	}
+	u.LastSeen = time.Now()
+	u.LastStatus = result.StatusCode
+	u.LatencyMs = result.Latency.Milliseconds()
+	u.LastError = ""
+	switch {
+	case result.Err != nil:
+		u.LastError = result.Err.Error()
+		u.Failures++
+	case isAuthSuccess(result):
+		u.Successes++
+	}
+}
+
+// recordDial updates the status of a backend from one dial attempt and
+// publishes backend.down/backend.up when its state changes.
+func (a *activityLog) recordDial(addr string, latency time.Duration, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b, ok := a.backends[addr]
+	if !ok {
+		// Unknown backends are assumed up, so a first failure is reported
+		b = &backendStatus{Addr: addr, Up: true}
+		a.backends[addr] = b
+	}
+	if wasUp := b.Up; wasUp != (err == nil) {
+		if err != nil {
+			events.publish(eventBackendDown, map[string]any{"backend": addr, "error": err.Error()})
+		} else {
+			events.publish(eventBackendUp, map[string]any{"backend": addr})
+		}
+	}
+	b.LastDial = time.Now()
+	b.LatencyMs = latency.Milliseconds()
+	b.Up = err == nil
+	b.LastError = ""
+	if err != nil {
+		b.LastError = err.Error()
+		b.DialsFailed++
+	} else {
+		b.DialsOK++
+	}
+}
+
+// sampleTraffic records transfer rates from the connection tracker every
+// trafficInterval. It never returns.
+func (a *activityLog) sampleTraffic(t *connTracker) {
+	lastIn, lastOut := t.bytesIn.Load(), t.bytesOut.Load()
+	ticker := time.NewTicker(trafficInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		in, out := t.bytesIn.Load(), t.bytesOut.Load()
+		secs := int64(trafficInterval / time.Second)
+		sample := trafficSample{
+			Time:   now,
+			InBps:  (in - lastIn) / secs,
+			OutBps: (out - lastOut) / secs,
+			Conns:  t.count(),
+		}
+		lastIn, lastOut = in, out
+
+		a.mu.Lock()
+		a.traffic = append(a.traffic, sample)
+		if len(a.traffic) > trafficHistorySize {
+			a.traffic = a.traffic[len(a.traffic)-trafficHistorySize:]
+		}
+		a.mu.Unlock()
+	}
+}
+
+// activitySnapshot is a copy of the activity log that is safe to serialize.
+type activitySnapshot struct {
+	AuthFeed  []authEvent      `json:"auth_feed"`
+	Upstreams []upstreamStatus `json:"upstreams"`
+	Backends  []backendStatus  `json:"backends"`
+	Traffic   []trafficSample  `json:"traffic"`
+}
+
+func (a *activityLog) snapshot() activitySnapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	snap := activitySnapshot{
+		AuthFeed: append([]authEvent(nil), a.authFeed...),
+		Traffic:  append([]trafficSample(nil), a.traffic...),
+	}
+	for _, u := range a.upstreams {
+		snap.Upstreams = append(snap.Upstreams, *u)
+	}
+	for _, b := range a.backends {
+		snap.Backends = append(snap.Backends, *b)
+	}
+	sort.Slice(snap.Upstreams, func(i, j int) bool { return snap.Upstreams[i].Name < snap.Upstreams[j].Name })
+	sort.Slice(snap.Backends, func(i, j int) bool { return snap.Backends[i].Addr < snap.Backends[j].Addr })
+	return snap
+}
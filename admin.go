@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// eventStreamKeepalive is how often an idle event stream sends a comment.
+const eventStreamKeepalive = 15 * time.Second
+
+// startTime is used to report uptime on the admin endpoints.
+var startTime = time.Now()
+
+// adminStatus is the payload of /api/status, which the dashboard polls.
+type adminStatus struct {
+	Build         buildInfo    `json:"build"`
+	UptimeSeconds float64      `json:"uptime_seconds"`
+	ListenAddr    string       `json:"listen_addr"`
+	BackendAddr   string       `json:"backend_addr"`
+	Accepted      int64        `json:"accepted"`
+	BytesIn       int64        `json:"bytes_in"`
+	BytesOut      int64        `json:"bytes_out"`
+	Connections   []connInfo   `json:"connections"`
+	Queue         *queueStats  `json:"queue,omitempty"`
+	BackendProbes []probeStats `json:"backend_probes,omitempty"`
+	activitySnapshot
+}
+
+func startAdmin(cfg Config) {
+	go activity.sampleTraffic(tracker)
+
+	server := &http.Server{
+		Addr:         cfg.AdminListenAddr,
+		Handler:      newAdminMux(cfg),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	infof("[admin] Listening on %s", cfg.AdminListenAddr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("[admin] Failed to start: %v", err)
+	}
+}
+
+func newAdminMux(cfg Config) http.Handler {
+	mux := http.NewServeMux()
+
+	// Dashboard UI
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	})
+
+	// Snapshot of everything the dashboard shows
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		var queue *queueStats
+		if cfg.Queue != nil {
+			stats := cfg.Queue.stats()
+			queue = &stats
+		}
+		writeJSON(w, adminStatus{
+			Build:            currentBuild(),
+			UptimeSeconds:    time.Since(startTime).Seconds(),
+			ListenAddr:       cfg.ListenAddr,
+			BackendAddr:      cfg.reloaded().currentBackend(),
+			Accepted:         tracker.accepted.Load(),
+			BytesIn:          tracker.bytesIn.Load(),
+			BytesOut:         tracker.bytesOut.Load(),
+			Connections:      tracker.snapshot(),
+			Queue:            queue,
+			BackendProbes:    latencyProbes.snapshot(),
+			activitySnapshot: activity.snapshot(),
+		})
+	})
+
+	// Live connections only, for quick inspection with curl
+	mux.HandleFunc("/debug/connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, tracker.snapshot())
+	})
+
+	// Disconnect players at the proxy layer
+	mux.HandleFunc("/api/kick", handleKick)
+
+	// Online players, for external tools
+	mux.HandleFunc("/api/players", handlePlayers)
+
+	// Public player count and server status, for websites and bots
+	registerPublicStatus(mux, cfg)
+
+	// Ban list management
+	mux.HandleFunc("/api/bans", handleBans(cfg.Bans))
+
+	// Whitelist management
+	mux.HandleFunc("/api/whitelist", handleWhitelist(cfg.Whitelist))
+
+	// Kubernetes probes
+	registerProbes(mux, cfg)
+
+	// Readiness with backend latency, for people
+	mux.HandleFunc("/health", handleHealth(cfg))
+
+	// Prometheus metrics
+	mux.HandleFunc("/metrics", handleMetrics(cfg))
+
+	// Live event stream (Server-Sent Events)
+	mux.HandleFunc("/api/events", handleEventStream)
+
+	// Runtime log level and per-connection debug toggles
+	mux.HandleFunc("/api/log", handleLogSettings)
+
+	return requireAdminToken(cfg.AdminToken, mux)
+}
+
+// isLoopbackListen reports whether the listen address addr only accepts
+// connections from this host.
+func isLoopbackListen(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// publicAdminPaths are served without the admin token.
+var publicAdminPaths = map[string]bool{"/": true, "/livez": true, "/readyz": true, "/api/server": true, "/api/server/shields": true}
+
+// requireAdminToken rejects requests that don't carry the admin token, either
+// as "Authorization: Bearer <token>" or as a ?token= query parameter. The
+// dashboard page itself, the probes and the public server status are public;
+// the data the dashboard loads is not.
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !publicAdminPaths[r.URL.Path] {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if got == "" {
+				got = r.URL.Query().Get("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logSettings is the payload of /api/log. On POST, omitted fields are left
+// unchanged.
+type logSettings struct {
+	Level        *string  `json:"level,omitempty"`
+	ConnDebug    *bool    `json:"conn_debug,omitempty"`
+	ConnDebugIPs []string `json:"conn_debug_ips"`
+}
+
+// handleLogSettings reports (GET) or changes (POST) the log level and
+// per-connection debug output without a restart.
+func handleLogSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req logSettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Level != nil {
+			level, err := parseLogLevel(*req.Level)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			setLogLevel(level)
+			infof("[admin] Log level set to %s", level)
+		}
+		if req.ConnDebug != nil {
+			connDebugging.all.Store(*req.ConnDebug)
+			infof("[admin] Per-connection debug output for all connections: %t", *req.ConnDebug)
+		}
+		if req.ConnDebugIPs != nil {
+			connDebugging.setIPs(req.ConnDebugIPs)
+			infof("[admin] Per-connection debug output for IPs: %v", req.ConnDebugIPs)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	level := getLogLevel().String()
+	all := connDebugging.all.Load()
+	writeJSON(w, logSettings{Level: &level, ConnDebug: &all, ConnDebugIPs: connDebugging.ipList()})
+}
+
+// kickRequest is the payload of /api/kick. Connections matching any of the
+// given fields are closed.
+type kickRequest struct {
+	ID       uint64 `json:"id,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+// handleKick closes live connections by connection ID, IP or username. Play
+// traffic is encrypted, so no disconnect message can be injected; the player
+// sees a plain "connection lost".
+func handleKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req kickRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ID == 0 && req.IP == "" && req.Username == "" {
+		http.Error(w, "one of id, ip or username is required", http.StatusBadRequest)
+		return
+	}
+
+	kicked := tracker.kick(req.ID, req.IP, req.Username)
+	infof("[admin] Kick (id=%d ip=%q username=%q): closed connections %v", req.ID, req.IP, req.Username, kicked)
+	if kicked == nil {
+		kicked = []uint64{}
+	}
+	writeJSON(w, map[string]any{"kicked": kicked})
+}
+
+// banRequest is the payload of POST /api/bans.
+type banRequest struct {
+	Target   string `json:"target"`             // IP, CIDR or username
+	Reason   string `json:"reason,omitempty"`   // shown to the player
+	Duration string `json:"duration,omitempty"` // e.g. "24h"; empty = permanent
+}
+
+// handleBans lists (GET), adds (POST) and lifts (DELETE ?target=) bans.
+// Adding a ban also kicks matching players who are online.
+func handleBans(bans *banList) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if bans == nil {
+			http.Error(w, "bans are not enabled", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, bans.list())
+
+		case http.MethodPost:
+			var req banRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			var duration time.Duration
+			if req.Duration != "" {
+				d, err := time.ParseDuration(req.Duration)
+				if err != nil || d <= 0 {
+					http.Error(w, "duration must be a positive duration such as 24h", http.StatusBadRequest)
+					return
+				}
+				duration = d
+			}
+			b, err := bans.add(req.Target, req.Reason, duration)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			kicked := tracker.kickWhere(func(c *trackedConn) bool {
+				name, _ := c.username.Load().(string)
+				_, ipBanned := bans.checkIP(c.RealAddr)
+				_, nameBanned := bans.checkUsername(name)
+				return ipBanned || (name != "" && nameBanned)
+			})
+			infof("[admin] Banned %s (reason=%q, expires=%v), kicked connections %v", b.Target, b.Reason, b.Expires, kicked)
+			writeJSON(w, b)
+
+		case http.MethodDelete:
+			target := r.URL.Query().Get("target")
+			removed, err := bans.remove(target)
+			if errors.Is(err, errBackendBan) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !removed {
+				http.Error(w, "no ban on "+target, http.StatusNotFound)
+				return
+			}
+			infof("[admin] Unbanned %s", target)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleWhitelist lists (GET), adds (POST {"name", "uuid"}) and removes
+// (DELETE ?name=) whitelisted players. Removing a player also kicks them if
+// they are online.
+func handleWhitelist(wl *whitelist) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if wl == nil {
+			http.Error(w, "the whitelist is not enabled", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, wl.list())
+
+		case http.MethodPost:
+			var req whitelistEntry
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			e, err := wl.add(req)
+			if errors.Is(err, errWhitelistReadOnly) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			infof("[admin] Whitelisted %s (uuid=%q)", e.Name, e.UUID)
+			writeJSON(w, e)
+
+		case http.MethodDelete:
+			name := r.URL.Query().Get("name")
+			removed, err := wl.remove(name)
+			if errors.Is(err, errWhitelistReadOnly) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !removed {
+				http.Error(w, name+" is not whitelisted", http.StatusNotFound)
+				return
+			}
+			kicked := tracker.kick(0, "", name)
+			infof("[admin] Removed %s from the whitelist, kicked connections %v", name, kicked)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleEventStream streams bus events as Server-Sent Events. The optional
+// "type" query parameter filters by event type prefix, e.g. ?type=auth.
+func handleEventStream(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// Streams outlive the server's write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	filter := r.URL.Query().Get("type")
+
+	ch, unsubscribe := events.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case ev := <-ch:
+			if !strings.HasPrefix(ev.Type, filter) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			// Comment lines keep intermediaries from closing an idle stream
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		rc.Flush()
+	}
+}
+
+// writeJSON writes v as an indented JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		warnf("[admin] Failed to encode response: %v", err)
+	}
+}
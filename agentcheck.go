@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// agentCheckTimeout bounds writing a reply to an agent check.
+const agentCheckTimeout = 5 * time.Second
+
+// startAgentCheck answers HAProxy agent checks on cfg.AgentCheckAddr
+// (-agent-check), so a load balancer in front of several proxies can
+// weight and drain them by their load.
+func startAgentCheck(cfg Config) {
+	ln, err := net.Listen("tcp", cfg.AgentCheckAddr)
+	if err != nil {
+		log.Fatalf("[agent] Failed to start: %v", err)
+	}
+	infof("[agent] Answering HAProxy agent checks on %s", ln.Addr())
+	serveAgentCheck(ln, cfg)
+}
+
+func serveAgentCheck(ln net.Listener, cfg Config) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			reply := readiness.agentCheckReply(cfg.reloaded())
+			debugf("[agent] %s: %s", conn.RemoteAddr(), reply)
+			conn.SetWriteDeadline(time.Now().Add(agentCheckTimeout))
+			fmt.Fprintf(conn, "%s\n", reply)
+		}()
+	}
+}
+
+// agentCheckReply returns the line HAProxy's agent-check reads: "drain"
+// while draining before shutdown, "down" with the reason when not ready,
+// and otherwise "up ready" with a weight that falls from 100% to 0% as
+// connections approach -max-connections or players -max-players, whichever
+// is closer to its cap.
+func (l *lifecycle) agentCheckReply(cfg Config) string {
+	if l.draining.Load() {
+		return "drain"
+	}
+	if ok, reason := l.ready(cfg); !ok {
+		// HAProxy shows what follows # in its stats page
+		return "down #" + strings.ReplaceAll(reason, "\n", " ")
+	}
+	load := 0.0
+	if cfg.ConnSlots != nil {
+		load = math.Max(load, float64(cfg.ConnSlots.inUse())/float64(cap(cfg.ConnSlots.sem)))
+	}
+	if cfg.Queue != nil {
+		s := cfg.Queue.stats()
+		load = math.Max(load, float64(s.Active)/float64(s.MaxPlayers))
+	}
+	weight := int(math.Round(100 * (1 - math.Min(load, 1))))
+	return fmt.Sprintf("up ready %d%%", weight)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// unverifiedLoginMessage is shown to players whose IP hasn't pinged the
+// server recently when -verify-ping is enabled.
+const unverifiedLoginMessage = "Please add this server to your server list and refresh it, then join again."
+
+// pingGate remembers which IPs recently completed a status ping. Real clients
+// ping a server whenever it is shown in their server list, while join bots
+// usually go straight to login, so with -verify-ping logins from IPs without
+// a recent ping are refused.
+type pingGate struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	verified  map[string]time.Time // IP → expiry
+	lastSweep time.Time
+}
+
+func newPingGate(window time.Duration) *pingGate {
+	return &pingGate{window: window, verified: make(map[string]time.Time), lastSweep: time.Now()}
+}
+
+// markVerified lets ip log in for the next window. It is called on status
+// pings and again on every admitted login, so active players stay verified.
+func (g *pingGate) markVerified(ip string) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.verified[ip] = now.Add(g.window)
+
+	// Drop expired entries now and then so scans don't grow the map forever
+	if now.Sub(g.lastSweep) >= g.window {
+		for k, expiry := range g.verified {
+			if now.After(expiry) {
+				delete(g.verified, k)
+			}
+		}
+		g.lastSweep = now
+	}
+}
+
+// isVerified reports whether ip pinged the server within the window.
+func (g *pingGate) isVerified(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	expiry, ok := g.verified[ip]
+	return ok && time.Now().Before(expiry)
+}
+
+// addrIP returns the IP part of a host:port address, or addr itself if it
+// has no port.
+func addrIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// size returns the number of IPs currently remembered.
+func (g *pingGate) size() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.verified)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// upstreamTrace is what one session server answered during test-auth.
+type upstreamTrace struct {
+	Server  string
+	Status  int
+	Latency time.Duration
+	Bytes   int
+	Err     error
+}
+
+// tracingTransport records every upstream request of a hasJoined fan-out,
+// so test-auth can show them without changing how the fan-out runs.
+type tracingTransport struct {
+	base    http.RoundTripper
+	servers []string
+
+	mu     sync.Mutex
+	traces []upstreamTrace
+	done   chan struct{} // receives one value per finished request
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := upstreamTrace{Server: req.URL.Scheme + "://" + req.URL.Host}
+	for _, server := range t.servers {
+		if u, err := url.Parse(server); err == nil && u.Host == req.URL.Host {
+			trace.Server = server
+		}
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		// Read the body here so the latency covers the whole answer
+		var body []byte
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		trace.Status, trace.Bytes = resp.StatusCode, len(body)
+	}
+	trace.Latency, trace.Err = time.Since(start), err
+
+	t.mu.Lock()
+	t.traces = append(t.traces, trace)
+	t.mu.Unlock()
+	t.done <- struct{}{}
+	return resp, err
+}
+
+// authRecorder is the http.ResponseWriter test-auth hands the fan-out.
+type authRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *authRecorder) Header() http.Header { return r.header }
+func (r *authRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+func (r *authRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+// runTestAuth implements the test-auth subcommand.
+func runTestAuth(args []string) error {
+	fs := flag.NewFlagSet("test-auth", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mc-dual-proxy test-auth [flags] USERNAME [SERVERID]")
+		fmt.Fprintln(fs.Output(), "Runs a hasJoined request through the multiauth fan-out and shows what every session server answered.")
+		fmt.Fprintln(fs.Output(), "Without SERVERID a random one is used, which no session server knows: every upstream should answer 204.")
+		fs.PrintDefaults()
+	}
+	sessionServers := fs.String("session-servers", "https://sessionserver.mojang.com,https://api.minehut.com/mitm/proxy", "Comma-separated session server base URLs")
+	var dialects stringList
+	fs.Var(&dialects, "upstream-dialect", "Session server dialect as NAME=DIALECT (repeatable)")
+	prefer := fs.String("prefer", "", "Preferred upstream and grace window, e.g. mojang=150ms")
+	conflictPolicy := fs.String("conflict-policy", conflictFirst, "What to do when several upstreams succeed: first, priority or reject")
+	ip := fs.String("ip", "", "Player IP sent along, as backends with prevent-proxy-connections do")
+	verbose := fs.Bool("v", false, "Also print the multiauth log lines")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return errors.New("expected USERNAME and an optional SERVERID")
+	}
+	username, serverID := fs.Arg(0), fs.Arg(1)
+	if serverID == "" {
+		serverID = randomServerID()
+	}
+
+	cfg := Config{SessionServers: parseSessionServers(*sessionServers), ConflictPolicy: *conflictPolicy}
+	if len(cfg.SessionServers) == 0 {
+		return errors.New("no -session-servers given")
+	}
+	var err error
+	if cfg.Dialects, err = parseDialects(dialects); err != nil {
+		return fmt.Errorf("invalid -upstream-dialect: %w", err)
+	}
+	if *prefer != "" {
+		if cfg.PreferUpstream, cfg.PreferWindow, err = parsePreference(*prefer); err != nil {
+			return fmt.Errorf("invalid -prefer: %w", err)
+		}
+	}
+	switch cfg.ConflictPolicy {
+	case conflictFirst, conflictPriority, conflictReject:
+	default:
+		return fmt.Errorf("invalid -conflict-policy %q (expected first, priority or reject)", cfg.ConflictPolicy)
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	fmt.Printf("hasJoined for %s with serverId %s via %d session servers\n\n", username, serverID, len(cfg.SessionServers))
+	status, body, traces := testAuth(cfg, username, serverID, *ip)
+	printTestAuth(os.Stdout, status, body, traces)
+	if status != http.StatusOK {
+		return fmt.Errorf("%s was not authenticated", username)
+	}
+	return nil
+}
+
+// testAuth runs one hasJoined request through handleHasJoined, waiting for
+// every upstream to answer (or time out) before returning what they said.
+func testAuth(cfg Config, username, serverID, ip string) (int, []byte, []upstreamTrace) {
+	transport := &tracingTransport{
+		base:    defaultUpstreamClient.Transport,
+		servers: cfg.SessionServers,
+		done:    make(chan struct{}, len(cfg.SessionServers)),
+	}
+	if cfg.UpstreamClient != nil && cfg.UpstreamClient.Transport != nil {
+		transport.base = cfg.UpstreamClient.Transport
+	}
+	cfg.UpstreamClient = &http.Client{Timeout: upstreamTimeout, Transport: transport}
+
+	query := url.Values{"username": {username}, "serverId": {serverID}}
+	if ip != "" {
+		query.Set("ip", ip)
+	}
+	req, _ := http.NewRequest(http.MethodGet, hasJoinedPath+"?"+query.Encode(), nil)
+	rec := &authRecorder{header: make(http.Header)}
+	handleHasJoined(rec, req, cfg)
+
+	// The fan-out answers as soon as it can; wait for the stragglers
+	timeout := time.After(upstreamTimeout + time.Second)
+wait:
+	for range cfg.SessionServers {
+		select {
+		case <-transport.done:
+		case <-timeout:
+			break wait
+		}
+	}
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	return rec.status, rec.body.Bytes(), append([]upstreamTrace(nil), transport.traces...)
+}
+
+// printTestAuth shows the per-upstream answers and the response the backend
+// would have received.
+func printTestAuth(w io.Writer, status int, body []byte, traces []upstreamTrace) {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "UPSTREAM\tSTATUS\tLATENCY\tBYTES")
+	for _, t := range traces {
+		result := fmt.Sprint(t.Status)
+		if t.Err != nil {
+			result = "error: " + t.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", upstreamName(t.Server), result, t.Latency.Round(time.Millisecond), t.Bytes)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nResult: %d %s\n", status, http.StatusText(status))
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, body, "", "  ") == nil {
+		fmt.Fprintln(w, pretty.String())
+	} else if len(body) > 0 {
+		fmt.Fprintln(w, string(body))
+	}
+}
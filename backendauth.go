@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// backendUpstreams limits which upstreams may authenticate players headed
+// for a backend (-backend-upstreams), e.g. so a Mojang-only server behind
+// the same proxy as a Minehut one never lets in a Minehut identity.
+// Backends without a rule accept every upstream.
+//
+// The login is encrypted by the time hasJoined is asked, so players refused
+// here only see the backend's "Failed to verify username".
+type backendUpstreams struct {
+	backends []string                   // in flag order, for String
+	allowed  map[string]map[string]bool // backend address → upstream names
+}
+
+// parseBackendUpstreams parses BACKEND=UPSTREAM,UPSTREAM values, naming
+// upstreams like -prefer does. No values return nil.
+func parseBackendUpstreams(values []string) (*backendUpstreams, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	b := &backendUpstreams{allowed: make(map[string]map[string]bool)}
+	for _, value := range values {
+		backend, names, ok := strings.Cut(value, "=")
+		backend = strings.TrimSpace(backend)
+		if !ok || backend == "" {
+			return nil, fmt.Errorf("%q is not BACKEND=UPSTREAMS", value)
+		}
+		if b.allowed[backend] != nil {
+			return nil, fmt.Errorf("backend %s is listed twice", backend)
+		}
+		upstreams := make(map[string]bool)
+		for _, server := range parseSessionServers(names) {
+			upstreams[upstreamName(server)] = true
+		}
+		if len(upstreams) == 0 {
+			return nil, fmt.Errorf("no upstreams for %s", backend)
+		}
+		b.backends = append(b.backends, backend)
+		b.allowed[backend] = upstreams
+	}
+	return b, nil
+}
+
+// accepts reports whether players headed for backend may be authenticated
+// by upstream. An unknown backend ("") accepts nothing, so the rules can't
+// be sidestepped by a login the proxy can't place.
+func (b *backendUpstreams) accepts(backend, upstream string) bool {
+	if b == nil {
+		return true
+	}
+	if backend == "" {
+		return false
+	}
+	if b.allowed[backend] == nil {
+		return true
+	}
+	return b.allowed[backend][upstream]
+}
+
+func (b *backendUpstreams) String() string {
+	var rules []string
+	for _, backend := range b.backends {
+		var names []string
+		for name := range b.allowed[backend] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		rules = append(rules, backend+" ← "+strings.Join(names, "/"))
+	}
+	return strings.Join(rules, ", ")
+}
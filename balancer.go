@@ -0,0 +1,202 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// balancerProbeTimeout bounds each latency probe.
+	balancerProbeTimeout = 2 * time.Second
+
+	// balancerSmoothing is the weight of a new probe in a backend's
+	// latency, so one slow probe doesn't reorder the backends.
+	balancerSmoothing = 0.3
+)
+
+// backendBalancer spreads connections over several backends given to
+// -backend, e.g. one per region. It measures the TCP connect time to each
+// every interval, and connections dial them nearest first (or in a fixed
+// order per player with -sticky), failing over to the next. Backends that
+// fail a probe or a dial go last until a probe reaches them again.
+type backendBalancer struct {
+	addrs    []string // as configured
+	interval time.Duration
+	sticky   string // stickyIP or stickyUsername to pin players to a backend; "" orders by latency
+
+	mu      sync.Mutex
+	rtt     map[string]time.Duration // smoothed connect time; absent until measured
+	down    map[string]error
+	nearest string // last logged nearest backend
+}
+
+// -sticky modes.
+const (
+	stickyIP       = "ip"
+	stickyUsername = "username"
+)
+
+// parseBackendList splits a comma-separated -backend value.
+func parseBackendList(s string) ([]string, error) {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no backend address in %q", s)
+	}
+	return addrs, nil
+}
+
+func newBackendBalancer(addrs []string, interval time.Duration) *backendBalancer {
+	return &backendBalancer{
+		addrs:    addrs,
+		interval: interval,
+		rtt:      make(map[string]time.Duration),
+		down:     make(map[string]error),
+	}
+}
+
+// run probes the backends every interval, starting right away.
+func (b *backendBalancer) run() {
+	for {
+		b.probe()
+		time.Sleep(b.interval)
+	}
+}
+
+// probe measures the connect time to every backend at once.
+func (b *backendBalancer) probe() {
+	var wg sync.WaitGroup
+	for _, addr := range b.addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", addr, balancerProbeTimeout)
+			if err != nil {
+				b.failed(addr, err)
+				return
+			}
+			conn.Close()
+			b.measured(addr, time.Since(start))
+		}()
+	}
+	wg.Wait()
+
+	if order := b.candidates(); b.sticky == "" && order[0] != b.nearest {
+		b.mu.Lock()
+		b.nearest = order[0]
+		rtt, ok := b.rtt[order[0]]
+		b.mu.Unlock()
+		if ok {
+			infof("[backend] nearest backend is now %s (%s)", order[0], rtt.Round(100*time.Microsecond))
+		}
+	}
+}
+
+func (b *backendBalancer) measured(addr string, rtt time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old, ok := b.rtt[addr]; ok {
+		rtt = time.Duration(float64(old)*(1-balancerSmoothing) + float64(rtt)*balancerSmoothing)
+	}
+	b.rtt[addr] = rtt
+	if _, wasDown := b.down[addr]; wasDown {
+		delete(b.down, addr)
+		infof("[backend] %s is reachable again", addr)
+	}
+}
+
+// failed marks addr down after a failed probe or dial.
+func (b *backendBalancer) failed(addr string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, wasDown := b.down[addr]; !wasDown {
+		warnf("[backend] %s is unreachable, trying it last: %v", addr, err)
+	}
+	b.down[addr] = err
+}
+
+// candidates returns the backends in the order to dial them: reachable ones
+// by latency, those not measured yet in configured order, then those that
+// are down.
+func (b *backendBalancer) candidates() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rank := func(addr string) int {
+		if _, down := b.down[addr]; down {
+			return 2
+		}
+		if _, ok := b.rtt[addr]; ok {
+			return 0
+		}
+		return 1
+	}
+	order := slices.Clone(b.addrs)
+	slices.SortStableFunc(order, func(x, y string) int {
+		if rx, ry := rank(x), rank(y); rx != ry {
+			return rx - ry
+		}
+		return cmp.Compare(b.rtt[x], b.rtt[y]) // 0 for unmeasured ones
+	})
+	return order
+}
+
+// candidatesFor returns the backends in the order to dial them for a
+// player. With -sticky, each player has a fixed order, found by rendezvous
+// hashing of their IP or username with each backend: a reconnecting player
+// lands on the same backend, and when one goes down only its players move.
+// Players whose name isn't known (status pings) are pinned by IP.
+func (b *backendBalancer) candidatesFor(ip, username string) []string {
+	if b.sticky == "" {
+		return b.candidates()
+	}
+	key := ip
+	if b.sticky == stickyUsername && username != "" {
+		key = strings.ToLower(username)
+	}
+	order := slices.Clone(b.addrs)
+	weight := func(addr string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(key + "\x00" + addr))
+		return h.Sum64()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	slices.SortStableFunc(order, func(x, y string) int {
+		_, downX := b.down[x]
+		_, downY := b.down[y]
+		if downX != downY {
+			if downX {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(weight(y), weight(x))
+	})
+	return order
+}
+
+// String lists the backends for the startup banner.
+func (b *backendBalancer) String() string {
+	if b.sticky != "" {
+		return fmt.Sprintf("%s (sticky by %s, probed every %s)", strings.Join(b.addrs, ", "), b.sticky, b.interval)
+	}
+	return fmt.Sprintf("%s (nearest first, probed every %s)", strings.Join(b.addrs, ", "), b.interval)
+}
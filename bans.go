@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ban is one entry of the ban list.
+type ban struct {
+	Target  string    `json:"target"` // IP, CIDR or username (lowercase)
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"` // zero = permanent
+	Source  string    `json:"source,omitempty"` // "backend" for bans from -backend-bans
+}
+
+func (b ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// message is the disconnect message shown to a banned player.
+func (b ban) message() string {
+	msg := "You are banned from this server."
+	if b.Reason != "" {
+		msg += "\nReason: " + b.Reason
+	}
+	if !b.Expires.IsZero() {
+		msg += "\nExpires: " + b.Expires.UTC().Format("2006-01-02 15:04 MST")
+	}
+	return msg
+}
+
+// banList holds IP, CIDR and username bans, persisted as JSON to path (if
+// set) on every change. Bans mirrored from the backend (backend) are
+// checked and listed too, but never saved or lifted here.
+type banList struct {
+	path    string
+	backend *backendBans
+
+	mu       sync.RWMutex
+	ips      map[netip.Addr]ban
+	prefixes map[netip.Prefix]ban
+	names    map[string]ban
+}
+
+func newBanList() *banList {
+	return &banList{ips: make(map[netip.Addr]ban), prefixes: make(map[netip.Prefix]ban), names: make(map[string]ban)}
+}
+
+// loadBanList reads the ban list from path, starting empty if it doesn't
+// exist yet.
+func loadBanList(path string) (*banList, error) {
+	bl := newBanList()
+	bl.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bans []ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, b := range bans {
+		if _, err := bl.insert(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return bl, nil
+}
+
+// insert adds b to the matching map and returns it with its target
+// normalized. Must be called with bl.mu held (or before bl is shared).
+func (bl *banList) insert(b ban) (ban, error) {
+	if addr, err := netip.ParseAddr(b.Target); err == nil {
+		b.Target = addr.Unmap().String()
+		bl.ips[addr.Unmap()] = b
+		return b, nil
+	}
+	if prefix, err := netip.ParsePrefix(b.Target); err == nil {
+		prefix = prefix.Masked()
+		b.Target = prefix.String()
+		bl.prefixes[prefix] = b
+		return b, nil
+	}
+	if usernamePattern.MatchString(b.Target) {
+		b.Target = strings.ToLower(b.Target)
+		bl.names[b.Target] = b
+		return b, nil
+	}
+	return ban{}, fmt.Errorf("invalid ban target %q (expected an IP, CIDR or username)", b.Target)
+}
+
+// add bans target for duration (0 = permanent) and saves the list.
+func (bl *banList) add(target, reason string, duration time.Duration) (ban, error) {
+	b := ban{Target: strings.TrimSpace(target), Reason: reason, Created: time.Now().UTC()}
+	if duration > 0 {
+		b.Expires = b.Created.Add(duration)
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	b, err := bl.insert(b)
+	if err != nil {
+		return ban{}, err
+	}
+	return b, bl.saveLocked()
+}
+
+// remove lifts the ban on target and saves the list. It reports whether a
+// ban existed.
+func (bl *banList) remove(target string) (bool, error) {
+	target = strings.TrimSpace(target)
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	removed := false
+	if addr, err := netip.ParseAddr(target); err == nil {
+		_, removed = bl.ips[addr.Unmap()]
+		delete(bl.ips, addr.Unmap())
+	} else if prefix, err := netip.ParsePrefix(target); err == nil {
+		_, removed = bl.prefixes[prefix.Masked()]
+		delete(bl.prefixes, prefix.Masked())
+	} else {
+		_, removed = bl.names[strings.ToLower(target)]
+		delete(bl.names, strings.ToLower(target))
+	}
+	if !removed {
+		if bl.backend.covers(target) {
+			return false, errBackendBan
+		}
+		return false, nil
+	}
+	return true, bl.saveLocked()
+}
+
+// checkIP returns the active ban covering ip (host or host:port), if any.
+func (bl *banList) checkIP(ip string) (ban, bool) {
+	addr, err := netip.ParseAddr(addrIP(ip))
+	if err != nil {
+		return ban{}, false
+	}
+	addr = addr.Unmap()
+	if b, ok := bl.backend.checkIP(addr.String()); ok {
+		return b, true
+	}
+	now := time.Now()
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	if b, ok := bl.ips[addr]; ok && !b.expired(now) {
+		return b, true
+	}
+	for prefix, b := range bl.prefixes {
+		if prefix.Contains(addr) && !b.expired(now) {
+			return b, true
+		}
+	}
+	return ban{}, false
+}
+
+// checkUsername returns the active ban on username, if any.
+func (bl *banList) checkUsername(username string) (ban, bool) {
+	if b, ok := bl.backend.checkUsername(username); ok {
+		return b, true
+	}
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	b, ok := bl.names[strings.ToLower(username)]
+	if !ok || b.expired(time.Now()) {
+		return ban{}, false
+	}
+	return b, true
+}
+
+// checkUUID returns the active ban on the player with id, if any. Only the
+// backend's bans know players by UUID.
+func (bl *banList) checkUUID(id string) (ban, bool) {
+	return bl.backend.checkUUID(id)
+}
+
+// list returns the active bans, the backend's included, oldest first.
+func (bl *banList) list() []ban {
+	bl.mu.RLock()
+	bans := bl.activeLocked()
+	bl.mu.RUnlock()
+	if backend := bl.backend.list(); len(backend) > 0 {
+		bans = append(bans, backend...)
+		sort.Slice(bans, func(i, j int) bool { return bans[i].Created.Before(bans[j].Created) })
+	}
+	return bans
+}
+
+// activeLocked returns the bans that haven't expired, oldest first. Must be
+// called with bl.mu held.
+func (bl *banList) activeLocked() []ban {
+	now := time.Now()
+	bans := make([]ban, 0, len(bl.ips)+len(bl.prefixes)+len(bl.names))
+	for _, b := range bl.ips {
+		if !b.expired(now) {
+			bans = append(bans, b)
+		}
+	}
+	for _, b := range bl.prefixes {
+		if !b.expired(now) {
+			bans = append(bans, b)
+		}
+	}
+	for _, b := range bl.names {
+		if !b.expired(now) {
+			bans = append(bans, b)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Created.Before(bans[j].Created) })
+	return bans
+}
+
+// saveLocked writes the active bans to disk atomically. Must be called with
+// bl.mu held.
+func (bl *banList) saveLocked() error {
+	if bl.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(bl.activeLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(bl.path), ".bans-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), bl.path)
+}
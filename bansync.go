@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// backendBanCheckInterval is how often at most the backend's ban files
+	// are checked for changes, so a flood of connections doesn't stat them
+	// on every handshake.
+	backendBanCheckInterval = time.Second
+
+	// vanillaBanTimeFormat is how the server writes the created and expires
+	// dates of its ban files.
+	vanillaBanTimeFormat = "2006-01-02 15:04:05 -0700"
+)
+
+// errBackendBan is returned when lifting a ban that comes from the
+// backend's ban files; it has to be lifted on the backend (/pardon).
+var errBackendBan = errors.New("the ban comes from the backend's ban files; lift it there with /pardon")
+
+// backendBans mirrors the bans of the backend server (-backend-bans): the
+// banned-ips.json and banned-players.json that vanilla, Paper and Spigot
+// keep in their directory. Bans made with /ban and /ban-ip then also take
+// effect at the proxy, so banned players are refused before they reach the
+// backend, even when they hammer the proxy directly. The files are read
+// again whenever they change.
+type backendBans struct {
+	dir string
+
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes [2]time.Time   // of banned-ips.json and banned-players.json when last read
+	bans     *banList       // by IP and by the name the player had when banned
+	uuids    map[string]ban // banned-players.json by UUID, without dashes
+	failing  bool
+}
+
+// vanillaBan is one entry of banned-ips.json (ip) or banned-players.json
+// (uuid and name).
+type vanillaBan struct {
+	IP      string `json:"ip,omitempty"`
+	UUID    string `json:"uuid,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Created string `json:"created"`
+	Source  string `json:"source"`
+	Expires string `json:"expires"` // "forever" or a date
+	Reason  string `json:"reason"`
+}
+
+// loadBackendBans reads the ban files in the backend's directory dir. A
+// file that doesn't exist yet counts as empty, since the server only writes
+// it on the first ban.
+func loadBackendBans(dir string) (*backendBans, error) {
+	s := &backendBans{dir: dir, bans: newBanList(), uuids: make(map[string]ban)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.checked = time.Now()
+	return s, nil
+}
+
+// load reads both files again if either changed since the last read. Must
+// be called with s.mu held (or before s is shared).
+func (s *backendBans) load() error {
+	var modTimes [2]time.Time
+	for i, name := range []string{"banned-ips.json", "banned-players.json"} {
+		info, err := os.Stat(filepath.Join(s.dir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	if modTimes == s.modTimes {
+		return nil
+	}
+
+	bans, uuids := newBanList(), make(map[string]ban)
+	ipEntries, err := readVanillaBans(filepath.Join(s.dir, "banned-ips.json"))
+	if err != nil {
+		return err
+	}
+	for _, e := range ipEntries {
+		b, err := e.ban(e.IP)
+		if err != nil {
+			return fmt.Errorf("banned-ips.json: %w", err)
+		}
+		if _, err := bans.insert(b); err != nil {
+			return fmt.Errorf("banned-ips.json: %w", err)
+		}
+	}
+	playerEntries, err := readVanillaBans(filepath.Join(s.dir, "banned-players.json"))
+	if err != nil {
+		return err
+	}
+	for _, e := range playerEntries {
+		b, err := e.ban(e.Name)
+		if err != nil {
+			return fmt.Errorf("banned-players.json: %w", err)
+		}
+		if e.Name != "" {
+			if b, err = bans.insert(b); err != nil {
+				return fmt.Errorf("banned-players.json: %w", err)
+			}
+		}
+		if id := strings.ToLower(strings.ReplaceAll(e.UUID, "-", "")); id != "" {
+			uuids[id] = b
+		}
+	}
+	s.bans, s.uuids, s.modTimes = bans, uuids, modTimes
+	return nil
+}
+
+// readVanillaBans reads one ban file, returning nothing if it doesn't exist.
+func readVanillaBans(path string) ([]vanillaBan, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []vanillaBan
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// ban converts the entry into a ban on target.
+func (e vanillaBan) ban(target string) (ban, error) {
+	b := ban{Target: target, Reason: e.Reason, Source: "backend"}
+	if e.Created != "" {
+		created, err := time.Parse(vanillaBanTimeFormat, e.Created)
+		if err != nil {
+			return ban{}, fmt.Errorf("ban on %s: invalid created date %q", target, e.Created)
+		}
+		b.Created = created.UTC()
+	}
+	if e.Expires != "" && !strings.EqualFold(e.Expires, "forever") {
+		expires, err := time.Parse(vanillaBanTimeFormat, e.Expires)
+		if err != nil {
+			return ban{}, fmt.Errorf("ban on %s: invalid expires date %q", target, e.Expires)
+		}
+		b.Expires = expires.UTC()
+	}
+	return b, nil
+}
+
+// current returns the bans, read again first if the files changed. If that
+// fails, the bans read last are kept.
+func (s *backendBans) current() (*banList, map[string]ban) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := time.Now(); now.Sub(s.checked) >= backendBanCheckInterval {
+		s.checked = now
+		err := s.load()
+		if err != nil && !s.failing {
+			warnf("[bans] Failed to reload the backend's bans from %s: %v", s.dir, err)
+		} else if err == nil && s.failing {
+			infof("[bans] Reading the backend's bans from %s works again", s.dir)
+		}
+		s.failing = err != nil
+	}
+	return s.bans, s.uuids
+}
+
+// checkIP returns the backend's active ban covering ip (host or host:port),
+// if any.
+func (s *backendBans) checkIP(ip string) (ban, bool) {
+	if s == nil {
+		return ban{}, false
+	}
+	bans, _ := s.current()
+	return bans.checkIP(ip)
+}
+
+// checkUsername returns the backend's active ban on username, if any.
+func (s *backendBans) checkUsername(username string) (ban, bool) {
+	if s == nil {
+		return ban{}, false
+	}
+	bans, _ := s.current()
+	return bans.checkUsername(username)
+}
+
+// checkUUID returns the backend's active ban on the player with id (with or
+// without dashes), if any. It catches banned players who changed their name.
+func (s *backendBans) checkUUID(id string) (ban, bool) {
+	if s == nil || id == "" {
+		return ban{}, false
+	}
+	_, uuids := s.current()
+	b, ok := uuids[strings.ToLower(strings.ReplaceAll(id, "-", ""))]
+	if !ok || b.expired(time.Now()) {
+		return ban{}, false
+	}
+	return b, true
+}
+
+// covers reports whether target (an IP or username) is banned exactly as
+// given in the backend's files.
+func (s *backendBans) covers(target string) bool {
+	if s == nil {
+		return false
+	}
+	bans, _ := s.current()
+	bans.mu.RLock()
+	defer bans.mu.RUnlock()
+	if addr, err := netip.ParseAddr(target); err == nil {
+		_, ok := bans.ips[addr.Unmap()]
+		return ok
+	}
+	_, ok := bans.names[strings.ToLower(target)]
+	return ok
+}
+
+// list returns the backend's active bans.
+func (s *backendBans) list() []ban {
+	if s == nil {
+		return nil
+	}
+	bans, _ := s.current()
+	return bans.list()
+}
+
+func (s *backendBans) String() string {
+	bans, uuids := s.current()
+	return fmt.Sprintf("%d IPs and %d players from %s", len(bans.ips), len(uuids), s.dir)
+}
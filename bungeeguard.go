@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"strings"
+)
+
+// bungeeGuardProperty is the profile property BungeeGuard checks on the
+// backend.
+const bungeeGuardProperty = "bungeeguard-token"
+
+// forwardedProperty is a property in BungeeCord legacy forwarding data. Its
+// fields are kept as sent, since backends verify the signatures.
+type forwardedProperty struct {
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// setBungeeGuardToken sets the BungeeGuard token in a handshake server
+// address carrying BungeeCord legacy forwarding data
+// ("host\x00ip\x00uuid[\x00properties]"), replacing any token already there;
+// an empty token only removes it. It reports false if the address has no
+// forwarding data or its properties can't be parsed, leaving it unchanged.
+func setBungeeGuardToken(addr, token string) (string, bool) {
+	parts := strings.Split(addr, "\x00")
+	// Forwarding data starts with the player's IP, unlike Forge markers
+	if len(parts) < 3 {
+		return addr, false
+	}
+	if _, err := netip.ParseAddr(parts[1]); err != nil {
+		return addr, false
+	}
+	var props []forwardedProperty
+	if len(parts) > 3 && parts[3] != "" {
+		if err := json.Unmarshal([]byte(parts[3]), &props); err != nil {
+			return addr, false
+		}
+	}
+	kept := props[:0]
+	for _, p := range props {
+		if p.Name != bungeeGuardProperty {
+			kept = append(kept, p)
+		}
+	}
+	if token != "" {
+		kept = append(kept, forwardedProperty{Name: bungeeGuardProperty, Value: token})
+	}
+	if kept == nil {
+		kept = []forwardedProperty{}
+	}
+	encoded, _ := json.Marshal(kept)
+	if len(parts) == 3 {
+		parts = append(parts, string(encoded))
+	} else {
+		parts[3] = string(encoded)
+	}
+	return strings.Join(parts, "\x00"), true
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Faults -chaos injects.
+const (
+	faultLatency         = "latency"          // delay every backend dial
+	faultTruncateHeader  = "truncate-header"  // send the backend half a PROXY header, then close
+	faultReset           = "reset"            // reset relayed connections part-way
+	faultUpstream500     = "upstream-500"     // answer session server requests with a 500
+	faultUpstreamTimeout = "upstream-timeout" // let session server requests hang until they time out
+)
+
+var chaosFaults = []string{faultLatency, faultTruncateHeader, faultReset, faultUpstream500, faultUpstreamTimeout}
+
+// chaosInjector breaks things on purpose (-chaos), so failover, alerting
+// and dashboards can be tried before a real incident. It is for test
+// setups only: every fault it injects is one players would notice.
+type chaosInjector struct {
+	latency     time.Duration
+	rates       map[string]float64 // chance of each fault, 0 to 1
+	resetWithin time.Duration      // resets happen this long into a connection at most
+
+	chance   func() float64 // uniform in [0, 1)
+	injected map[string]*atomic.Int64
+}
+
+// parseChaos parses FAULT=VALUE pairs: latency takes a duration, the other
+// faults a chance as a fraction or percentage, e.g.
+// "latency=200ms,reset=1%,upstream-500=0.1".
+func parseChaos(spec string) (*chaosInjector, error) {
+	c := &chaosInjector{rates: make(map[string]float64), resetWithin: 10 * time.Second, chance: rand.Float64, injected: make(map[string]*atomic.Int64)}
+	for _, fault := range chaosFaults {
+		c.injected[fault] = new(atomic.Int64)
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not FAULT=VALUE", part)
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch key {
+		case faultLatency, "reset-within":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid duration %q for %s", value, key)
+			}
+			if key == faultLatency {
+				c.latency = d
+			} else {
+				c.resetWithin = d
+			}
+		case faultTruncateHeader, faultReset, faultUpstream500, faultUpstreamTimeout:
+			rate, err := parseChance(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid chance %q for %s", value, key)
+			}
+			c.rates[key] = rate
+		default:
+			return nil, fmt.Errorf("unknown fault %q (expected %s)", key, strings.Join(chaosFaults, ", "))
+		}
+	}
+	if c.latency == 0 && len(c.rates) == 0 {
+		return nil, fmt.Errorf("no faults in %q", spec)
+	}
+	return c, nil
+}
+
+// parseChance parses a chance written as 0.05 or 5%.
+func parseChance(s string) (float64, error) {
+	scale := 1.0
+	if trimmed, ok := strings.CutSuffix(s, "%"); ok {
+		s, scale = trimmed, 100
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 || v/scale > 1 {
+		return 0, fmt.Errorf("invalid chance %q", s)
+	}
+	return v / scale, nil
+}
+
+func (c *chaosInjector) String() string {
+	var parts []string
+	if c.latency > 0 {
+		parts = append(parts, "latency "+c.latency.String())
+	}
+	for _, fault := range chaosFaults[1:] {
+		if rate, ok := c.rates[fault]; ok {
+			parts = append(parts, fmt.Sprintf("%s %g%%", fault, rate*100))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// roll reports whether fault happens this time, and counts it if so.
+func (c *chaosInjector) roll(fault string) bool {
+	if c == nil || c.rates[fault] == 0 || c.chance() >= c.rates[fault] {
+		return false
+	}
+	c.injected[fault].Add(1)
+	return true
+}
+
+// delayDial sleeps for the configured latency before a backend dial.
+func (c *chaosInjector) delayDial() {
+	if c == nil || c.latency == 0 {
+		return
+	}
+	c.injected[faultLatency].Add(1)
+	time.Sleep(c.latency)
+}
+
+// truncateHeader returns a prefix of header to send instead of all of it,
+// or nil to send it unharmed.
+func (c *chaosInjector) truncateHeader(header []byte) []byte {
+	if len(header) < 2 || !c.roll(faultTruncateHeader) {
+		return nil
+	}
+	return header[:len(header)/2]
+}
+
+// scheduleReset resets conn at a random point of its first resetWithin if
+// the reset fault fires. The returned function cancels a pending reset.
+func (c *chaosInjector) scheduleReset(conn net.Conn) (cancel func()) {
+	if !c.roll(faultReset) {
+		return func() {}
+	}
+	timer := time.AfterFunc(time.Duration(c.chance()*float64(c.resetWithin)), func() {
+		warnf("[chaos] %s: resetting the connection", conn.RemoteAddr())
+		// Without lingering, closing sends an RST instead of a FIN
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		conn.Close()
+	})
+	return func() { timer.Stop() }
+}
+
+// transport wraps a session server transport with the upstream faults.
+func (c *chaosInjector) transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &chaosTransport{base: base, chaos: c}
+}
+
+type chaosTransport struct {
+	base  http.RoundTripper
+	chaos *chaosInjector
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case t.chaos.roll(faultUpstreamTimeout):
+		warnf("[chaos] letting the request to %s time out", req.URL.Host)
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	case t.chaos.roll(faultUpstream500):
+		warnf("[chaos] answering the request to %s with a 500", req.URL.Host)
+		return &http.Response{
+			Status:     "500 Internal Server Error",
+			StatusCode: http.StatusInternalServerError,
+			Proto:      "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+			Header:  http.Header{"Content-Type": {"text/plain"}},
+			Body:    io.NopCloser(strings.NewReader("injected by -chaos\n")),
+			Request: req,
+		}, nil
+	}
+	return t.base.RoundTrip(req)
+}
+
+// write adds the injected fault counters to the metrics.
+func (c *chaosInjector) write(p metricsSink) {
+	p.family("chaos_faults_total", "counter", "Faults injected by -chaos, by fault.")
+	for _, fault := range chaosFaults {
+		p.sample("chaos_faults_total", float64(c.injected[fault].Load()), "fault", fault)
+	}
+}
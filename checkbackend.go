@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// backendProbe is one status ping check-backend sent.
+type backendProbe struct {
+	ProxyHeader string // none, v1 or v2
+	Status      string // status JSON; empty if the ping failed
+	Latency     time.Duration
+	Err         error
+}
+
+// backendCheck is the outcome of check-backend: the ping as configured and,
+// if it failed, one with the other PROXY header setting to tell what's wrong.
+type backendCheck struct {
+	Backend  string
+	Probe    backendProbe
+	Fallback *backendProbe
+}
+
+// runCheckBackend implements the check-backend subcommand.
+func runCheckBackend(args []string) error {
+	fs := flag.NewFlagSet("check-backend", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mc-dual-proxy check-backend [flags]")
+		fmt.Fprintln(fs.Output(), "Pings the backend the way the proxy would, to check its PROXY protocol setup end to end.")
+		fs.PrintDefaults()
+	}
+	backend := fs.String("backend", "127.0.0.1:25566", "Backend to check (your -backend address)")
+	kind := fs.String("proxy-header", "v2", "PROXY header to send from a 198.18.0.0/15 test address: v2 (like the proxy), v1 or none (for -transparent)")
+	host := fs.String("host", "", "Server address put in the handshake (default: the backend host)")
+	timeout := fs.Duration("timeout", 5*time.Second, "How long to wait for the backend")
+	fs.Parse(args)
+
+	switch *kind {
+	case "none", "v1", "v2":
+	default:
+		return fmt.Errorf("invalid -proxy-header %q (expected v2, v1 or none)", *kind)
+	}
+	check := checkBackend(*backend, *kind, *host, *timeout)
+	check.report(os.Stdout)
+	if check.Probe.Err != nil {
+		return errors.New("backend check failed")
+	}
+	return nil
+}
+
+// checkBackend pings backendAddr with a PROXY header of the given kind, and
+// again with the other setting if that fails.
+func checkBackend(backendAddr, kind, host string, timeout time.Duration) *backendCheck {
+	check := &backendCheck{Backend: backendAddr, Probe: probeBackend(backendAddr, kind, host, timeout)}
+	if check.Probe.Err != nil && !isDialError(check.Probe.Err) {
+		other := "none"
+		if kind == "none" {
+			other = "v2"
+		}
+		fallback := probeBackend(backendAddr, other, host, timeout)
+		check.Fallback = &fallback
+	}
+	return check
+}
+
+func probeBackend(backendAddr, kind, host string, timeout time.Duration) backendProbe {
+	var dst net.Addr
+	if addr, err := net.ResolveTCPAddr("tcp", backendAddr); err == nil {
+		dst = addr
+	}
+	var port uint16
+	if host != "" {
+		_, port = splitHostPortDefault(backendAddr)
+	}
+	start := time.Now()
+	status, err := fetchBackendStatus(backendAddr, fakeProxyHeader(kind, dst), host, port, timeout)
+	return backendProbe{ProxyHeader: kind, Status: status, Latency: time.Since(start), Err: err}
+}
+
+// isDialError reports whether err means the backend couldn't be reached at
+// all, which no PROXY header setting changes.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// headerName describes a PROXY header kind in messages.
+func headerName(kind string) string {
+	if kind == "none" {
+		return "no PROXY header"
+	}
+	return "a PROXY " + kind + " header"
+}
+
+// report prints the outcome with a diagnosis.
+func (c *backendCheck) report(w io.Writer) {
+	p := c.Probe
+	fmt.Fprintf(w, "Checking %s with %s\n", c.Backend, headerName(p.ProxyHeader))
+	switch {
+	case p.Err == nil:
+		fmt.Fprintf(w, "✓ The backend answered a status ping with %s (%s)\n", headerName(p.ProxyHeader), p.Latency.Round(time.Millisecond))
+		reportStatus(w, p.Status)
+		return
+	case isDialError(p.Err):
+		fmt.Fprintf(w, "✗ Can't connect: %v\n", p.Err)
+		fmt.Fprintln(w, "  Check that the backend is running and listens on this address.")
+		return
+	}
+	fmt.Fprintf(w, "✗ No status response with %s: %v\n", headerName(p.ProxyHeader), p.Err)
+	f := c.Fallback
+	switch {
+	case f.Err != nil:
+		fmt.Fprintf(w, "✗ No status response with %s either\n", headerName(f.ProxyHeader))
+		fmt.Fprintln(w, "  The backend may not be a Minecraft server, or still be starting.")
+	case p.ProxyHeader != "none":
+		fmt.Fprintf(w, "✓ The backend answered with %s instead\n", headerName(f.ProxyHeader))
+		fmt.Fprintln(w, "  PROXY protocol is not enabled on the backend: set haproxy-protocol = true")
+		fmt.Fprintln(w, "  (Velocity) or proxies.proxy-protocol: true in paper-global.yml (Paper).")
+		reportStatus(w, f.Status)
+	default:
+		fmt.Fprintf(w, "✓ The backend answered with %s instead\n", headerName(f.ProxyHeader))
+		fmt.Fprintln(w, "  The backend expects PROXY protocol, which -transparent doesn't send: turn it off")
+		fmt.Fprintln(w, "  on the backend, or run the proxy without -transparent.")
+		reportStatus(w, f.Status)
+	}
+}
+
+// reportStatus prints the highlights of a status response and the JSON.
+func reportStatus(w io.Writer, body string) {
+	status := &ServerStatus{}
+	if err := json.Unmarshal([]byte(body), status); err != nil {
+		fmt.Fprintf(w, "  Status JSON doesn't parse: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "  Version: %s (protocol %d)\n", status.Version.Name, status.Version.Protocol)
+		fmt.Fprintf(w, "  Players: %d/%d\n", status.Players.Online, status.Players.Max)
+		fmt.Fprintf(w, "  MOTD:    %s\n", status.MOTD())
+	}
+	// A favicon is kilobytes of base64; show its size instead
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(body), &fields) == nil {
+		var favicon string
+		if json.Unmarshal(fields["favicon"], &favicon) == nil {
+			fields["favicon"], _ = json.Marshal(fmt.Sprintf("(%d bytes)", len(favicon)))
+		}
+		data, _ := json.MarshalIndent(fields, "  ", "  ")
+		fmt.Fprintf(w, "\n  %s\n", data)
+	}
+}
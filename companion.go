@@ -0,0 +1,44 @@
+package main
+
+import "encoding/json"
+
+// companionProperty is the profile property carrying what the proxy knows
+// about a player to backend plugins (-companion). It rides along with the
+// hasJoined profile because nothing else reaches the backend once a login
+// is encrypted: Velocity and Paper hand it to plugins like the textures.
+const companionProperty = "mc-dual-proxy:meta"
+
+// companionVersion is bumped when companionMeta changes incompatibly.
+// Fields may be added without a bump.
+const companionVersion = 1
+
+// companionMeta is the JSON value of companionProperty. Its fields are a
+// stable interface for plugins, like /api/players. Backends pass profile
+// properties on to every client (Paper's player list carries them), so
+// nothing private such as the player's address belongs here; plugins get
+// that from the PROXY header.
+type companionMeta struct {
+	Version    int    `json:"version"`
+	AuthSource string `json:"auth_source"`          // upstream that authenticated the player
+	Host       string `json:"host,omitempty"`       // hostname from the player's handshake
+	Route      string `json:"route,omitempty"`      // listener the player came in on
+	Node       string `json:"node,omitempty"`       // name of this mc-dual-proxy instance
+	Connection uint64 `json:"connection,omitempty"` // connection ID, as in /api/players and /api/kick
+}
+
+// companion builds companionMeta properties for the proxy instance named
+// node.
+type companion struct {
+	node string
+}
+
+// property returns the companion property for a login authenticated by
+// upstream over conn, which is nil if the proxy hasn't seen the connection.
+func (c *companion) property(upstream string, conn *trackedConn) profileProperty {
+	meta := companionMeta{Version: companionVersion, AuthSource: upstreamName(upstream), Node: c.node}
+	if conn != nil {
+		meta.Host, meta.Route, meta.Connection = conn.Host, conn.Route, conn.ID
+	}
+	value, _ := json.Marshal(meta)
+	return profileProperty{Name: companionProperty, Value: string(value)}
+}
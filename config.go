@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// configFetchTimeout bounds fetching a -config URL.
+const configFetchTimeout = 10 * time.Second
+
+var configClient = &http.Client{Timeout: configFetchTimeout}
+
+// liveConfig is the default route's configuration as changed by the last
+// config reload; nil when no -config is in use.
+var liveConfig atomic.Pointer[Config]
+
+// reloaded returns the latest configuration for cfg's connections and auth
+// requests: the reloaded one for the default route, cfg itself otherwise.
+func (cfg Config) reloaded() Config {
+	if cfg.Route == defaultRouteName {
+		if live := liveConfig.Load(); live != nil {
+			return *live
+		}
+	}
+	return cfg
+}
+
+// configSource is a -config file or URL. It holds settings by flag name:
+//
+//	{
+//	  "backend": "10.0.0.5:25566",
+//	  "verify-ping": "30s",
+//	  "max-players": 50,
+//	  "block-username": ["^bot_", "^test"]
+//	}
+//
+// Arrays give a repeatable flag several values. Flags given on the command
+// line win over the source. When the source changes (SIGHUP, or every
+// -config-poll), the settings in reloadableSettings are applied to new
+// connections and auth requests; changes to others need a restart.
+type configSource struct {
+	location string // path or http(s):// URL
+	flags    *flag.FlagSet
+	explicit map[string]bool // flags set on the command line
+
+	mu      sync.Mutex
+	etag    string
+	last    []byte
+	applied map[string][]string // flag name → values from the source
+}
+
+func newConfigSource(location string, flags *flag.FlagSet) *configSource {
+	s := &configSource{location: location, flags: flags, explicit: map[string]bool{}}
+	flags.Visit(func(f *flag.Flag) { s.explicit[f.Name] = true })
+	return s
+}
+
+func (s *configSource) isURL() bool {
+	return strings.HasPrefix(s.location, "http://") || strings.HasPrefix(s.location, "https://")
+}
+
+// fetch reads the source, returning nil data if it hasn't changed since
+// the last fetch. URLs are requested with the last ETag, so an unchanged
+// config costs a 304.
+func (s *configSource) fetch() ([]byte, error) {
+	var data []byte
+	if s.isURL() {
+		req, err := http.NewRequest(http.MethodGet, s.location, nil)
+		if err != nil {
+			return nil, err
+		}
+		if s.etag != "" {
+			req.Header.Set("If-None-Match", s.etag)
+		}
+		resp, err := configClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusNotModified:
+			return nil, nil
+		case http.StatusOK:
+		default:
+			return nil, fmt.Errorf("server returned %s", resp.Status)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return nil, err
+		}
+		s.etag = resp.Header.Get("ETag")
+	} else {
+		var err error
+		if data, err = os.ReadFile(s.location); err != nil {
+			return nil, err
+		}
+	}
+	if s.last != nil && bytes.Equal(data, s.last) {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// parse decodes a config and checks it only names known flags.
+func (s *configSource) parse(data []byte) (map[string][]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw map[string]any
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	settings := make(map[string][]string, len(raw))
+	for name, v := range raw {
+		f := s.flags.Lookup(name)
+		if f == nil || name == "config" {
+			return nil, fmt.Errorf("unknown setting %q", name)
+		}
+		_, repeatable := f.Value.(*stringList)
+		items, isList := v.([]any)
+		if !isList {
+			items = []any{v}
+		} else if !repeatable {
+			return nil, fmt.Errorf("%s takes a single value", name)
+		}
+		for _, item := range items {
+			switch item := item.(type) {
+			case string:
+				settings[name] = append(settings[name], item)
+			case json.Number:
+				settings[name] = append(settings[name], item.String())
+			case bool:
+				settings[name] = append(settings[name], strconv.FormatBool(item))
+			default:
+				return nil, fmt.Errorf("%s: unsupported value %v", name, item)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// load reads the source at startup and sets the flags it names, except
+// those given on the command line.
+func (s *configSource) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.fetch()
+	if err != nil {
+		return err
+	}
+	settings, err := s.parse(data)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(settings) {
+		if s.explicit[name] {
+			continue
+		}
+		for _, v := range settings[name] {
+			if err := s.flags.Set(name, v); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	s.last, s.applied = data, settings
+	return nil
+}
+
+// values returns the values settings gives flag name, or its default.
+func (s *configSource) values(settings map[string][]string, name string) []string {
+	if v, ok := settings[name]; ok {
+		return v
+	}
+	f := s.flags.Lookup(name)
+	if _, repeatable := f.Value.(*stringList); repeatable || f.DefValue == "" {
+		return nil
+	}
+	return []string{f.DefValue}
+}
+
+// reload reads the source again and applies what changed to liveConfig. A
+// config with an invalid setting is refused as a whole.
+func (s *configSource) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.fetch()
+	if err != nil || data == nil {
+		return err
+	}
+	settings, err := s.parse(data)
+	if err != nil {
+		return err
+	}
+
+	cfg := *liveConfig.Load()
+	var applied, restart []string
+	var level *logLevel
+	names := sortedKeys(settings)
+	for name := range s.applied {
+		if _, ok := settings[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		old, cur := s.values(s.applied, name), s.values(settings, name)
+		if slices.Equal(old, cur) || s.explicit[name] {
+			continue
+		}
+		if name == "log-level" {
+			l, err := parseLogLevel(lastValue(cur))
+			if err != nil {
+				return fmt.Errorf("log-level: %w", err)
+			}
+			level = &l
+		} else if apply, ok := reloadableSettings[name]; !ok {
+			restart = append(restart, name)
+			continue
+		} else if err := apply(&cfg, cur); errors.Is(err, errNeedsRestart) {
+			restart = append(restart, name)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		applied = append(applied, name)
+	}
+
+	s.last, s.applied = data, settings
+	if level != nil {
+		setLogLevel(*level)
+	}
+	liveConfig.Store(&cfg)
+	if len(applied) > 0 {
+		infof("[config] Applied %s from %s", strings.Join(applied, ", "), s.location)
+	}
+	if len(restart) > 0 {
+		warnf("[config] %s changed in %s; restart to apply", strings.Join(restart, ", "), s.location)
+	}
+	return nil
+}
+
+// poll reloads the source every interval. It never returns.
+func (s *configSource) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.reload(); err != nil {
+			warnf("[config] Failed to reload %s: %v", s.location, err)
+		}
+	}
+}
+
+func lastValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+// errNeedsRestart is returned by a reloadable setting that can't change in
+// the current setup.
+var errNeedsRestart = errors.New("needs a restart")
+
+// reloadableSettings apply a changed flag's values to a configuration.
+// log-level is handled separately since it is process-wide.
+var reloadableSettings = map[string]func(cfg *Config, values []string) error{
+	"backend": func(cfg *Config, values []string) error {
+		// Discovery, supervised and balanced backends keep the addresses
+		// they started with
+		if cfg.Discovery != nil || cfg.Supervisor != nil || cfg.Balancer != nil || strings.Contains(lastValue(values), ",") {
+			return errNeedsRestart
+		}
+		resolver, err := newBackendResolver(lastValue(values))
+		if err != nil {
+			return err
+		}
+		cfg.BackendAddr, cfg.Resolver = lastValue(values), resolver
+		return nil
+	},
+	"user-route": func(cfg *Config, values []string) error {
+		cfg.UserRouter = nil
+		if len(values) > 0 {
+			router, err := parseUserRoutes(values)
+			if err != nil {
+				return err
+			}
+			cfg.UserRouter = router
+		}
+		return nil
+	},
+	"session-servers": func(cfg *Config, values []string) error {
+		servers := parseSessionServers(lastValue(values))
+		if len(servers) == 0 {
+			return errors.New("at least one session server must be configured")
+		}
+		cfg.SessionServers = servers
+		return nil
+	},
+	"host-session-servers": func(cfg *Config, values []string) error {
+		router, err := newHostAuthRouter(values)
+		if err != nil {
+			return err
+		}
+		cfg.HostAuth = router
+		return nil
+	},
+	"backend-upstreams": func(cfg *Config, values []string) error {
+		rules, err := parseBackendUpstreams(values)
+		if err != nil {
+			return err
+		}
+		cfg.BackendUpstreams = rules
+		return nil
+	},
+	"prefer": func(cfg *Config, values []string) error {
+		cfg.PreferUpstream, cfg.PreferWindow = "", 0
+		if v := lastValue(values); v != "" {
+			name, window, err := parsePreference(v)
+			if err != nil {
+				return err
+			}
+			cfg.PreferUpstream, cfg.PreferWindow = name, window
+		}
+		return nil
+	},
+	"upstream-dialect": func(cfg *Config, values []string) error {
+		dialects, err := parseDialects(values)
+		if err != nil {
+			return err
+		}
+		cfg.Dialects = dialects
+		return nil
+	},
+	"allowed-hosts": func(cfg *Config, values []string) error {
+		cfg.AllowedHosts = nil
+		if v := lastValue(values); v != "" {
+			hosts, err := parseAllowedHosts(v)
+			if err != nil {
+				return err
+			}
+			cfg.AllowedHosts = hosts
+		}
+		return nil
+	},
+	"offline-fallback": func(cfg *Config, values []string) error {
+		cfg.OfflineFallback = nil
+		if v := lastValue(values); v != "" {
+			fallback, err := parseOfflineFallback(v)
+			if err != nil {
+				return err
+			}
+			cfg.OfflineFallback = fallback
+		}
+		return nil
+	},
+	"auth-source-property": func(cfg *Config, values []string) error {
+		cfg.AuthSourceProperty = strings.TrimSpace(lastValue(values))
+		return nil
+	},
+	"conflict-policy": func(cfg *Config, values []string) error {
+		switch v := lastValue(values); v {
+		case conflictFirst, conflictPriority, conflictReject:
+			cfg.ConflictPolicy = v
+			return nil
+		default:
+			return fmt.Errorf("invalid policy %q", v)
+		}
+	},
+	"slow-upstream": func(cfg *Config, values []string) error {
+		return setDuration(&cfg.SlowUpstream, lastValue(values))
+	},
+	"handshake-timeout": func(cfg *Config, values []string) error {
+		return setDuration(&cfg.HandshakeTimeout, lastValue(values))
+	},
+	"first-byte-timeout": func(cfg *Config, values []string) error {
+		return setDuration(&cfg.FirstByteTimeout, lastValue(values))
+	},
+	"block-username": func(cfg *Config, values []string) error {
+		filter, err := newUsernameFilter(values)
+		if err != nil {
+			return err
+		}
+		cfg.UsernameFilter = filter
+		return nil
+	},
+	"auth-rate": func(cfg *Config, values []string) error {
+		return setRateLimit(&cfg.AuthLimiter, lastValue(values))
+	},
+	"login-rate": func(cfg *Config, values []string) error {
+		return setRateLimit(&cfg.LoginLimiter, lastValue(values))
+	},
+	"status-rate": func(cfg *Config, values []string) error {
+		return setRateLimit(&cfg.StatusLimiter, lastValue(values))
+	},
+	"trusted-proxies": func(cfg *Config, values []string) error {
+		prefixes, err := parseTrustedProxies(lastValue(values))
+		if err != nil {
+			return err
+		}
+		cfg.TrustedProxies = prefixes
+		return nil
+	},
+	"proxy-unknown": func(cfg *Config, values []string) error {
+		switch v := lastValue(values); v {
+		case proxyUnknownPeer, proxyUnknownPassthrough, proxyUnknownReject:
+			cfg.ProxyUnknown = v
+			return nil
+		default:
+			return fmt.Errorf("invalid policy %q", v)
+		}
+	},
+	"untrusted-proxy-header": func(cfg *Config, values []string) error {
+		switch v := lastValue(values); v {
+		case proxyHeaderPassthrough, proxyHeaderRewrite, proxyHeaderReject:
+			cfg.UntrustedProxyHeader = v
+			return nil
+		default:
+			return fmt.Errorf("invalid policy %q", v)
+		}
+	},
+	"legacy-motd": func(cfg *Config, values []string) error {
+		cfg.LegacyMOTD = lastValue(values)
+		return nil
+	},
+	"legacy-max-players": func(cfg *Config, values []string) error {
+		n, err := strconv.Atoi(lastValue(values))
+		if err != nil {
+			return err
+		}
+		cfg.LegacyMaxPlayers = n
+		return nil
+	},
+}
+
+func setDuration(d *time.Duration, s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("%s must not be negative", v)
+	}
+	*d = v
+	return nil
+}
+
+// setRateLimit replaces *limiter, starting its counts over; an empty spec
+// disables it.
+func setRateLimit(limiter **rateLimiter, spec string) error {
+	if spec == "" {
+		*limiter = nil
+		return nil
+	}
+	l, err := parseRateLimit(spec)
+	if err != nil {
+		return err
+	}
+	*limiter = l
+	return nil
+}
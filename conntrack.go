@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackedConn is a live proxied connection, as shown by the admin endpoints.
+type trackedConn struct {
+	ID         uint64
+	ClientAddr string // TCP peer address
+	RealAddr   string // Address from the PROXY header, or the peer address
+	Source     string // "direct" or "proxied"
+	Host       string // Hostname from the handshake, if any
+	Modded     string // Forge marker (FML, FML2, FML3) for modded clients
+	Route      string // Name of the route (listener) the connection came in on
+	Started    time.Time
+
+	client   net.Conn     // closed to kick the player; nil for connections not proxied by us
+	backend  atomic.Value // string, set once the backend is chosen
+	username atomic.Value // string, set once the player's name is known
+	bytesIn  atomic.Int64 // client → backend
+	bytesOut atomic.Int64 // backend → client
+}
+
+// connInfo is a point-in-time JSON view of a trackedConn.
+type connInfo struct {
+	ID         uint64  `json:"id"`
+	ClientAddr string  `json:"client_addr"`
+	RealAddr   string  `json:"real_addr"`
+	Source     string  `json:"source"`
+	Host       string  `json:"host,omitempty"`
+	Modded     string  `json:"modded,omitempty"`
+	Route      string  `json:"route,omitempty"`
+	Backend    string  `json:"backend"`
+	Username   string  `json:"username,omitempty"`
+	BytesIn    int64   `json:"bytes_in"`
+	BytesOut   int64   `json:"bytes_out"`
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+// connTracker keeps the table of live connections and lifetime totals.
+type connTracker struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*trackedConn
+
+	accepted atomic.Int64
+	refused  atomic.Int64 // turned away before reaching the backend
+	silent   atomic.Int64 // closed without sending a byte
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// tracker is the process-wide connection table.
+var tracker = newConnTracker()
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[uint64]*trackedConn)}
+}
+
+// add registers a connection and assigns its ID.
+func (t *connTracker) add(c *trackedConn) {
+	t.mu.Lock()
+	t.nextID++
+	c.ID = t.nextID
+	t.conns[c.ID] = c
+	t.mu.Unlock()
+	t.accepted.Add(1)
+}
+
+// remove drops a connection from the live table.
+func (t *connTracker) remove(c *trackedConn) {
+	t.mu.Lock()
+	delete(t.conns, c.ID)
+	t.mu.Unlock()
+}
+
+// count returns the number of live connections.
+func (t *connTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// snapshot returns all live connections ordered by ID.
+func (t *connTracker) snapshot() []connInfo {
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+
+	infos := make([]connInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, c.info())
+	}
+	return infos
+}
+
+func (c *trackedConn) setBackend(addr string) {
+	c.backend.Store(addr)
+}
+
+func (c *trackedConn) setUsername(name string) {
+	c.username.Store(name)
+}
+
+// kick closes every live connection matching the given ID, IP or username
+// (case-insensitive); empty criteria match nothing. It returns the IDs of the
+// kicked connections.
+func (t *connTracker) kick(id uint64, ip, username string) []uint64 {
+	return t.kickWhere(func(c *trackedConn) bool {
+		name, _ := c.username.Load().(string)
+		return (id != 0 && c.ID == id) ||
+			(ip != "" && addrIP(c.RealAddr) == ip) ||
+			(username != "" && strings.EqualFold(name, username))
+	})
+}
+
+// kickWhere closes every live connection for which match returns true and
+// returns their IDs.
+func (t *connTracker) kickWhere(match func(c *trackedConn) bool) []uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var kicked []uint64
+	for _, c := range t.conns {
+		if match(c) {
+			if c.client != nil {
+				c.client.Close()
+			}
+			kicked = append(kicked, c.ID)
+		}
+	}
+	sort.Slice(kicked, func(i, j int) bool { return kicked[i] < kicked[j] })
+	return kicked
+}
+
+// tagUsername attaches username to the live connections from ip that don't
+// have a name yet, e.g. when a successful hasJoined carries the player's IP.
+func (t *connTracker) tagUsername(ip, username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range t.conns {
+		if name, _ := c.username.Load().(string); name == "" && addrIP(c.RealAddr) == ip {
+			c.setUsername(username)
+		}
+	}
+}
+
+// loginConn returns the newest live connection logged in as username
+// (case-insensitive), from ip if it isn't empty, or nil if there is none.
+// hasJoined requests use it to learn where the player is connecting.
+func (t *connTracker) loginConn(username, ip string) *trackedConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var newest *trackedConn
+	for _, c := range t.conns {
+		name, _ := c.username.Load().(string)
+		if !strings.EqualFold(name, username) || (ip != "" && addrIP(c.RealAddr) != ip) {
+			continue
+		}
+		if newest == nil || c.ID > newest.ID {
+			newest = c
+		}
+	}
+	return newest
+}
+
+func (c *trackedConn) info() connInfo {
+	backend, _ := c.backend.Load().(string)
+	username, _ := c.username.Load().(string)
+	return connInfo{
+		ID:         c.ID,
+		ClientAddr: c.ClientAddr,
+		RealAddr:   c.RealAddr,
+		Source:     c.Source,
+		Host:       c.Host,
+		Modded:     c.Modded,
+		Route:      c.Route,
+		Backend:    backend,
+		Username:   username,
+		BytesIn:    c.bytesIn.Load(),
+		BytesOut:   c.bytesOut.Load(),
+		AgeSeconds: time.Since(c.Started).Seconds(),
+	}
+}
+
+// countingWriter adds the number of bytes written to a per-connection and
+// a global counter.
+type countingWriter struct {
+	w           io.Writer
+	conn, total *atomic.Int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.conn.Add(int64(n))
+	cw.total.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	consoleAuto   = "auto"
+	consolePretty = "pretty"
+	consolePlain  = "plain"
+)
+
+// ANSI escape sequences used by the pretty console.
+const (
+	ansiReset  = "\x1b[0m"
+	ansiDim    = "\x1b[2m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiBlue   = "\x1b[34m"
+	ansiCyan   = "\x1b[36m"
+)
+
+// connChatter matches the info lines the pretty console shows as events
+// instead: per-connection [tcp] lines and per-request [auth] lines.
+var connChatter = regexp.MustCompile(`^(\[tcp\] \S+: |\[auth\] hasJoined |\[auth\]   )`)
+
+// isTerminal reports whether f is an interactive terminal that should get
+// colors: not redirected, and neither NO_COLOR nor TERM=dumb set.
+func isTerminal(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// prettyConsole renders the log for a person watching it (-console pretty):
+// connections and logins become one aligned, colored line each with a
+// symbol, taken from the event bus, and the per-connection log lines they
+// replace are hidden unless debug logging is on. Other messages keep their
+// text, colored by level.
+type prettyConsole struct {
+	mu  sync.Mutex
+	out io.Writer
+	now func() time.Time
+}
+
+func newPrettyConsole(out io.Writer) *prettyConsole {
+	return &prettyConsole{out: out, now: time.Now}
+}
+
+// Write receives the log package's output, one line per call; log flags
+// must be 0 since the console stamps lines itself.
+func (c *prettyConsole) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	color := ""
+	if tag, rest, ok := strings.Cut(line, " "); ok {
+		switch tag {
+		case "DEBUG":
+			color, line = ansiDim, rest
+		case "WARN":
+			color, line = ansiYellow, "⚠ "+rest
+		case "ERROR":
+			color, line = ansiRed+ansiBold, "✗ "+rest
+		}
+	}
+	if color == "" && getLogLevel() > levelDebug && connChatter.MatchString(line) {
+		return len(p), nil
+	}
+	c.print(color + line + ansiReset)
+	return len(p), nil
+}
+
+// Send renders an event; the console is an event sink.
+func (c *prettyConsole) Send(ev Event) error {
+	if line := c.render(ev); line != "" {
+		c.print(line)
+	}
+	return nil
+}
+
+func (c *prettyConsole) print(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.out, "%s%s%s %s\n", ansiDim, c.now().Format("15:04:05"), ansiReset, line)
+}
+
+// render formats an event as symbol, kind, subject and details, or returns
+// "" for events the console doesn't show.
+func (c *prettyConsole) render(ev Event) string {
+	str := func(key string) string {
+		s, _ := ev.Data[key].(string)
+		return s
+	}
+	row := func(color, symbol, kind, subject, details string) string {
+		return fmt.Sprintf("%s%s %-7s%s %-22s %s", color, symbol, kind, ansiReset, subject, details)
+	}
+	switch ev.Type {
+	case eventConnOpen:
+		details := ansiDim + "host " + ansiReset + str("host")
+		if route := str("route"); route != "" && route != defaultRouteName {
+			details += ansiDim + "  route " + ansiReset + route
+		}
+		if modded := str("modded"); modded != "" {
+			details += ansiDim + "  " + modded + ansiReset
+		}
+		return row(ansiCyan, "→", "join", str("real"), details)
+	case eventConnClose:
+		subject := str("real")
+		if name := str("username"); name != "" {
+			subject = name
+		}
+		seconds, _ := ev.Data["duration"].(float64)
+		in, _ := ev.Data["bytes_in"].(int64)
+		out, _ := ev.Data["bytes_out"].(int64)
+		return row(ansiDim, "←", "leave", subject, fmt.Sprintf("%s%s  ↑%s ↓%s%s",
+			ansiDim, (time.Duration(seconds)*time.Second).String(), formatBytes(in), formatBytes(out), ansiReset))
+	case eventAuthSuccess:
+		return row(ansiGreen+ansiBold, "✓", "auth", str("username"), "via "+ansiGreen+upstreamName(str("upstream"))+ansiReset)
+	case eventAuthFail:
+		return row(ansiRed+ansiBold, "✗", "auth", str("username"), ansiRed+"all session servers failed"+ansiReset)
+	case eventLoginBlocked:
+		subject := str("username")
+		if subject == "" {
+			subject = str("real")
+		}
+		return row(ansiYellow, "⊘", "blocked", subject, str("reason"))
+	case eventLoginFlagged:
+		return row(ansiYellow, "⚑", "flagged", str("real"), str("reason"))
+	case eventRateLimitHit:
+		subject := str("username")
+		if subject == "" {
+			subject = str("real")
+		}
+		return row(ansiYellow, "⏱", "limit", subject, str("limit")+" rate exceeded")
+	case eventBackendDown:
+		return row(ansiRed+ansiBold, "▼", "backend", str("backend"), ansiRed+"down: "+str("error")+ansiReset)
+	case eventBackendUp:
+		return row(ansiBlue+ansiBold, "▲", "backend", str("backend"), "up")
+	case eventKeepaliveDown:
+		return row(ansiRed+ansiBold, "▼", "route", str("target"), ansiRed+"not answering: "+str("error")+ansiReset)
+	case eventKeepaliveUp:
+		return row(ansiBlue+ansiBold, "▲", "route", str("target"), "answering again")
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// devMarkerProperty is added to dev-sessionserver profiles so plugins
+	// can tell made-up players from real ones.
+	devMarkerProperty = "mc-dual-proxy:dev"
+
+	// devJoinPath is where clients announce a join before the server
+	// checks it with hasJoined.
+	devJoinPath = "/session/minecraft/join"
+
+	// devSkinURL is the skin dev-sessionserver gives everyone: Steve, so
+	// that clients without internet access show the same default they
+	// fall back to anyway.
+	devSkinURL = "http://textures.minecraft.net/texture/1a4af718455d4aab528e7a61f86fa25e6a369d1768dcb13f7df319a713eb810b"
+)
+
+// devSessionServer answers hasJoined for any valid username, for
+// developing and demoing a server stack without access to Mojang or
+// Minehut. Every player gets the offline-mode UUID of their name, so their
+// data is the same from run to run, and a marker skin.
+type devSessionServer struct {
+	skin   string
+	reject map[string]bool // lowercased usernames answered with 204
+	now    func() time.Time
+}
+
+func (s *devSessionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Clients pointed here (-Dminecraft.api.session.host) announce their
+	// join first; any announcement is fine
+	if r.URL.Path == devJoinPath && r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.URL.Path != hasJoinedPath {
+		http.NotFound(w, r)
+		return
+	}
+	username := r.URL.Query().Get("username")
+	if !usernamePattern.MatchString(username) || r.URL.Query().Get("serverId") == "" {
+		log.Printf("[dev] hasJoined with username=%q: bad request", username)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if s.reject[strings.ToLower(username)] {
+		log.Printf("[dev] hasJoined username=%s: rejected", username)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	log.Printf("[dev] hasJoined username=%s: uuid=%s", username, offlineUUID(username))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.profile(username))
+}
+
+// profile returns username's hasJoined response: the textures property
+// Mojang would send, unsigned, and the dev marker.
+func (s *devSessionServer) profile(username string) []byte {
+	id := offlineUUID(username)
+	textures, _ := json.Marshal(map[string]any{
+		"timestamp":   s.now().UnixMilli(),
+		"profileId":   id,
+		"profileName": username,
+		"textures":    map[string]any{"SKIN": map[string]string{"url": s.skin}},
+	})
+	body, _ := json.Marshal(map[string]any{
+		"id":   id,
+		"name": username,
+		"properties": []profileProperty{
+			{Name: "textures", Value: base64.StdEncoding.EncodeToString(textures)},
+			{Name: devMarkerProperty, Value: "true"},
+		},
+		"profileActions": []string{},
+	})
+	return body
+}
+
+// runDevSessionServer implements the dev-sessionserver subcommand.
+func runDevSessionServer(args []string) error {
+	fs := flag.NewFlagSet("dev-sessionserver", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mc-dual-proxy dev-sessionserver [flags]")
+		fmt.Fprintln(fs.Output(), "Runs a fake session server that authenticates every username, for offline development.")
+		fmt.Fprintln(fs.Output(), "Point the proxy at it with -session-servers http://127.0.0.1:8660. Never expose it to players.")
+		fs.PrintDefaults()
+	}
+	listen := fs.String("listen", "127.0.0.1:8660", "Address to serve hasJoined on")
+	skin := fs.String("skin", devSkinURL, "Skin URL put in every profile's textures")
+	var reject stringList
+	fs.Var(&reject, "reject", "Username to answer as not authenticated, to test failed logins (repeatable)")
+	fs.Parse(args)
+
+	s := &devSessionServer{skin: *skin, reject: make(map[string]bool), now: time.Now}
+	for _, name := range reject {
+		s.reject[strings.ToLower(name)] = true
+	}
+	log.Printf("[dev] Fake session server on http://%s, authenticating every username", *listen)
+	log.Printf("[dev] Run the proxy with -session-servers http://%s", *listen)
+	return http.ListenAndServe(*listen, s)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// logDiagnostics dumps a snapshot of the proxy's state to the log: runtime
+// and memory stats, the connection table, cache sizes and upstream/backend
+// health. It is triggered by SIGUSR1 to debug stuck states on hosts where a
+// profiler can't be attached.
+func logDiagnostics(cfg Config) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	infof("[diag] goroutines=%d heap_alloc=%s heap_sys=%s sys=%s gc_cycles=%d last_gc=%s ago",
+		runtime.NumGoroutine(), formatBytes(int64(mem.HeapAlloc)), formatBytes(int64(mem.HeapSys)),
+		formatBytes(int64(mem.Sys)), mem.NumGC, time.Since(time.Unix(0, int64(mem.LastGC))).Round(time.Second))
+
+	conns := tracker.snapshot()
+	infof("[diag] %d active connections (%d accepted, %d refused since startup)", len(conns), tracker.accepted.Load(), tracker.refused.Load())
+	phases := handlers.byPhase()
+	infof("[diag] connection handlers: %d reading headers, %d dialing, %d relaying (%d reported stuck)",
+		phases[phaseHeader], phases[phaseDialing], phases[phaseRelaying], handlers.stuck.Load())
+	if cfg.ConnSlots != nil {
+		infof("[diag] connection slots: %d/%d in use", cfg.ConnSlots.inUse(), cap(cfg.ConnSlots.sem))
+	}
+	for _, c := range conns {
+		infof("[diag]   #%d client=%s real=%s username=%q route=%s backend=%s age=%s in=%s out=%s",
+			c.ID, c.ClientAddr, c.RealAddr, c.Username, c.Route, c.Backend,
+			(time.Duration(c.AgeSeconds) * time.Second).Round(time.Second), formatBytes(c.BytesIn), formatBytes(c.BytesOut))
+	}
+
+	if cfg.PingGate != nil {
+		infof("[diag] ping gate: %d verified IPs", cfg.PingGate.size())
+	}
+	if cfg.LoginLimiter != nil {
+		infof("[diag] login rate limiter: %d tracked IPs", cfg.LoginLimiter.size())
+	}
+	if cfg.BackendPool != nil {
+		infof("[diag] backend pool: %d/%d ready, %d hits, %d misses, %s saved", cfg.BackendPool.idleCount(), cfg.BackendPool.size,
+			cfg.BackendPool.hits.Load(), cfg.BackendPool.misses.Load(), time.Duration(cfg.BackendPool.saved.Load()).Round(time.Millisecond))
+	}
+	if cfg.Queue != nil {
+		stats := cfg.Queue.stats()
+		infof("[diag] queue: %d/%d active, %d waiting", stats.Active, stats.MaxPlayers, stats.Waiting)
+	}
+	if cfg.Bans != nil {
+		infof("[diag] bans: %d active", len(cfg.Bans.list()))
+	}
+	infof("[diag] sessions: %d remembered", sessions.size())
+	if cfg.ReplayGuard != nil {
+		infof("[diag] replay guard: %d serverIds remembered", cfg.ReplayGuard.size())
+	}
+
+	snap := activity.snapshot()
+	for _, u := range snap.Upstreams {
+		infof("[diag] upstream %s: last_status=%d last_error=%q latency=%dms last_seen=%s ago successes=%d failures=%d",
+			u.Name, u.LastStatus, u.LastError, u.LatencyMs, time.Since(u.LastSeen).Round(time.Second), u.Successes, u.Failures)
+	}
+	for _, b := range snap.Backends {
+		infof("[diag] backend %s: up=%t last_error=%q latency=%dms last_dial=%s ago dials_ok=%d dials_failed=%d",
+			b.Addr, b.Up, b.LastError, b.LatencyMs, time.Since(b.LastDial).Round(time.Second), b.DialsOK, b.DialsFailed)
+	}
+}
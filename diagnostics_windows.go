@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// notifyDiagnostics does nothing: Windows has no SIGUSR1.
+func notifyDiagnostics(c chan<- os.Signal) {}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Yggdrasil dialects: session servers that implement Mojang's hasJoined API
+// with small differences, which are smoothed over so the backend always
+// sees Mojang's format.
+const (
+	// dialectMojang passes requests and responses through untouched.
+	dialectMojang = "mojang"
+	// dialectElyBy is Ely.by's session server.
+	dialectElyBy = "elyby"
+	// dialectBlessingSkin is the Yggdrasil API plugin of Blessing Skin
+	// (base URL .../api/yggdrasil/sessionserver).
+	dialectBlessingSkin = "blessing-skin"
+)
+
+// upstreamDialect adapts requests to and responses from one kind of session
+// server.
+type upstreamDialect struct {
+	name string
+	// query rewrites the hasJoined query sent by the backend; nil keeps it
+	query func(q url.Values) url.Values
+	// normalize rewrites a 200 body into Mojang's profile format, or fails
+	// if it isn't a usable profile; nil keeps it
+	normalize func(body []byte) ([]byte, error)
+}
+
+var upstreamDialects = map[string]upstreamDialect{
+	dialectMojang: {name: dialectMojang},
+	dialectElyBy: {
+		name:      dialectElyBy,
+		query:     canonicalQuery,
+		normalize: normalizeProfile,
+	},
+	dialectBlessingSkin: {
+		name: dialectBlessingSkin,
+		query: func(q url.Values) url.Values {
+			// It compares ip with the address that called /join, which is
+			// the player's client and often differs from what the backend saw
+			// (NAT, Minehut's proxies)
+			q = canonicalQuery(q)
+			q.Del("ip")
+			return q
+		},
+		normalize: normalizeProfile,
+	},
+}
+
+// parseDialects parses -upstream-dialect values of the form NAME=DIALECT,
+// where NAME is an upstream's name as logged (e.g. "minehut") or its base URL.
+func parseDialects(specs []string) (map[string]string, error) {
+	dialects := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		name, dialect, ok := strings.Cut(spec, "=")
+		name, dialect = strings.TrimSpace(name), strings.TrimSpace(dialect)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected NAME=DIALECT, got %q", spec)
+		}
+		if _, known := upstreamDialects[dialect]; !known {
+			return nil, fmt.Errorf("unknown dialect %q (expected mojang, elyby or blessing-skin)", dialect)
+		}
+		dialects[name] = dialect
+	}
+	return dialects, nil
+}
+
+// dialectFor returns the dialect of the session server at serverBase: the one
+// configured for its name or URL, else one guessed from the URL.
+func dialectFor(dialects map[string]string, serverBase string) upstreamDialect {
+	if d, ok := dialects[serverBase]; ok {
+		return upstreamDialects[d]
+	}
+	if d, ok := dialects[upstreamName(serverBase)]; ok {
+		return upstreamDialects[d]
+	}
+	switch {
+	case strings.Contains(serverBase, "ely.by"):
+		return upstreamDialects[dialectElyBy]
+	case strings.Contains(serverBase, "/api/yggdrasil"):
+		return upstreamDialects[dialectBlessingSkin]
+	}
+	return upstreamDialects[dialectMojang]
+}
+
+// canonicalQuery spells the hasJoined parameters the way Mojang documents
+// them, whatever casing the backend used (some forks send "serverid").
+func canonicalQuery(q url.Values) url.Values {
+	out := url.Values{}
+	for key, values := range q {
+		switch strings.ToLower(key) {
+		case "username":
+			key = "username"
+		case "serverid":
+			key = "serverId"
+		case "ip":
+			key = "ip"
+		}
+		out[key] = append(out[key], values...)
+	}
+	return out
+}
+
+// profileProperty is a property of a game profile, e.g. its textures.
+type profileProperty struct {
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// addProfileProperty appends prop to a hasJoined profile's properties,
+// keeping everything else as the upstream sent it.
+func addProfileProperty(body []byte, prop profileProperty) ([]byte, error) {
+	var p map[string]json.RawMessage
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("invalid profile JSON: %w", err)
+	}
+	var props []profileProperty
+	if raw, ok := p["properties"]; ok {
+		if err := json.Unmarshal(raw, &props); err != nil {
+			return nil, fmt.Errorf("invalid profile properties: %w", err)
+		}
+	}
+	raw, err := json.Marshal(append(props, prop))
+	if err != nil {
+		return nil, err
+	}
+	p["properties"] = raw
+	return json.Marshal(p)
+}
+
+// normalizeProfile rewrites a hasJoined profile into Mojang's exact shape: an
+// undashed lowercase id, and properties and profileActions arrays even when
+// empty (some servers omit them, and backends don't expect that).
+func normalizeProfile(body []byte) ([]byte, error) {
+	var p struct {
+		ID         string            `json:"id"`
+		Name       string            `json:"name"`
+		Properties []profileProperty `json:"properties"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("invalid profile JSON: %w", err)
+	}
+	if p.Name == "" {
+		return nil, errors.New("profile has no name")
+	}
+	id := strings.ToLower(strings.ReplaceAll(p.ID, "-", ""))
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return nil, fmt.Errorf("profile has an invalid id %q", p.ID)
+	}
+	if p.Properties == nil {
+		p.Properties = []profileProperty{}
+	}
+	return json.Marshal(map[string]any{
+		"id":             id,
+		"name":           p.Name,
+		"properties":     p.Properties,
+		"profileActions": []string{},
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// discoveryWait is how long a Consul blocking query waits for changes.
+	discoveryWait = 5 * time.Minute
+
+	// discoveryMaxBackoff caps the delay between retries after a failed watch.
+	discoveryMaxBackoff = time.Minute
+)
+
+// backendDiscovery follows the backend address published in a Consul service
+// or an etcd key (-backend-discovery), so the proxy keeps up when the backend
+// is rescheduled to another node. Until the first lookup succeeds, and
+// whenever the source has no address, the last known address is used.
+type backendDiscovery struct {
+	source string // as given to -backend-discovery
+	watch  func(set func(addr string)) error
+
+	mu   sync.RWMutex
+	addr string
+}
+
+// parseDiscovery parses a -backend-discovery value:
+//
+//	consul://127.0.0.1:8500/SERVICE  healthy instances of a Consul service
+//	etcd://127.0.0.1:2379/KEY        host:port stored in an etcd key
+//
+// Use consul+https:// or etcd+https:// for TLS. fallback is used until the
+// first lookup succeeds.
+func parseDiscovery(spec, fallback string) (*backendDiscovery, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	scheme, transport, _ := strings.Cut(u.Scheme, "+")
+	if transport == "" {
+		transport = "http"
+	}
+	if transport != "http" && transport != "https" {
+		return nil, fmt.Errorf("unsupported transport %q", transport)
+	}
+	base := transport + "://" + u.Host
+	name := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || name == "" {
+		return nil, fmt.Errorf("expected %s://HOST:PORT/NAME, got %q", scheme, spec)
+	}
+
+	d := &backendDiscovery{source: spec, addr: fallback}
+	switch scheme {
+	case "consul":
+		d.watch = func(set func(string)) error { return watchConsul(base, name, set) }
+	case "etcd":
+		d.watch = func(set func(string)) error { return watchEtcd(base, name, set) }
+	default:
+		return nil, fmt.Errorf("unknown discovery scheme %q (expected consul or etcd)", scheme)
+	}
+	return d, nil
+}
+
+// currentBackend returns the address of cfg's backend, following discovery
+// if it is enabled, or the nearest one if there are several.
+func (cfg Config) currentBackend() string {
+	if cfg.Discovery != nil {
+		return cfg.Discovery.current()
+	}
+	if cfg.Balancer != nil {
+		return cfg.Balancer.candidates()[0]
+	}
+	return cfg.BackendAddr
+}
+
+// current returns the backend address to dial.
+func (d *backendDiscovery) current() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.addr
+}
+
+func (d *backendDiscovery) set(addr string) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		warnf("[backend] discovery: ignoring invalid address %q from %s", addr, d.source)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if addr != d.addr {
+		infof("[backend] discovery: backend moved from %s to %s", d.addr, addr)
+		d.addr = addr
+	}
+}
+
+// run watches the source for changes, retrying with backoff when the watch
+// fails. It never returns.
+func (d *backendDiscovery) run() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := d.watch(d.set)
+		if time.Since(start) > discoveryMaxBackoff {
+			backoff = time.Second
+		}
+		warnf("[backend] discovery via %s failed: %v (retrying in %s)", d.source, err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, discoveryMaxBackoff)
+	}
+}
+
+// discoveryClient has no overall timeout, since watches are long-polls; the
+// transport still bounds connecting and waiting for headers.
+var discoveryClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		ResponseHeaderTimeout: discoveryWait + 30*time.Second,
+	},
+}
+
+// watchConsul follows the first passing instance of a Consul service using
+// blocking queries.
+func watchConsul(base, service string, set func(string)) error {
+	index := uint64(0)
+	for {
+		u := fmt.Sprintf("%s/v1/health/service/%s?passing=1&index=%d&wait=%s", base, url.PathEscape(service), index, discoveryWait)
+		resp, err := discoveryClient.Get(u)
+		if err != nil {
+			return err
+		}
+		var entries []struct {
+			Node    struct{ Address string }
+			Service struct {
+				Address string
+				Port    int
+			}
+		}
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("consul returned %s", resp.Status)
+		}
+		if err != nil {
+			return fmt.Errorf("decode consul response: %w", err)
+		}
+
+		if len(entries) == 0 {
+			warnf("[backend] discovery: consul service %s has no passing instances", service)
+		} else {
+			host := entries[0].Service.Address
+			if host == "" {
+				host = entries[0].Node.Address
+			}
+			set(net.JoinHostPort(host, strconv.Itoa(entries[0].Service.Port)))
+		}
+
+		// Start over if the index goes backwards, as Consul recommends
+		next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+		if next < index {
+			next = 0
+		}
+		// Don't hammer a server that answers without blocking
+		if next == index {
+			time.Sleep(time.Second)
+		}
+		index = next
+	}
+}
+
+// etcdKeyValue is a key-value pair as returned by the etcd v3 JSON gateway.
+type etcdKeyValue struct {
+	Value []byte `json:"value"` // base64 in JSON
+}
+
+// watchEtcd reads the key through the etcd v3 JSON gateway, then follows its
+// changes with a watch stream.
+func watchEtcd(base, key string, set func(string)) error {
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+
+	var current struct {
+		Header struct {
+			Revision int64 `json:"revision,string"`
+		} `json:"header"`
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	if err := etcdPost(base+"/v3/kv/range", map[string]any{"key": encodedKey}, &current); err != nil {
+		return err
+	}
+	if len(current.Kvs) == 0 {
+		warnf("[backend] discovery: etcd key %s does not exist", key)
+	} else {
+		set(strings.TrimSpace(string(current.Kvs[0].Value)))
+	}
+
+	body, _ := json.Marshal(map[string]any{"create_request": map[string]any{
+		"key":            encodedKey,
+		"start_revision": current.Header.Revision + 1,
+	}})
+	resp, err := discoveryClient.Post(base+"/v3/watch", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd returned %s", resp.Status)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Events []struct {
+					Type string       `json:"type"` // omitted for PUT
+					Kv   etcdKeyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return fmt.Errorf("etcd watch: %w", err)
+		}
+		if msg.Error != nil {
+			return errors.New("etcd watch: " + msg.Error.Message)
+		}
+		for _, ev := range msg.Result.Events {
+			if ev.Type == "DELETE" {
+				warnf("[backend] discovery: etcd key %s was deleted, keeping the last address", key)
+				continue
+			}
+			set(strings.TrimSpace(string(ev.Kv.Value)))
+		}
+	}
+}
+
+// etcdPost makes a unary request to the etcd v3 JSON gateway.
+func etcdPost(u string, req, resp any) error {
+	body, _ := json.Marshal(req)
+	r, err := discoveryClient.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd returned %s", r.Status)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
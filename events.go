@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types published on the event bus.
+const (
+	eventConnOpen      = "connection.open"
+	eventConnClose     = "connection.close"
+	eventAuthSuccess   = "auth.success"
+	eventAuthFail      = "auth.fail"
+	eventBackendDown   = "backend.down"
+	eventBackendUp     = "backend.up"
+	eventRateLimitHit  = "ratelimit.hit"
+	eventLoginBlocked  = "login.blocked"
+	eventLoginFlagged  = "login.flagged"
+	eventKeepaliveDown = "keepalive.down"
+	eventKeepaliveUp   = "keepalive.up"
+	eventConnStuck     = "connection.stuck"
+)
+
+const (
+	// sinkQueueSize is how many events a slow sink may lag behind before
+	// new events for it are dropped.
+	sinkQueueSize = 1024
+
+	// sinkRetryDelay is how long a network sink waits before reconnecting.
+	sinkRetryDelay = 5 * time.Second
+)
+
+// errSinkBackoff is returned for events dropped while a sink waits to reconnect.
+var errSinkBackoff = errors.New("sink is reconnecting")
+
+// Event is a single occurrence published on the event bus.
+type Event struct {
+	Type string         `json:"type"`
+	Time time.Time      `json:"time"`
+	Data map[string]any `json:"data,omitempty"`
+}
+
+// eventSink delivers events to an external system. Send is only ever called
+// from one goroutine per sink.
+type eventSink interface {
+	Send(ev Event) error
+}
+
+// eventBus fans events out to all configured sinks without blocking the
+// publisher; each sink is fed from its own queue and goroutine.
+type eventBus struct {
+	mu     sync.RWMutex
+	queues []chan Event
+}
+
+// events is the process-wide event bus.
+var events = &eventBus{}
+
+// publish sends an event to every sink. It never blocks: if a sink's queue
+// is full, the event is dropped for that sink.
+func (b *eventBus) publish(typ string, data map[string]any) {
+	ev := Event{Type: typ, Time: time.Now(), Data: data}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, q := range b.queues {
+		select {
+		case q <- ev:
+		default:
+		}
+	}
+}
+
+// addSink starts delivering events to sink.
+func (b *eventBus) addSink(name string, sink eventSink) {
+	q := make(chan Event, sinkQueueSize)
+	b.mu.Lock()
+	b.queues = append(b.queues, q)
+	b.mu.Unlock()
+
+	go func() {
+		for ev := range q {
+			if err := sink.Send(ev); err != nil && !errors.Is(err, errSinkBackoff) {
+				warnf("[events] %s: failed to deliver %s: %v", name, ev.Type, err)
+			}
+		}
+	}()
+}
+
+// subscribe returns a channel receiving every event published from now on,
+// and a function that stops the subscription. Like sinks, a subscriber that
+// falls behind misses events rather than blocking the bus.
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	q := make(chan Event, sinkQueueSize)
+	b.mu.Lock()
+	b.queues = append(b.queues, q)
+	b.mu.Unlock()
+
+	return q, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, other := range b.queues {
+			if other == q {
+				b.queues = append(b.queues[:i], b.queues[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// startEventSinks creates the sinks described by cfg.EventSinks and the
+// hooks of cfg.ExecHooks.
+func startEventSinks(cfg Config) error {
+	for _, spec := range cfg.EventSinks {
+		sink, err := newEventSink(spec)
+		if err != nil {
+			return fmt.Errorf("event sink %q: %w", spec, err)
+		}
+		events.addSink(spec, sink)
+		infof("[events] Publishing to %s", spec)
+	}
+	for _, spec := range cfg.ExecHooks {
+		hook, err := parseExecHook(spec)
+		if err != nil {
+			return fmt.Errorf("exec hook: %w", err)
+		}
+		events.addSink("hook "+hook.pattern, hook)
+		infof("[events] Running %q on %s events", hook.command, hook.pattern)
+	}
+	return nil
+}
+
+// newEventSink parses a sink specification:
+//
+//	stdout                       JSON lines on standard output
+//	file:/path/to/events.jsonl   JSON lines appended to a file
+//	http(s)://host/path          JSON POSTed to a webhook
+//	nats://host:4222/subject     NATS publish
+//	mqtt://host:1883/topic       MQTT 3.1.1 publish (QoS 0)
+func newEventSink(spec string) (eventSink, error) {
+	if spec == "stdout" {
+		return &writerSink{w: os.Stdout}, nil
+	}
+	if path, ok := strings.CutPrefix(spec, "file:"); ok {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return &writerSink{w: f}, nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	topic := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "http", "https":
+		return &webhookSink{url: spec, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "nats":
+		if topic == "" {
+			topic = "mc-dual-proxy.events"
+		}
+		return &natsSink{addr: hostWithPort(u.Host, "4222"), subject: strings.ReplaceAll(topic, "/", ".")}, nil
+	case "mqtt":
+		if topic == "" {
+			topic = "mc-dual-proxy/events"
+		}
+		return &mqttSink{addr: hostWithPort(u.Host, "1883"), topic: topic}, nil
+	}
+	return nil, fmt.Errorf("unsupported sink (expected stdout, file:, http(s)://, nats:// or mqtt://)")
+}
+
+// hostWithPort appends defaultPort to host if it has no port.
+func hostWithPort(host, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, defaultPort)
+}
+
+// writerSink writes each event as a JSON line.
+type writerSink struct {
+	w io.Writer
+}
+
+func (s *writerSink) Send(ev Event) error {
+	return json.NewEncoder(s.w).Encode(ev)
+}
+
+// webhookSink POSTs each event as JSON.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Send(ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// natsSink publishes events to a NATS subject using the plain-text client
+// protocol. The connection is re-established on the next event after a failure.
+type natsSink struct {
+	addr    string
+	subject string
+	mu      sync.Mutex // guards conn against the PING responder
+	conn    net.Conn
+	failed  time.Time // last failed connect, for backoff
+}
+
+func (s *natsSink) Send(ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if s.conn == nil {
+		if time.Since(s.failed) < sinkRetryDelay {
+			return errSinkBackoff
+		}
+		if err := s.connect(); err != nil {
+			s.failed = time.Now()
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = fmt.Fprintf(s.conn, "PUB %s %d\r\n%s\r\n", s.subject, len(payload), payload)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *natsSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(conn)
+
+	// The server greets with INFO before accepting CONNECT
+	conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	if line, err := br.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting %q: %v", line, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if _, err := io.WriteString(conn, `CONNECT {"verbose":false,"pedantic":false,"name":"mc-dual-proxy"}`+"\r\n"); err != nil {
+		conn.Close()
+		return err
+	}
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	// Answer server PINGs so we are not disconnected as a stale client
+	go func() {
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "PING") {
+				s.mu.Lock()
+				if s.conn == conn {
+					io.WriteString(conn, "PONG\r\n")
+				}
+				s.mu.Unlock()
+			} else if strings.HasPrefix(line, "-ERR") {
+				warnf("[events] nats %s: %s", s.addr, strings.TrimSpace(line))
+			}
+		}
+	}()
+	return nil
+}
+
+// mqttSink publishes events to an MQTT 3.1.1 broker at QoS 0. The connection
+// is re-established on the next event after a failure.
+type mqttSink struct {
+	addr   string
+	topic  string
+	conn   net.Conn
+	failed time.Time // last failed connect, for backoff
+}
+
+func (s *mqttSink) Send(ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if s.conn == nil {
+		if time.Since(s.failed) < sinkRetryDelay {
+			return errSinkBackoff
+		}
+		if err := s.connect(); err != nil {
+			s.failed = time.Now()
+			return err
+		}
+	}
+
+	// PUBLISH, QoS 0: topic name followed directly by the payload
+	var body bytes.Buffer
+	writeMQTTString(&body, s.topic)
+	body.Write(payload)
+	if _, err := s.conn.Write(mqttPacket(0x30, body.Bytes())); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *mqttSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+
+	// CONNECT: protocol "MQTT" level 4, clean session, keep-alive disabled
+	var body bytes.Buffer
+	writeMQTTString(&body, "MQTT")
+	body.WriteByte(4)    // protocol level 3.1.1
+	body.WriteByte(0x02) // clean session
+	binary.Write(&body, binary.BigEndian, uint16(0))
+	writeMQTTString(&body, fmt.Sprintf("mc-dual-proxy-%d", os.Getpid()))
+
+	if _, err := conn.Write(mqttPacket(0x10, body.Bytes())); err != nil {
+		conn.Close()
+		return err
+	}
+
+	// CONNACK: 0x20 0x02 <flags> <return code>
+	ack := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		conn.Close()
+		return fmt.Errorf("read CONNACK: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if ack[0] != 0x20 || ack[3] != 0 {
+		conn.Close()
+		return fmt.Errorf("broker refused connection (return code %d)", ack[3])
+	}
+
+	// Nothing is subscribed, so anything the broker sends can be discarded
+	go io.Copy(io.Discard, conn)
+
+	s.conn = conn
+	return nil
+}
+
+// mqttPacket frames body with a fixed header and variable-length remaining length.
+func mqttPacket(header byte, body []byte) []byte {
+	pkt := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		pkt = append(pkt, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(pkt, body...)
+}
+
+// writeMQTTString writes a length-prefixed UTF-8 string.
+func writeMQTTString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
@@ -0,0 +1,7 @@
+package main
+
+// fileDescriptorLimit reports no limit: Windows has no per-process cap on
+// sockets to check.
+func fileDescriptorLimit() (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// requesterIP returns the address a multiauth request came from. Behind a
+// reverse proxy in trusted (-auth-trusted-proxies), that is taken from the
+// Forwarded or X-Forwarded-For header: the chain is walked from the nearest
+// hop back, skipping trusted proxies, so a client can't pick its address by
+// sending the header itself. Unix socket peers are local and count as
+// trusted.
+func requesterIP(r *http.Request, trusted []netip.Prefix) string {
+	peer := addrIP(r.RemoteAddr)
+	_, err := netip.ParseAddr(peer)
+	peerIsIP := err == nil
+	if peerIsIP && !isTrustedProxy(trusted, peer) {
+		return peer
+	}
+	if !peerIsIP && len(trusted) == 0 {
+		return peer
+	}
+	hops := forwardedFor(r.Header)
+	ip := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// An obfuscated or broken entry: nothing before it can be
+			// trusted, so stop at the proxy that reported it
+			break
+		}
+		ip = hop.Unmap().String()
+		if !isTrustedProxy(trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedFor lists the client addresses in the Forwarded header (RFC 7239)
+// or, without one, X-Forwarded-For, oldest first. Ports, brackets and
+// quotes are removed; entries that aren't addresses are kept as they are.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(key, "for") {
+						hops = append(hops, hostOnly(strings.Trim(v, `"`)))
+					}
+				}
+			}
+		}
+		return hops
+	}
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hostOnly(hop))
+			}
+		}
+	}
+	return hops
+}
+
+// hostOnly strips the port and IPv6 brackets from a forwarded address.
+func hostOnly(s string) string {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().String()
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// execHookTimeout bounds one run of an -exec-hook command; a command
+	// still running then is killed.
+	execHookTimeout = 30 * time.Second
+
+	// execHookOutputLimit is how much of a failed command's output ends up
+	// in the log.
+	execHookOutputLimit = 512
+)
+
+// execHook runs a shell command for every event of some types (-exec-hook),
+// so notifications and automation can be glued in with a script. The event
+// is passed in environment variables: MC_EVENT (its type), MC_EVENT_TIME,
+// MC_EVENT_JSON (the whole event) and MC_<KEY> for each data field, e.g.
+// MC_USERNAME or MC_REASON. A hook runs one command at a time, as an event
+// sink, so a slow command delays only its own later events.
+type execHook struct {
+	pattern string // event type, type prefix ending in "*", or "*" for all
+	command string
+	timeout time.Duration
+}
+
+// parseExecHook parses an -exec-hook of the form EVENT=COMMAND.
+func parseExecHook(spec string) (*execHook, error) {
+	pattern, command, ok := strings.Cut(spec, "=")
+	pattern, command = strings.TrimSpace(pattern), strings.TrimSpace(command)
+	if !ok || pattern == "" || command == "" {
+		return nil, fmt.Errorf("expected EVENT=COMMAND, got %q", spec)
+	}
+	if strings.Contains(strings.TrimSuffix(pattern, "*"), "*") {
+		return nil, fmt.Errorf("event %q may only end in *", pattern)
+	}
+	return &execHook{pattern: pattern, command: command, timeout: execHookTimeout}, nil
+}
+
+// matches reports whether the hook runs for events of type typ.
+func (h *execHook) matches(typ string) bool {
+	if prefix, ok := strings.CutSuffix(h.pattern, "*"); ok {
+		return strings.HasPrefix(typ, prefix)
+	}
+	return typ == h.pattern
+}
+
+func (h *execHook) Send(ev Event) error {
+	if !h.matches(ev.Type) {
+		return nil
+	}
+	env, err := execHookEnv(ev)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	cmd := shellCommand(h.command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	cmd.WaitDelay = time.Second // don't wait on children holding the output open
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(h.timeout, func() { cmd.Process.Kill() })
+	err = cmd.Wait()
+	if !timer.Stop() {
+		return fmt.Errorf("%q ran longer than %s and was killed", h.command, h.timeout)
+	}
+	output := strings.TrimSpace(out.String())
+	if err != nil {
+		if len(output) > execHookOutputLimit {
+			output = output[:execHookOutputLimit] + "…"
+		}
+		return fmt.Errorf("%q: %v: %s", h.command, err, output)
+	}
+	debugf("[hooks] %s: ran %q: %s", ev.Type, h.command, output)
+	return nil
+}
+
+// execHookEnv returns the environment variables describing ev. Data fields
+// that aren't strings are passed as JSON.
+func execHookEnv(ev Event) ([]string, error) {
+	full, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	env := []string{
+		"MC_EVENT=" + ev.Type,
+		"MC_EVENT_TIME=" + ev.Time.UTC().Format(time.RFC3339),
+		"MC_EVENT_JSON=" + string(full),
+	}
+	for key, value := range ev.Data {
+		s, ok := value.(string)
+		if !ok {
+			raw, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			s = string(raw)
+		}
+		env = append(env, "MC_"+execHookEnvName(key)+"="+s)
+	}
+	return env, nil
+}
+
+// execHookEnvName turns a data field name into an environment variable
+// name: upper case, with anything but letters and digits replaced by _.
+func execHookEnvName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// hostNotAllowedMessage is shown to players who log in via an address not in
+// -allowed-hosts, e.g. the server's raw IP.
+const hostNotAllowedMessage = "Please connect using the server's address."
+
+// hostOther is the metrics label for handshakes with a host not allowed.
+const hostOther = "other"
+
+// hostAllowlist only lets in handshakes whose server address is one of the
+// server's hostnames (-allowed-hosts). Scanners and players using a leaked
+// IP address connect with something else.
+type hostAllowlist struct {
+	patterns []string // lowercased, may contain * wildcards
+}
+
+// parseAllowedHosts parses a comma-separated list of hostnames, which may
+// contain * wildcards (e.g. *.minehut.gg).
+func parseAllowedHosts(spec string) (*hostAllowlist, error) {
+	l := &hostAllowlist{}
+	for _, host := range strings.Split(spec, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("invalid hostname pattern %q", host)
+		}
+		l.patterns = append(l.patterns, host)
+	}
+	if len(l.patterns) == 0 {
+		return nil, fmt.Errorf("expected hostnames, got %q", spec)
+	}
+	return l, nil
+}
+
+// match returns the pattern host matches, ignoring case and a trailing dot,
+// or "" if it matches none.
+func (l *hostAllowlist) match(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range l.patterns {
+		if ok, _ := path.Match(pattern, host); ok {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// String formats the hostnames the way parseAllowedHosts accepts them.
+func (l *hostAllowlist) String() string {
+	return strings.Join(l.patterns, ",")
+}
+
+// hostCounter counts checked handshakes by allowed pattern (or hostOther)
+// and result, for /metrics. Labels stay few since hosts not allowed share
+// one.
+type hostCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64 // pattern + "\x00" + result → count
+}
+
+// hostChecks is the process-wide handshake host counter.
+var hostChecks = &hostCounter{counts: make(map[string]int64)}
+
+func (c *hostCounter) record(pattern string, allowed bool) {
+	key := hostOther + "\x00rejected"
+	if allowed {
+		key = pattern + "\x00allowed"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[key]++
+}
+
+// write outputs the counts as a metric family.
+func (c *hostCounter) write(p metricsSink) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p.family("handshake_hosts_total", "counter", "Handshakes checked against -allowed-hosts, by matching host pattern (other when none) and result.")
+	for _, key := range sortedKeys(c.counts) {
+		host, result, _ := strings.Cut(key, "\x00")
+		p.sample("handshake_hosts_total", float64(c.counts[key]), "host", host, "result", result)
+	}
+}
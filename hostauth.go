@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// hostSessionServers is one -host-session-servers rule.
+type hostSessionServers struct {
+	hosts   *hostAllowlist
+	servers []string
+}
+
+// hostAuthRouter picks the session servers for a hasJoined request by the
+// hostname the player connected with (-host-session-servers), so one
+// listener can serve a network that accepts Minehut identities and another
+// that is Mojang-only. hasJoined doesn't carry the hostname; it is taken
+// from the player's live connection in the tracker.
+type hostAuthRouter struct {
+	rules []hostSessionServers
+}
+
+// newHostAuthRouter parses HOST=URL,URL values, where HOST may contain *
+// wildcards. Rules are tried in order. No values return nil.
+func newHostAuthRouter(values []string) (*hostAuthRouter, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	r := &hostAuthRouter{}
+	for _, value := range values {
+		host, urls, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not HOST=SESSION-SERVERS", value)
+		}
+		hosts, err := parseAllowedHosts(host)
+		if err != nil {
+			return nil, err
+		}
+		servers := parseSessionServers(urls)
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("no session servers for %s", host)
+		}
+		r.rules = append(r.rules, hostSessionServers{hosts: hosts, servers: servers})
+	}
+	return r, nil
+}
+
+// serversFor returns the session servers of the first rule matching host
+// and its pattern, or nil if none matches.
+func (r *hostAuthRouter) serversFor(host string) ([]string, string) {
+	if r == nil || host == "" {
+		return nil, ""
+	}
+	for _, rule := range r.rules {
+		if pattern := rule.hosts.match(host); pattern != "" {
+			return rule.servers, pattern
+		}
+	}
+	return nil, ""
+}
+
+func (r *hostAuthRouter) String() string {
+	var rules []string
+	for _, rule := range r.rules {
+		rules = append(rules, fmt.Sprintf("%s → %d session servers", rule.hosts, len(rule.servers)))
+	}
+	return strings.Join(rules, ", ")
+}
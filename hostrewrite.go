@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// hostRewriter rewrites the server address of incoming handshakes before they
+// are forwarded, for backends that reject unexpected host strings.
+type hostRewriter struct {
+	stripFML  bool          // drop \0FML\0-style markers appended by Forge
+	trimDot   bool          // drop the trailing dot of fully-qualified names
+	maxLength int           // truncate the hostname to this many bytes (0 = no limit)
+	mappings  []hostMapping // first matching mapping wins
+}
+
+// hostMapping replaces hostnames matching Pattern (case-insensitive, with
+// shell-style wildcards such as *.minehut.gg) with Replacement.
+type hostMapping struct {
+	Pattern     string
+	Replacement string
+}
+
+// parseHostRewrites builds a hostRewriter from -host-rewrite rules:
+//
+//	strip-fml            remove Forge \0FML\0 / \0FML2\0 / \0FML3\0 markers
+//	trim-dot             remove a trailing "." left by SRV/FQDN lookups
+//	max-length=N         truncate the hostname to N bytes
+//	PATTERN=REPLACEMENT  map a hostname (wildcards allowed) to another
+func parseHostRewrites(rules []string) (*hostRewriter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	rw := &hostRewriter{}
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		switch {
+		case rule == "strip-fml":
+			rw.stripFML = true
+		case rule == "trim-dot":
+			rw.trimDot = true
+		case strings.HasPrefix(rule, "max-length="):
+			n, err := strconv.Atoi(strings.TrimPrefix(rule, "max-length="))
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid host rewrite %q: max-length must be a positive integer", rule)
+			}
+			rw.maxLength = n
+		default:
+			pattern, replacement, ok := strings.Cut(rule, "=")
+			if !ok || pattern == "" || replacement == "" {
+				return nil, fmt.Errorf("invalid host rewrite %q (expected strip-fml, trim-dot, max-length=N or pattern=replacement)", rule)
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid host rewrite pattern %q: %w", pattern, err)
+			}
+			rw.mappings = append(rw.mappings, hostMapping{Pattern: strings.ToLower(pattern), Replacement: replacement})
+		}
+	}
+	return rw, nil
+}
+
+// rewrite applies the rules to a handshake server address. Anything after
+// the first NUL byte (Forge markers, forwarding data) is treated as a suffix:
+// rules apply to the hostname only and the suffix is kept unless stripFML
+// removes an FML marker. This keeps Forge clients working through mappings,
+// since Forge servers refuse modded clients whose marker went missing.
+func (rw *hostRewriter) rewrite(addr string) string {
+	host, suffix := addr, ""
+	if i := strings.IndexByte(addr, 0); i >= 0 {
+		host, suffix = addr[:i], addr[i:]
+	}
+
+	if rw.stripFML {
+		if marker := forgeMarker(addr); marker != "" {
+			suffix = strings.Replace(suffix, "\x00"+marker+"\x00", "", 1)
+		}
+	}
+	if rw.trimDot {
+		host = strings.TrimSuffix(host, ".")
+	}
+	lower := strings.ToLower(host)
+	for _, m := range rw.mappings {
+		if ok, _ := path.Match(m.Pattern, lower); ok {
+			host = m.Replacement
+			break
+		}
+	}
+	if rw.maxLength > 0 && len(host) > rw.maxLength {
+		host = host[:rw.maxLength]
+	}
+	return host + suffix
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxTimeout bounds one push to InfluxDB.
+const influxTimeout = 10 * time.Second
+
+// influxPusher writes the metrics served on /metrics to InfluxDB every
+// interval (-influx-url), in line protocol. Every sample becomes a point of
+// the measurement named like the Prometheus metric, with its labels as tags
+// and a single value field; counters stay cumulative.
+type influxPusher struct {
+	url      string
+	token    string
+	interval time.Duration
+	client   *http.Client
+	failing  bool // the last push failed; only touched by run
+}
+
+func newInfluxPusher(rawURL, token string, interval time.Duration) (*influxPusher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("expected an http(s) URL, got %q", rawURL)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive, got %s", interval)
+	}
+	return &influxPusher{url: rawURL, token: token, interval: interval, client: &http.Client{Timeout: influxTimeout}}, nil
+}
+
+// run pushes the metrics every interval. Failures are logged when they
+// start and when pushes work again, not on every attempt.
+func (p *influxPusher) run(cfg Config) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		err := p.push(cfg.reloaded(), now)
+		switch {
+		case err != nil && !p.failing:
+			warnf("[influx] Failed to push metrics: %v", err)
+		case err == nil && p.failing:
+			infof("[influx] Pushing metrics again")
+		}
+		p.failing = err != nil
+	}
+}
+
+// push writes one batch of points stamped with now.
+func (p *influxPusher) push(cfg Config, now time.Time) error {
+	w := &influxWriter{timestamp: strconv.FormatInt(now.UnixNano(), 10)}
+	writeMetrics(w, cfg)
+
+	req, err := http.NewRequest(http.MethodPost, p.url, &w.buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Token "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// influxWriter renders writeMetrics as line protocol.
+type influxWriter struct {
+	timestamp string
+	buf       bytes.Buffer
+}
+
+func (w *influxWriter) family(name, typ, help string) {}
+
+func (w *influxWriter) sample(name string, value float64, labels ...string) {
+	w.buf.WriteString(influxEscape(metricsPrefix+name, ", "))
+	for i := 0; i+1 < len(labels); i += 2 {
+		if labels[i+1] == "" {
+			continue // line protocol has no empty tag values
+		}
+		w.buf.WriteString("," + influxEscape(labels[i], ",= ") + "=" + influxEscape(labels[i+1], ",= "))
+	}
+	w.buf.WriteString(" value=" + strconv.FormatFloat(value, 'g', -1, 64) + " " + w.timestamp + "\n")
+}
+
+// influxEscape backslash-escapes the characters in special, and backslashes.
+func influxEscape(s, special string) string {
+	if !strings.ContainsAny(s, special+`\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
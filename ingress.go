@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ingressAuto is the default ingress profile: any PROXY header version is
+// accepted, and connections without one are taken as direct players.
+const ingressAuto = "auto"
+
+// ingressProfile describes how the TCP front-end in front of a listener
+// (-ingress, or ingress= in -route) sends PROXY headers, so headers it would
+// never send are refused instead of believed.
+type ingressProfile struct {
+	name     string
+	v1, v2   bool // header versions the front-end sends
+	required bool // it sends one on every connection, so one without came around it
+	// probes means headers without an address (v1 UNKNOWN, v2 LOCAL)
+	// followed by nothing are the front-end's health checks, closed
+	// quietly instead of being proxied to the backend
+	probes bool
+}
+
+var ingressProfiles = map[string]ingressProfile{
+	"none":      {name: "none"},
+	"spectrum":  {name: "spectrum", v1: true, required: true, probes: true},
+	"tcpshield": {name: "tcpshield", v1: true, v2: true, required: true, probes: true},
+	"infrared":  {name: "infrared", v2: true, required: true, probes: true},
+}
+
+// parseIngressProfile looks a profile up by name; auto returns nil, which
+// keeps the default detection.
+func parseIngressProfile(name string) (*ingressProfile, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == ingressAuto {
+		return nil, nil
+	}
+	p, ok := ingressProfiles[name]
+	if !ok {
+		names := []string{ingressAuto}
+		for n := range ingressProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names[1:])
+		return nil, fmt.Errorf("unknown ingress profile %q (expected %s)", name, strings.Join(names, ", "))
+	}
+	return &p, nil
+}
+
+// check returns why the profile's front-end can't have sent header (nil:
+// none was sent), or "" if it could.
+func (p *ingressProfile) check(header *ProxyHeader) string {
+	switch {
+	case header == nil && p.required:
+		return "no PROXY header"
+	case header == nil:
+		return ""
+	case header.Version == 1 && !p.v1, header.Version == 2 && !p.v2:
+		return fmt.Sprintf("unexpected PROXY v%d header", header.Version)
+	}
+	return ""
+}
+
+// String describes the profile for the startup banner.
+func (p *ingressProfile) String() string {
+	var versions []string
+	if p.v1 {
+		versions = append(versions, "v1")
+	}
+	if p.v2 {
+		versions = append(versions, "v2")
+	}
+	if len(versions) == 0 {
+		return p.name + " (no PROXY headers)"
+	}
+	return fmt.Sprintf("%s (PROXY %s required)", p.name, strings.Join(versions, "/"))
+}
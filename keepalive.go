@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// keepaliveFailAfter is how many pings in a row must fail before the
+	// route is reported down, so one lost ping doesn't page anyone.
+	keepaliveFailAfter = 3
+
+	keepaliveTimeout = 10 * time.Second
+)
+
+// routeKeepalive pings the server through its public Minehut address
+// (-keepalive) every interval. The pings take the same path as Minehut
+// players, which keeps Minehut's route to the proxy from going stale while
+// nobody plays, and notices when that path breaks.
+type routeKeepalive struct {
+	target   string // host:port as players connect
+	interval time.Duration
+
+	mu       sync.Mutex
+	failures int // in a row
+	down     bool
+	latency  time.Duration
+}
+
+func newRouteKeepalive(target string, interval time.Duration) *routeKeepalive {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "25565")
+	}
+	return &routeKeepalive{target: target, interval: interval}
+}
+
+// run pings every interval. It never returns.
+func (k *routeKeepalive) run() {
+	for {
+		time.Sleep(k.interval)
+		k.ping()
+	}
+}
+
+// ping sends one status ping and reports state changes.
+func (k *routeKeepalive) ping() {
+	host, port := splitHostPortDefault(k.target)
+	start := time.Now()
+	_, err := queryBackendStatus(k.target, nil, host, port, keepaliveTimeout)
+	latency := time.Since(start)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err == nil {
+		debugf("[keepalive] %s answered in %s", k.target, latency.Round(time.Millisecond))
+		if k.down {
+			infof("[keepalive] %s answers again after %d failed pings", k.target, k.failures)
+			events.publish(eventKeepaliveUp, map[string]any{"target": k.target, "failures": k.failures})
+		}
+		k.failures, k.down, k.latency = 0, false, latency
+		return
+	}
+	k.failures++
+	debugf("[keepalive] ping %d through %s failed: %v", k.failures, k.target, err)
+	if k.failures == keepaliveFailAfter {
+		k.down = true
+		warnf("[keepalive] %d pings in a row through %s failed, players there may not get in: %v", k.failures, k.target, err)
+		events.publish(eventKeepaliveDown, map[string]any{"target": k.target, "failures": k.failures, "error": err.Error()})
+	}
+}
+
+// state reports whether the route is up and the last answered ping's round
+// trip.
+func (k *routeKeepalive) state() (bool, time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return !k.down, k.latency
+}
+
+// write outputs the route's state as metrics.
+func (k *routeKeepalive) write(p metricsSink) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	up := 1.0
+	if k.down {
+		up = 0
+	}
+	p.family("keepalive_up", "gauge", "Whether status pings through the -keepalive address are answered (0 after several failures in a row).")
+	p.sample("keepalive_up", up, "target", k.target)
+	p.family("keepalive_seconds", "gauge", "Round trip of the last answered -keepalive ping.")
+	p.sample("keepalive_seconds", k.latency.Seconds(), "target", k.target)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Modes for answering pre-1.7 (0xFE) server list pings.
+const (
+	// legacyPingPassthrough forwards legacy pings to the backend unchanged.
+	legacyPingPassthrough = "passthrough"
+	// legacyPingStatic answers with the configured MOTD and player limit.
+	legacyPingStatic = "static"
+	// legacyPingBackend answers with the backend's modern status, translated
+	// to the legacy format (falling back to static if the backend is down).
+	legacyPingBackend = "backend"
+)
+
+const (
+	// legacyPingProtocol is reported to legacy clients. It is newer than any
+	// legacy protocol, so clients list the server as incompatible but still
+	// show the MOTD and player count.
+	legacyPingProtocol = 127
+
+	// legacyPingVersion is the version name shown in static mode.
+	legacyPingVersion = "1.7+"
+
+	// legacyPingTimeout bounds both waiting for the rest of the client's ping
+	// and querying the backend in backend mode.
+	legacyPingTimeout = 3 * time.Second
+)
+
+// isLegacyPing reports whether the client started with the 0xFE legacy
+// server list ping instead of a modern handshake.
+func isLegacyPing(br *bufio.Reader) bool {
+	b, err := br.Peek(1)
+	return err == nil && b[0] == 0xFE
+}
+
+// handleLegacyPing answers a legacy server list ping and closes the
+// connection. backendHeader is the PROXY header to send if the backend has to
+// be queried.
+func handleLegacyPing(clientConn net.Conn, br *bufio.Reader, cfg Config, backendHeader []byte, clientAddr string) {
+	// Beta clients send a lone 0xFE, 1.4+ clients follow it with 0x01. Don't
+	// wait long for a second byte that may never come.
+	clientConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	b, _ := br.Peek(2)
+	modern := len(b) == 2 && b[1] == 0x01
+	clientConn.SetReadDeadline(time.Time{})
+
+	motd, version := cfg.LegacyMOTD, legacyPingVersion
+	online, max := 0, cfg.LegacyMaxPlayers
+	if cfg.LegacyPing == legacyPingBackend {
+		status, err := queryBackendStatus(cfg.currentBackend(), backendHeader, "", 0, legacyPingTimeout)
+		if err != nil {
+			debugf("[tcp] %s: legacy ping: backend status unavailable, answering statically: %v", clientAddr, err)
+		} else {
+			motd, version = status.MOTD(), status.Version.Name
+			online, max = status.Players.Online, status.Players.Max
+			if cfg.AggregatePlayers {
+				online = networkPlayers()
+			}
+		}
+	}
+	// Legacy clients only render a single line
+	motd = strings.ReplaceAll(motd, "\n", " ")
+
+	var response string
+	if modern {
+		// 1.4–1.6: §1 \0 protocol \0 version \0 motd \0 online \0 max
+		response = strings.Join([]string{"§1", strconv.Itoa(legacyPingProtocol), version, motd, strconv.Itoa(online), strconv.Itoa(max)}, "\x00")
+	} else {
+		// Beta 1.8–1.3: motd § online § max, with § reserved as separator
+		response = strings.ReplaceAll(motd, "§", "") + "§" + strconv.Itoa(online) + "§" + strconv.Itoa(max)
+	}
+
+	debugf("[tcp] %s: answered legacy server list ping (%s)", clientAddr, cfg.LegacyPing)
+	clientConn.SetWriteDeadline(time.Now().Add(legacyPingTimeout))
+	clientConn.Write(encodeLegacyKick(response))
+}
+
+// encodeLegacyKick encodes s as a legacy 0xFF kick packet: a big-endian
+// length in UTF-16 code units followed by the UTF-16BE string.
+func encodeLegacyKick(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	out := make([]byte, 0, 3+2*len(units))
+	out = append(out, 0xFF, byte(len(units)>>8), byte(len(units)))
+	for _, u := range units {
+		out = append(out, byte(u>>8), byte(u))
+	}
+	return out
+}
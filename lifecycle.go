@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readinessDialTimeout bounds the backend check of /readyz.
+const readinessDialTimeout = 2 * time.Second
+
+// lifecycle tracks what orchestrators such as Kubernetes need to know: whether
+// the listeners are up, and whether we are draining before shutdown.
+type lifecycle struct {
+	tcpUp    atomic.Bool // default player listener
+	authUp   atomic.Bool
+	draining atomic.Bool
+
+	mu        sync.Mutex
+	listeners []net.Listener // player listeners, closed when draining
+}
+
+// readiness is the process-wide lifecycle state.
+var readiness = &lifecycle{}
+
+// playerListenerUp registers a player listener of route so it can be closed
+// when draining.
+func (l *lifecycle) playerListenerUp(ln net.Listener, route string) {
+	l.mu.Lock()
+	l.listeners = append(l.listeners, ln)
+	l.mu.Unlock()
+	if route == "" || route == defaultRouteName {
+		l.tcpUp.Store(true)
+	}
+}
+
+// ready reports whether new players should be sent to this instance, and if
+// not, why.
+func (l *lifecycle) ready(cfg Config) (bool, string) {
+	switch {
+	case l.draining.Load():
+		return false, "draining"
+	case !l.tcpUp.Load():
+		return false, "player listener not up"
+	case !l.authUp.Load():
+		return false, "multiauth listener not up"
+	}
+	// Backends started on demand are down by design until a player joins
+	onDemand := cfg.Waker != nil || (cfg.Supervisor != nil && !cfg.Supervisor.running())
+	if !onDemand {
+		conn, err := net.DialTimeout("tcp", cfg.currentBackend(), readinessDialTimeout)
+		if err != nil {
+			return false, fmt.Sprintf("backend unreachable: %v", err)
+		}
+		conn.Close()
+	}
+	return true, "ok"
+}
+
+// drain stops accepting players and waits up to timeout for the connected
+// ones to leave.
+func (l *lifecycle) drain(timeout time.Duration) {
+	l.draining.Store(true)
+	l.mu.Lock()
+	for _, ln := range l.listeners {
+		ln.Close()
+	}
+	l.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastLog := time.Now()
+	for n := tracker.count(); n > 0; n = tracker.count() {
+		if time.Now().After(deadline) {
+			warnf("Drain timeout reached with %d connection(s) left", n)
+			return
+		}
+		if time.Since(lastLog) >= 5*time.Second {
+			infof("Draining: waiting for %d connection(s), %s left", n, time.Until(deadline).Round(time.Second))
+			lastLog = time.Now()
+		}
+		<-ticker.C
+	}
+	infof("Drained all connections")
+}
+
+// registerProbes adds the Kubernetes-style /livez and /readyz endpoints to mux.
+func registerProbes(mux *http.ServeMux, cfg Config) {
+	// Liveness: the process is responsive
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	// Readiness: both listeners are up, the backend is reachable and we
+	// aren't draining
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ok, reason := readiness.ready(cfg.reloaded())
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprint(w, reason)
+	})
+}
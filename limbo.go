@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// limboMinProtocol is the first protocol (1.20.5) with Transfer packets,
+	// which send players in limbo back once the backend is up.
+	limboMinProtocol = 766
+
+	// limboStrictErrorsUntil is the last protocol (1.21.1) whose Login
+	// Success ends with a "strict error handling" flag.
+	limboStrictErrorsUntil = 767
+
+	// limboKeepAliveInterval is how often players in limbo get a keep-alive;
+	// clients give up on a server that is silent for 30 seconds.
+	limboKeepAliveInterval = 10 * time.Second
+
+	// limboPollInterval is how often limbo checks whether the backend is
+	// back.
+	limboPollInterval = time.Second
+)
+
+// Packet IDs limbo uses, the same in every protocol it supports.
+const (
+	loginSuccessID      = 0x02 // clientbound, login
+	loginAcknowledgedID = 0x03 // serverbound, login
+	configDisconnectID  = 0x02 // clientbound, configuration
+	configKeepAliveID   = 0x04 // clientbound, configuration
+	configTransferID    = 0x0B // clientbound, configuration
+)
+
+// limbo keeps players who log in while the backend is (re)starting
+// connected, instead of disconnecting them with the startup message, and
+// transfers them back once it accepts connections again (-limbo). It
+// finishes the login itself, without encryption like an offline-mode
+// server, and holds the player in the configuration phase, which needs no
+// world: the client shows its "Joining world" screen. The transfer starts a
+// real login through the proxy, authenticated as usual.
+//
+// Sessions already on the backend can't be kept: they are encrypted end to
+// end, so the proxy can't take them over when the backend goes away.
+type limbo struct {
+	timeout time.Duration // longest stay before the player is disconnected
+
+	waiting     atomic.Int64
+	transferred atomic.Int64
+	timedOut    atomic.Int64
+	left        atomic.Int64
+}
+
+// accepts reports whether a login with handshake hs can wait in limbo.
+// Older clients can't be transferred and get the startup message instead.
+func (l *limbo) accepts(hs *Handshake) bool {
+	return l != nil && hs.NextState != stateStatus && hs.ProtocolVersion >= limboMinProtocol
+}
+
+// hold finishes the login whose handshake has already been consumed from
+// br and keeps the player until back reports the backend is up, then
+// transfers them to the address they connected to. message is shown if
+// they time out.
+func (l *limbo) hold(clientConn net.Conn, br *bufio.Reader, hs *Handshake, back func() bool, message string) {
+	clientAddr := clientConn.RemoteAddr().String()
+	clientConn.SetDeadline(time.Now().Add(loginStartTimeout))
+	loginStart, err := readPacket(br, 1+1+maxLoginNameLen+16)
+	if err != nil {
+		debugf("[limbo] %s: no Login Start: %v", clientAddr, err)
+		return
+	}
+	name := decodeLoginStartName(loginStart)
+	if name == "" {
+		return
+	}
+	uuid, _ := hex.DecodeString(offlineUUID(name))
+	if _, n, err := decodeString(loginStart[1:], maxLoginNameLen); err == nil && len(loginStart) >= 1+n+16 {
+		uuid = loginStart[1+n : 1+n+16]
+	}
+
+	if _, err := clientConn.Write(encodeLoginSuccess(hs.ProtocolVersion, uuid, name)); err != nil {
+		return
+	}
+	for {
+		packet, err := readPacket(br, 1<<16)
+		if err != nil {
+			return
+		}
+		if packet[0] == loginAcknowledgedID {
+			break
+		}
+	}
+	clientConn.SetDeadline(time.Time{})
+
+	l.waiting.Add(1)
+	defer l.waiting.Add(-1)
+	infof("[limbo] %s: %s waits in limbo for the backend", clientAddr, name)
+
+	// The client's packets (settings, brand, keep-alive answers) are read and
+	// ignored; reading fails once the client leaves
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, err := readPacket(br, 1<<21); err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	poll := time.NewTicker(limboPollInterval)
+	defer poll.Stop()
+	lastKeepAlive := start
+	for {
+		select {
+		case <-gone:
+			l.left.Add(1)
+			infof("[limbo] %s: %s left limbo after %s", clientAddr, name, time.Since(start).Round(time.Second))
+			return
+		case now := <-poll.C:
+			switch {
+			case back():
+				l.transferred.Add(1)
+				infof("[limbo] %s: backend is back, transferring %s after %s", clientAddr, name, time.Since(start).Round(time.Second))
+				writeLimboPacket(clientConn, encodeTransfer(hs.Hostname(), hs.ServerPort))
+				// The client closes the connection once it has the transfer
+				select {
+				case <-gone:
+				case <-time.After(disconnectTimeout):
+				}
+				return
+			case now.Sub(start) >= l.timeout:
+				l.timedOut.Add(1)
+				infof("[limbo] %s: %s waited %s, disconnecting", clientAddr, name, l.timeout)
+				writeLimboPacket(clientConn, encodeConfigDisconnect(message))
+				return
+			case now.Sub(lastKeepAlive) >= limboKeepAliveInterval:
+				lastKeepAlive = now
+				if err := writeLimboPacket(clientConn, encodeConfigKeepAlive(now.UnixMilli())); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func writeLimboPacket(conn net.Conn, packet []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(disconnectTimeout))
+	_, err := conn.Write(packet)
+	return err
+}
+
+// encodeLoginSuccess returns a Login Success packet for an unencrypted,
+// uncompressed login: the player's UUID and name, without properties.
+func encodeLoginSuccess(protocol int32, uuid []byte, name string) []byte {
+	body := append([]byte{loginSuccessID}, uuid...)
+	body = appendString(body, name)
+	body = appendVarInt(body, 0) // properties
+	if protocol <= limboStrictErrorsUntil {
+		body = append(body, 0) // no strict error handling
+	}
+	return appendVarInt(nil, int32(len(body)), body...)
+}
+
+func encodeConfigKeepAlive(id int64) []byte {
+	body := binary.BigEndian.AppendUint64([]byte{configKeepAliveID}, uint64(id))
+	return appendVarInt(nil, int32(len(body)), body...)
+}
+
+// encodeTransfer returns a Transfer packet sending the client to host:port.
+func encodeTransfer(host string, port uint16) []byte {
+	body := appendString([]byte{configTransferID}, host)
+	body = appendVarInt(body, int32(port))
+	return appendVarInt(nil, int32(len(body)), body...)
+}
+
+// encodeConfigDisconnect returns a configuration-phase Disconnect packet.
+// Since 1.20.3 its reason is an NBT text component; a plain string tag,
+// without the root name network NBT omits, is the simplest one.
+func encodeConfigDisconnect(reason string) []byte {
+	body := []byte{configDisconnectID, 0x08}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(reason)))
+	body = append(body, reason...)
+	return appendVarInt(nil, int32(len(body)), body...)
+}
+
+func (l *limbo) String() string {
+	return fmt.Sprintf("holding 1.20.5+ logins for up to %s while the backend starts", l.timeout)
+}
+
+// write adds the limbo counters to the metrics.
+func (l *limbo) write(p metricsSink) {
+	p.family("limbo_players", "gauge", "Players waiting in -limbo for the backend.")
+	p.sample("limbo_players", float64(l.waiting.Load()))
+	p.family("limbo_exits_total", "counter", "Players who left -limbo, by how.")
+	p.sample("limbo_exits_total", float64(l.transferred.Load()), "result", "transferred")
+	p.sample("limbo_exits_total", float64(l.timedOut.Load()), "result", "timed_out")
+	p.sample("limbo_exits_total", float64(l.left.Load()), "result", "left")
+}
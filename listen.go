@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Address families a player listener binds (-listen-family, or family= in
+// -route).
+const (
+	listenAuto = "auto" // whatever the platform does: dual-stack for wildcards where it can
+	listenDual = "dual" // separate IPv4 and IPv6-only sockets for wildcards
+	listenIPv4 = "ipv4" // IPv4 only
+	listenIPv6 = "ipv6" // IPv6 only
+)
+
+// listenAddress is one socket address a player listener binds.
+type listenAddress struct {
+	network string // tcp, tcp4 or tcp6
+	addr    string
+}
+
+func (a listenAddress) String() string {
+	switch a.network {
+	case "tcp4":
+		return a.addr + " (IPv4)"
+	case "tcp6":
+		return a.addr + " (IPv6 only)"
+	}
+	return a.addr
+}
+
+// parseListenAddrs expands a comma-separated -listen value into the sockets
+// to bind for family. The platform default ("auto") makes wildcard addresses
+// dual-stack on most systems but IPv4-only on some (OpenBSD), and a
+// dual-stack socket is subject to sysctls on others; the explicit families
+// don't depend on either.
+func parseListenAddrs(spec, family string) ([]listenAddress, error) {
+	switch family {
+	case "", listenAuto, listenDual, listenIPv4, listenIPv6:
+	default:
+		return nil, fmt.Errorf("unknown address family %q (expected auto, dual, ipv4 or ipv6)", family)
+	}
+	var addrs []listenAddress
+	seen := make(map[listenAddress]bool)
+	add := func(network, host, port string) error {
+		a := listenAddress{network, net.JoinHostPort(host, port)}
+		if seen[a] {
+			return fmt.Errorf("%s is listed twice", a)
+		}
+		seen[a] = true
+		addrs = append(addrs, a)
+		return nil
+	}
+	for _, addr := range strings.Split(spec, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(host)
+		wildcard := host == "" || (ip != nil && ip.IsUnspecified())
+		switch {
+		case family == "" || family == listenAuto:
+			err = add("tcp", host, port)
+		case wildcard && family == listenDual:
+			if err = add("tcp4", "0.0.0.0", port); err == nil {
+				err = add("tcp6", "::", port)
+			}
+		case wildcard && family == listenIPv4:
+			err = add("tcp4", "0.0.0.0", port)
+		case wildcard && family == listenIPv6:
+			err = add("tcp6", "::", port)
+		case ip == nil:
+			// Hostnames resolve to one address of the family
+			network := map[string]string{listenDual: "tcp", listenIPv4: "tcp4", listenIPv6: "tcp6"}[family]
+			err = add(network, host, port)
+		case ip.To4() != nil && family != listenIPv6:
+			err = add("tcp4", host, port)
+		case ip.To4() == nil && family != listenIPv4:
+			err = add("tcp6", host, port)
+		default:
+			err = fmt.Errorf("%s doesn't belong to address family %s", addr, family)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no listen address in %q", spec)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// loadTestOpTimeout bounds each simulated client.
+	loadTestOpTimeout = 10 * time.Second
+
+	// loadTestProgressInterval is how often progress is printed.
+	loadTestProgressInterval = 5 * time.Second
+
+	// loadTestProtocol is the protocol version fake clients announce (1.21).
+	loadTestProtocol = 767
+)
+
+// loadTestSources is where fake PROXY headers claim clients come from: the
+// range reserved for benchmarking (RFC 2544), so they never hit real players'
+// bans or rate limits.
+var loadTestSources = netip.MustParsePrefix("198.18.0.0/15")
+
+// loadTestOptions configure a load test (see runLoadTest for the flags).
+type loadTestOptions struct {
+	Target      string
+	Clients     int
+	Duration    time.Duration
+	Mode        string // status, login or mixed
+	ProxyHeader string // none, v1 or v2
+	Host        string // server address in the handshake; defaults to Target's host
+	StreamBytes int    // login mode: bytes sent after Login Start
+}
+
+// loadTestStats collects the outcome of every simulated client.
+type loadTestStats struct {
+	mu        sync.Mutex
+	ok        int
+	errors    map[string]int // error message → count
+	latencies []time.Duration
+}
+
+func (s *loadTestStats) record(latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors[err.Error()]++
+		return
+	}
+	s.ok++
+	s.latencies = append(s.latencies, latency)
+}
+
+func (s *loadTestStats) failed() int {
+	n := 0
+	for _, count := range s.errors {
+		n += count
+	}
+	return n
+}
+
+// runLoadTest implements the loadtest subcommand.
+func runLoadTest(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mc-dual-proxy loadtest [flags]")
+		fmt.Fprintln(fs.Output(), "Simulates concurrent Minecraft clients against a proxy or server to check its capacity.")
+		fs.PrintDefaults()
+	}
+	var opts loadTestOptions
+	fs.StringVar(&opts.Target, "target", "127.0.0.1:25565", "Address to test (your -listen address)")
+	fs.IntVar(&opts.Clients, "clients", 50, "Concurrent fake clients")
+	fs.DurationVar(&opts.Duration, "duration", 30*time.Second, "How long to run")
+	fs.StringVar(&opts.Mode, "mode", "mixed", "What clients do: status (server list pings), login (handshake, Login Start and data) or mixed")
+	fs.StringVar(&opts.ProxyHeader, "proxy-header", "none", "Send a fake PROXY header from a random 198.18.0.0/15 address: none, v1 or v2")
+	fs.StringVar(&opts.Host, "host", "", "Server address put in the handshake (default: the -target host)")
+	fs.IntVar(&opts.StreamBytes, "stream-bytes", 4096, "Login mode: random bytes sent after Login Start, simulating game traffic")
+	fs.Parse(args)
+
+	switch {
+	case opts.Clients < 1:
+		return fmt.Errorf("invalid -clients %d: must be at least 1", opts.Clients)
+	case opts.Duration <= 0:
+		return fmt.Errorf("invalid -duration %s: must be positive", opts.Duration)
+	case opts.StreamBytes < 0:
+		return fmt.Errorf("invalid -stream-bytes %d: must not be negative", opts.StreamBytes)
+	}
+	switch opts.Mode {
+	case "status", "login", "mixed":
+	default:
+		return fmt.Errorf("invalid -mode %q (expected status, login or mixed)", opts.Mode)
+	}
+	switch opts.ProxyHeader {
+	case "none", "v1", "v2":
+	default:
+		return fmt.Errorf("invalid -proxy-header %q (expected none, v1 or v2)", opts.ProxyHeader)
+	}
+
+	fmt.Printf("Load testing %s with %d %s clients for %s\n", opts.Target, opts.Clients, opts.Mode, opts.Duration)
+	stats := loadTest(opts, func(elapsed time.Duration, ok, failed int) {
+		fmt.Printf("  %s: %d ok, %d failed (%.1f/s)\n", elapsed.Round(time.Second), ok, failed, float64(ok+failed)/elapsed.Seconds())
+	})
+	fmt.Println(formatLoadTestReport(stats, opts.Duration))
+	if stats.ok == 0 {
+		return errors.New("no client succeeded")
+	}
+	return nil
+}
+
+// loadTest runs opts.Clients clients back to back for opts.Duration, calling
+// progress every loadTestProgressInterval.
+func loadTest(opts loadTestOptions, progress func(elapsed time.Duration, ok, failed int)) *loadTestStats {
+	stats := &loadTestStats{errors: make(map[string]int)}
+	start := time.Now()
+	deadline := start.Add(opts.Duration)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(loadTestProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				stats.mu.Lock()
+				ok, failed := stats.ok, stats.failed()
+				stats.mu.Unlock()
+				progress(time.Since(start), ok, failed)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := range opts.Clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; time.Now().Before(deadline); n++ {
+				login := opts.Mode == "login" || (opts.Mode == "mixed" && (i+n)%2 == 1)
+				latency, err := loadTestClient(opts, login)
+				stats.record(latency, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	return stats
+}
+
+// loadTestClient simulates one client and returns how long the target took
+// to answer it: the status and pong for pings, the first packet for logins.
+func loadTestClient(opts loadTestOptions, login bool) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", opts.Target, loadTestOpTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(loadTestOpTimeout))
+
+	host, port := splitHostPortDefault(opts.Target)
+	if opts.Host != "" {
+		host = opts.Host
+	}
+	out := fakeProxyHeader(opts.ProxyHeader, conn.RemoteAddr())
+	br := bufio.NewReader(conn)
+
+	if !login {
+		hs := &Handshake{ProtocolVersion: loadTestProtocol, ServerAddress: host, ServerPort: port, NextState: stateStatus}
+		out = append(out, hs.encode()...)
+		out = append(out, 0x01, 0x00) // Status Request
+		out = append(out, 0x09, 0x01) // Ping Request with an 8 byte payload
+		out = binary.BigEndian.AppendUint64(out, uint64(start.UnixMilli()))
+		if _, err := conn.Write(out); err != nil {
+			return 0, err
+		}
+		if packet, err := readPacket(br, maxStatusResponse); err != nil {
+			return 0, fmt.Errorf("read status: %w", loadTestReadError(err))
+		} else if packet[0] != 0x00 {
+			return 0, fmt.Errorf("unexpected status packet 0x%02x", packet[0])
+		}
+		if _, err := readPacket(br, 16); err != nil {
+			return 0, fmt.Errorf("read pong: %w", loadTestReadError(err))
+		}
+		return time.Since(start), nil
+	}
+
+	hs := &Handshake{ProtocolVersion: loadTestProtocol, ServerAddress: host, ServerPort: port, NextState: stateLogin}
+	out = append(out, hs.encode()...)
+	name := fmt.Sprintf("load%d", rand.IntN(1_000_000_000))
+	loginStart := appendString([]byte{0x00}, name)
+	loginStart = append(loginStart, make([]byte, 16)...) // player UUID, unused offline
+	out = appendVarInt(out, int32(len(loginStart)), loginStart...)
+	if _, err := conn.Write(out); err != nil {
+		return 0, err
+	}
+	if _, err := readPacket(br, maxStatusResponse); err != nil {
+		return 0, fmt.Errorf("read login response: %w", loadTestReadError(err))
+	}
+	latency := time.Since(start)
+
+	// Game traffic is encrypted, so random bytes are as good as any
+	if opts.StreamBytes > 0 {
+		data := make([]byte, opts.StreamBytes)
+		for i := range data {
+			data[i] = byte(rand.Uint32())
+		}
+		conn.Write(data)
+	}
+	return latency, nil
+}
+
+// loadTestReadError shortens read errors so they group well in the report.
+func loadTestReadError(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errors.New("timeout")
+	case errors.Is(err, net.ErrClosed), strings.Contains(err.Error(), "EOF"), strings.Contains(err.Error(), "reset"):
+		return errors.New("connection closed")
+	}
+	return err
+}
+
+// fakeProxyHeader returns a PROXY header of the given kind from a random
+// benchmarking address to dst, or nil for "none".
+func fakeProxyHeader(kind string, dst net.Addr) []byte {
+	if kind == "none" {
+		return nil
+	}
+	ip := loadTestSources.Addr().As4()
+	binary.BigEndian.PutUint32(ip[:], binary.BigEndian.Uint32(ip[:])|rand.Uint32()&0x1FFFF)
+	src := &net.TCPAddr{IP: net.IP(ip[:]), Port: 1024 + rand.IntN(60000)}
+	dstTCP, ok := dst.(*net.TCPAddr)
+	if !ok || dstTCP.IP.To4() == nil {
+		dstTCP = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25565}
+	}
+	if kind == "v1" {
+		return fmt.Appendf(nil, "PROXY TCP4 %s %s %d %d\r\n", src.IP, dstTCP.IP, src.Port, dstTCP.Port)
+	}
+	return buildProxyV2Header(src, dstTCP)
+}
+
+// formatLoadTestReport summarizes a finished load test.
+func formatLoadTestReport(stats *loadTestStats, duration time.Duration) string {
+	var sb strings.Builder
+	failed := stats.failed()
+	fmt.Fprintf(&sb, "\n%d clients succeeded, %d failed (%.1f/s)\n", stats.ok, failed, float64(stats.ok+failed)/duration.Seconds())
+	if len(stats.latencies) > 0 {
+		slices.Sort(stats.latencies)
+		pct := func(p float64) time.Duration {
+			return stats.latencies[int(p*float64(len(stats.latencies)-1))].Round(100 * time.Microsecond)
+		}
+		fmt.Fprintf(&sb, "Latency: p50 %s, p90 %s, p99 %s, max %s\n", pct(0.5), pct(0.9), pct(0.99), pct(1))
+	}
+	if failed > 0 {
+		sb.WriteString("Errors:\n")
+		errs := sortedKeys(stats.errors)
+		slices.SortStableFunc(errs, func(a, b string) int { return stats.errors[b] - stats.errors[a] })
+		for _, msg := range errs {
+			fmt.Fprintf(&sb, "  %6d  %s\n", stats.errors[msg], msg)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logLevel orders log messages by severity.
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+// parseLogLevel converts a level name such as "debug" to a logLevel.
+func parseLogLevel(s string) (logLevel, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", s)
+}
+
+// currentLevel is the minimum level that is logged; it can be changed at
+// runtime through the admin API.
+var currentLevel atomic.Int32
+
+func init() {
+	currentLevel.Store(int32(levelInfo))
+}
+
+func setLogLevel(l logLevel) {
+	currentLevel.Store(int32(l))
+}
+
+func getLogLevel() logLevel {
+	return logLevel(currentLevel.Load())
+}
+
+// logf logs a message at the given level if it is enabled. Levels other than
+// info are tagged so they stand out in plain logs.
+func logf(level logLevel, format string, args ...any) {
+	if level < getLogLevel() {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if !logDedup.allow(level, format, msg) {
+		return
+	}
+	log.Output(3, levelTag(level)+msg)
+}
+
+// levelTag is the prefix of messages logged at level.
+func levelTag(level logLevel) string {
+	if level == levelInfo {
+		return ""
+	}
+	return strings.ToUpper(level.String()) + " "
+}
+
+// logDedupBurst is how many messages of one kind are logged per dedup window
+// before the rest are counted instead.
+const logDedupBurst = 5
+
+// logDeduper collapses floods of the same warning or error (-log-dedup), such
+// as backend dial failures during an attack. Messages are of the same kind
+// when they come from the same format string, whatever the client address in
+// them. The first logDedupBurst of each kind per window are logged as usual;
+// the rest are summed up in one line when the window ends. Debug and info
+// messages are never dropped.
+type logDeduper struct {
+	window atomic.Int64 // time.Duration; 0 disables deduplication
+
+	mu    sync.Mutex
+	kinds map[string]*logKind // level tag + format → kind
+}
+
+// logKind counts the messages of one kind in the current window.
+type logKind struct {
+	level      logLevel
+	logged     int
+	suppressed int
+	last       string // most recent suppressed message
+}
+
+var logDedup = &logDeduper{kinds: make(map[string]*logKind)}
+
+// start turns deduplication on with the given window and sums up suppressed
+// messages at the end of every window.
+func (d *logDeduper) start(window time.Duration) {
+	d.window.Store(int64(window))
+	go func() {
+		for range time.Tick(window) {
+			d.flush()
+		}
+	}()
+}
+
+// allow reports whether msg, formatted from format, should be logged.
+func (d *logDeduper) allow(level logLevel, format, msg string) bool {
+	if level < levelWarn || d.window.Load() == 0 {
+		return true
+	}
+	key := levelTag(level) + format
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	k, ok := d.kinds[key]
+	if !ok {
+		k = &logKind{level: level}
+		d.kinds[key] = k
+	}
+	if k.logged < logDedupBurst {
+		k.logged++
+		return true
+	}
+	k.suppressed++
+	k.last = msg
+	return false
+}
+
+// flush logs a summary for every kind with suppressed messages and starts a
+// new window.
+func (d *logDeduper) flush() {
+	window := time.Duration(d.window.Load())
+	d.mu.Lock()
+	kinds := d.kinds
+	d.kinds = make(map[string]*logKind)
+	d.mu.Unlock()
+	for _, key := range sortedKeys(kinds) {
+		if k := kinds[key]; k.suppressed > 0 {
+			log.Output(2, fmt.Sprintf("%s%s (%d more like this in the last %s)", levelTag(k.level), k.last, k.suppressed, window))
+		}
+	}
+}
+
+func debugf(format string, args ...any) { logf(levelDebug, format, args...) }
+func infof(format string, args ...any)  { logf(levelInfo, format, args...) }
+func warnf(format string, args ...any)  { logf(levelWarn, format, args...) }
+func errorf(format string, args ...any) { logf(levelError, format, args...) }
+
+// connDebug controls verbose per-connection output, either for every
+// connection or only for selected client IPs. It is independent of the log
+// level so an incident can be traced without turning on debug everywhere.
+type connDebug struct {
+	all atomic.Bool
+	mu  sync.RWMutex
+	ips map[string]bool
+}
+
+var connDebugging = &connDebug{ips: make(map[string]bool)}
+
+// enabled reports whether per-connection debug output is on for addr, which
+// may be a bare IP or host:port.
+func (d *connDebug) enabled(addr string) bool {
+	if d.all.Load() {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.ips[addr]
+}
+
+// setIPs replaces the set of IPs with per-connection debugging enabled.
+func (d *connDebug) setIPs(ips []string) {
+	set := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		set[ip] = true
+	}
+	d.mu.Lock()
+	d.ips = set
+	d.mu.Unlock()
+}
+
+func (d *connDebug) ipList() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ips := make([]string, 0, len(d.ips))
+	for ip := range d.ips {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// connDebugf logs verbose output for a connection from realAddr, if
+// per-connection debugging is enabled for it.
+func connDebugf(realAddr, format string, args ...any) {
+	if connDebugging.enabled(realAddr) {
+		log.Output(2, "DEBUG "+fmt.Sprintf(format, args...))
+	}
+}
@@ -3,86 +3,1389 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // Config holds all runtime configuration.
 type Config struct {
-	// Address the TCP proxy listens on (players connect here)
+	// Addresses the TCP proxy listens on, comma-separated (players connect here)
 	ListenAddr string
+	// Address family of the listener: auto, dual, ipv4 or ipv6
+	ListenFamily string
 	// Address of the actual backend (Velocity/Paper)
 	BackendAddr string
+	// Follows the backend address in Consul or etcd; nil uses BackendAddr
+	Discovery *backendDiscovery
+	// Re-resolves a backend hostname and rotates over its addresses; nil dials BackendAddr as is
+	Resolver *backendResolver
+	// Orders several backends by measured latency; nil when -backend names one
+	Balancer *backendBalancer
+	// Name of the route connections on ListenAddr belong to
+	Route string
+	// Additional listeners with their own backends (-route)
+	Routes []routeConfig
+	// Pre-dialed connections to the default backend for logins; nil disables it
+	BackendPool *backendPool
+	// Number of SO_REUSEPORT sockets each listener opens (Linux); 0 or 1 opens a plain one
+	ListenSockets int
+	// Caps connections handled at once across all listeners; nil is unlimited
+	ConnSlots *connSlots
+	// Size of the buffer the PROXY header and handshake are peeked from; 0 uses peekBufferSize
+	PeekBufferSize int
+	// Size of the buffer each direction of a connection is relayed with; 0 uses io.Copy's
+	CopyBufferSize int
+	// Relay established connections with splice(2) instead of copying them through Go
+	Splice bool
+	// Forwards established connections in the kernel through an eBPF sockmap; nil is disabled
+	Sockmap *sockmap
+	// Connections must send their PROXY header and handshake within this; 0 disables it
+	HandshakeTimeout time.Duration
+	// Connections must send their first byte within this; 0 leaves it to HandshakeTimeout
+	FirstByteTimeout time.Duration
+	// Injects faults for resilience testing; nil disables it
+	Chaos *chaosInjector
+	// Saves the start of failed logins for bug reports; nil disables it
+	Recorder *trafficRecorder
+	// Copies a sample of connections to a shadow backend; nil disables it
+	Mirror *trafficMirror
+	// Bandwidth classes by player network; nil leaves connections unshaped
+	Shaper *trafficShaper
+	// Rewrites applied to the handshake server address; nil disables rewriting
+	HostRewriter *hostRewriter
+	// Hostnames handshakes must use; nil allows any
+	AllowedHosts *hostAllowlist
+	// Sends logins of listed players to other backends; nil disables it
+	UserRouter *userRouter
 
-	// Address the multiauth HTTP server listens on
-	AuthListenAddr string
+	// Added to BungeeCord forwarding data from trusted proxies; empty disables it
+	BungeeGuardToken string
+
+	// Peers whose PROXY headers are believed; see UntrustedProxyHeader
+	TrustedProxies []netip.Prefix
+
+	// Refuse PROXY headers that are out of spec in any way, not only the
+	// ones that can't be parsed
+	StrictProxyProtocol bool
+	// Add the handshake hostname to v2 headers sent to the backend, in an AUTHORITY TLV
+	HostTLV bool
+
+	// How the front-end in front of ListenAddr sends PROXY headers; nil
+	// accepts any header, or none
+	Ingress *ingressProfile
+	// What to do with PROXY headers that don't name the source (v1
+	// UNKNOWN, v2 AF_UNSPEC): peer, passthrough or reject
+	ProxyUnknown string
+	// What to do with PROXY headers from other peers: passthrough, rewrite or reject
+	UntrustedProxyHeader string
+	// Signs backend connections for a paired instance; nil disables it
+	RelaySecret []byte
+	// Refuses connections not signed by a paired instance; nil disables it
+	RelayVerifier *relayVerifier
+
+	// How to answer pre-1.7 (0xFE) server list pings: passthrough, static or backend
+	LegacyPing       string
+	LegacyMOTD       string
+	LegacyMaxPlayers int
+
+	// Report the players of every listener and backend in status responses
+	AggregatePlayers bool
+
+	// Pings the server through its public Minehut address; nil disables it
+	Keepalive *routeKeepalive
+
+	// Posts the proxy's health to a status API on a schedule; nil disables it
+	StatusReport *statusReporter
+
+	// Refuses logins from IPs without a status ping in the gate's window; nil disables it
+	PingGate *pingGate
+
+	// Refuses or flags logins from addresses with a bad reputation; nil disables it
+	Reputation *reputationCheck
+
+	// Applies -vpn-policy to logins from VPNs and hosting providers; nil disables it
+	VPN *vpnDetector
+
+	// Limits login attempts per IP; nil disables it
+	LoginLimiter *rateLimiter
+
+	// Limits status pings per IP, counted apart from logins; nil disables it
+	StatusLimiter *rateLimiter
+
+	// Refuses invalid and blocked usernames at auth time; nil disables it
+	UsernameFilter *usernameFilter
+
+	// Limits hasJoined fan-outs per username; nil disables it
+	AuthLimiter *rateLimiter
+
+	// Reverse proxies in front of the multiauth server whose Forwarded and
+	// X-Forwarded-For headers name the real requester
+	AuthTrustedProxies []netip.Prefix
+
+	// Requesters allowed to call the multiauth server; nil allows everyone
+	AuthAllow []netip.Prefix
+
+	// Limits hasJoined requests per requester IP; nil disables it
+	AuthIPLimiter *rateLimiter
+
+	// Records every multiauth request; nil disables it
+	AuthAccessLog *accessLog
+
+	// Refuses serverIds that already authenticated a player, past a short window; nil disables it
+	ReplayGuard *replayGuard
+
+	// Caps the number of players and optionally queues logins beyond it; nil disables it
+	Queue *playerQueue
+
+	// Answers players with a "Starting up" message while the backend refuses connections; nil disables it
+	Startup *startupHold
+
+	// Holds logins while the backend is starting and transfers them back; nil disables it
+	Limbo *limbo
+
+	// Starts the backend when a player logs in and stops it when idle; nil disables it
+	Supervisor *backendSupervisor
+
+	// Wakes a sleeping backend when it can't be reached, with Wake-on-LAN or
+	// the Minehut API; nil disables it
+	Waker backendWaker
+
+	// IP, CIDR and username bans, enforced on connect and at auth time
+	Bans *banList
+	// Lets players no upstream authenticates in as offline players; nil disables it
+	OfflineFallback *offlineFallback
+	// Only lets listed players log in, enforced on Login Start and at auth time; nil disables it
+	Whitelist *whitelist
+
+	// Dial the backend from the player's own IP (IP_TRANSPARENT) instead of
+	// sending a PROXY protocol header
+	Transparent bool
+
+	// Addresses the multiauth HTTP server listens on (unix:PATH for sockets)
+	AuthListenAddrs []string
+
+	// Address the admin HTTP server (dashboard) listens on; empty disables it
+	AdminListenAddr string
+	// Token required for the admin API; empty disables the check
+	AdminToken string
+	// Address HAProxy agent checks are answered on; empty disables it
+	AgentCheckAddr string
 
 	// Session server endpoints to fan out to
 	SessionServers []string
+	// Session servers by the hostname players connected with; nil uses SessionServers for all
+	HostAuth *hostAuthRouter
+	// Upstreams each backend accepts logins from; nil accepts any everywhere
+	BackendUpstreams *backendUpstreams
+
+	// Yggdrasil dialect per upstream name or URL (-upstream-dialect); others are guessed from their URL
+	Dialects map[string]string
+
+	// Profile property naming the upstream that authenticated the player; "" adds none
+	AuthSourceProperty string
+	// Adds the player's metadata to returned profiles for companion plugins; nil disables it
+	Companion *companion
+
+	// Upstream whose 200 wins over others if it answers within PreferWindow
+	PreferUpstream string
+	PreferWindow   time.Duration
+
+	// How to resolve more than one upstream returning 200 (first, priority, reject)
+	ConflictPolicy string
+
+	// Client for session server requests, with the -upstream-* pool settings; nil uses defaultUpstreamClient
+	UpstreamClient *http.Client
+
+	// Upstreams slower than this are logged with a warning; 0 disables it
+	SlowUpstream time.Duration
+
+	// How long SIGTERM waits for players to leave before exiting; 0 exits right away
+	DrainTimeout time.Duration
+
+	// How often a one-line summary of activity is logged; 0 disables it
+	SummaryInterval time.Duration
+
+	// Event sink specifications (stdout, file:, http(s)://, nats://, mqtt://)
+	EventSinks []string
+
+	// Shell commands run on events, as EVENT=COMMAND
+	ExecHooks []string
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		if err := runLoadTest(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-backend" {
+		if err := runCheckBackend(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "update" {
+		if err := runUpdate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mock-backend" {
+		if err := runMockBackend(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dev-sessionserver" {
+		if err := runDevSessionServer(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "test-auth" {
+		if err := runTestAuth(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// generate-setup takes the proxy's flags and writes files instead of
+	// starting the proxy
+	var setup *setupOptions
+	if len(os.Args) > 1 && os.Args[1] == "generate-setup" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		setup = &setupOptions{}
+		flag.StringVar(&setup.Dir, "out", "setup", "generate-setup: directory the files are written to")
+		flag.StringVar(&setup.AuthDomain, "auth-domain", "", "generate-setup: public domain Caddy serves the multiauth server on; empty makes backends connect directly")
+	}
+
+	// selftest takes them too, and checks the configuration against mocks
+	var selfTestHost *string
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		selfTestHost = flag.String("selftest-host", "localhost", "selftest: server address put in the test handshakes, e.g. one -allowed-hosts accepts")
+	}
+
 	cfg := Config{}
 
-	flag.StringVar(&cfg.ListenAddr, "listen", "0.0.0.0:25565", "TCP proxy listen address (players connect here)")
-	flag.StringVar(&cfg.BackendAddr, "backend", "127.0.0.1:25566", "Backend server address (Velocity/Paper)")
-	flag.StringVar(&cfg.AuthListenAddr, "auth-listen", "127.0.0.1:8652", "Multiauth HTTP server listen address")
+	showVersion := flag.Bool("version", false, "Print the version, commit and build date, then exit")
+	configLocation := flag.String("config", "", "JSON file or http(s):// URL with settings by flag name; command-line flags win over it")
+	configPoll := flag.Duration("config-poll", 0, "Re-read -config this often and apply changed settings, e.g. 1m (0: only on SIGHUP)")
+	flag.StringVar(&cfg.ListenAddr, "listen", "0.0.0.0:25565", "TCP proxy listen address (players connect here); several may be comma-separated, e.g. 203.0.113.5:25565,[2001:db8::5]:25565")
+	flag.StringVar(&cfg.ListenFamily, "listen-family", listenAuto, "Address families for -listen: auto (platform default), dual (separate IPv4 and IPv6 sockets), ipv4 or ipv6")
+	flag.BoolVar(&cfg.HostTLV, "host-tlv", false, "Tell the backend the hostname players connected with, before -rewrite-host, in a PROXY v2 AUTHORITY TLV (forwarded v1 headers become v2)")
+	flag.BoolVar(&cfg.StrictProxyProtocol, "strict-proxy-protocol", false, "Refuse PROXY headers with anything out of spec (non-canonical v1 fields, v2 datagram transports, bad TLVs or checksums)")
+	ingress := flag.String("ingress", ingressAuto, "PROXY header profile of the front-end players reach -listen through: auto, none, spectrum, tcpshield or infrared")
+	watchdogSpec := flag.String("watchdog", "", "Report connection handlers stuck in a phase longer than this, as PHASE=DURATION pairs (header, dialing, relaying), e.g. header=1m,dialing=5m; empty disables it")
+	watchdogKill := flag.Bool("watchdog-kill", false, "Also close the connection of handlers -watchdog finds stuck")
+	chaos := flag.String("chaos", "", "Inject faults for resilience testing, never in production: latency=DURATION and chances for truncate-header, reset, upstream-500, upstream-timeout, e.g. latency=200ms,reset=1%")
+	recordDir := flag.String("record-dir", "", "Save the start of failed logins to this directory, for bug reports; empty disables it")
+	recordBytes := flag.Int("record-bytes", 8192, "How many bytes of each direction -record-dir keeps")
+	mirrorAddr := flag.String("mirror", "", "Copy what players send to this shadow backend too, discarding its answers, to soak-test a new server build; empty disables it")
+	mirrorRate := flag.String("mirror-rate", "100%", "Share of connections -mirror copies, e.g. 10%")
+	var shapeClasses stringList
+	flag.Var(&shapeClasses, "shape-class", "Bandwidth of each connection from some networks, as NAME:RATE=CIDR,CIDR with RATE like 256KB/s or unlimited; the first class listing a player applies (repeatable)")
+	portMapMode := flag.String("port-mapping", "", "Forward the listen ports on the local router: auto, upnp or natpmp; empty disables it")
+	portMapGateway := flag.String("port-mapping-gateway", "", "Router address for NAT-PMP (default: the default gateway)")
+	flag.StringVar(&cfg.BackendAddr, "backend", "127.0.0.1:25566", "Backend server address (Velocity/Paper); several comma-separated ones are dialed nearest first")
+	latencyProbe := flag.Duration("latency-probe", 0, "Measure the connect latency to every backend this often, for /health and metrics (0 disables)")
+	latencyProbeStatus := flag.Bool("latency-probe-status", false, "Also time a full status ping in -latency-probe")
+	keepalive := flag.String("keepalive", "", "Status-ping the server through this public address (e.g. myserver.minehut.gg) to keep Minehut's route warm; empty disables it")
+	keepaliveInterval := flag.Duration("keepalive-interval", time.Minute, "How often to send -keepalive pings")
+	statusReportURL := flag.String("status-report-url", "", "POST the proxy's and backend's health as JSON to this URL on a schedule; empty disables it")
+	statusReportToken := flag.String("status-report-token", "", "Bearer token sent with -status-report-url reports")
+	statusReportInterval := flag.Duration("status-report-interval", time.Minute, "How often to send -status-report-url reports")
+	sticky := flag.String("sticky", "", "When -backend lists several, pin each player to one of them by ip or username instead of picking the nearest")
+	backendProbeInterval := flag.Duration("backend-probe-interval", 10*time.Second, "How often to measure the latency to each backend when -backend lists several")
+	backendDiscovery := flag.String("backend-discovery", "", "Follow the backend address in consul://HOST:PORT/SERVICE or etcd://HOST:PORT/KEY (-backend is the fallback)")
+	var routes stringList
+	flag.Var(&routes, "route", "Additional listener: name=NAME;listen=ADDR;backend=ADDR[;session-servers=URL,...] (repeatable)")
+	flag.IntVar(&cfg.PeekBufferSize, "peek-buffer", peekBufferSize, "Bytes buffered to read the PROXY header and handshake; raise it for v2 headers with large TLVs or long forwarding handshakes, which handshake checks refuse otherwise")
+	flag.BoolVar(&cfg.Splice, "splice", false, "Linux: relay established connections with splice(2), so their bytes stay in the kernel (off for connections -record-dir or -mirror taps)")
+	useSockmap := flag.Bool("sockmap", false, "Linux amd64/arm64, root or CAP_BPF+CAP_NET_ADMIN: forward established connections in the kernel through an eBPF sockmap, so the proxy never touches their bytes (-splice or copying covers the rest)")
+	flag.IntVar(&cfg.CopyBufferSize, "copy-buffer", 32*1024, "Bytes buffered per direction when relaying a connection")
+	poolSize := flag.Int("backend-pool", 0, "Keep this many backend connections dialed ahead of time so logins skip the dial (0 disables)")
+	poolMaxAge := flag.Duration("backend-pool-max-age", 10*time.Second, "Replace pre-dialed backend connections after this long, before the backend times them out")
+	flag.IntVar(&cfg.ListenSockets, "listen-sockets", 1, "Linux only: open this many SO_REUSEPORT sockets per listener, each with its own accept loop")
+	maxConnections := flag.Int("max-connections", 0, "Maximum connections handled at once across all listeners; further ones are closed right away (0 = unlimited)")
+	flag.DurationVar(&cfg.FirstByteTimeout, "first-byte-timeout", 2*time.Second, "Close connections that send nothing within this, e.g. port scanners (0: only -handshake-timeout applies)")
+	flag.DurationVar(&cfg.HandshakeTimeout, "handshake-timeout", 5*time.Second, "Close connections that don't send their PROXY header and handshake within this (0 disables)")
+	var userRoutes stringList
+	flag.Var(&userRoutes, "user-route", "Send logins of some players to another backend, as NAMES=BACKEND with NAMES a comma-separated list of usernames or @FILE (repeatable)")
+	allowedHosts := flag.String("allowed-hosts", "", "Refuse handshakes whose server address isn't one of these hostnames (comma-separated, * wildcards)")
+	var hostRewrites stringList
+	flag.Var(&hostRewrites, "host-rewrite", "Handshake host rewrite rule: strip-fml, trim-dot, max-length=N or pattern=replacement (repeatable)")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated IPs/CIDRs allowed to send PROXY headers (e.g. Minehut's proxies)")
+	flag.StringVar(&cfg.ProxyUnknown, "proxy-unknown", proxyUnknownPeer, "What to do with PROXY headers that carry no source address (v1 UNKNOWN, v2 AF_UNSPEC): peer, passthrough or reject")
+	flag.StringVar(&cfg.UntrustedProxyHeader, "untrusted-proxy-header", proxyHeaderPassthrough, "What to do with PROXY headers from peers outside -trusted-proxies: passthrough, rewrite or reject")
+	flag.StringVar(&cfg.BungeeGuardToken, "bungeeguard-token", "", "BungeeGuard token added to BungeeCord forwarding data in handshakes from -trusted-proxies")
+	relaySecret := flag.String("relay-secret", "", "Shared secret to sign backend connections with, when the backend is another mc-dual-proxy")
+	requireRelaySecret := flag.String("require-relay-secret", "", "Only accept connections signed with this shared secret by another mc-dual-proxy")
+	flag.StringVar(&cfg.LegacyPing, "legacy-ping", legacyPingPassthrough, "How to answer pre-1.7 (0xFE) server list pings: passthrough, static or backend")
+	flag.StringVar(&cfg.LegacyMOTD, "legacy-motd", "A Minecraft Server", "MOTD for legacy server list pings in static mode")
+	flag.IntVar(&cfg.LegacyMaxPlayers, "legacy-max-players", 20, "Max players for legacy server list pings in static mode")
+	flag.BoolVar(&cfg.AggregatePlayers, "aggregate-players", false, "Replace the player count in status responses with the players on all routes and backends")
+	verifyPing := flag.Duration("verify-ping", 0, "Anti-bot: only accept logins from IPs that sent a status ping within this window (0 disables)")
+	reputation := flag.String("reputation", "", "Anti-bot: check the reputation of login addresses with abuseipdb or dnsbl:ZONE,ZONE; empty disables it")
+	reputationKey := flag.String("reputation-key", "", "API key for -reputation abuseipdb")
+	reputationThreshold := flag.Int("reputation-threshold", 75, "Score (1-100) at which -reputation acts on a login; DNS blocklist listings score 100")
+	reputationAction := flag.String("reputation-action", "deny", "What -reputation does with logins at the threshold: deny or flag (log and publish login.flagged)")
+	reputationCache := flag.Duration("reputation-cache", 6*time.Hour, "How long -reputation remembers the score of an address")
+	var vpnRanges stringList
+	flag.Var(&vpnRanges, "vpn-ranges", "Anti-bot: file of VPN or hosting provider IPs/CIDRs, one per line, as [LABEL=]FILE; LABEL defaults to vpn (repeatable)")
+	vpnPolicy := flag.String("vpn-policy", vpnBlock, "What to do with logins from -vpn-ranges: block, whitelist (only players on -vpn-whitelist) or tag (PROXY v2 TLV 0xE0 with the label)")
+	vpnWhitelistFile := flag.String("vpn-whitelist", "", "whitelist.json of players allowed in from -vpn-ranges with -vpn-policy whitelist")
+	var hostSessionServers stringList
+	flag.Var(&hostSessionServers, "host-session-servers", "Session servers for players who connected with a hostname, as HOST=URL,URL; HOST may contain * wildcards (repeatable)")
+	var backendUpstreamRules stringList
+	flag.Var(&backendUpstreamRules, "backend-upstreams", "Upstreams that may authenticate players headed for a backend, as BACKEND=UPSTREAM,UPSTREAM (repeatable); refused players only see the backend's \"Failed to verify username\"")
+	var blockedUsernames stringList
+	flag.Var(&blockedUsernames, "block-username", "Regular expression (case-insensitive) of usernames refused at auth time (repeatable)")
+	replayWindow := flag.Duration("replay-window", 10*time.Second, "Refuse a serverId that already authenticated a player once this long has passed since (0 disables)")
+	authRate := flag.String("auth-rate", "", "Max hasJoined requests per username, as count/window (e.g. 5/1m); empty disables it")
+	authTrusted := flag.String("auth-trusted-proxies", "", "Comma-separated IPs/CIDRs of reverse proxies (e.g. Caddy) whose X-Forwarded-For the multiauth server believes")
+	authAllow := flag.String("auth-allow", "", "Comma-separated IPs/CIDRs allowed to send hasJoined requests (e.g. your backends); empty allows everyone")
+	authAccessLog := flag.String("auth-access-log", "", "Log every multiauth request to this file (or stdout), apart from the application log; empty disables it")
+	authAccessFormat := flag.String("auth-access-log-format", accessLogCommon, "Format of -auth-access-log: common (Common Log Format) or json")
+	authIPRate := flag.String("auth-ip-rate", "", "Max hasJoined requests per requester IP, as count/window (e.g. 60/1m); empty disables it")
+	loginRate := flag.String("login-rate", "", "Max login attempts per IP, as count/window (e.g. 3/10s); empty disables it")
+	statusRate := flag.String("status-rate", "", "Max status pings per IP, counted apart from logins, as count/window (e.g. 20/10s); empty disables it")
+	maxPlayers := flag.Int("max-players", 0, "Maximum players on the backend; further logins are queued or rejected (0 = unlimited)")
+	queueing := flag.Bool("queue", false, "Queue logins beyond -max-players instead of rejecting them")
+	startupTime := flag.Duration("startup-hold", 0, "While the backend refuses connections, answer pings and logins with a \"Starting up\" countdown from this expected startup time (0 disables)")
+	limboMode := flag.Bool("limbo", false, "While the backend is starting, keep 1.20.5+ players connected and transfer them back when it is up (the backend needs accepts-transfers=true)")
+	limboTimeout := flag.Duration("limbo-timeout", 5*time.Minute, "Longest time a player waits in -limbo before being disconnected")
+	backendCommand := flag.String("backend-command", "", "Run the backend as a child process with this command (through the shell), restarting it if it crashes")
+	startCommand := flag.String("start-command", "", "Command that starts the backend when a player logs in (run through the shell); empty disables on-demand starting")
+	stopCommand := flag.String("stop-command", "", "Command that stops the backend; empty interrupts the process started by -backend-command or -start-command")
+	idleStop := flag.Duration("idle-stop", 0, "Stop an on-demand backend after this long without players (0 = never)")
+	wolMAC := flag.String("wol-mac", "", "MAC address of the backend machine to wake with Wake-on-LAN when it can't be reached")
+	wolBroadcast := flag.String("wol-broadcast", "255.255.255.255:9", "UDP address Wake-on-LAN packets are sent to")
+	minehutServer := flag.String("minehut-server-id", "", "ID of the Minehut server to start through the Minehut API when it can't be reached (hibernating)")
+	minehutToken := flag.String("minehut-token", "", "Minehut API token (the panel session's Authorization header); best kept in -config")
+	minehutSession := flag.String("minehut-session-id", "", "Minehut panel session ID sent as x-session-id, if your token needs one")
+	minehutURL := flag.String("minehut-api", minehutAPI, "Minehut API base URL")
+	flag.DurationVar(&cfg.DrainTimeout, "drain-timeout", 30*time.Second, "On SIGTERM, stop accepting players and wait up to this long for connected ones to leave (0 exits right away)")
+	flag.DurationVar(&cfg.SummaryInterval, "summary-interval", 0, "Log a one-line activity summary this often, e.g. 15m (0 disables)")
+	statsdAddr := flag.String("statsd", "", "Send metrics to this StatsD server (host:port, UDP); empty disables it")
+	statsdPrefix := flag.String("statsd-prefix", "mc_dual_proxy.", "Prefix of StatsD metric names")
+	statsdFormat := flag.String("statsd-format", statsdFormatDogStatsD, "How StatsD metrics carry labels: dogstatsd (tags) or plain (in the name)")
+	statsdInterval := flag.Duration("statsd-interval", 10*time.Second, "How often counters and gauges are sent to StatsD")
+	influxURL := flag.String("influx-url", "", "Push metrics in InfluxDB line protocol to this write URL, e.g. http://influx:8086/api/v2/write?org=ORG&bucket=BUCKET; empty disables it")
+	influxToken := flag.String("influx-token", "", "InfluxDB API token sent with metric pushes")
+	influxInterval := flag.Duration("influx-interval", 10*time.Second, "How often metrics are pushed to InfluxDB")
+	offline := flag.String("offline-fallback", "", "Let players no session server authenticates in as offline players when connecting via these hostnames (comma-separated, * wildcards; * for all)")
+	whitelistFile := flag.String("whitelist", "", "Only let players in this JSON file (vanilla whitelist.json format) log in; created if missing. An http(s) URL, e.g. of the backend's whitelist.json, is fetched every 30s instead")
+	whitelistMessage := flag.String("whitelist-message", defaultWhitelistMessage, "Disconnect message for players who aren't whitelisted")
+	banFile := flag.String("ban-file", "", "JSON file the ban list is persisted to; empty keeps bans in memory only")
+	backendBanDir := flag.String("backend-bans", "", "Backend server directory whose banned-ips.json and banned-players.json are enforced at the proxy too, read again when they change")
+	flag.BoolVar(&cfg.Transparent, "transparent", false, "Linux only: spoof the player's IP when dialing the backend (IP_TRANSPARENT) instead of sending PROXY protocol")
+	authListen := flag.String("auth-listen", "127.0.0.1:8652", "Multiauth HTTP server listen addresses (comma-separated; unix:PATH for a Unix socket)")
+	flag.StringVar(&cfg.AgentCheckAddr, "agent-check", "", "Answer HAProxy agent checks with this proxy's load and drain state on this address, e.g. :8653; empty disables it")
+	flag.StringVar(&cfg.AdminListenAddr, "admin-listen", "", "Admin HTTP server (dashboard) listen address; empty disables it. Anything but a loopback address needs -admin-token")
+	flag.StringVar(&cfg.AdminToken, "admin-token", "", "Bearer token required by the admin API (also accepted as ?token=); without it, the API is open to anyone who can reach -admin-listen")
+	logLevelName := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	logDedupWindow := flag.Duration("log-dedup", 10*time.Second, "Log only the first few of a kind of warning or error per this window and sum up the rest (0 disables)")
+	consoleMode := flag.String("console", consoleAuto, "Log format: pretty (colors and symbols, for watching live), plain, or auto (pretty on a terminal)")
+	syslogTarget := flag.String("syslog", "", "Log to syslog instead of stderr: local, unix:PATH, udp://HOST:PORT or tcp://HOST:PORT")
+	syslogFacility := flag.String("syslog-facility", "daemon", "Syslog facility: daemon, user, local0 to local7, ...")
+	syslogTag := flag.String("syslog-tag", "mc-dual-proxy", "Syslog app name messages are tagged with")
 
 	sessionServers := flag.String("session-servers", "https://sessionserver.mojang.com,https://api.minehut.com/mitm/proxy", "Comma-separated session server base URLs")
+	var dialects stringList
+	flag.Var(&dialects, "upstream-dialect", "Session server dialect as NAME=DIALECT, NAME being an upstream name or URL and DIALECT mojang, elyby or blessing-skin (repeatable)")
+	prefer := flag.String("prefer", "", "Preferred upstream and grace window, e.g. mojang=150ms")
+	flag.Var((*stringList)(&cfg.EventSinks), "event-sink", "Publish events to a sink: stdout, file:PATH, http(s)://URL, nats://HOST/SUBJECT or mqtt://HOST/TOPIC (repeatable)")
+	flag.Var((*stringList)(&cfg.ExecHooks), "exec-hook", "Run a shell command on events of a type, as EVENT=COMMAND; EVENT may end in * to match a prefix, and the event is passed in MC_* environment variables (repeatable)")
+	flag.DurationVar(&cfg.SlowUpstream, "slow-upstream", 2*time.Second, "Log a warning when a session server takes longer than this to answer (0 disables)")
+	transport := defaultUpstreamTransport
+	flag.IntVar(&transport.MaxIdleConns, "upstream-max-idle", transport.MaxIdleConns, "Idle connections kept open to session servers in total")
+	flag.IntVar(&transport.MaxIdleConnsPerHost, "upstream-max-idle-per-host", transport.MaxIdleConnsPerHost, "Idle connections kept open to each session server")
+	flag.DurationVar(&transport.IdleConnTimeout, "upstream-idle-timeout", transport.IdleConnTimeout, "Close idle session server connections after this long (0 = never)")
+	flag.DurationVar(&transport.TLSHandshakeTimeout, "upstream-tls-timeout", transport.TLSHandshakeTimeout, "Timeout for TLS handshakes with session servers")
+	flag.DurationVar(&transport.KeepAlive, "upstream-keepalive", transport.KeepAlive, "TCP keep-alive interval for session server connections (negative disables)")
+	companionMode := flag.Bool("companion", false, "Add a "+companionProperty+" property with the player's auth source, hostname and route to returned profiles, for backend plugins; every client can read it")
+	companionNode := flag.String("companion-node", "", "Name of this instance in the "+companionProperty+" property (default: the machine's hostname)")
+	flag.StringVar(&cfg.AuthSourceProperty, "auth-source-property", "", "Add a property with this name to returned profiles, naming the upstream that authenticated the player (e.g. authSource)")
+	flag.StringVar(&cfg.ConflictPolicy, "conflict-policy", conflictFirst, "What to do when several upstreams return 200: first, priority or reject")
 
 	flag.Parse()
 
-	for _, s := range strings.Split(*sessionServers, ",") {
-		s = strings.TrimSpace(s)
-		if s != "" {
-			cfg.SessionServers = append(cfg.SessionServers, s)
+	if *showVersion {
+		fmt.Println("mc-dual-proxy " + currentBuild().String())
+		return
+	}
+
+	if setup != nil {
+		// The unit runs the proxy with the flags given here; -config
+		// settings stay in the file
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "out" || f.Name == "auth-domain" {
+				return
+			}
+			if list, ok := f.Value.(*stringList); ok {
+				for _, v := range *list {
+					setup.Args = append(setup.Args, "-"+f.Name+"="+v)
+				}
+				return
+			}
+			setup.Args = append(setup.Args, "-"+f.Name+"="+f.Value.String())
+		})
+		setup.Binary, _ = os.Executable()
+	}
+
+	var configSrc *configSource
+	if *configLocation != "" {
+		configSrc = newConfigSource(*configLocation, flag.CommandLine)
+		if err := configSrc.load(); err != nil {
+			log.Fatalf("Failed to load -config %s: %v", *configLocation, err)
 		}
 	}
 
+	cfg.SessionServers = parseSessionServers(*sessionServers)
+
 	if len(cfg.SessionServers) == 0 {
 		log.Fatal("At least one session server must be configured")
 	}
 
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+	cfg.Route = defaultRouteName
+	profile, err := parseIngressProfile(*ingress)
+	if err != nil {
+		log.Fatalf("Invalid -ingress: %v", err)
+	}
+	cfg.Ingress = profile
+	if _, err := parseListenAddrs(cfg.ListenAddr, cfg.ListenFamily); err != nil {
+		log.Fatalf("Invalid -listen: %v", err)
+	}
+	seenNames := map[string]bool{}
+	seenListen := map[string]bool{cfg.ListenAddr: true}
+	for _, spec := range routes {
+		rt, err := parseRoute(spec)
+		if err != nil {
+			log.Fatalf("Invalid -route: %v", err)
+		}
+		if seenNames[rt.Name] || seenListen[rt.ListenAddr] {
+			log.Fatalf("Invalid -route %s: duplicate name or listen address", rt.Name)
+		}
+		seenNames[rt.Name], seenListen[rt.ListenAddr] = true, true
+		cfg.Routes = append(cfg.Routes, rt)
+	}
+
+	if *recordDir != "" {
+		if *recordBytes <= 0 {
+			log.Fatal("-record-bytes must be positive")
+		}
+		rec, err := newTrafficRecorder(*recordDir, *recordBytes)
+		if err != nil {
+			log.Fatalf("Invalid -record-dir: %v", err)
+		}
+		cfg.Recorder = rec
+	}
+	if *mirrorAddr != "" {
+		rate, err := parseChance(*mirrorRate)
+		if err != nil {
+			log.Fatalf("Invalid -mirror-rate: %v", err)
+		}
+		cfg.Mirror = newTrafficMirror(*mirrorAddr, rate)
+	}
+	shaper, err := parseShapeClasses(shapeClasses)
+	if err != nil {
+		log.Fatalf("Invalid -shape-class: %v", err)
+	}
+	cfg.Shaper = shaper
+	var watchdog *connWatchdog
+	if *watchdogSpec != "" {
+		w, err := parseWatchdog(*watchdogSpec, *watchdogKill)
+		if err != nil {
+			log.Fatalf("Invalid -watchdog: %v", err)
+		}
+		watchdog = w
+	} else if *watchdogKill {
+		log.Fatal("-watchdog-kill needs -watchdog")
+	}
+	var portMap *portMapping
+	if *portMapMode != "" {
+		listenAddrs := strings.Split(cfg.ListenAddr, ",")
+		for _, rt := range cfg.Routes {
+			listenAddrs = append(listenAddrs, strings.Split(rt.ListenAddr, ",")...)
+		}
+		m, err := newPortMapping(*portMapMode, *portMapGateway, listenAddrs)
+		if err != nil {
+			log.Fatalf("Invalid -port-mapping: %v", err)
+		}
+		portMap = m
+	}
+
+	rewriter, err := parseHostRewrites(hostRewrites)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.HostRewriter = rewriter
+	if rewriter != nil && rewriter.stripFML {
+		warnf("-host-rewrite strip-fml is set: Forge clients will reach the backend without their FML marker")
+	}
+
+	authAddrs, err := parseAuthListen(*authListen)
+	if err != nil {
+		log.Fatalf("Invalid -auth-listen: %v", err)
+	}
+	cfg.AuthListenAddrs = authAddrs
+
+	// The admin API shows player IPs and can kick and ban; without a token,
+	// only a loopback listener keeps it from the rest of the network
+	if cfg.AdminListenAddr != "" && cfg.AdminToken == "" {
+		if !isLoopbackListen(cfg.AdminListenAddr) {
+			log.Fatalf("-admin-listen %s is reachable from other hosts; set -admin-token, or listen on 127.0.0.1", cfg.AdminListenAddr)
+		}
+		warnf("-admin-token is not set: every local user can use the admin API on %s", cfg.AdminListenAddr)
+	}
+
+	if *statsdAddr != "" {
+		emitter, err := newStatsdEmitter(*statsdAddr, *statsdPrefix, *statsdFormat, *statsdInterval)
+		if err != nil {
+			log.Fatalf("Invalid -statsd: %v", err)
+		}
+		statsd.Store(emitter)
+	}
+
+	var influx *influxPusher
+	if *influxURL != "" {
+		if influx, err = newInfluxPusher(*influxURL, *influxToken, *influxInterval); err != nil {
+			log.Fatalf("Invalid -influx-url: %v", err)
+		}
+	}
+
+	if *allowedHosts != "" {
+		hosts, err := parseAllowedHosts(*allowedHosts)
+		if err != nil {
+			log.Fatalf("Invalid -allowed-hosts: %v", err)
+		}
+		cfg.AllowedHosts = hosts
+	}
+
+	if len(hostSessionServers) > 0 {
+		router, err := newHostAuthRouter(hostSessionServers)
+		if err != nil {
+			log.Fatalf("Invalid -host-session-servers: %v", err)
+		}
+		cfg.HostAuth = router
+	}
+
+	if *companionMode {
+		node := *companionNode
+		if node == "" {
+			node, _ = os.Hostname()
+		}
+		cfg.Companion = &companion{node: node}
+	}
+
+	if len(backendUpstreamRules) > 0 {
+		rules, err := parseBackendUpstreams(backendUpstreamRules)
+		if err != nil {
+			log.Fatalf("Invalid -backend-upstreams: %v", err)
+		}
+		cfg.BackendUpstreams = rules
+	}
+
+	if len(userRoutes) > 0 {
+		router, err := parseUserRoutes(userRoutes)
+		if err != nil {
+			log.Fatalf("Invalid -user-route: %v", err)
+		}
+		cfg.UserRouter = router
+	}
+
+	if *latencyProbe < 0 {
+		log.Fatalf("Invalid -latency-probe %s: must not be negative", *latencyProbe)
+	}
+	if strings.Contains(cfg.BackendAddr, ",") {
+		addrs, err := parseBackendList(cfg.BackendAddr)
+		if err != nil {
+			log.Fatalf("Invalid -backend: %v", err)
+		}
+		if *backendDiscovery != "" {
+			log.Fatal("-backend-discovery needs a single -backend address")
+		}
+		if *backendProbeInterval <= 0 {
+			log.Fatalf("Invalid -backend-probe-interval %s: must be positive", *backendProbeInterval)
+		}
+		cfg.Balancer = newBackendBalancer(addrs, *backendProbeInterval)
+		switch *sticky {
+		case "", stickyIP, stickyUsername:
+			cfg.Balancer.sticky = *sticky
+		default:
+			log.Fatalf("Invalid -sticky %q (expected ip or username)", *sticky)
+		}
+		cfg.BackendAddr = addrs[0]
+	} else if *backendDiscovery != "" {
+		discovery, err := parseDiscovery(*backendDiscovery, cfg.BackendAddr)
+		if err != nil {
+			log.Fatalf("Invalid -backend-discovery: %v", err)
+		}
+		cfg.Discovery = discovery
+	} else if resolver, err := newBackendResolver(cfg.BackendAddr); err != nil {
+		log.Fatalf("Invalid -backend %q: %v", cfg.BackendAddr, err)
+	} else {
+		cfg.Resolver = resolver
+	}
+
+	if *keepalive != "" {
+		if *keepaliveInterval <= 0 {
+			log.Fatalf("Invalid -keepalive-interval %s: must be positive", *keepaliveInterval)
+		}
+		cfg.Keepalive = newRouteKeepalive(*keepalive, *keepaliveInterval)
+	}
+	if *statusReportURL != "" {
+		reporter, err := newStatusReporter(*statusReportURL, *statusReportToken, *statusReportInterval)
+		if err != nil {
+			log.Fatalf("Invalid -status-report-url settings: %v", err)
+		}
+		cfg.StatusReport = reporter
+	}
+	if *sticky != "" && cfg.Balancer == nil {
+		log.Fatal("-sticky needs several comma-separated -backend addresses")
+	}
+
+	switch cfg.ProxyUnknown {
+	case proxyUnknownPeer, proxyUnknownPassthrough, proxyUnknownReject:
+	default:
+		log.Fatalf("Invalid -proxy-unknown %q (expected peer, passthrough or reject)", cfg.ProxyUnknown)
+	}
+	switch cfg.UntrustedProxyHeader {
+	case proxyHeaderPassthrough, proxyHeaderRewrite, proxyHeaderReject:
+	default:
+		log.Fatalf("Invalid -untrusted-proxy-header %q (expected passthrough, rewrite or reject)", cfg.UntrustedProxyHeader)
+	}
+	if prefixes, err := parseTrustedProxies(*trustedProxies); err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	} else {
+		cfg.TrustedProxies = prefixes
+	}
+	if len(cfg.TrustedProxies) > 0 && cfg.UntrustedProxyHeader == proxyHeaderPassthrough && cfg.BungeeGuardToken == "" {
+		warnf("-trusted-proxies has no effect with -untrusted-proxy-header passthrough")
+	}
+
+	if *relaySecret != "" {
+		cfg.RelaySecret = []byte(*relaySecret)
+	}
+	if *requireRelaySecret != "" {
+		cfg.RelayVerifier = newRelayVerifier([]byte(*requireRelaySecret))
+	}
+	if cfg.BungeeGuardToken != "" && len(cfg.TrustedProxies) == 0 && cfg.RelayVerifier == nil {
+		log.Fatalf("-bungeeguard-token needs -trusted-proxies (or -require-relay-secret) to know whose forwarding data to vouch for")
+	}
+
+	switch cfg.LegacyPing {
+	case legacyPingPassthrough, legacyPingStatic, legacyPingBackend:
+	default:
+		log.Fatalf("Invalid -legacy-ping %q (expected passthrough, static or backend)", cfg.LegacyPing)
+	}
+
+	if *verifyPing < 0 {
+		log.Fatalf("Invalid -verify-ping %s: must not be negative", *verifyPing)
+	}
+	if *verifyPing > 0 {
+		cfg.PingGate = newPingGate(*verifyPing)
+	}
+	if *reputation != "" {
+		check, err := parseReputation(*reputation, *reputationKey, *reputationThreshold, *reputationAction, *reputationCache)
+		if err != nil {
+			log.Fatalf("Invalid -reputation: %v", err)
+		}
+		cfg.Reputation = check
+	}
+
+	if *loginRate != "" {
+		limiter, err := parseRateLimit(*loginRate)
+		if err != nil {
+			log.Fatalf("Invalid -login-rate: %v", err)
+		}
+		cfg.LoginLimiter = limiter
+	}
+	if *statusRate != "" {
+		limiter, err := parseRateLimit(*statusRate)
+		if err != nil {
+			log.Fatalf("Invalid -status-rate: %v", err)
+		}
+		cfg.StatusLimiter = limiter
+	}
+	filter, err := newUsernameFilter(blockedUsernames)
+	if err != nil {
+		log.Fatalf("Invalid -block-username: %v", err)
+	}
+	cfg.UsernameFilter = filter
+	if *authRate != "" {
+		limiter, err := parseRateLimit(*authRate)
+		if err != nil {
+			log.Fatalf("Invalid -auth-rate: %v", err)
+		}
+		cfg.AuthLimiter = limiter
+	}
+	if cfg.AuthTrustedProxies, err = parseTrustedProxies(*authTrusted); err != nil {
+		log.Fatalf("Invalid -auth-trusted-proxies: %v", err)
+	}
+	if *authAllow != "" {
+		if cfg.AuthAllow, err = parseTrustedProxies(*authAllow); err != nil {
+			log.Fatalf("Invalid -auth-allow: %v", err)
+		}
+	}
+	if *authAccessLog != "" {
+		accessLog, err := newAccessLog(*authAccessLog, *authAccessFormat, cfg.AuthTrustedProxies)
+		if err != nil {
+			log.Fatalf("Invalid -auth-access-log: %v", err)
+		}
+		cfg.AuthAccessLog = accessLog
+	}
+	if *authIPRate != "" {
+		limiter, err := parseRateLimit(*authIPRate)
+		if err != nil {
+			log.Fatalf("Invalid -auth-ip-rate: %v", err)
+		}
+		cfg.AuthIPLimiter = limiter
+	}
+	if *replayWindow < 0 {
+		log.Fatalf("Invalid -replay-window %s: must not be negative", *replayWindow)
+	}
+	if *replayWindow > 0 {
+		cfg.ReplayGuard = newReplayGuard(*replayWindow)
+	}
+
+	if cfg.PeekBufferSize < minPeekBufferSize || cfg.PeekBufferSize > maxPeekBufferSize {
+		log.Fatalf("Invalid -peek-buffer %d: must be between %d and %d", cfg.PeekBufferSize, minPeekBufferSize, maxPeekBufferSize)
+	}
+	if cfg.CopyBufferSize < minCopyBufferSize || cfg.CopyBufferSize > maxCopyBufferSize {
+		log.Fatalf("Invalid -copy-buffer %d: must be between %d and %d", cfg.CopyBufferSize, minCopyBufferSize, maxCopyBufferSize)
+	}
+
+	if *useSockmap {
+		m, err := newSockmap()
+		if err != nil {
+			log.Fatalf("Failed to set up -sockmap: %v", err)
+		}
+		cfg.Sockmap = m
+	}
+
+	if *poolSize < 0 {
+		log.Fatalf("Invalid -backend-pool %d: must not be negative", *poolSize)
+	}
+	if *poolSize > 0 {
+		if *poolMaxAge < 2*poolRefillInterval {
+			log.Fatalf("Invalid -backend-pool-max-age %s: must be at least %s", *poolMaxAge, 2*poolRefillInterval)
+		}
+		if cfg.Transparent {
+			log.Fatal("-backend-pool can't be used with -transparent, which dials from each player's address")
+		}
+		cfg.BackendPool = newBackendPool(*poolSize, *poolMaxAge)
+	}
+
+	if *maxConnections < 0 {
+		log.Fatalf("Invalid -max-connections %d: must not be negative", *maxConnections)
+	}
+	if *maxConnections > 0 {
+		cfg.ConnSlots = newConnSlots(*maxConnections)
+	}
+	checkFileDescriptors(*maxConnections)
+
+	if *maxPlayers < 0 {
+		log.Fatalf("Invalid -max-players %d: must not be negative", *maxPlayers)
+	}
+	if *maxPlayers > 0 {
+		cfg.Queue = newPlayerQueue(*maxPlayers, *queueing)
+	} else if *queueing {
+		warnf("-queue has no effect without -max-players")
+	}
+
+	if *startupTime < 0 {
+		log.Fatalf("Invalid -startup-hold %s: must not be negative", *startupTime)
+	}
+	if *startupTime > 0 {
+		cfg.Startup = newStartupHold(*startupTime)
+	}
+
+	if *backendCommand != "" && *startCommand != "" {
+		log.Fatal("-backend-command and -start-command are mutually exclusive")
+	}
+	if *backendCommand != "" || *startCommand != "" {
+		// Players need something better than "connection refused" while it boots
+		if cfg.Startup == nil {
+			cfg.Startup = newStartupHold(defaultStartupTime)
+		}
+		if *backendCommand != "" {
+			cfg.Supervisor = newBackendSupervisor(*backendCommand, *stopCommand, 0, cfg.BackendAddr, cfg.Startup)
+		} else {
+			cfg.Supervisor = newBackendSupervisor(*startCommand, *stopCommand, *idleStop, cfg.BackendAddr, cfg.Startup)
+		}
+	}
+	if *startCommand == "" && *idleStop != 0 {
+		warnf("-idle-stop has no effect without -start-command")
+	}
+
+	if *wolMAC != "" {
+		wol, err := newWakeOnLAN(*wolMAC, *wolBroadcast)
+		if err != nil {
+			log.Fatalf("Invalid Wake-on-LAN settings: %v", err)
+		}
+		cfg.Waker = wol
+		if cfg.Startup == nil {
+			cfg.Startup = newStartupHold(defaultStartupTime)
+		}
+	}
+	if *minehutServer != "" {
+		if *wolMAC != "" {
+			log.Fatal("-minehut-server-id and -wol-mac can't be combined")
+		}
+		waker, err := newMinehutWaker(*minehutURL, *minehutServer, *minehutToken, *minehutSession)
+		if err != nil {
+			log.Fatalf("Invalid Minehut wake settings: %v", err)
+		}
+		cfg.Waker = waker
+		if cfg.Startup == nil {
+			cfg.Startup = newStartupHold(defaultStartupTime)
+		}
+	}
+	if *limboMode {
+		if *limboTimeout <= 0 {
+			log.Fatalf("Invalid -limbo-timeout %s: must be positive", *limboTimeout)
+		}
+		cfg.Limbo = &limbo{timeout: *limboTimeout}
+		// Limbo takes the players the hold would disconnect
+		if cfg.Startup == nil {
+			cfg.Startup = newStartupHold(defaultStartupTime)
+		}
+	}
+
+	if *banFile != "" {
+		bans, err := loadBanList(*banFile)
+		if err != nil {
+			log.Fatalf("Failed to load -ban-file: %v", err)
+		}
+		cfg.Bans = bans
+	} else {
+		cfg.Bans = newBanList()
+	}
+	if *backendBanDir != "" {
+		backend, err := loadBackendBans(*backendBanDir)
+		if err != nil {
+			log.Fatalf("Failed to read -backend-bans: %v", err)
+		}
+		cfg.Bans.backend = backend
+	}
+	if *offline != "" {
+		fallback, err := parseOfflineFallback(*offline)
+		if err != nil {
+			log.Fatalf("Invalid -offline-fallback: %v", err)
+		}
+		cfg.OfflineFallback = fallback
+	}
+	if *whitelistFile != "" {
+		wl, err := loadWhitelist(*whitelistFile, *whitelistMessage)
+		if err != nil {
+			log.Fatalf("Failed to load -whitelist: %v", err)
+		}
+		cfg.Whitelist = wl
+	}
+
+	var vpnAllow *whitelist
+	if *vpnWhitelistFile != "" {
+		if vpnAllow, err = loadWhitelist(*vpnWhitelistFile, vpnBlockedMessage); err != nil {
+			log.Fatalf("Invalid -vpn-whitelist: %v", err)
+		}
+	}
+	if cfg.VPN, err = parseVPNDetector(vpnRanges, *vpnPolicy, vpnAllow); err != nil {
+		log.Fatalf("Invalid -vpn-ranges: %v", err)
+	}
+
+	if cfg.ListenSockets < 1 {
+		log.Fatalf("Invalid -listen-sockets %d: must be at least 1", cfg.ListenSockets)
+	}
+	if cfg.ListenSockets > 1 && runtime.GOOS != "linux" {
+		log.Fatal("-listen-sockets is only supported on Linux")
+	}
+
+	if cfg.Transparent && runtime.GOOS != "linux" {
+		log.Fatal("-transparent is only supported on Linux")
+	}
+
+	level, err := parseLogLevel(*logLevelName)
+	if err != nil {
+		log.Fatalf("Invalid -log-level: %v", err)
+	}
+	setLogLevel(level)
+	if *logDedupWindow < 0 {
+		log.Fatal("Invalid -log-dedup: must not be negative")
+	}
+	if *logDedupWindow > 0 {
+		logDedup.start(*logDedupWindow)
+	}
+
+	if cfg.Dialects, err = parseDialects(dialects); err != nil {
+		log.Fatalf("Invalid -upstream-dialect: %v", err)
+	}
+
+	if *prefer != "" {
+		name, window, err := parsePreference(*prefer)
+		if err != nil {
+			log.Fatalf("Invalid -prefer: %v", err)
+		}
+		cfg.PreferUpstream = name
+		cfg.PreferWindow = window
+	}
+
+	if transport.MaxIdleConns < 0 || transport.MaxIdleConnsPerHost < 0 || transport.IdleConnTimeout < 0 || transport.TLSHandshakeTimeout < 0 {
+		log.Fatal("Invalid -upstream-* settings: only -upstream-keepalive may be negative")
+	}
+	cfg.UpstreamClient = newUpstreamClient(transport)
+	if *chaos != "" {
+		c, err := parseChaos(*chaos)
+		if err != nil {
+			log.Fatalf("Invalid -chaos: %v", err)
+		}
+		cfg.Chaos = c
+		cfg.UpstreamClient.Transport = c.transport(cfg.UpstreamClient.Transport)
+	}
+
+	switch cfg.ConflictPolicy {
+	case conflictFirst, conflictPriority, conflictReject:
+	default:
+		log.Fatalf("Invalid -conflict-policy %q (expected first, priority or reject)", cfg.ConflictPolicy)
+	}
+	if cfg.PreferUpstream != "" && cfg.ConflictPolicy != conflictFirst {
+		warnf("-prefer only applies with -conflict-policy=first")
+	}
+
+	var syslogOut *syslogWriter
+	if *syslogTarget != "" {
+		if syslogOut, err = newSyslogWriter(*syslogTarget, *syslogFacility, *syslogTag); err != nil {
+			log.Fatalf("Invalid -syslog: %v", err)
+		}
+		log.SetOutput(syslogOut)
+		log.SetFlags(0) // syslog timestamps messages itself
+	} else {
+		log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+	}
+	switch *consoleMode {
+	case consoleAuto, consolePlain:
+	case consolePretty:
+		if syslogOut != nil {
+			log.Fatal("-console pretty can't be combined with -syslog")
+		}
+	default:
+		log.Fatalf("Invalid -console %q (expected auto, pretty or plain)", *consoleMode)
+	}
+	if *consoleMode == consolePretty || (*consoleMode == consoleAuto && syslogOut == nil && isTerminal(os.Stderr)) {
+		console := newPrettyConsole(os.Stderr)
+		log.SetOutput(console)
+		log.SetFlags(0) // the console stamps lines itself
+		events.addSink("console", console)
+	}
+
+	if selfTestHost != nil {
+		log.SetOutput(io.Discard)
+		checks, err := runSelfTest(cfg, *selfTestHost)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			log.Fatalf("Self-test setup failed: %v", err)
+		}
+		if printSelfTest(os.Stdout, checks) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if setup != nil {
+		paths, err := writeSetupFiles(cfg, *setup)
+		if err != nil {
+			log.Fatalf("Failed to write setup files: %v", err)
+		}
+		for _, path := range paths {
+			fmt.Println(path)
+		}
+		return
+	}
 
 	log.Println("=== mc-dual-proxy ===")
-	log.Printf("TCP proxy:   %s → %s", cfg.ListenAddr, cfg.BackendAddr)
-	log.Printf("Multiauth:   %s", cfg.AuthListenAddr)
+	log.Printf("Version:     %s", currentBuild())
+	if syslogOut != nil {
+		log.Printf("Syslog:      %s (facility %s, tag %s)", syslogOut, *syslogFacility, *syslogTag)
+	}
+	if configSrc != nil {
+		if *configPoll > 0 {
+			log.Printf("Config:      %s (polled every %s)", configSrc.location, *configPoll)
+		} else {
+			log.Printf("Config:      %s (reloaded on SIGHUP)", configSrc.location)
+		}
+	}
+	if cfg.Balancer != nil {
+		log.Printf("TCP proxy:   %s → %s", cfg.ListenAddr, cfg.Balancer)
+	} else {
+		log.Printf("TCP proxy:   %s → %s", cfg.ListenAddr, cfg.BackendAddr)
+	}
+	if cfg.Ingress != nil {
+		log.Printf("Ingress:     %s", cfg.Ingress)
+	}
+	if cfg.Splice {
+		if runtime.GOOS == "linux" {
+			log.Printf("Relay:       splice(2)")
+		} else {
+			warnf("Relay:       -splice only works on Linux, copying instead")
+		}
+	}
+	if cfg.Sockmap != nil {
+		log.Printf("Relay:       %s", cfg.Sockmap)
+	}
+	if cfg.StrictProxyProtocol {
+		log.Printf("PROXY parse: strict")
+	}
+	if cfg.HostTLV && !cfg.Transparent {
+		log.Printf("Host TLV:    the backend gets the original hostname in PROXY v2 headers")
+	}
+	if cfg.Discovery != nil {
+		log.Printf("Discovery:   following %s", cfg.Discovery.source)
+	}
+	if cfg.Keepalive != nil {
+		log.Printf("Keepalive:   pinging %s every %s", cfg.Keepalive.target, cfg.Keepalive.interval)
+	}
+	if watchdog != nil {
+		log.Printf("Watchdog:    %s", watchdog)
+	}
+	if cfg.Recorder != nil {
+		log.Printf("Recording:   %s", cfg.Recorder)
+	}
+	if cfg.Mirror != nil {
+		log.Printf("Mirror:      %s", cfg.Mirror)
+	}
+	if cfg.Shaper != nil {
+		log.Printf("Shaping:     %s", cfg.Shaper)
+	}
+	if cfg.Chaos != nil {
+		warnf("Chaos:       injecting %s; players will notice", cfg.Chaos)
+	}
+	if portMap != nil {
+		log.Printf("Port map:    forwarding TCP %v on the router (%s)", portMap.ports, portMap.mode)
+	}
+	if cfg.StatusReport != nil {
+		log.Printf("Status:      reporting health to %s every %s", cfg.StatusReport.redactedURL(), cfg.StatusReport.interval)
+	}
+	if *latencyProbe > 0 {
+		if *latencyProbeStatus {
+			log.Printf("Probes:      backend connect and status latency every %s", *latencyProbe)
+		} else {
+			log.Printf("Probes:      backend connect latency every %s", *latencyProbe)
+		}
+	}
+	for _, spec := range userRoutes {
+		log.Printf("User route:  %s", spec)
+	}
+	if cfg.Limbo != nil {
+		log.Printf("Limbo:       %s", cfg.Limbo)
+	}
+	for _, rt := range cfg.Routes {
+		if len(rt.SessionServers) > 0 {
+			log.Printf("Route %s: %s → %s (session servers: %v)", rt.Name, rt.ListenAddr, rt.BackendAddr, rt.SessionServers)
+		} else {
+			log.Printf("Route %s: %s → %s", rt.Name, rt.ListenAddr, rt.BackendAddr)
+		}
+		if rt.Ingress != nil {
+			log.Printf("Route %s: ingress %s", rt.Name, rt.Ingress)
+		}
+	}
+	if cfg.UntrustedProxyHeader != proxyHeaderPassthrough {
+		log.Printf("PROXY trust: %v (%s others)", cfg.TrustedProxies, cfg.UntrustedProxyHeader)
+	}
+	if cfg.BungeeGuardToken != "" {
+		log.Printf("BungeeGuard: token added to forwarding data from %v", cfg.TrustedProxies)
+	}
+	if cfg.RelaySecret != nil {
+		log.Printf("Relay:       signing backend connections")
+	}
+	if cfg.RelayVerifier != nil {
+		log.Printf("Relay:       only accepting signed connections")
+	}
+	if cfg.Transparent {
+		log.Printf("Transparent: backend sees player IPs directly (no PROXY protocol)")
+	}
+	if cfg.PingGate != nil {
+		log.Printf("Anti-bot:    logins need a status ping within %s", cfg.PingGate.window)
+	}
+	if cfg.Reputation != nil {
+		log.Printf("Reputation:  %s", cfg.Reputation)
+	}
+	if cfg.VPN != nil {
+		log.Printf("VPN ranges:  %s", cfg.VPN)
+		if cfg.VPN.policy == vpnTag && cfg.Transparent {
+			warnf("VPN ranges:  -vpn-policy tag needs PROXY headers, which -transparent doesn't send")
+		}
+	}
+	if cfg.LoginLimiter != nil {
+		log.Printf("Login rate:  %s per IP", cfg.LoginLimiter)
+	}
+	if cfg.StatusLimiter != nil {
+		log.Printf("Status rate: %s per IP", cfg.StatusLimiter)
+	}
+	if cfg.AuthLimiter != nil {
+		log.Printf("Auth rate:   %s per username", cfg.AuthLimiter)
+	}
+	if cfg.AuthIPLimiter != nil {
+		log.Printf("Auth rate:   %s per requester IP", cfg.AuthIPLimiter)
+	}
+	if len(cfg.AuthTrustedProxies) > 0 {
+		log.Printf("Auth XFF:    believed from %v", cfg.AuthTrustedProxies)
+	}
+	if cfg.AuthAllow != nil {
+		log.Printf("Auth allow:  %v", cfg.AuthAllow)
+	}
+	if cfg.AuthAccessLog != nil {
+		log.Printf("Access log:  %s (%s)", cfg.AuthAccessLog.path, cfg.AuthAccessLog.format)
+	}
+	if cfg.ReplayGuard != nil {
+		log.Printf("Replays:     serverIds refused %s after their first success", cfg.ReplayGuard.window)
+	}
+	if cfg.BackendPool != nil {
+		log.Printf("Backend pool: %d pre-dialed connections, replaced after %s", cfg.BackendPool.size, cfg.BackendPool.maxAge)
+	}
+	if cfg.ConnSlots != nil {
+		log.Printf("Conn limit:  %d at once", cap(cfg.ConnSlots.sem))
+	}
+	if cfg.AggregatePlayers {
+		log.Printf("Player count: status responses show players on all backends")
+	}
+	if cfg.Queue != nil {
+		if cfg.Queue.queueing {
+			log.Printf("Player cap:  %d (queueing enabled)", cfg.Queue.maxPlayers)
+		} else {
+			log.Printf("Player cap:  %d", cfg.Queue.maxPlayers)
+		}
+	}
+	if *backendCommand != "" {
+		log.Printf("Backend:     %s", *backendCommand)
+	} else if cfg.Supervisor != nil {
+		if cfg.Supervisor.idleStop > 0 {
+			log.Printf("On demand:   backend starts with the first player, stops after %s idle", cfg.Supervisor.idleStop)
+		} else {
+			log.Printf("On demand:   backend starts with the first player")
+		}
+	}
+	switch w := cfg.Waker.(type) {
+	case *wakeOnLAN:
+		log.Printf("Wake-on-LAN: %s via %s", w.mac, w.broadcast)
+	case *minehutWaker:
+		log.Printf("Minehut:     starts server %s when it hibernates", w.serverID)
+	}
+	if *banFile != "" {
+		log.Printf("Bans:        %d active, stored in %s", len(cfg.Bans.list()), *banFile)
+	}
+	if cfg.Bans.backend != nil {
+		log.Printf("Backend bans: %s", cfg.Bans.backend)
+	}
+	if cfg.AllowedHosts != nil {
+		log.Printf("Hostnames:   only %s", cfg.AllowedHosts)
+	}
+	if cfg.OfflineFallback != nil {
+		log.Printf("Offline:     unauthenticated players allowed in offline mode via %s", cfg.OfflineFallback)
+	}
+	if cfg.Whitelist != nil {
+		if cfg.Whitelist.isURL() {
+			log.Printf("Whitelist:   %d players, fetched from %s every %s", len(cfg.Whitelist.list()), *whitelistFile, whitelistPollInterval)
+		} else {
+			log.Printf("Whitelist:   %d players, stored in %s", len(cfg.Whitelist.list()), *whitelistFile)
+		}
+	}
+	log.Printf("Multiauth:   %s", strings.Join(cfg.AuthListenAddrs, ", "))
+	if cfg.AgentCheckAddr != "" {
+		log.Printf("Agent check: %s", cfg.AgentCheckAddr)
+	}
+	if cfg.AdminListenAddr != "" {
+		log.Printf("Admin:       http://%s/", cfg.AdminListenAddr)
+	}
+	if s := statsd.Load(); s != nil {
+		log.Printf("StatsD:      %s every %s (%s)", *statsdAddr, s.interval, s.format)
+	}
+	if influx != nil {
+		// The query may hold v1 credentials
+		target, _, _ := strings.Cut(influx.url, "?")
+		log.Printf("InfluxDB:    %s every %s", target, influx.interval)
+	}
 	log.Printf("Session servers: %v", cfg.SessionServers)
-	fmt.Println()
-	printSetupInstructions(cfg)
+	for _, server := range cfg.SessionServers {
+		if d := dialectFor(cfg.Dialects, server); d.name != dialectMojang {
+			log.Printf("Dialect:     %s speaks %s", upstreamName(server), d.name)
+		}
+	}
+	if cfg.HostAuth != nil {
+		log.Printf("Host auth:   %s", cfg.HostAuth)
+	}
+	if cfg.BackendUpstreams != nil {
+		log.Printf("Upstreams:   %s", cfg.BackendUpstreams)
+	}
+	if cfg.PreferUpstream != "" {
+		log.Printf("Preferred:   %s (within %s)", cfg.PreferUpstream, cfg.PreferWindow)
+	}
+	if cfg.AuthSourceProperty != "" {
+		log.Printf("Auth source: profiles get a %q property", cfg.AuthSourceProperty)
+	}
+	if cfg.Companion != nil {
+		log.Printf("Companion:   profiles get a %s property (node %q)", companionProperty, cfg.Companion.node)
+	}
+	log.Printf("Conflict policy: %s", cfg.ConflictPolicy)
+	log.Printf("Backend setup files: run %s generate-setup with these flags", filepath.Base(os.Args[0]))
+
+	if err := startEventSinks(cfg); err != nil {
+		log.Fatal(err)
+	}
 
+	if *backendCommand != "" {
+		cfg.Supervisor.ensureStarted()
+	}
+
+	if cfg.Discovery != nil {
+		go cfg.Discovery.run()
+	}
+	if cfg.Balancer != nil {
+		go cfg.Balancer.run()
+	}
+	if cfg.Keepalive != nil {
+		go cfg.Keepalive.run()
+	}
+	if cfg.StatusReport != nil {
+		go cfg.StatusReport.run(cfg)
+	}
+	if watchdog != nil {
+		go watchdog.run()
+	}
+	if portMap != nil {
+		go portMap.run()
+	}
+	if *latencyProbe > 0 {
+		go runLatencyProbes(cfg, *latencyProbe, *latencyProbeStatus)
+	}
+	if configSrc != nil {
+		liveConfig.Store(&cfg)
+		reloadCh := make(chan os.Signal, 1)
+		signal.Notify(reloadCh, syscall.SIGHUP)
+		go func() {
+			for range reloadCh {
+				if err := configSrc.reload(); err != nil {
+					warnf("[config] Failed to reload %s: %v", configSrc.location, err)
+				}
+			}
+		}()
+		if *configPoll > 0 {
+			go configSrc.poll(*configPoll)
+		}
+	}
+	if cfg.AuthAccessLog != nil {
+		// SIGHUP also reopens the access log after logrotate moved it
+		reopenCh := make(chan os.Signal, 1)
+		signal.Notify(reopenCh, syscall.SIGHUP)
+		go func() {
+			for range reopenCh {
+				if err := cfg.AuthAccessLog.reopen(); err != nil {
+					warnf("[auth] Failed to reopen the access log %s: %v", cfg.AuthAccessLog.path, err)
+				}
+			}
+		}()
+	}
+	if cfg.BackendPool != nil {
+		go cfg.BackendPool.run(cfg)
+	}
 	go startMultiauth(cfg)
 	go startTCPProxy(cfg)
+	if s := statsd.Load(); s != nil {
+		go s.run(cfg)
+	}
+	if influx != nil {
+		go influx.run(cfg)
+	}
+	if cfg.SummaryInterval > 0 {
+		go logSummaries(cfg.SummaryInterval)
+	}
+	if cfg.AdminListenAddr != "" {
+		go startAdmin(cfg)
+	}
+	if cfg.AgentCheckAddr != "" {
+		go startAgentCheck(cfg)
+	}
+
+	diagCh := make(chan os.Signal, 1)
+	notifyDiagnostics(diagCh)
+	go func() {
+		for range diagCh {
+			logDiagnostics(cfg)
+		}
+	}()
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-sigCh
 	log.Printf("Received %s, shutting down", sig)
+	if sig == syscall.SIGTERM && cfg.DrainTimeout > 0 {
+		infof("Draining: no longer accepting players, waiting up to %s for %d connection(s)", cfg.DrainTimeout, tracker.count())
+		drained := make(chan struct{})
+		go func() {
+			readiness.drain(cfg.DrainTimeout)
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case sig = <-sigCh:
+			log.Printf("Received %s, exiting without waiting for the drain", sig)
+		}
+	}
+	if cfg.Supervisor != nil {
+		cfg.Supervisor.shutdown()
+	}
+	if portMap != nil {
+		portMap.close()
+	}
+}
+
+// parsePreference parses a -prefer value of the form "name=window",
+// e.g. "mojang=150ms".
+func parsePreference(s string) (string, time.Duration, error) {
+	name, window, ok := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", 0, fmt.Errorf("expected name=duration, got %q", s)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(window))
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid window: %w", err)
+	}
+	if d <= 0 {
+		return "", 0, fmt.Errorf("window must be positive, got %s", d)
+	}
+	return name, d, nil
 }
 
-func printSetupInstructions(cfg Config) {
-	fmt.Println("--- Setup Instructions ---")
-	fmt.Println()
-	fmt.Println("For Velocity, use these JVM flags:")
-	fmt.Printf("  -Dmojang.sessionserver=http://%s/session/minecraft/hasJoined\n", cfg.AuthListenAddr)
-	fmt.Println()
-	fmt.Println("For standalone Paper, use these JVM flags:")
-	fmt.Printf("  -Dminecraft.api.session.host=http://%s\n", cfg.AuthListenAddr)
-	fmt.Println()
-	fmt.Println("In the Minehut panel, point your external server to this proxy's")
-	fmt.Printf("public IP on port %s (the -listen port).\n", strings.Split(cfg.ListenAddr, ":")[len(strings.Split(cfg.ListenAddr, ":"))-1])
-	fmt.Println()
-	fmt.Printf("Your backend (Velocity/Paper) should listen on %s with\n", cfg.BackendAddr)
-	fmt.Println("proxy-protocol enabled (haproxy-protocol = true for Velocity,")
-	fmt.Println("proxy-protocol: true in paper-global.yml for Paper).")
-	fmt.Println()
-	fmt.Println("For Caddy reverse proxy to the multiauth server:")
-	fmt.Printf("  auth.yourdomain.com { reverse_proxy %s }\n", cfg.AuthListenAddr)
-	fmt.Println()
-	fmt.Println("--------------------------")
-	fmt.Println()
+// parseSessionServers parses a comma-separated -session-servers value.
+func parseSessionServers(s string) []string {
+	var servers []string
+	for _, server := range strings.Split(s, ",") {
+		server = strings.TrimSpace(server)
+		if server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers
 }
@@ -3,20 +3,565 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf16"
 )
 
 // --- PROXY Protocol Tests ---
 
+func TestStrictProxyProtocol(t *testing.T) {
+	ipv4 := []byte{1, 2, 3, 4, 10, 0, 0, 1, 0x30, 0x39, 0x63, 0xdd}
+	v2 := func(famProto byte, tlvs ...byte) []byte {
+		h := append(append([]byte{}, proxyV2Sig...), 0x21, famProto, 0, 0)
+		binary.BigEndian.PutUint16(h[14:], uint16(len(ipv4)+len(tlvs)))
+		return append(append(h, ipv4...), tlvs...)
+	}
+	withCRC := v2(0x11, 0x03, 0x00, 0x04, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(withCRC[len(withCRC)-4:], crc32.Checksum(withCRC, crc32.MakeTable(crc32.Castagnoli)))
+	badCRC := append([]byte(nil), withCRC...)
+	badCRC[len(badCRC)-1] ^= 1
+
+	for _, tc := range []struct {
+		name            string
+		data            []byte
+		lenient, strict bool // whether each mode accepts it
+	}{
+		{"v1", []byte("PROXY TCP4 1.2.3.4 10.0.0.1 12345 25565\r\n"), true, true},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 25565\r\n"), true, true},
+		{"v1 port with leading zeros", []byte("PROXY TCP4 1.2.3.4 10.0.0.1 012345 25565\r\n"), true, false},
+		{"v1 tcp4 in ipv6 notation", []byte("PROXY TCP4 ::ffff:1.2.3.4 ::ffff:10.0.0.1 1 2\r\n"), true, false},
+		{"v1 tcp4 with ipv6 addresses", []byte("PROXY TCP4 ::1 ::1 1 2\r\n"), false, false},
+		{"v2", v2(0x11), true, true},
+		{"v2 datagram", v2(0x12), true, false},
+		{"v2 with TLV", v2(0x11, 0xE0, 0x00, 0x01, 'x'), true, true},
+		{"v2 truncated TLV", v2(0x11, 0xE0, 0x00), true, false},
+		{"v2 TLV overrun", v2(0x11, 0xE0, 0x00, 0x09, 'x'), true, false},
+		{"v2 CRC32c", withCRC, true, true},
+		{"v2 CRC32c mismatch", badCRC, true, false},
+	} {
+		for _, strict := range []bool{false, true} {
+			header, err := detectProxyHeader(bufio.NewReader(bytes.NewReader(tc.data)), strict)
+			want := tc.lenient
+			if strict {
+				want = tc.strict
+			}
+			if got := err == nil && header != nil; got != want {
+				t.Errorf("%s (strict=%t): accepted=%t, want %t (err %v)", tc.name, strict, got, want, err)
+			}
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cfg     Config
+		proxied string // detail of the proxied ping, by prefix
+	}{
+		{"passthrough", Config{}, "backend saw 198.1"},
+		{"rewrite", Config{UntrustedProxyHeader: proxyHeaderRewrite}, "backend saw 127.0.0.1:"},
+		{"reject", Config{UntrustedProxyHeader: proxyHeaderReject}, "refused, as configured"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			checks, err := runSelfTest(tc.cfg, "localhost")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var report bytes.Buffer
+			if printSelfTest(&report, checks) != 0 {
+				t.Fatalf("checks failed:\n%s", report.String())
+			}
+			if !strings.HasPrefix(checks[1].Detail, tc.proxied) {
+				t.Errorf("proxied ping: %q, want %q...", checks[1].Detail, tc.proxied)
+			}
+		})
+	}
+
+	// A proxy that breaks what it promises fails the check
+	env, err := newSelfTestEnv(Config{}, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.close()
+	env.cfg.UntrustedProxyHeader = proxyHeaderReject // expected, but not what the handler runs with
+	if check := env.checkPath("Proxied status ping", true); check.OK {
+		t.Errorf("check passed although the proxied ping was answered: %+v", check)
+	}
+}
+
+func TestMockBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go (&mockBackend{motd: "mock", requireHeader: true}).serve(ln)
+
+	dial := func(data []byte) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write(data)
+		return conn, bufio.NewReader(conn)
+	}
+	header := buildProxyV2Header(&net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51234}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 25566})
+
+	// Status pings show the address from the header
+	hs := (&Handshake{ProtocolVersion: 767, ServerAddress: "myserver.minehut.gg", ServerPort: 25565, NextState: stateStatus}).encode()
+	conn, br := dial(append(append(append([]byte{}, header...), hs...), 0x01, 0x00))
+	packet, err := readPacket(br, 1<<16)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(packet), `203.0.113.7:51234 via PROXY v2`) || !strings.Contains(string(packet), `"protocol":767`) {
+		t.Errorf("status response %q", packet)
+	}
+
+	// Logins are disconnected with what the backend saw
+	hs = (&Handshake{ProtocolVersion: 767, ServerAddress: "myserver.minehut.gg", ServerPort: 25565, NextState: stateLogin}).encode()
+	body := appendString([]byte{0x00}, "Notch")
+	conn, br = dial(append(append(append([]byte{}, []byte("PROXY TCP4 198.51.100.2 10.0.0.1 4000 25566\r\n")...), hs...), appendVarInt(nil, int32(len(body)), body...)...))
+	packet, err = readPacket(br, 1<<16)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Notch", "198.51.100.2:4000", "PROXY v1", "myserver.minehut.gg"} {
+		if !strings.Contains(string(packet), want) {
+			t.Errorf("disconnect message %q lacks %q", packet, want)
+		}
+	}
+
+	// Without a header, the connection is refused
+	conn, br = dial(hs)
+	if _, err := readPacket(br, 1<<16); err == nil {
+		t.Error("connection without a PROXY header was answered")
+	}
+	conn.Close()
+}
+
+func TestDevSessionServer(t *testing.T) {
+	dev := &devSessionServer{skin: devSkinURL, reject: map[string]bool{"griefer": true}, now: time.Now}
+	srv := httptest.NewServer(dev)
+	defer srv.Close()
+
+	// Through the multiauth fan-out, like a backend would see it
+	status, body, _ := testAuth(Config{SessionServers: []string{srv.URL}}, "Notch", "abc123", "")
+	if status != http.StatusOK {
+		t.Fatalf("hasJoined = %d, want 200", status)
+	}
+	var profile struct {
+		ID         string            `json:"id"`
+		Name       string            `json:"name"`
+		Properties []profileProperty `json:"properties"`
+	}
+	if err := json.Unmarshal(body, &profile); err != nil {
+		t.Fatal(err)
+	}
+	if profile.ID != offlineUUID("Notch") || profile.Name != "Notch" {
+		t.Errorf("profile %s/%s, want the offline UUID of Notch", profile.ID, profile.Name)
+	}
+	var skin, marker bool
+	for _, p := range profile.Properties {
+		switch p.Name {
+		case "textures":
+			data, _ := base64.StdEncoding.DecodeString(p.Value)
+			skin = strings.Contains(string(data), devSkinURL) && strings.Contains(string(data), `"profileName":"Notch"`)
+		case devMarkerProperty:
+			marker = p.Value == "true"
+		}
+	}
+	if !skin || !marker {
+		t.Errorf("properties %+v lack the skin or the dev marker", profile.Properties)
+	}
+
+	if status, _, _ := testAuth(Config{SessionServers: []string{srv.URL}}, "Griefer", "abc123", ""); status != http.StatusNoContent {
+		t.Errorf("rejected username: %d, want 204", status)
+	}
+	resp, err := http.Post(srv.URL+devJoinPath, "application/json", strings.NewReader(`{"accessToken":"x","selectedProfile":"y","serverId":"abc123"}`))
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("client join announcement: %v, %v", resp, err)
+	}
+	resp, err = http.Get(srv.URL + hasJoinedPath + "?username=not+valid&serverId=1")
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid username: %v, %v", resp, err)
+	}
+}
+
+func TestChaos(t *testing.T) {
+	for _, spec := range []string{"", "latency", "latency=-1s", "reset=150%", "reset=lots", "flood=1%"} {
+		if _, err := parseChaos(spec); err == nil {
+			t.Errorf("parseChaos(%q) succeeded", spec)
+		}
+	}
+	c, err := parseChaos("latency=1ms, truncate-header=100%,reset=1,upstream-500=0.5,reset-within=1ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.String(); got != "latency 1ms, truncate-header 100%, reset 100%, upstream-500 50%" {
+		t.Errorf("String() = %q", got)
+	}
+	c.chance = func() float64 { return 0.25 }
+
+	// The backend only gets half the PROXY header
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(conn)
+		conn.Close()
+		received <- data
+	}()
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyLn.Close()
+	go func() {
+		if conn, err := proxyLn.Accept(); err == nil {
+			handleConnection(conn, Config{BackendAddr: backendLn.Addr().String(), Chaos: c})
+		}
+	}()
+	client, err := net.DialTimeout("tcp", proxyLn.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("MC_DATA"))
+	client.(*net.TCPConn).CloseWrite()
+	select {
+	case data := <-received:
+		if len(data) != 14 || !bytes.HasPrefix(data, proxyV2Sig) {
+			t.Errorf("backend received %x, want the start of a PROXY v2 header", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend got nothing")
+	}
+
+	// Relayed connections are reset
+	a, b := net.Pipe()
+	defer b.Close()
+	c.scheduleReset(a)
+	a.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := a.Read(make([]byte, 1)); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("read after the reset: %v, want the connection closed", err)
+	}
+
+	// Session server requests fail without being sent
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the session server")
+	}))
+	defer upstream.Close()
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	resp, err := c.transport(nil).RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("upstream answer %v, %v; want a 500", resp, err)
+	}
+
+	var buf bytes.Buffer
+	p := &promWriter{w: bufio.NewWriter(&buf)}
+	writeMetrics(p, Config{Chaos: c})
+	p.w.Flush()
+	for _, want := range []string{`chaos_faults_total{fault="latency"} 1`, `chaos_faults_total{fault="truncate-header"} 1`, `chaos_faults_total{fault="upstream-500"} 1`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
+
+func TestTrafficRecorder(t *testing.T) {
+	rec, err := newTrafficRecorder(filepath.Join(t.TempDir(), "captures"), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := (&Handshake{ProtocolVersion: 760, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: stateLogin}).encode()
+	body := appendString([]byte{0x00}, "Notch")
+	login := append(hs, appendVarInt(nil, int32(len(body)), body...)...)
+
+	// A backend that kicks every login, like one failing authentication
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			br := bufio.NewReader(conn)
+			detectProxyProtocol(br)
+			readPacket(br, 1024)
+			readPacket(br, 1024)
+			conn.Write(encodeLoginDisconnect("Failed to verify username!"))
+			conn.Close()
+		}
+	}()
+
+	join := func(backend string) {
+		t.Helper()
+		server, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			handleConnection(server, Config{BackendAddr: backend, Recorder: rec})
+			close(done)
+		}()
+		client.Write(login)
+		// Leave once kicked, as the game does
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		readPacket(bufio.NewReader(client), 1024)
+		client.Close()
+		<-done
+	}
+	join(backendLn.Addr().String())
+	backendLn.Close()
+	join(backendLn.Addr().String())
+
+	captures, _ := filepath.Glob(filepath.Join(rec.dir, "*"+captureSuffix))
+	if len(captures) != 2 {
+		t.Fatalf("captures = %v, want 2", captures)
+	}
+	kicked, _ := os.ReadFile(captures[0])
+	unreachable, _ := os.ReadFile(captures[1])
+	for _, want := range []string{"username: Notch", "reason:   connection ended after the backend sent", "client→backend", "backend→client", "|...Notch|", `{"text":"Fail|`} {
+		if !strings.Contains(string(kicked), want) {
+			t.Errorf("capture of the kicked login lacks %q:\n%s", want, kicked)
+		}
+	}
+	if !strings.Contains(string(unreachable), "reason:   backend error") || !strings.Contains(string(unreachable), "mc.example.com") {
+		t.Errorf("capture of the failed dial:\n%s", unreachable)
+	}
+	if !strings.HasSuffix(captures[0], "-pipe-Notch"+captureSuffix) {
+		t.Errorf("capture name %s", filepath.Base(captures[0]))
+	}
+
+	// Logins that get into the game aren't kept
+	capture := rec.start("pipe", "pipe", "")
+	capture.record(captureToClient, make([]byte, 1000))
+	if capture.failedLogin(int64(len(make([]byte, 1000)))) {
+		t.Error("a login the backend sent more than -record-bytes to counted as failed")
+	}
+	if (*trafficRecorder)(nil).start("a", "b", "c") != nil {
+		t.Error("a nil recorder started a capture")
+	}
+}
+
+func TestConnWatchdog(t *testing.T) {
+	for _, spec := range []string{"", "header", "reading=1m", "header=0s", "dialing=soon"} {
+		if _, err := parseWatchdog(spec, false); err == nil {
+			t.Errorf("parseWatchdog(%q) succeeded", spec)
+		}
+	}
+	w, err := parseWatchdog("Header=1m, dialing=5m", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.String(); got != "header 1m0s, dialing 5m0s, closing stuck connections" {
+		t.Errorf("String() = %q", got)
+	}
+	if w.interval != 15*time.Second {
+		t.Errorf("interval = %s, want 15s", w.interval)
+	}
+
+	// Without any timeouts, a client that never finishes its header holds
+	// its handler until the watchdog closes the connection
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(server, Config{BackendAddr: "127.0.0.1:1"})
+		close(done)
+	}()
+	client.Write([]byte("PROX"))
+	if stuck := w.check(time.Now()); len(stuck) != 0 {
+		t.Fatalf("handlers %v reported stuck right away", stuck)
+	}
+	if handlers.byPhase()[phaseHeader] == 0 {
+		t.Fatal("handler not registered in the header phase")
+	}
+	stuckBefore, killedBefore := handlers.stuck.Load(), handlers.killed.Load()
+	if stuck := w.check(time.Now().Add(2 * time.Minute)); len(stuck) == 0 {
+		t.Fatal("stuck handler not reported")
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still running after its connection was closed")
+	}
+	if handlers.stuck.Load() == stuckBefore || handlers.killed.Load() == killedBefore {
+		t.Errorf("stuck/killed counters didn't move: %d/%d", handlers.stuck.Load(), handlers.killed.Load())
+	}
+	// Each stay in a phase is reported once
+	if stuck := w.check(time.Now().Add(time.Hour)); len(stuck) != 0 {
+		t.Errorf("handlers %v reported again", stuck)
+	}
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	go func() {
+		if conn, err := backendLn.Accept(); err == nil {
+			conn.Close()
+			t.Error("silent connection reached the backend")
+		}
+	}()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	silentBefore := tracker.silent.Load()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(server, Config{BackendAddr: backendLn.Addr().String(), FirstByteTimeout: 50 * time.Millisecond, HandshakeTimeout: time.Minute})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("silent connection wasn't closed after -first-byte-timeout")
+	}
+	if tracker.silent.Load() != silentBefore+1 {
+		t.Errorf("silent = %d, want %d", tracker.silent.Load(), silentBefore+1)
+	}
+
+	var buf bytes.Buffer
+	p := &promWriter{w: bufio.NewWriter(&buf)}
+	writeMetrics(p, Config{})
+	p.w.Flush()
+	if !strings.Contains(buf.String(), "mc_dual_proxy_connections_silent_total ") {
+		t.Errorf("metrics lack connections_silent_total:\n%s", buf.String())
+	}
+}
+
+func TestProxyUnknown(t *testing.T) {
+	for _, tc := range []struct {
+		line    string
+		unknown bool
+		ok      bool
+	}{
+		{"PROXY UNKNOWN\r\n", true, true},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", true, true},
+		{"PROXY TCP6 ::ffff:1.2.3.4 ::1 1 2\r\n", false, true},
+		{"PROXY TCP6 1.2.3.4 10.0.0.1 1 2\r\n", false, false},
+		{"PROXY TCP4 1.2.3.4 10.0.0.1 65536 25565\r\n", false, false},
+		{"PROXY TCP4 1.2.3.4 10.0.0.1 -1 25565\r\n", false, false},
+		{"PROXY TCP4 1.2.3.4 10.0.0.1 1\r\n", false, false},
+	} {
+		header, err := detectProxyProtocol(bufio.NewReader(strings.NewReader(tc.line)))
+		if (err == nil && header != nil) != tc.ok {
+			t.Errorf("%q: header %+v, err %v; want accepted=%t", tc.line, header, err, tc.ok)
+			continue
+		}
+		if tc.ok && header.Unknown != tc.unknown {
+			t.Errorf("%q: Unknown=%t, want %t", tc.line, header.Unknown, tc.unknown)
+		}
+	}
+	unspec := append(append([]byte{}, proxyV2Sig...), 0x21, 0x00, 0, 0)
+	if header, err := detectProxyProtocol(bufio.NewReader(bytes.NewReader(unspec))); err != nil || !header.Unknown {
+		t.Errorf("v2 AF_UNSPEC: header %+v, err %v; want Unknown", header, err)
+	}
+
+	// What the backend receives for an UNKNOWN header under each policy
+	for _, tc := range []struct {
+		policy string
+		want   string // prefix of what the backend reads; "" if not reached
+	}{
+		{proxyUnknownPeer, string(proxyV2Sig)},
+		{proxyUnknownPassthrough, "PROXY UNKNOWN\r\n"},
+		{proxyUnknownReject, ""},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer backendLn.Close()
+			received := make(chan []byte, 1)
+			go func() {
+				conn, err := backendLn.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				received <- data
+			}()
+			proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proxyLn.Close()
+			go func() {
+				conn, err := proxyLn.Accept()
+				if err != nil {
+					return
+				}
+				handleConnection(conn, Config{BackendAddr: backendLn.Addr().String(), ProxyUnknown: tc.policy})
+			}()
+			client, err := net.DialTimeout("tcp", proxyLn.Addr().String(), 2*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.Write([]byte("PROXY UNKNOWN\r\nMC_DATA"))
+			client.(*net.TCPConn).CloseWrite()
+
+			select {
+			case data := <-received:
+				if tc.want == "" || !bytes.HasPrefix(data, []byte(tc.want)) || !bytes.HasSuffix(data, []byte("MC_DATA")) {
+					t.Fatalf("backend received %q, want %q first", data, tc.want)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if tc.want != "" {
+					t.Fatal("connection didn't reach the backend")
+				}
+			}
+		})
+	}
+}
+
 func TestDetectProxyV2(t *testing.T) {
 	// Build a valid v2 header for 192.168.1.100:12345 → 10.0.0.1:25565
 	header := make([]byte, 28) // 16 + 12 (IPv4)
@@ -114,6 +659,89 @@ func TestDetectNoProxyProtocol(t *testing.T) {
 	}
 }
 
+func TestDetectProxyRejectsMalformedHeaders(t *testing.T) {
+	v2 := func(verCmd, famProto byte, addrLen uint16) []byte {
+		header := append([]byte(nil), proxyV2Sig...)
+		header = append(header, verCmd, famProto, byte(addrLen>>8), byte(addrLen))
+		return append(header, make([]byte, addrLen)...)
+	}
+	for name, data := range map[string][]byte{
+		"v1 line too long":     []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"),
+		"v1 bad port":          []byte("PROXY TCP4 1.2.3.4 10.0.0.1 99999 25565\r\n"),
+		"v1 family mismatch":   []byte("PROXY TCP4 ::1 10.0.0.1 1234 25565\r\n"),
+		"v1 bad protocol":      []byte("PROXY UDP4 1.2.3.4 10.0.0.1 1234 25565\r\n"),
+		"v2 unknown command":   v2(0x22, 0x11, 12),
+		"v2 short IPv4 block":  v2(0x21, 0x11, 4),
+		"v2 short IPv6 block":  v2(0x21, 0x21, 12),
+		"v2 exceeds buffer":    v2(0x21, 0x11, 1000),
+		"v2 truncated address": v2(0x21, 0x11, 12)[:20],
+	} {
+		ph, err := detectProxyProtocol(bufio.NewReaderSize(bytes.NewReader(data), 512))
+		if err == nil {
+			t.Errorf("%s: expected an error, got %+v", name, ph)
+		}
+	}
+}
+
+// fuzzProxyHeader checks that detectProxyProtocol never panics, that a
+// detected header is exactly the consumed prefix of the input, and that
+// strict mode only accepts headers lenient mode accepts too. The seed
+// corpus in testdata/fuzz holds malformed headers.
+func fuzzProxyHeader(t *testing.T, data []byte) {
+	strictPH, strictErr := detectProxyHeader(bufio.NewReaderSize(bytes.NewReader(data), 512), true)
+	br := bufio.NewReaderSize(bytes.NewReader(data), 512)
+	ph, err := detectProxyProtocol(br)
+	if strictErr == nil && strictPH != nil && (err != nil || ph == nil || !bytes.Equal(ph.RawBytes, strictPH.RawBytes)) {
+		t.Fatalf("strict mode accepted %q, lenient mode didn't: %v", strictPH.RawBytes, err)
+	}
+	if err != nil || ph == nil {
+		return
+	}
+	if ph.Version == 1 && (len(ph.RawBytes) > proxyV1MaxLen || !bytes.HasSuffix(ph.RawBytes, []byte("\r\n"))) {
+		t.Fatalf("invalid v1 header accepted: %q", ph.RawBytes)
+	}
+	if !bytes.HasPrefix(data, ph.RawBytes) {
+		t.Fatalf("raw header %q is not a prefix of the input %q", ph.RawBytes, data)
+	}
+	rest, _ := io.ReadAll(br)
+	if !bytes.Equal(rest, data[len(ph.RawBytes):]) {
+		t.Fatalf("consumed %d bytes, header is %d bytes", len(data)-len(rest), len(ph.RawBytes))
+	}
+	if (ph.SrcAddr == nil) != (ph.DstAddr == nil) {
+		t.Fatalf("only one of source %v and destination %v is set", ph.SrcAddr, ph.DstAddr)
+	}
+}
+
+func FuzzDetectProxyProtocol(f *testing.F) {
+	f.Add([]byte("PROXY TCP4 192.168.1.50 10.0.0.1 54321 25565\r\nDATA"))
+	f.Add([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 54321 25565\r\n"))
+	f.Add([]byte("PROXY UNKNOWN\r\n"))
+	f.Add(buildProxyV2Header(&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 2}))
+	f.Add(buildProxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2}))
+	f.Add(append(append([]byte(nil), proxyV2Sig...), 0x20, 0x00, 0x00, 0x00))
+	f.Add([]byte{0x10, 0x00, 0xFF})
+	f.Fuzz(fuzzProxyHeader)
+}
+
+func FuzzParseProxyV1(f *testing.F) {
+	f.Add("TCP4 192.168.1.50 10.0.0.1 54321 25565")
+	f.Add("TCP6 ::1 ::1 1 2")
+	f.Add("UNKNOWN")
+	f.Fuzz(func(t *testing.T, line string) {
+		fuzzProxyHeader(t, []byte("PROXY "+line+"\r\n"))
+	})
+}
+
+func FuzzParseProxyV2(f *testing.F) {
+	f.Add(byte(0x21), byte(0x11), []byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 1, 0, 2})
+	f.Add(byte(0x20), byte(0x00), []byte{})
+	f.Add(byte(0x21), byte(0x21), make([]byte, 36))
+	f.Fuzz(func(t *testing.T, verCmd, famProto byte, block []byte) {
+		header := append(append([]byte(nil), proxyV2Sig...), verCmd, famProto, byte(len(block)>>8), byte(len(block)))
+		fuzzProxyHeader(t, append(header, block...))
+	})
+}
+
 func TestBuildProxyV2Header(t *testing.T) {
 	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.50"), Port: 49152}
 	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 25565}
@@ -171,264 +799,5736 @@ func TestBuildProxyV2HeaderIPv6(t *testing.T) {
 	}
 }
 
-// --- Multiauth Tests ---
-
-func TestMultiauthFirstServerSucceeds(t *testing.T) {
-	// Simulate Mojang returning 200 (direct player)
-	mojang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Query().Get("username") != "TestPlayer" {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"id":   "abcdef1234567890abcdef1234567890",
-			"name": "TestPlayer",
-		})
-	}))
-	defer mojang.Close()
+// --- Minecraft Protocol Tests ---
 
-	// Simulate Minehut returning 204 (not their player)
-	minehut := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		time.Sleep(50 * time.Millisecond) // Slight delay
-		w.WriteHeader(http.StatusNoContent)
-	}))
-	defer minehut.Close()
+func TestHandshakeRoundtrip(t *testing.T) {
+	hs := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: stateLogin}
+	data := append(hs.encode(), 0x01, 0x02) // followed by the next packet
 
-	servers := []string{mojang.URL, minehut.URL}
+	br := bufio.NewReaderSize(bytes.NewReader(data), 512)
+	got, n := peekHandshake(br)
+	if got == nil {
+		t.Fatal("expected handshake to be parsed")
+	}
+	if *got != *hs {
+		t.Fatalf("roundtrip mismatch: got %+v, want %+v", got, hs)
+	}
+	if n != len(data)-2 {
+		t.Fatalf("expected packet size %d, got %d", len(data)-2, n)
+	}
 
-	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=TestPlayer&serverId=abc123", nil)
-	rec := httptest.NewRecorder()
+	// Peeking must not consume anything
+	remaining, _ := io.ReadAll(br)
+	if !bytes.Equal(remaining, data) {
+		t.Fatal("peekHandshake consumed data")
+	}
+}
 
-	handleHasJoined(rec, req, servers)
+func TestPeekHandshakeRejectsNonMinecraft(t *testing.T) {
+	for _, data := range [][]byte{
+		[]byte("HELLO_MC"),
+		[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		{0xFE, 0x01, 0xFA},
+	} {
+		br := bufio.NewReaderSize(bytes.NewReader(data), 512)
+		if hs, _ := peekHandshake(br); hs != nil {
+			t.Fatalf("unexpected handshake parsed from %q: %+v", data, hs)
+		}
+	}
+}
 
-	if rec.Code != http.StatusOK {
-		t.Fatalf("expected 200, got %d", rec.Code)
+func TestPeekLoginStart(t *testing.T) {
+	hs := (&Handshake{ProtocolVersion: 760, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: stateLogin}).encode()
+	loginStart := func(name string, trailer int) []byte {
+		body := appendString([]byte{0x00}, name)
+		body = append(body, make([]byte, trailer)...)
+		return appendVarInt(nil, int32(len(body)), body...)
 	}
 
-	var body map[string]interface{}
-	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
-		t.Fatalf("failed to parse response: %v", err)
+	cases := []struct {
+		data []byte
+		want string
+	}{
+		{loginStart("Notch", 16), "Notch"},
+		// 1.19.1 sends a key and signature that don't fit in a small buffer
+		{loginStart("Steve_99", 700), "Steve_99"},
+		{loginStart("not a name", 16), ""},
+		{loginStart("", 0), ""},
+		{[]byte("LOGIN_START"), ""},
 	}
-	if body["name"] != "TestPlayer" {
-		t.Fatalf("expected name TestPlayer, got %v", body["name"])
+	for _, c := range cases {
+		data := append(slices.Clone(hs), c.data...)
+		br := bufio.NewReaderSize(bytes.NewReader(data), 256)
+		_, n := peekHandshake(br)
+		if got := peekLoginStart(br, n); got != c.want {
+			t.Errorf("peekLoginStart(%x...) = %q, want %q", c.data[:min(len(c.data), 16)], got, c.want)
+		}
+		if br.Buffered() > 0 {
+			if b, _ := br.Peek(len(hs)); !bytes.Equal(b, hs) {
+				t.Fatal("peekLoginStart consumed data")
+			}
+		}
 	}
 }
 
-func TestMultiauthSecondServerSucceeds(t *testing.T) {
-	// Simulate Mojang returning 204 (Minehut player, hash won't match Mojang)
-	mojang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNoContent)
-	}))
-	defer mojang.Close()
+func TestTCPProxyTagsConnectionWithLoginName(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	backendRest := make(chan []byte, 1)
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReaderSize(conn, 512)
+		detectProxyProtocol(br)
+		rest, _ := io.ReadAll(br)
+		backendRest <- rest
+	}()
 
-	// Simulate Minehut returning 200
-	minehut := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"id":   "1234567890abcdef1234567890abcdef",
-			"name": "MinehutPlayer",
-		})
+	client, server := net.Pipe()
+	go handleConnection(server, Config{BackendAddr: backendLn.Addr().String()})
+
+	hs := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: stateLogin}
+	body := appendString([]byte{0x00}, "Tagged_Player")
+	body = append(body, make([]byte, 16)...)
+	sent := append(hs.encode(), appendVarInt(nil, int32(len(body)), body...)...)
+	go client.Write(sent)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		var name string
+		for _, c := range tracker.snapshot() {
+			if c.Username == "Tagged_Player" {
+				name = c.Username
+			}
+		}
+		if name != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection was not tagged with the Login Start name")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Close()
+	if rest := <-backendRest; !bytes.Equal(rest, sent) {
+		t.Fatalf("backend got %x, want the handshake and Login Start untouched", rest)
+	}
+}
+
+func TestHostRewriteRules(t *testing.T) {
+	rw, err := parseHostRewrites([]string{"trim-dot", "strip-fml", "*.minehut.gg=mc.mydomain.com", "max-length=20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"myserver.minehut.gg":                 "mc.mydomain.com",
+		"MyServer.Minehut.GG.":                "mc.mydomain.com",
+		"myserver.minehut.gg\x00FML2\x00":     "mc.mydomain.com",
+		"play.example.com":                    "play.example.com",
+		"a-very-long-hostname.example.com":    "a-very-long-hostname",
+		"play.example.com\x001.2.3.4\x00uuid": "play.example.com\x001.2.3.4\x00uuid",
+	}
+	for in, want := range cases {
+		if got := rw.rewrite(in); got != want {
+			t.Errorf("rewrite(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	for _, bad := range []string{"max-length=0", "nonsense", "[=x"} {
+		if _, err := parseHostRewrites([]string{bad}); err == nil {
+			t.Errorf("expected error for rule %q", bad)
+		}
+	}
+}
+
+func TestForgeMarkerDetection(t *testing.T) {
+	cases := map[string]string{
+		"mc.example.com":                   "",
+		"mc.example.com\x00FML\x00":        "FML",
+		"mc.example.com\x00FML2\x00":       "FML2",
+		"mc.example.com\x00FML3\x00":       "FML3",
+		"mc.example.com\x001.2.3.4\x00FML": "",
+	}
+	for addr, want := range cases {
+		hs := &Handshake{ServerAddress: addr}
+		if got := hs.ForgeMarker(); got != want {
+			t.Errorf("ForgeMarker(%q) = %q, want %q", addr, got, want)
+		}
+		if hs.Hostname() != "mc.example.com" {
+			t.Errorf("Hostname(%q) = %q", addr, hs.Hostname())
+		}
+	}
+
+	// Mappings must keep the marker so Forge servers still accept the client
+	rw, _ := parseHostRewrites([]string{"*.minehut.gg=mc.mydomain.com"})
+	if got := rw.rewrite("abc.minehut.gg\x00FML3\x00"); got != "mc.mydomain.com\x00FML3\x00" {
+		t.Fatalf("marker not preserved: %q", got)
+	}
+}
+
+func TestUserRoutes(t *testing.T) {
+	listen := func(name string, hits chan<- string) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				hits <- name
+				conn.Close()
+			}
+		}()
+		return ln.Addr().String()
+	}
+	hits := make(chan string, 4)
+	defaultAddr, stagingAddr := listen("default", hits), listen("staging", hits)
+
+	staffFile := filepath.Join(t.TempDir(), "staff.txt")
+	os.WriteFile(staffFile, []byte("# staff\nAdmin_1\n"), 0o644)
+	router, err := parseUserRoutes([]string{"@" + staffFile + "=" + stagingAddr, "Streamer=" + stagingAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{BackendAddr: defaultAddr, UserRouter: router}
+
+	login := func(name string) string {
+		t.Helper()
+		client, server := net.Pipe()
+		defer client.Close()
+		go handleConnection(server, cfg)
+		hs := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: stateLogin}
+		body := appendString([]byte{0x00}, name)
+		body = append(body, make([]byte, 16)...)
+		go client.Write(append(hs.encode(), appendVarInt(nil, int32(len(body)), body...)...))
+		select {
+		case backend := <-hits:
+			return backend
+		case <-time.After(3 * time.Second):
+			t.Fatalf("login as %s reached no backend", name)
+			return ""
+		}
+	}
+
+	for name, want := range map[string]string{"admin_1": "staging", "STREAMER": "staging", "Steve": "default"} {
+		if got := login(name); got != want {
+			t.Errorf("%s went to %s, want %s", name, got, want)
+		}
+	}
+
+	// The file is read again once it changes
+	os.WriteFile(staffFile, []byte("Steve\n"), 0o644)
+	os.Chtimes(staffFile, time.Now(), time.Now().Add(time.Minute))
+	if got := login("Steve"); got != "staging" {
+		t.Errorf("Steve went to %s after being added to the file", got)
+	}
+	if got := login("Admin_1"); got != "default" {
+		t.Errorf("Admin_1 went to %s after being removed from the file", got)
+	}
+
+	for _, bad := range []string{"Steve", "=127.0.0.1:1", "not a name=127.0.0.1:1", "@/nonexistent=127.0.0.1:1", "Steve=nohost"} {
+		if _, err := parseUserRoutes([]string{bad}); err == nil {
+			t.Errorf("expected -user-route %q to be refused", bad)
+		}
+	}
+}
+
+func TestHostSessionServers(t *testing.T) {
+	if _, err := newHostAuthRouter([]string{"mc.example.com"}); err == nil {
+		t.Error("expected an error without session servers")
+	}
+	if r, err := newHostAuthRouter(nil); r != nil || err != nil {
+		t.Errorf("newHostAuthRouter(nil) = %v, %v, want nil", r, err)
+	}
+
+	// Each session server knows everyone and names itself in the profile
+	var asked sync.Map
+	server := func(name string) string {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			asked.Store(name, true)
+			json.NewEncoder(w).Encode(map[string]any{"id": offlineUUID(name), "name": name})
+		}))
+		t.Cleanup(s.Close)
+		return s.URL
+	}
+	mojang, minehut := server("mojang"), server("minehut")
+	router, err := newHostAuthRouter([]string{"vanilla.example.com=" + mojang, "*.minehut.gg,Play.Example.com=" + minehut})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if servers, pattern := router.serversFor("PLAY.example.com."); len(servers) != 1 || servers[0] != minehut || pattern != "play.example.com" {
+		t.Errorf("serversFor(PLAY.example.com.) = %v, %q", servers, pattern)
+	}
+
+	for i, c := range []struct{ name, real, host string }{
+		{"Alice", "10.0.0.1:7000", "vanilla.example.com"},
+		{"Bob", "10.0.0.2:7000", "bob.minehut.gg"},
+		{"Carol", "10.0.0.3:7000", "other.example.com"},
+	} {
+		tc := &trackedConn{ClientAddr: "127.0.0.1:" + itoa(5000+i), RealAddr: c.real, Host: c.host, Started: time.Now()}
+		tracker.add(tc)
+		defer tracker.remove(tc)
+		tc.setUsername(c.name)
+	}
+
+	cfg := Config{SessionServers: []string{server("default")}, HostAuth: router}
+	for _, c := range []struct{ query, want string }{
+		{"username=alice", "mojang"},
+		{"username=Bob&ip=10.0.0.2", "minehut"},
+		{"username=Bob&ip=10.0.0.9", "default"}, // connected from elsewhere
+		{"username=Carol", "default"},           // no rule for the host
+		{"username=Dave", "default"},            // no live connection
+	} {
+		asked.Clear()
+		req := httptest.NewRequest("GET", hasJoinedPath+"?serverId=abc123&"+c.query, nil)
+		rec := httptest.NewRecorder()
+		handleHasJoined(rec, req, cfg)
+		var profile map[string]any
+		json.Unmarshal(rec.Body.Bytes(), &profile)
+		if rec.Code != http.StatusOK || profile["name"] != c.want {
+			t.Errorf("%s: got %d %s, want the profile from %s", c.query, rec.Code, rec.Body, c.want)
+		}
+		asked.Range(func(name, _ any) bool {
+			if name != c.want {
+				t.Errorf("%s: asked %s as well", c.query, name)
+			}
+			return true
+		})
+	}
+}
+
+func TestBackendUpstreams(t *testing.T) {
+	for _, bad := range []string{"10.0.0.5:25565", "=mojang", "10.0.0.5:25565= , "} {
+		if _, err := parseBackendUpstreams([]string{bad}); err == nil {
+			t.Errorf("parseBackendUpstreams(%q): expected an error", bad)
+		}
+	}
+	rules, err := parseBackendUpstreams([]string{"10.0.0.5:25565=https://sessionserver.mojang.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rules.accepts("10.0.0.5:25565", "mojang") || rules.accepts("10.0.0.5:25565", "minehut") || !rules.accepts("10.0.0.6:25565", "minehut") || rules.accepts("", "mojang") {
+		t.Errorf("unexpected rules %s", rules)
+	}
+
+	// Upstreams are named after their URL, so the path names them here
+	answer := func(name string, status int, delay time.Duration) string {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			w.WriteHeader(status)
+			if status == http.StatusOK {
+				json.NewEncoder(w).Encode(map[string]any{"id": offlineUUID("Steve"), "name": "Steve"})
+			}
+		}))
+		t.Cleanup(s.Close)
+		return s.URL + "/" + name
+	}
+	// Minehut knows the player and answers first
+	mojangOK, mojangNo := answer("mojang", http.StatusOK, 50*time.Millisecond), answer("mojang", http.StatusNoContent, 0)
+	minehut := answer("minehut", http.StatusOK, 0)
+	cfg := Config{BackendUpstreams: rules}
+
+	tc := &trackedConn{ClientAddr: "127.0.0.1:5000", RealAddr: "10.1.0.1:7000", Started: time.Now()}
+	tracker.add(tc)
+	defer tracker.remove(tc)
+	tc.setUsername("Steve")
+	tc.setBackend("10.0.0.5:25565")
+
+	evs, stop := events.subscribe()
+	defer stop()
+	for _, c := range []struct {
+		servers []string
+		want    int
+	}{
+		{[]string{minehut, mojangOK}, http.StatusOK},        // mojang's success is used
+		{[]string{minehut, mojangNo}, http.StatusNoContent}, // only minehut knows Steve
+	} {
+		cfg.SessionServers = c.servers
+		rec := httptest.NewRecorder()
+		handleHasJoined(rec, httptest.NewRequest("GET", hasJoinedPath+"?username=Steve&serverId=abc123", nil), cfg)
+		if rec.Code != c.want {
+			t.Errorf("%v: got %d, want %d", c.servers, rec.Code, c.want)
+		}
+	}
+	var blocked []map[string]any
+	for len(evs) > 0 {
+		if ev := <-evs; ev.Type == eventLoginBlocked {
+			blocked = append(blocked, ev.Data)
+		}
+	}
+	if len(blocked) != 1 || blocked[0]["reason"] != "upstream_not_accepted" || blocked[0]["upstream"] != "minehut" || blocked[0]["backend"] != "10.0.0.5:25565" {
+		t.Errorf("login.blocked events = %v, want one for minehut", blocked)
+	}
+
+	// Without a live connection the route's backend applies, and no backend
+	// at all accepts no upstream
+	for backendAddr, want := range map[string]int{"10.0.0.5:25565": http.StatusNoContent, "10.0.0.6:25565": http.StatusOK, "": http.StatusNoContent} {
+		cfg := Config{BackendUpstreams: rules, BackendAddr: backendAddr, SessionServers: []string{minehut}}
+		rec := httptest.NewRecorder()
+		handleHasJoined(rec, httptest.NewRequest("GET", hasJoinedPath+"?username=Alex&serverId=abc123", nil), cfg)
+		if rec.Code != want {
+			t.Errorf("backend %q without a connection: got %d, want %d", backendAddr, rec.Code, want)
+		}
+	}
+}
+
+func TestAuthSourceProperty(t *testing.T) {
+	minehut := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"069a79f444e94726a5befca90e38aaf5","name":"Notch","properties":[{"name":"textures","value":"e30=","signature":"c2ln"}],"profileActions":[]}`))
+	}))
+	defer minehut.Close()
+
+	cfg := Config{SessionServers: []string{minehut.URL + "/minehut"}, AuthSourceProperty: "authSource"}
+	rec := httptest.NewRecorder()
+	handleHasJoined(rec, httptest.NewRequest("GET", hasJoinedPath+"?username=Notch&serverId=abc123", nil), cfg)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var profile struct {
+		ID             string            `json:"id"`
+		Properties     []profileProperty `json:"properties"`
+		ProfileActions []string          `json:"profileActions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &profile); err != nil {
+		t.Fatal(err)
+	}
+	want := []profileProperty{{Name: "textures", Value: "e30=", Signature: "c2ln"}, {Name: "authSource", Value: "minehut"}}
+	if profile.ID != "069a79f444e94726a5befca90e38aaf5" || profile.ProfileActions == nil || !slices.Equal(profile.Properties, want) {
+		t.Errorf("unexpected profile %s", rec.Body)
+	}
+
+	if body, err := addProfileProperty([]byte(`{"id":"x","name":"Steve"}`), profileProperty{Name: "authSource", Value: "offline"}); err != nil || string(body) != `{"id":"x","name":"Steve","properties":[{"name":"authSource","value":"offline"}]}` {
+		t.Errorf("addProfileProperty without properties = %s, %v", body, err)
+	}
+	if _, err := addProfileProperty([]byte(`not json`), profileProperty{}); err == nil {
+		t.Error("expected an error for an invalid profile")
+	}
+}
+
+func TestCompanionProperty(t *testing.T) {
+	minehut := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"069a79f444e94726a5befca90e38aaf5","name":"Notch","properties":[]}`))
 	}))
 	defer minehut.Close()
 
-	servers := []string{mojang.URL, minehut.URL}
+	tc := &trackedConn{ClientAddr: "198.51.100.7:40000", RealAddr: "203.0.113.50:51000", Source: "proxied", Host: "play.example.com", Route: "lobby", Started: time.Now()}
+	tracker.add(tc)
+	defer tracker.remove(tc)
+	tc.setUsername("Notch")
+
+	cfg := Config{SessionServers: []string{minehut.URL + "/minehut"}, Companion: &companion{node: "proxy-eu-1"}, AuthSourceProperty: "authSource"}
+	for _, c := range []struct {
+		username string
+		want     companionMeta
+	}{
+		{"notch", companionMeta{Version: 1, AuthSource: "minehut", Host: "play.example.com", Route: "lobby", Node: "proxy-eu-1", Connection: tc.ID}},
+		{"Steve", companionMeta{Version: 1, AuthSource: "minehut", Node: "proxy-eu-1"}}, // not connected
+	} {
+		rec := httptest.NewRecorder()
+		handleHasJoined(rec, httptest.NewRequest("GET", hasJoinedPath+"?serverId=abc123&username="+c.username, nil), cfg)
+		var profile struct {
+			Properties []profileProperty `json:"properties"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &profile)
+		if len(profile.Properties) != 2 || profile.Properties[0].Name != "authSource" || profile.Properties[1].Name != companionProperty {
+			t.Fatalf("%s: unexpected properties %v", c.username, profile.Properties)
+		}
+		var meta companionMeta
+		if err := json.Unmarshal([]byte(profile.Properties[1].Value), &meta); err != nil || meta != c.want {
+			t.Errorf("%s: meta = %+v, %v, want %+v", c.username, meta, err, c.want)
+		}
+	}
+}
+
+func TestHostTLV(t *testing.T) {
+	// authority returns the AUTHORITY TLV of a v2 header, checking the rest
+	authority := func(header []byte) string {
+		t.Helper()
+		parsed, err := detectProxyHeader(bufio.NewReader(bytes.NewReader(header)), true)
+		if err != nil || parsed == nil || parsed.Version != 2 {
+			t.Fatalf("invalid v2 header %x: %v", header, err)
+		}
+		tlvs := header[16+proxyV2AddrLen[header[13]>>4]:]
+		for off := 0; off < len(tlvs); off += 3 + int(binary.BigEndian.Uint16(tlvs[off+1:])) {
+			if tlvs[off] == proxyV2TypeAuthority {
+				return string(tlvs[off+3 : off+3+int(binary.BigEndian.Uint16(tlvs[off+1:]))])
+			}
+		}
+		return ""
+	}
+
+	src, dst := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51234}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 25565}
+	plain := buildProxyV2Header(src, dst)
+	if got := authority(withTLV(plain, proxyV2TypeAuthority, "play.example.com")); got != "play.example.com" {
+		t.Errorf("authority = %q", got)
+	}
+
+	// A header with an AUTHORITY, another TLV and a CRC32c
+	withTLVs := append(append([]byte(nil), plain...), proxyV2TypeAuthority, 0, 3, 'o', 'l', 'd', 0xE0, 0, 1, 'x', proxyV2TypeCRC32C, 0, 4, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(withTLVs[14:16], uint16(len(withTLVs)-16))
+	binary.BigEndian.PutUint32(withTLVs[len(withTLVs)-4:], crc32.Checksum(withTLVs, castagnoli))
+	rewritten := withTLV(withTLVs, proxyV2TypeAuthority, "mc.example.com")
+	if got := authority(rewritten); got != "mc.example.com" {
+		t.Errorf("authority = %q, want the old one replaced", got)
+	}
+	if !bytes.Contains(rewritten, []byte{0xE0, 0, 1, 'x'}) {
+		t.Error("other TLVs weren't kept")
+	}
+	if broken := append(append([]byte(nil), plain...), 0xE0); !bytes.Equal(withTLV(broken, proxyV2TypeAuthority, "x"), broken) {
+		t.Error("a header with broken TLVs was changed")
+	}
+
+	// Forwarded v1 headers become v2 with the same addresses
+	v1 := []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 25565\r\n")
+	forwarded, _ := detectProxyProtocol(bufio.NewReader(bytes.NewReader(v1)))
+	cfg := Config{HostTLV: true}
+	header := backendProxyHeader(cfg, nil, forwarded, "play.example.com", "")
+	if got := authority(header); got != "play.example.com" || !bytes.Equal(header[16:28], plain[16:28]) {
+		t.Errorf("v1 header became %x", header)
+	}
+	if header := backendProxyHeader(cfg, nil, forwarded, "", ""); !bytes.Equal(header, v1) {
+		t.Error("a v1 header without a hostname wasn't forwarded as is")
+	}
+	if header := backendProxyHeader(Config{}, nil, forwarded, "play.example.com", ""); !bytes.Equal(header, v1) {
+		t.Error("the v1 header was changed without -host-tlv")
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	if _, err := parseAllowedHosts(" , "); err == nil {
+		t.Error("expected an error for an empty list")
+	}
+	hosts, err := parseAllowedHosts("mc.example.com, *.Minehut.gg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"mc.example.com":  "mc.example.com",
+		"MC.Example.com.": "mc.example.com",
+		"abc.minehut.gg":  "*.minehut.gg",
+		"203.0.113.7":     "",
+		"example.com":     "",
+	}
+	for host, want := range cases {
+		if got := hosts.match(host); got != want {
+			t.Errorf("match(%q) = %q, want %q", host, got, want)
+		}
+	}
+
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	accepted := make(chan struct{}, 4)
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+	cfg := Config{BackendAddr: backendLn.Addr().String(), AllowedHosts: hosts}
+	connect := func(host string, state int32) net.Conn {
+		client, server := net.Pipe()
+		go handleConnection(server, cfg)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		hs := &Handshake{ProtocolVersion: 767, ServerAddress: host, ServerPort: 25565, NextState: state}
+		go client.Write(hs.encode())
+		return client
+	}
+
+	// Logins via the raw IP are told to use the hostname
+	client := connect("203.0.113.7", stateLogin)
+	packet, err := readPacket(bufio.NewReader(client), 1024)
+	client.Close()
+	if err != nil {
+		t.Fatalf("reading disconnect: %v", err)
+	}
+	if reason, _, _ := decodeString(packet[1:], 1024); packet[0] != 0x00 || !strings.Contains(reason, "connect using") {
+		t.Fatalf("unexpected disconnect packet %q", packet)
+	}
+	// Scanners' pings get nothing
+	client = connect("203.0.113.7", stateStatus)
+	if n, _ := client.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("a ping for an unknown host was answered")
+	}
+	client.Close()
+	select {
+	case <-accepted:
+		t.Fatal("a handshake for an unknown host reached the backend")
+	default:
+	}
+
+	client = connect("abc.minehut.gg.", stateLogin)
+	select {
+	case <-accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("a handshake for an allowed host didn't reach the backend")
+	}
+	client.Close()
+
+	// Padding the address past the peek buffer doesn't get around the check
+	client = connect(strings.Repeat("a", 2*peekBufferSize), stateLogin)
+	if n, _ := client.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("an oversized handshake was answered")
+	}
+	client.Close()
+	select {
+	case <-accepted:
+		t.Fatal("an oversized handshake reached the backend")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	hostChecks.write(&promWriter{w: w})
+	w.Flush()
+	for _, want := range []string{
+		`mc_dual_proxy_handshake_hosts_total{host="*.minehut.gg",result="allowed"} 1`,
+		`mc_dual_proxy_handshake_hosts_total{host="other",result="rejected"} 2`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestTCPProxyRewritesHandshakeHost(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+
+	backendGot := make(chan *Handshake, 1)
+	backendRest := make(chan []byte, 1)
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReaderSize(conn, 512)
+		detectProxyProtocol(br)
+		hs, n := peekHandshake(br)
+		backendGot <- hs
+		br.Discard(n)
+		rest, _ := io.ReadAll(br)
+		backendRest <- rest
+	}()
+
+	rw, _ := parseHostRewrites([]string{"*.minehut.gg=mc.mydomain.com"})
+	client, server := net.Pipe()
+	go handleConnection(server, Config{BackendAddr: backendLn.Addr().String(), HostRewriter: rw})
+
+	hs := &Handshake{ProtocolVersion: 767, ServerAddress: "abc.minehut.gg", ServerPort: 25565, NextState: stateLogin}
+	go func() {
+		client.Write(append(hs.encode(), []byte("LOGIN_START")...))
+		client.Close()
+	}()
+
+	select {
+	case got := <-backendGot:
+		if got == nil || got.ServerAddress != "mc.mydomain.com" || got.ServerPort != 25565 {
+			t.Fatalf("backend got unexpected handshake: %+v", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for backend handshake")
+	}
+	if rest := <-backendRest; string(rest) != "LOGIN_START" {
+		t.Fatalf("data after handshake mangled: %q", rest)
+	}
+}
+
+func TestBungeeGuardToken(t *testing.T) {
+	textures := `{"name":"textures","value":"dGV4dHVyZXM=","signature":"c2ln"}`
+	cases := []struct {
+		addr, token string
+		want        string
+		ok          bool
+	}{
+		{"mc.example.com", "secret", "mc.example.com", false},
+		{"mc.example.com\x00FML2\x00", "secret", "mc.example.com\x00FML2\x00", false},
+		{"mc.example.com\x001.2.3.4\x00069a79f444e94726a5befca90e38aaf5", "secret",
+			"mc.example.com\x001.2.3.4\x00069a79f444e94726a5befca90e38aaf5\x00[{\"name\":\"bungeeguard-token\",\"value\":\"secret\"}]", true},
+		// A forged token is replaced, other properties are kept as sent
+		{"mc.example.com\x001.2.3.4\x00uuid\x00[" + textures + `,{"name":"bungeeguard-token","value":"forged"}]`, "secret",
+			"mc.example.com\x001.2.3.4\x00uuid\x00[" + textures + `,{"name":"bungeeguard-token","value":"secret"}]`, true},
+		{"mc.example.com\x001.2.3.4\x00uuid\x00[" + `{"name":"bungeeguard-token","value":"forged"}]`, "",
+			"mc.example.com\x001.2.3.4\x00uuid\x00[]", true},
+		{"mc.example.com\x001.2.3.4\x00uuid\x00not json", "secret", "mc.example.com\x001.2.3.4\x00uuid\x00not json", false},
+	}
+	for _, c := range cases {
+		got, ok := setBungeeGuardToken(c.addr, c.token)
+		if got != c.want || ok != c.ok {
+			t.Errorf("setBungeeGuardToken(%q, %q) = %q, %t; want %q, %t", c.addr, c.token, got, ok, c.want, c.ok)
+		}
+	}
+
+	// Through the proxy: only trusted peers get the token
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	backendGot := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			br := bufio.NewReaderSize(conn, 4096)
+			detectProxyProtocol(br)
+			hs, _ := peekHandshake(br)
+			if hs != nil {
+				backendGot <- hs.ServerAddress
+			} else {
+				backendGot <- ""
+			}
+			conn.Close()
+		}
+	}()
+	forwarded := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com\x001.2.3.4\x00uuid\x00[]", ServerPort: 25565, NextState: stateLogin}
+	for _, trusted := range []bool{true, false} {
+		cfg := Config{BackendAddr: backendLn.Addr().String(), BungeeGuardToken: "secret", PeekBufferSize: 4096}
+		if trusted {
+			cfg.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+		}
+		proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			if conn, err := proxyLn.Accept(); err == nil {
+				handleConnection(conn, cfg)
+			}
+		}()
+		client, err := net.Dial("tcp", proxyLn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write(forwarded.encode())
+		select {
+		case got := <-backendGot:
+			hasToken := strings.Contains(got, `"value":"secret"`)
+			if hasToken != trusted || !strings.HasPrefix(got, "mc.example.com\x001.2.3.4\x00uuid\x00") {
+				t.Errorf("trusted=%t: backend got handshake address %q", trusted, got)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout waiting for the backend handshake")
+		}
+		client.Close()
+		proxyLn.Close()
+	}
+}
+
+func TestEncodeLegacyKick(t *testing.T) {
+	got := encodeLegacyKick("§1")
+	want := []byte{0xFF, 0x00, 0x02, 0x00, 0xA7, 0x00, '1'}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+// legacyPing sends a legacy ping through handleConnection and returns the
+// decoded kick message.
+func legacyPing(t *testing.T, cfg Config, ping []byte) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConnection(server, cfg)
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write(ping); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) < 3 || resp[0] != 0xFF {
+		t.Fatalf("expected a 0xFF kick packet, got %x", resp)
+	}
+	units := make([]uint16, 0, len(resp)/2)
+	for i := 3; i+1 < len(resp); i += 2 {
+		units = append(units, uint16(resp[i])<<8|uint16(resp[i+1]))
+	}
+	if int(resp[1])<<8|int(resp[2]) != len(units) {
+		t.Fatalf("kick length %d does not match payload (%d units)", int(resp[1])<<8|int(resp[2]), len(units))
+	}
+	return string(utf16.Decode(units))
+}
+
+func TestLegacyPingStatic(t *testing.T) {
+	cfg := Config{BackendAddr: "127.0.0.1:1", LegacyPing: legacyPingStatic, LegacyMOTD: "Hello", LegacyMaxPlayers: 20}
+
+	if got, want := legacyPing(t, cfg, []byte{0xFE, 0x01, 0xFA}), "§1\x00127\x001.7+\x00Hello\x000\x0020"; got != want {
+		t.Fatalf("1.4+ ping: got %q, want %q", got, want)
+	}
+	if got, want := legacyPing(t, cfg, []byte{0xFE}), "Hello§0§20"; got != want {
+		t.Fatalf("beta ping: got %q, want %q", got, want)
+	}
+}
+
+func TestLegacyPingCountsAsStatusPing(t *testing.T) {
+	limiter, _ := parseRateLimit("1/1m")
+	cfg := Config{BackendAddr: "127.0.0.1:1", LegacyPing: legacyPingStatic, LegacyMOTD: "Hello", LegacyMaxPlayers: 20, StatusLimiter: limiter}
+
+	legacyPing(t, cfg, []byte{0xFE, 0x01, 0xFA})
+
+	// The second ping is over -status-rate and closed without an answer
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConnection(server, cfg)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go client.Write([]byte{0xFE, 0x01, 0xFA})
+	if resp, _ := io.ReadAll(client); len(resp) != 0 {
+		t.Fatalf("throttled legacy ping was answered: %x", resp)
+	}
+}
+
+func TestLegacyPingFromBackendStatus(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		// Direct pings get a generated PROXY v2 header first
+		if _, err := detectProxyProtocol(br); err != nil {
+			return
+		}
+		if packet, err := readPacket(br, 1024); err != nil || packet[0] != 0x00 {
+			return
+		}
+		if _, err := readPacket(br, 1024); err != nil {
+			return
+		}
+		status := `{"version":{"name":"Paper 1.21","protocol":767},"players":{"max":100,"online":7},` +
+			`"description":{"text":"Dual ","extra":["Proxy",{"text":"!"}]}}`
+		conn.Write(appendVarInt(nil, int32(len(appendString([]byte{0x00}, status))), appendString([]byte{0x00}, status)...))
+	}()
+
+	cfg := Config{BackendAddr: backendLn.Addr().String(), LegacyPing: legacyPingBackend, LegacyMOTD: "unused", LegacyMaxPlayers: 20}
+	if got, want := legacyPing(t, cfg, []byte{0xFE, 0x01, 0xFA}), "§1\x00127\x00Paper 1.21\x00Dual Proxy!\x007\x00100"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestAggregatePlayers(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		detectProxyProtocol(br)
+		readPacket(br, 1024)
+		readPacket(br, 1024)
+		status := `{"version":{"name":"Paper 1.21","protocol":767},"players":{"max":50,"online":1,"sample":[{"name":"Alice","id":"00000000-0000-0000-0000-000000000001"}]},"description":"Hi","favicon":"data:image/png;base64,AAAA"}`
+		conn.Write(appendVarInt(nil, int32(len(appendString([]byte{0x00}, status))), appendString([]byte{0x00}, status)...))
+		// Echo the ping
+		if ping, err := readPacket(br, 1024); err == nil {
+			conn.Write(appendVarInt(nil, int32(len(ping)), ping...))
+		}
+	}()
+
+	// Players on this backend and on another route
+	for i, name := range []string{"Alice", "Bob", "bob"} {
+		tc := &trackedConn{ClientAddr: "127.0.0.1:5000", RealAddr: "10.0.0.1:" + itoa(7000+i), Route: []string{"default", "lobby", "lobby"}[i], Started: time.Now()}
+		tracker.add(tc)
+		defer tracker.remove(tc)
+		tc.setUsername(name)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConnection(server, Config{BackendAddr: backendLn.Addr().String(), AggregatePlayers: true})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	hs := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: stateStatus}
+	go client.Write(append(hs.encode(), 0x01, 0x00, 0x09, 0x01, 1, 2, 3, 4, 5, 6, 7, 8))
+
+	br := bufio.NewReader(client)
+	packet, err := readPacket(br, maxStatusResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _, err := decodeString(packet[1:], maxStatusResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status struct {
+		Players struct {
+			Max    int               `json:"max"`
+			Online int               `json:"online"`
+			Sample []json.RawMessage `json:"sample"`
+		} `json:"players"`
+		Favicon string `json:"favicon"`
+	}
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatal(err)
+	}
+	// Bob is counted once even with two connections
+	if status.Players.Online != 2 || status.Players.Max != 50 || len(status.Players.Sample) != 1 || status.Favicon == "" {
+		t.Fatalf("status = %s", body)
+	}
+	if pong, err := readPacket(br, 1024); err != nil || !bytes.Equal(pong, []byte{0x01, 1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatalf("pong = %x, %v", pong, err)
+	}
+
+	if _, err := setOnlinePlayers("not json", 3); err == nil {
+		t.Error("setOnlinePlayers accepted invalid JSON")
+	}
+}
+
+func TestCheckBackend(t *testing.T) {
+	// A backend without PROXY protocol enabled drops pings that carry a header
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			br := bufio.NewReader(conn)
+			if header, err := detectProxyProtocol(br); err != nil || header != nil {
+				conn.Close()
+				continue
+			}
+			readPacket(br, 1024)
+			readPacket(br, 1024)
+			status := `{"version":{"name":"Paper 1.21","protocol":767},"players":{"max":20,"online":1},"description":"Hi","favicon":"data:image/png;base64,AAAA"}`
+			conn.Write(appendVarInt(nil, int32(len(appendString([]byte{0x00}, status))), appendString([]byte{0x00}, status)...))
+			conn.Close()
+		}
+	}()
+
+	check := checkBackend(backendLn.Addr().String(), "v2", "", 2*time.Second)
+	if check.Probe.Err == nil || check.Fallback == nil || check.Fallback.Err != nil || check.Fallback.ProxyHeader != "none" {
+		t.Fatalf("unexpected check %+v (fallback %+v)", check, check.Fallback)
+	}
+	var out bytes.Buffer
+	check.report(&out)
+	for _, want := range []string{"PROXY protocol is not enabled", "Version: Paper 1.21 (protocol 767)", "Players: 1/20", `"favicon": "(26 bytes)"`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report missing %q:\n%s", want, out.String())
+		}
+	}
+
+	check = checkBackend(backendLn.Addr().String(), "none", "", 2*time.Second)
+	if check.Probe.Err != nil || check.Fallback != nil {
+		t.Fatalf("unexpected check %+v", check)
+	}
+
+	// Nothing listening: no retry
+	backendLn.Close()
+	check = checkBackend(backendLn.Addr().String(), "v2", "", 2*time.Second)
+	out.Reset()
+	check.report(&out)
+	if check.Fallback != nil || !strings.Contains(out.String(), "Can't connect") {
+		t.Fatalf("unexpected report for a closed port:\n%s", out.String())
+	}
+}
+
+func TestPingGateRefusesLoginWithoutStatusPing(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	accepted := make(chan struct{}, 4)
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	cfg := Config{BackendAddr: backendLn.Addr().String(), PingGate: newPingGate(time.Minute)}
+	handshake := func(nextState int32) []byte {
+		hs := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: nextState}
+		return hs.encode()
+	}
+
+	// A login straight away gets a disconnect and never reaches the backend
+	client, server := net.Pipe()
+	go handleConnection(server, cfg)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go client.Write(handshake(stateLogin))
+	packet, err := readPacket(bufio.NewReader(client), 1024)
+	client.Close()
+	if err != nil {
+		t.Fatalf("reading disconnect: %v", err)
+	}
+	reason, _, err := decodeString(packet[1:], 1024)
+	if packet[0] != 0x00 || err != nil || !strings.Contains(reason, "server list") {
+		t.Fatalf("unexpected disconnect packet %q (err=%v)", packet, err)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("unverified login reached the backend")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Transfer intent doesn't get around the gate
+	client, server = net.Pipe()
+	go handleConnection(server, cfg)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go client.Write(handshake(stateTransfer))
+	if _, err := readPacket(bufio.NewReader(client), 1024); err != nil {
+		t.Fatalf("expected a disconnect for an unverified transfer: %v", err)
+	}
+	client.Close()
+	select {
+	case <-accepted:
+		t.Fatal("unverified transfer reached the backend")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Nor does a handshake padded past the peek buffer, which the proxy
+	// can't tell from a login
+	padded := &Handshake{ProtocolVersion: 767, ServerAddress: strings.Repeat("a", 2*peekBufferSize), ServerPort: 25565, NextState: stateLogin}
+	client, server = net.Pipe()
+	go handleConnection(server, cfg)
+	go client.Write(padded.encode())
+	select {
+	case <-accepted:
+		t.Fatal("oversized handshake got around the ping gate")
+	case <-time.After(300 * time.Millisecond):
+	}
+	client.Close()
+
+	// After a status ping from the same IP, logins are forwarded
+	for _, nextState := range []int32{stateStatus, stateLogin} {
+		client, server := net.Pipe()
+		go handleConnection(server, cfg)
+		client.Write(handshake(nextState))
+		select {
+		case <-accepted:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("next state %d: connection was not forwarded", nextState)
+		}
+		client.Close()
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	limiter, err := parseRateLimit("3/50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("1.2.3.4") {
+			t.Fatalf("attempt %d refused", i+1)
+		}
+	}
+	if limiter.allow("1.2.3.4") {
+		t.Fatal("4th attempt within the window was allowed")
+	}
+	if !limiter.allow("5.6.7.8") {
+		t.Fatal("other IP was throttled")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !limiter.allow("1.2.3.4") {
+		t.Fatal("attempt after the window was refused")
+	}
+
+	for _, bad := range []string{"3", "0/10s", "x/10s", "3/abc", "3/-1s"} {
+		if _, err := parseRateLimit(bad); err == nil {
+			t.Errorf("parseRateLimit(%q): expected error", bad)
+		}
+	}
+}
+
+func TestLoginRateLimitCoversTransfers(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	accepted := make(chan struct{}, 4)
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	limiter, _ := parseRateLimit("1/1m")
+	cfg := Config{BackendAddr: backendLn.Addr().String(), LoginLimiter: limiter}
+	hs := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: stateTransfer}
+
+	// The first transfer is forwarded, the second one counts as a login
+	// attempt too and is throttled
+	for i, wantForwarded := range []bool{true, false} {
+		client, server := net.Pipe()
+		go handleConnection(server, cfg)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		go client.Write(hs.encode())
+		if !wantForwarded {
+			go io.Copy(io.Discard, client)
+		}
+		select {
+		case <-accepted:
+			if !wantForwarded {
+				t.Fatalf("transfer %d: throttled transfer reached the backend", i+1)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if wantForwarded {
+				t.Fatalf("transfer %d: connection was not forwarded", i+1)
+			}
+		}
+		client.Close()
+	}
+
+	// A handshake padded past the peek buffer can't skip the limit
+	cfg.LoginLimiter, _ = parseRateLimit("1/1m")
+	hs.ServerAddress = strings.Repeat("a", 2*peekBufferSize)
+	client, server := net.Pipe()
+	go handleConnection(server, cfg)
+	go client.Write(hs.encode())
+	select {
+	case <-accepted:
+		t.Fatal("an oversized handshake got around -login-rate")
+	case <-time.After(300 * time.Millisecond):
+	}
+	client.Close()
+}
+
+func TestStatusRateLimit(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	accepted := make(chan struct{}, 8)
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+	cfg := Config{BackendAddr: backendLn.Addr().String(), StatusLimiter: newRateLimiter(2, time.Minute), LoginLimiter: newRateLimiter(1, time.Minute)}
+	connect := func(state int32) net.Conn {
+		client, server := net.Pipe()
+		go handleConnection(server, cfg)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		hs := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: state}
+		go client.Write(hs.encode())
+		return client
+	}
+	reachesBackend := func(state int32) bool {
+		client := connect(state)
+		defer client.Close()
+		select {
+		case <-accepted:
+			return true
+		case <-time.After(500 * time.Millisecond):
+			return false
+		}
+	}
+
+	if !reachesBackend(stateStatus) || !reachesBackend(stateStatus) {
+		t.Fatal("pings within -status-rate didn't reach the backend")
+	}
+	if reachesBackend(stateStatus) {
+		t.Fatal("a ping beyond -status-rate reached the backend")
+	}
+	// The pings didn't use up the login budget
+	if !reachesBackend(stateLogin) {
+		t.Fatal("a login was throttled by the status limit")
+	}
+	client := connect(stateLogin)
+	packet, err := readPacket(bufio.NewReader(client), 1024)
+	client.Close()
+	if err != nil {
+		t.Fatalf("reading disconnect: %v", err)
+	}
+	if reason, _, _ := decodeString(packet[1:], 1024); !strings.Contains(reason, "Too many login attempts") {
+		t.Fatalf("unexpected disconnect %q", reason)
+	}
+}
+
+func TestPlayerQueue(t *testing.T) {
+	q := newPlayerQueue(1, true)
+	releaseA, _ := q.acquire("1.1.1.1", time.Second)
+	if releaseA == nil {
+		t.Fatal("first player did not get a slot")
+	}
+
+	// While full, players are held and then told their position
+	if release, pos := q.acquire("2.2.2.2", 20*time.Millisecond); release != nil || pos != 1 {
+		t.Fatalf("second player: release=%v pos=%d, expected to be #1 in queue", release != nil, pos)
+	}
+	if release, pos := q.acquire("3.3.3.3", 20*time.Millisecond); release != nil || pos != 2 {
+		t.Fatalf("third player: release=%v pos=%d, expected to be #2 in queue", release != nil, pos)
+	}
+
+	// A reconnecting player keeps their place and is admitted when a slot frees up
+	admitted := make(chan func(), 1)
+	go func() {
+		release, _ := q.acquire("2.2.2.2", 3*time.Second)
+		admitted <- release
+	}()
+	time.Sleep(20 * time.Millisecond)
+	releaseA()
+	select {
+	case release := <-admitted:
+		if release == nil {
+			t.Fatal("queued player was not admitted after a slot freed up")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for queued player")
+	}
+	if stats := q.stats(); stats.Active != 1 || stats.Waiting != 1 {
+		t.Fatalf("stats = %+v, expected 1 active and 1 waiting", stats)
+	}
+
+	// Without queueing, logins beyond the cap are rejected immediately
+	full := newPlayerQueue(1, false)
+	full.acquire("1.1.1.1", time.Second)
+	if release, pos := full.acquire("2.2.2.2", time.Second); release != nil || pos != 0 {
+		t.Fatalf("release=%v pos=%d, expected an immediate rejection", release != nil, pos)
+	}
+}
+
+func TestStartupHoldAnswersWhileBackendIsDown(t *testing.T) {
+	// Grab a free port with nothing listening on it
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendAddr := ln.Addr().String()
+	ln.Close()
+
+	cfg := Config{BackendAddr: backendAddr, Startup: newStartupHold(30 * time.Second)}
+	handshake := func(nextState int32) []byte {
+		hs := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: nextState}
+		return hs.encode()
+	}
+
+	// Status ping: the refused dial starts holding and the client gets a startup status
+	client, server := net.Pipe()
+	go handleConnection(server, cfg)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go client.Write(append(handshake(stateStatus), 0x01, 0x00))
+	cr := bufio.NewReader(client)
+	packet, err := readPacket(cr, maxStatusResponse)
+	if err != nil {
+		t.Fatalf("reading status: %v", err)
+	}
+	body, _, err := decodeString(packet[1:], maxStatusResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status ServerStatus
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatal(err)
+	}
+	if motd := status.MOTD(); !strings.HasPrefix(motd, "Starting up") {
+		t.Fatalf("MOTD = %q, expected a startup message", motd)
+	}
+	ping := []byte{0x09, 0x01, 1, 2, 3, 4, 5, 6, 7, 8}
+	go client.Write(ping)
+	pong := make([]byte, len(ping))
+	if _, err := io.ReadFull(cr, pong); err != nil || !bytes.Equal(pong, ping) {
+		t.Fatalf("pong = %x (err=%v), expected %x", pong, err, ping)
+	}
+	client.Close()
+
+	if _, ok := cfg.Startup.message(); !ok {
+		t.Fatal("expected the proxy to be holding after a refused dial")
+	}
+
+	// Logins while holding get the countdown as a disconnect message
+	client, server = net.Pipe()
+	defer client.Close()
+	go handleConnection(server, cfg)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go client.Write(handshake(stateLogin))
+	packet, err = readPacket(bufio.NewReader(client), 1024)
+	if err != nil {
+		t.Fatalf("reading disconnect: %v", err)
+	}
+	if reason, _, _ := decodeString(packet[1:], 1024); !strings.Contains(reason, "Starting up… (") {
+		t.Fatalf("disconnect reason = %q, expected a countdown", reason)
+	}
+}
+
+func TestBackendSupervisorIdleStop(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	dir := t.TempDir()
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	s := newBackendSupervisor("touch "+filepath.Join(dir, "started"), "touch "+filepath.Join(dir, "stopped"), 100*time.Millisecond, "127.0.0.1:1", nil)
+
+	s.ensureStarted()
+	left := s.playerJoined()
+	time.Sleep(250 * time.Millisecond)
+	if !exists("started") {
+		t.Fatal("start command did not run")
+	}
+	if exists("stopped") {
+		t.Fatal("backend was stopped while a player was online")
+	}
+
+	left()
+	deadline := time.Now().Add(3 * time.Second)
+	for !exists("stopped") {
+		if time.Now().After(deadline) {
+			t.Fatal("backend was not stopped after the idle timeout")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWakeOnLANSendsMagicPacket(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	wol, err := newWakeOnLAN("aa:bb:cc:dd:ee:ff", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wol.wake()
+
+	pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 256)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	if n != 102 || !bytes.Equal(buf[:6], bytes.Repeat([]byte{0xFF}, 6)) || !bytes.Equal(buf[96:102], mac) {
+		t.Fatalf("unexpected magic packet %x", buf[:n])
+	}
+
+	if _, err := newWakeOnLAN("not-a-mac", "255.255.255.255:9"); err == nil {
+		t.Error("expected an error for an invalid MAC")
+	}
+}
+
+func TestMinehutWake(t *testing.T) {
+	// The backend's port is free until Minehut is asked to start the server
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendAddr := probe.Addr().String()
+	probe.Close()
+
+	var starts atomic.Int32
+	var backend net.Listener
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/server/abc123/start_service" {
+			http.Error(w, "unexpected "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "secret" || r.Header.Get("x-session-id") != "sess" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if starts.Add(1) == 1 {
+			backend, _ = net.Listen("tcp", backendAddr)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer api.Close()
+
+	m, err := newMinehutWaker(api.URL+"/", "abc123", "secret", "sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := wakeAndDial(m, func() (net.Conn, error) { return net.DialTimeout("tcp", backendAddr, time.Second) })
+	if err != nil {
+		t.Fatalf("backend still unreachable after waking: %v", err)
+	}
+	conn.Close()
+	defer backend.Close()
+
+	// Players joining meanwhile don't repeat the start request
+	m.wake()
+	if n := starts.Load(); n != 1 {
+		t.Errorf("Minehut was asked to start the server %d times, want 1", n)
+	}
+	if m.holdText() != startingText {
+		t.Errorf("hold text %q, want %q", m.holdText(), startingText)
+	}
+
+	// A rejected token is reported, not retried in a loop
+	bad, _ := newMinehutWaker(api.URL, "abc123", "wrong", "")
+	if err := bad.start(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected a 401 error for a bad token, got %v", err)
+	}
+	if _, err := newMinehutWaker(minehutAPI, "abc123", "", ""); err == nil {
+		t.Error("expected an error without a token")
+	}
+}
+
+func TestBackendSupervisorRestartsCrashedBackend(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	runs := filepath.Join(t.TempDir(), "runs")
+	s := newBackendSupervisor("echo run >> "+runs+"; exit 1", "", 0, "127.0.0.1:1", nil)
+	s.ensureStarted()
+	defer s.shutdown()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(runs)
+		if strings.Count(string(data), "run") >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backend was not restarted after crashing (runs: %q)", data)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	for crashes, want := range map[int]time.Duration{0: time.Second, 1: 2 * time.Second, 5: 32 * time.Second, 6: backendMaxBackoff, 36: backendMaxBackoff, 57: backendMaxBackoff, 1000: backendMaxBackoff} {
+		if got := restartDelay(crashes); got != want {
+			t.Errorf("restartDelay(%d) = %s, want %s", crashes, got, want)
+		}
+	}
+}
+
+// --- Multiauth Tests ---
+
+func TestMultiauthFirstServerSucceeds(t *testing.T) {
+	// Simulate Mojang returning 200 (direct player)
+	mojang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("username") != "TestPlayer" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":   "abcdef1234567890abcdef1234567890",
+			"name": "TestPlayer",
+		})
+	}))
+	defer mojang.Close()
+
+	// Simulate Minehut returning 204 (not their player)
+	minehut := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond) // Slight delay
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer minehut.Close()
+
+	servers := []string{mojang.URL, minehut.URL}
+
+	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=TestPlayer&serverId=abc123", nil)
+	rec := httptest.NewRecorder()
+
+	handleHasJoined(rec, req, Config{SessionServers: servers})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if body["name"] != "TestPlayer" {
+		t.Fatalf("expected name TestPlayer, got %v", body["name"])
+	}
+}
+
+func TestMultiauthSecondServerSucceeds(t *testing.T) {
+	// Simulate Mojang returning 204 (Minehut player, hash won't match Mojang)
+	mojang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer mojang.Close()
+
+	// Simulate Minehut returning 200
+	minehut := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":   "1234567890abcdef1234567890abcdef",
+			"name": "MinehutPlayer",
+		})
+	}))
+	defer minehut.Close()
+
+	servers := []string{mojang.URL, minehut.URL}
+
+	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=MinehutPlayer&serverId=def456", nil)
+	rec := httptest.NewRecorder()
+
+	handleHasJoined(rec, req, Config{SessionServers: servers})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	var body map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if body["name"] != "MinehutPlayer" {
+		t.Fatalf("expected name MinehutPlayer, got %v", body["name"])
+	}
+}
+
+func TestMultiauthBothFail(t *testing.T) {
+	// Both servers return 204
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server1.Close()
+
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server2.Close()
+
+	servers := []string{server1.URL, server2.URL}
+
+	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=FakePlayer&serverId=xyz", nil)
+	rec := httptest.NewRecorder()
+
+	handleHasJoined(rec, req, Config{SessionServers: servers})
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 when both fail, got %d", rec.Code)
+	}
+}
+
+func TestMultiauthPreferredWithinWindow(t *testing.T) {
+	// Fast non-preferred upstream answers 200 immediately
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "fast", "name": "Player"})
+	}))
+	defer fast.Close()
+
+	// Preferred upstream answers 200 a little later, but within the window
+	preferred := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "preferred", "name": "Player"})
+	}))
+	defer preferred.Close()
+
+	cfg := Config{
+		SessionServers: []string{fast.URL, preferred.URL},
+		PreferUpstream: preferred.URL,
+		PreferWindow:   500 * time.Millisecond,
+	}
+
+	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=Player&serverId=abc", nil)
+	rec := httptest.NewRecorder()
+	handleHasJoined(rec, req, cfg)
+
+	var body map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if body["id"] != "preferred" {
+		t.Fatalf("expected preferred profile, got %v", body["id"])
+	}
+}
+
+func TestMultiauthPreferredWindowElapses(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "fast", "name": "Player"})
+	}))
+	defer fast.Close()
+
+	// Preferred upstream is too slow for the window
+	preferred := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "preferred", "name": "Player"})
+	}))
+	defer preferred.Close()
+
+	cfg := Config{
+		SessionServers: []string{fast.URL, preferred.URL},
+		PreferUpstream: preferred.URL,
+		PreferWindow:   50 * time.Millisecond,
+	}
+
+	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=Player&serverId=abc", nil)
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	handleHasJoined(rec, req, cfg)
+
+	var body map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if body["id"] != "fast" {
+		t.Fatalf("expected fast profile after window elapsed, got %v", body["id"])
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("held response for too long: %s", elapsed)
+	}
+}
+
+// newProfileServer returns a session server that always authenticates with the given id.
+func newProfileServer(id string, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "name": "Player"})
+	}))
+}
+
+func TestTestAuth(t *testing.T) {
+	// The fast 204 answers first; the slow success still shows up
+	none := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer none.Close()
+	slow := newProfileServer("test-auth-uuid", 50*time.Millisecond)
+	defer slow.Close()
+
+	status, body, traces := testAuth(Config{SessionServers: []string{none.URL, slow.URL}}, "Player", "abc", "")
+	if status != http.StatusOK || !strings.Contains(string(body), "test-auth-uuid") {
+		t.Fatalf("unexpected result %d %s", status, body)
+	}
+	if len(traces) != 2 || traces[0].Server != none.URL || traces[0].Status != http.StatusNoContent ||
+		traces[1].Server != slow.URL || traces[1].Status != http.StatusOK || traces[1].Latency < 50*time.Millisecond {
+		t.Fatalf("unexpected traces %+v", traces)
+	}
+
+	var out bytes.Buffer
+	printTestAuth(&out, status, body, traces)
+	if !regexp.MustCompile(regexp.QuoteMeta(none.URL) + ` +204 `).MatchString(out.String()) {
+		t.Errorf("output misses the 204 row:\n%s", out.String())
+	}
+	for _, want := range []string{"UPSTREAM", "Result: 200 OK", `"id": "test-auth-uuid"`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestUpstreamClientReusesConnections(t *testing.T) {
+	var opened atomic.Int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode(map[string]string{"id": "reuse", "name": "Player"})
+	}))
+	upstream.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			opened.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	transport := defaultUpstreamTransport
+	transport.MaxIdleConnsPerHost = 8
+	cfg := Config{SessionServers: []string{upstream.URL}, UpstreamClient: newUpstreamClient(transport)}
+	burst := func() {
+		var wg sync.WaitGroup
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest("GET", fmt.Sprintf("/session/minecraft/hasJoined?username=Burst%d&serverId=abc", i), nil)
+				handleHasJoined(httptest.NewRecorder(), req, cfg)
+			}()
+		}
+		wg.Wait()
+		// Let the last responses go back to the pool
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	burst()
+	first := opened.Load()
+	burst()
+	if reopened := opened.Load() - first; reopened != 0 {
+		t.Fatalf("second burst opened %d new connections, expected the %d idle ones to be reused", reopened, first)
+	}
+}
+
+func TestMultiauthDialects(t *testing.T) {
+	var gotQuery url.Values
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/yggdrasil/sessionserver/session/minecraft/hasJoined", func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query()
+		fmt.Fprint(w, `{"id":"0123ABCD-89ab-cdef-0123-456789ABCDEF","name":"Skinned","extra":true}`)
+	})
+	mux.HandleFunc("/broken/session/minecraft/hasJoined", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name":"NoID"}`)
+	})
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	// Guessed from the URL: the query is canonicalized without ip, the
+	// profile rewritten into Mojang's shape
+	cfg := Config{SessionServers: []string{upstream.URL + "/api/yggdrasil/sessionserver"}}
+	rec := httptest.NewRecorder()
+	handleHasJoined(rec, httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=Skinned&serverid=abc&ip=1.2.3.4", nil), cfg)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if gotQuery.Get("serverId") != "abc" || gotQuery.Has("serverid") || gotQuery.Has("ip") {
+		t.Fatalf("unexpected upstream query %v", gotQuery)
+	}
+	var profile map[string]any
+	json.Unmarshal(rec.Body.Bytes(), &profile)
+	if profile["id"] != "0123abcd89abcdef0123456789abcdef" || profile["name"] != "Skinned" || profile["extra"] != nil {
+		t.Fatalf("unexpected normalized profile %s", rec.Body.String())
+	}
+	if props, ok := profile["properties"].([]any); !ok || len(props) != 0 {
+		t.Fatalf("expected an empty properties array, got %s", rec.Body.String())
+	}
+
+	// Configured by name: a profile without an id is a failed login
+	dialects, err := parseDialects([]string{upstream.URL + "/broken=elyby"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = Config{SessionServers: []string{upstream.URL + "/broken"}, Dialects: dialects}
+	rec = httptest.NewRecorder()
+	handleHasJoined(rec, httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=NoID&serverId=abc", nil), cfg)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 for an unusable profile, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for _, bad := range []string{"minehut", "minehut=yggdrasil", "=elyby"} {
+		if _, err := parseDialects([]string{bad}); err == nil {
+			t.Errorf("expected -upstream-dialect %q to be refused", bad)
+		}
+	}
+}
+
+func TestMultiauthReplayGuard(t *testing.T) {
+	var queries atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		fmt.Fprint(w, `{"id":"0123abcd89abcdef0123456789abcdef","name":"Steve","properties":[]}`)
+	}))
+	defer upstream.Close()
+
+	cfg := Config{SessionServers: []string{upstream.URL}, ReplayGuard: newReplayGuard(100 * time.Millisecond)}
+	hasJoined := func(serverID string) int {
+		rec := httptest.NewRecorder()
+		handleHasJoined(rec, httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=Steve&serverId="+serverID, nil), cfg)
+		return rec.Code
+	}
+
+	// A backend retrying right away is fine
+	if code := hasJoined("-5f3a"); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := hasJoined("-5f3a"); code != http.StatusOK {
+		t.Fatalf("expected a retry within the window to succeed, got %d", code)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	before := queries.Load()
+	if code := hasJoined("-5f3a"); code != http.StatusNoContent {
+		t.Fatalf("expected a replay to get 204, got %d", code)
+	}
+	if queries.Load() != before {
+		t.Fatal("expected a replay not to reach the upstreams")
+	}
+	if code := hasJoined("7c1e"); code != http.StatusOK {
+		t.Fatalf("expected a fresh serverId to succeed, got %d", code)
+	}
+}
+
+func TestMultiauthOfflineFallback(t *testing.T) {
+	status := http.StatusNoContent
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer upstream.Close()
+
+	fallback, err := parseOfflineFallback("cracked.example.com, *.cracked.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{SessionServers: []string{upstream.URL, upstream.URL}, OfflineFallback: fallback}
+	hasJoined := func(name string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleHasJoined(rec, httptest.NewRequest("GET", "/session/minecraft/hasJoined?username="+name+"&serverId=x", nil), cfg)
+		return rec
+	}
+
+	// The hostname comes from the player's connection
+	if rec := hasJoined("CrackedNotch"); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected a player without a known connection to be refused, got %d", rec.Code)
+	}
+	conn := &trackedConn{ClientAddr: "1.2.3.4:5", RealAddr: "1.2.3.4:5", Host: "play.cracked.example.net", Started: time.Now()}
+	conn.setUsername("Notch")
+	tracker.add(conn)
+	defer tracker.remove(conn)
+
+	rec := hasJoined("Notch")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected an offline login, got %d", rec.Code)
+	}
+	var profile struct {
+		ID         string            `json:"id"`
+		Name       string            `json:"name"`
+		Properties []profileProperty `json:"properties"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &profile)
+	// What an offline-mode server would give Notch
+	if profile.ID != "b50ad385829d3141a2167e7d7539ba7f" || profile.Name != "Notch" {
+		t.Fatalf("unexpected offline profile %s", rec.Body.String())
+	}
+	if len(profile.Properties) != 1 || profile.Properties[0].Name != offlineMarkerProperty {
+		t.Fatalf("expected the offline marker property, got %s", rec.Body.String())
+	}
+
+	// An upstream outage is not a "no"
+	status = http.StatusServiceUnavailable
+	if rec := hasJoined("Notch"); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected no fallback while an upstream fails, got %d", rec.Code)
+	}
+
+	if _, err := parseOfflineFallback(" , "); err == nil {
+		t.Error("expected an empty host list to be refused")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	binary := []byte("new mc-dual-proxy binary")
+	sum := sha256.Sum256(binary)
+	sums := fmt.Sprintf("%x  mc-dual-proxy_linux_amd64\n%064x  mc-dual-proxy_windows_amd64.exe\n", sum, 0)
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(sums)))
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/owner/proxy/releases/latest":
+			fmt.Fprintf(w, `{"tag_name":"v1.10.0","assets":[
+				{"name":"mc-dual-proxy_linux_amd64","browser_download_url":%q},
+				{"name":"mc-dual-proxy_windows_amd64.exe","browser_download_url":%q},
+				{"name":"SHA256SUMS","browser_download_url":%q},
+				{"name":"SHA256SUMS.sig","browser_download_url":%q}]}`,
+				srv.URL+"/bin", srv.URL+"/bin", srv.URL+"/sums", srv.URL+"/sig")
+		case "/bin":
+			w.Write(binary)
+		case "/sums":
+			io.WriteString(w, sums)
+		case "/sig":
+			io.WriteString(w, sig)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u := &updater{api: srv.URL, repo: "owner/proxy", goos: "linux", goarch: "amd64", publicKey: pub, client: srv.Client()}
+	rel, err := u.latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Tag != "v1.10.0" {
+		t.Errorf("tag = %q", rel.Tag)
+	}
+	data, err := u.download(rel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, binary) {
+		t.Errorf("downloaded %q", data)
+	}
+
+	// The windows entry's checksum doesn't match the served binary
+	u.goos = "windows"
+	if _, err := u.download(rel); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("mismatched checksum: err = %v", err)
+	}
+	u.goos = "darwin"
+	if _, err := u.download(rel); err == nil {
+		t.Error("missing platform binary: no error")
+	}
+	u.goos = "linux"
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	u.publicKey = otherPub
+	if _, err := u.download(rel); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("wrong key: err = %v", err)
+	}
+
+	exe := filepath.Join(t.TempDir(), "mc-dual-proxy")
+	if err := os.WriteFile(exe, []byte("old"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceExecutable(exe, binary); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(exe); !bytes.Equal(got, binary) {
+		t.Errorf("replaced binary = %q", got)
+	}
+	if info, _ := os.Stat(exe); runtime.GOOS != "windows" && info.Mode().Perm() != 0o750 {
+		t.Errorf("mode = %v, want the old one kept", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(exe)); len(entries) != 1 {
+		t.Errorf("left %d files behind, want only the binary", len(entries))
+	}
+
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.3", "v1.2.3", 0},
+		{"v1.9.0", "v1.10.0", -1},
+		{"1.2", "v1.2.1", -1},
+		{"v2.0.0", "v1.99.99", 1},
+	} {
+		if got := compareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestSetupFiles(t *testing.T) {
+	cfg := Config{
+		BackendAddr:     "127.0.0.1:25566",
+		AuthListenAddrs: []string{"unix:/run/auth.sock", "127.0.0.1:8652"},
+		Routes:          []routeConfig{{Name: "creative", BackendAddr: "127.0.0.1:25567"}},
+		DrainTimeout:    time.Minute,
+	}
+	opts := setupOptions{Dir: t.TempDir(), Binary: "/usr/local/bin/mc-dual-proxy", Args: []string{"-backend=127.0.0.1:25566", "-motd=50% off $today"}}
+	paths, err := writeSetupFiles(cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(opts.Dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	if _, err := os.Stat(filepath.Join(opts.Dir, "Caddyfile")); err == nil || len(paths) != 9 {
+		t.Fatalf("unexpected files without -auth-domain: %v", paths)
+	}
+	if got := read("velocity.jvmflags"); got != "-Dmojang.sessionserver=http://127.0.0.1:8652/session/minecraft/hasJoined\n" {
+		t.Errorf("unexpected Velocity flags %q", got)
+	}
+	if got := read("paper-creative.jvmflags"); !strings.Contains(got, "-Dminecraft.api.session.host=http://127.0.0.1:8652/route/creative\n") {
+		t.Errorf("unexpected route flags %q", got)
+	}
+	if got := read("velocity.patch.toml"); !strings.Contains(got, `bind = "127.0.0.1:25566"`) || !strings.Contains(got, "haproxy-protocol = true") {
+		t.Errorf("unexpected Velocity patch %q", got)
+	}
+	unit := read("mc-dual-proxy.service")
+	for _, want := range []string{`ExecStart=/usr/local/bin/mc-dual-proxy -backend=127.0.0.1:25566 "-motd=50%% off $$today"`, "TimeoutStopSec=70"} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q:\n%s", want, unit)
+		}
+	}
+
+	opts.AuthDomain = "auth.example.com"
+	files, err := setupFiles(cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		switch f.Name {
+		case "Caddyfile":
+			if f.Content != "auth.example.com {\n\treverse_proxy 127.0.0.1:8652\n}\n" {
+				t.Errorf("unexpected Caddyfile %q", f.Content)
+			}
+		case "velocity.jvmflags":
+			if !strings.Contains(f.Content, "=https://auth.example.com/session/") {
+				t.Errorf("flags don't use the domain: %q", f.Content)
+			}
+		}
+	}
+
+	// Backends can't reach a Unix socket; Caddy can
+	cfg.AuthListenAddrs = []string{"unix:/run/auth.sock"}
+	files, err = setupFiles(cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Name == "Caddyfile" && !strings.Contains(f.Content, "reverse_proxy unix//run/auth.sock") {
+			t.Errorf("Caddyfile doesn't proxy to the socket: %q", f.Content)
+		}
+	}
+	opts.AuthDomain = ""
+	if _, err := setupFiles(cfg, opts); err == nil {
+		t.Error("expected setup files with only a Unix socket and no -auth-domain to be refused")
+	}
+}
+
+func TestAuthListenAddrs(t *testing.T) {
+	for _, spec := range []string{"", " , ", "127.0.0.1", "unix:", "127.0.0.1:8652,127.0.0.1:8652"} {
+		if _, err := parseAuthListen(spec); err == nil {
+			t.Errorf("parseAuthListen(%q): expected an error", spec)
+		}
+	}
+	sock := filepath.Join(t.TempDir(), "auth.sock")
+	addrs, err := parseAuthListen("127.0.0.1:0, unix:" + sock)
+	if err != nil || len(addrs) != 2 || addrs[1] != "unix:"+sock {
+		t.Fatalf("parseAuthListen = %v, %v", addrs, err)
+	}
+	if got, tcp := authHTTPAddr([]string{"unix:" + sock, "10.0.0.2:8652"}); got != "10.0.0.2:8652" || !tcp {
+		t.Errorf("authHTTPAddr = %q, %v", got, tcp)
+	}
+	if got, tcp := authHTTPAddr([]string{"unix:" + sock}); got != "unix:"+sock || tcp {
+		t.Errorf("authHTTPAddr with only a socket = %q, %v", got, tcp)
+	}
+
+	// A stale socket from a previous run doesn't block startup
+	for range 2 {
+		ln, err := listenAuth(addrs[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		ln.Close()
+	}
+	ln, err := listenAuth(addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "ok") }))
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+	}}}
+	resp, err := client.Get("http://auth/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	// Other files are left alone
+	file := filepath.Join(t.TempDir(), "auth.sock")
+	os.WriteFile(file, []byte("data"), 0o644)
+	if _, err := listenAuth("unix:" + file); err == nil {
+		t.Error("expected an error for a regular file")
+	}
+}
+
+func TestMultiauthConflictReject(t *testing.T) {
+	first := newProfileServer("first", 0)
+	defer first.Close()
+	second := newProfileServer("second", 20*time.Millisecond)
+	defer second.Close()
+
+	cfg := Config{
+		SessionServers: []string{first.URL, second.URL},
+		ConflictPolicy: conflictReject,
+	}
+
+	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=Player&serverId=abc", nil)
+	rec := httptest.NewRecorder()
+	handleHasJoined(rec, req, cfg)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 on conflict, got %d", rec.Code)
+	}
+}
+
+func TestMultiauthConflictPriority(t *testing.T) {
+	// The higher-priority upstream is slower, but must still win
+	slow := newProfileServer("slow", 50*time.Millisecond)
+	defer slow.Close()
+	fast := newProfileServer("fast", 0)
+	defer fast.Close()
+
+	cfg := Config{
+		SessionServers: []string{slow.URL, fast.URL},
+		ConflictPolicy: conflictPriority,
+	}
+
+	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=Player&serverId=abc", nil)
+	rec := httptest.NewRecorder()
+	handleHasJoined(rec, req, cfg)
+
+	var body map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if body["id"] != "slow" {
+		t.Fatalf("expected priority upstream to win, got %v", body["id"])
+	}
+}
+
+func TestMultiauthLogsSlowUpstream(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(80 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer slow.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=Player&serverId=abc", nil)
+	handleHasJoined(httptest.NewRecorder(), req, Config{SessionServers: []string{slow.URL}, SlowUpstream: 20 * time.Millisecond})
+	if !strings.Contains(logs.String(), "SLOW upstream="+slow.URL) {
+		t.Fatalf("expected a slow upstream warning, got:\n%s", logs.String())
+	}
+
+	logs.Reset()
+	handleHasJoined(httptest.NewRecorder(), req, Config{SessionServers: []string{slow.URL}})
+	if strings.Contains(logs.String(), "SLOW") {
+		t.Fatalf("slow upstream warning with the check disabled:\n%s", logs.String())
+	}
+}
+
+func TestMultiauthAuthRateLimit(t *testing.T) {
+	var queries atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	limiter, _ := parseRateLimit("2/1m")
+	cfg := Config{SessionServers: []string{upstream.URL}, AuthLimiter: limiter}
+	for i, username := range []string{"Bot", "bot", "BOT", "Player"} {
+		rec := httptest.NewRecorder()
+		handleHasJoined(rec, httptest.NewRequest("GET", fmt.Sprintf("/session/minecraft/hasJoined?username=%s&serverId=%d", username, i), nil), cfg)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: expected 204, got %d", username, rec.Code)
+		}
+	}
+	// The third attempt for the same name (case-insensitively) is answered locally
+	if n := queries.Load(); n != 3 {
+		t.Fatalf("expected 3 upstream queries, got %d", n)
+	}
+}
+
+func TestRequesterIP(t *testing.T) {
+	trusted, _ := parseTrustedProxies("127.0.0.1, 10.0.0.0/8")
+	for _, tc := range []struct {
+		name, peer string
+		header     http.Header
+		want       string
+	}{
+		{"direct", "192.0.2.1:4000", http.Header{"X-Forwarded-For": {"203.0.113.9"}}, "192.0.2.1"},
+		{"behind caddy", "127.0.0.1:4000", http.Header{"X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+		{"spoofed hop before caddy", "127.0.0.1:4000", http.Header{"X-Forwarded-For": {"6.6.6.6, 203.0.113.9"}}, "203.0.113.9"},
+		{"chain of trusted proxies", "127.0.0.1:4000", http.Header{"X-Forwarded-For": {"203.0.113.9, 10.1.2.3"}}, "203.0.113.9"},
+		{"forwarded", "127.0.0.1:4000", http.Header{"Forwarded": {`for="[2001:db8::1]:4711";proto=https`}, "X-Forwarded-For": {"6.6.6.6"}}, "2001:db8::1"},
+		{"obfuscated", "127.0.0.1:4000", http.Header{"Forwarded": {"for=_hidden, for=10.0.0.2"}}, "10.0.0.2"},
+		{"no header", "127.0.0.1:4000", nil, "127.0.0.1"},
+		{"unix socket", "@", http.Header{"X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr, r.Header = tc.peer, tc.header
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		if got := requesterIP(r, trusted); got != tc.want {
+			t.Errorf("%s: requesterIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMultiauthRequesterChecks(t *testing.T) {
+	var queries atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	trusted, _ := parseTrustedProxies("127.0.0.1")
+	allow, _ := parseTrustedProxies("192.168.1.0/24")
+	limiter, _ := parseRateLimit("1/1m")
+	cfg := Config{SessionServers: []string{upstream.URL}, AuthTrustedProxies: trusted, AuthAllow: allow, AuthIPLimiter: limiter}
+	request := func(xff string, i int) int {
+		r := httptest.NewRequest("GET", fmt.Sprintf("/session/minecraft/hasJoined?username=Steve&serverId=%d", i), nil)
+		r.RemoteAddr = "127.0.0.1:5000"
+		r.Header.Set("X-Forwarded-For", xff)
+		rec := httptest.NewRecorder()
+		handleHasJoined(rec, r, cfg)
+		return rec.Code
+	}
+	if code := request("203.0.113.9", 0); code != http.StatusForbidden {
+		t.Errorf("requester outside -auth-allow: got %d, want 403", code)
+	}
+	if code := request("192.168.1.20", 1); code != http.StatusNoContent {
+		t.Errorf("allowed requester: got %d, want 204", code)
+	}
+	request("192.168.1.20", 2)
+	request("192.168.1.21", 3)
+	// The second request from .20 is throttled; .21 has a budget of its own
+	if n := queries.Load(); n != 2 {
+		t.Errorf("expected 2 upstream queries, got %d", n)
+	}
+}
+
+func TestAuthAccessLog(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/session/minecraft/hasJoined", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "ok") })
+
+	trusted, _ := parseTrustedProxies("127.0.0.1")
+	path := filepath.Join(t.TempDir(), "access.log")
+	for _, format := range []string{accessLogCommon, accessLogJSON} {
+		l, err := newAccessLog(path, format, trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.now = func() time.Time { return time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC) }
+		h := l.wrap(mux)
+		r := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=Steve&serverId=abc", nil)
+		r.RemoteAddr = "127.0.0.1:5000"
+		r.Header.Set("X-Forwarded-For", "198.51.100.20")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		r = httptest.NewRequest("GET", "/health", nil)
+		r.RemoteAddr = "192.0.2.1:5000"
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		l.f.Close()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got:\n%s", data)
+	}
+	if want := `198.51.100.20 - - [16/Oct/2026:12:00:00 +0000] "GET /session/minecraft/hasJoined?username=Steve&serverId=abc HTTP/1.1" 204 -`; lines[0] != want {
+		t.Errorf("common line\n got %s\nwant %s", lines[0], want)
+	}
+	if want := `192.0.2.1 - - [16/Oct/2026:12:00:00 +0000] "GET /health HTTP/1.1" 200 2`; lines[1] != want {
+		t.Errorf("common line\n got %s\nwant %s", lines[1], want)
+	}
+	var e accessEntry
+	if err := json.Unmarshal([]byte(lines[2]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Remote != "198.51.100.20" || e.Status != 204 || e.Username != "Steve" || e.Method != "GET" {
+		t.Errorf("json entry = %+v", e)
+	}
+
+	if _, err := newAccessLog(path, "apache", nil); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestMultiauthUsernameFilter(t *testing.T) {
+	var queries atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	filter, err := newUsernameFilter([]string{"^admin", "notch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{SessionServers: []string{upstream.URL}, UsernameFilter: filter}
+	for _, tc := range []struct {
+		username string
+		want     string
+	}{
+		{"Player_1", ""},
+		{"Admin_Steve", "blocked_username"},
+		{"RealNotch", "blocked_username"},
+		{"SteveAdmin", ""},
+		{"Bad Name", "invalid_username"},
+		{"ThisNameIsWayTooLong", "invalid_username"},
+		{"", "invalid_username"},
+	} {
+		if got := filter.check(tc.username); got != tc.want {
+			t.Errorf("check(%q) = %q, want %q", tc.username, got, tc.want)
+		}
+	}
+
+	for _, username := range []string{"Admin_Steve", "Player_1"} {
+		rec := httptest.NewRecorder()
+		handleHasJoined(rec, httptest.NewRequest("GET", "/session/minecraft/hasJoined?username="+username+"&serverId=abc", nil), cfg)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: expected 204, got %d", username, rec.Code)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("expected only the valid name to reach the upstream, got %d queries", n)
+	}
+
+	if _, err := newUsernameFilter([]string{"("}); err == nil {
+		t.Fatal("expected an invalid pattern to be rejected")
+	}
+}
+
+func TestParsePreference(t *testing.T) {
+	name, window, err := parsePreference("mojang=150ms")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name != "mojang" || window != 150*time.Millisecond {
+		t.Fatalf("got %s=%s", name, window)
+	}
+
+	for _, bad := range []string{"mojang", "=150ms", "mojang=soon", "mojang=0s"} {
+		if _, _, err := parsePreference(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+// --- Integration Test: TCP proxy + backend ---
+
+func TestTCPProxyDirectConnection(t *testing.T) {
+	// Start a mock "backend" that expects a PROXY protocol v2 header
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+
+	backendGotHeader := make(chan *ProxyHeader, 1)
+	backendGotData := make(chan []byte, 1)
+
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		br := bufio.NewReaderSize(conn, 512)
+		ph, _ := detectProxyProtocol(br)
+		backendGotHeader <- ph
+
+		data, _ := io.ReadAll(br)
+		backendGotData <- data
+
+		conn.Write([]byte("RESPONSE"))
+	}()
+
+	// Start the TCP proxy
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyLn.Close()
+
+	go func() {
+		conn, err := proxyLn.Accept()
+		if err != nil {
+			return
+		}
+		handleConnection(conn, Config{BackendAddr: backendLn.Addr().String()})
+	}()
+
+	// Connect as a "direct player" (no PROXY protocol)
+	clientConn, err := net.DialTimeout("tcp", proxyLn.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer clientConn.Close()
+
+	// Send some Minecraft-like data
+	clientConn.Write([]byte("HELLO_MC"))
+	clientConn.(*net.TCPConn).CloseWrite()
+
+	// Verify backend received a PROXY protocol header
+	select {
+	case ph := <-backendGotHeader:
+		if ph == nil {
+			t.Fatal("backend did not receive PROXY protocol header")
+		}
+		if ph.Version != 2 {
+			t.Fatalf("expected v2 header, got v%d", ph.Version)
+		}
+		t.Logf("Backend received v2 header: src=%s:%d", ph.SrcAddr, ph.SrcPort)
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for backend to receive header")
+	}
+
+	// Verify backend received the MC data
+	select {
+	case data := <-backendGotData:
+		if !bytes.Equal(data, []byte("HELLO_MC")) {
+			t.Fatalf("backend got %q, expected HELLO_MC", data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for backend data")
+	}
+
+	// Verify client can read the response
+	clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp, _ := io.ReadAll(clientConn)
+	if !bytes.Equal(resp, []byte("RESPONSE")) {
+		t.Fatalf("client got %q, expected RESPONSE", resp)
+	}
+}
+
+func TestTCPProxyPeekBufferFitsLargeTLVs(t *testing.T) {
+	header := buildProxyV2Header(&net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 11111}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 25565})
+	tlv := append([]byte{0xE0, 0x02, 0x58}, bytes.Repeat([]byte{'x'}, 600)...) // custom type, 600 bytes
+	header = append(header, tlv...)
+	binary.BigEndian.PutUint16(header[14:], uint16(12+len(tlv)))
+
+	for _, tc := range []struct {
+		name       string
+		peek, copy int
+		wantHeader bool
+	}{
+		{"default buffer", 0, 0, false},
+		{"larger buffer", 2048, minCopyBufferSize, true},
+	} {
+		backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		type received struct {
+			header *ProxyHeader
+			data   string
+		}
+		got := make(chan received, 1)
+		go func() {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			br := bufio.NewReaderSize(conn, 4096)
+			ph, _ := detectProxyProtocol(br)
+			data, _ := io.ReadAll(br)
+			got <- received{ph, string(data)}
+		}()
+
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			handleConnection(server, Config{BackendAddr: backendLn.Addr().String(), PeekBufferSize: tc.peek, CopyBufferSize: tc.copy})
+			close(done)
+		}()
+		go func() {
+			client.Write(header)
+			client.Write([]byte("MC_DATA"))
+			client.Close()
+		}()
+
+		select {
+		case r := <-got:
+			if !tc.wantHeader {
+				t.Fatalf("%s: header larger than the buffer reached the backend", tc.name)
+			}
+			if r.header == nil || len(r.header.RawBytes) != len(header) || r.data != "MC_DATA" {
+				t.Fatalf("%s: backend got header %+v and data %q", tc.name, r.header, r.data)
+			}
+		case <-done:
+			if tc.wantHeader {
+				t.Fatalf("%s: connection closed without reaching the backend", tc.name)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: timed out", tc.name)
+		}
+		backendLn.Close()
+	}
+}
+
+func TestTCPProxyPassthroughProxyProtocol(t *testing.T) {
+	// Start a mock backend
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+
+	backendGotHeader := make(chan *ProxyHeader, 1)
+
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		br := bufio.NewReaderSize(conn, 512)
+		ph, _ := detectProxyProtocol(br)
+		backendGotHeader <- ph
+	}()
+
+	// Start the TCP proxy
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyLn.Close()
+
+	go func() {
+		conn, err := proxyLn.Accept()
+		if err != nil {
+			return
+		}
+		handleConnection(conn, Config{BackendAddr: backendLn.Addr().String()})
+	}()
+
+	// Connect and send a v1 PROXY protocol header (as Minehut would)
+	clientConn, err := net.DialTimeout("tcp", proxyLn.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	// Write a v1 header pretending to be from 1.2.3.4
+	fmt.Fprintf(clientConn, "PROXY TCP4 1.2.3.4 10.0.0.1 11111 25565\r\n")
+	clientConn.Write([]byte("MC_DATA"))
+	clientConn.(*net.TCPConn).CloseWrite()
+
+	// The backend should receive the same v1 header with the original IP
+	select {
+	case ph := <-backendGotHeader:
+		if ph == nil {
+			t.Fatal("backend did not receive PROXY protocol header")
+		}
+		if ph.Version != 1 {
+			t.Fatalf("expected v1 header passthrough, got v%d", ph.Version)
+		}
+		if ph.SrcAddr.String() != "1.2.3.4" {
+			t.Fatalf("expected src addr 1.2.3.4, got %s", ph.SrcAddr)
+		}
+		if ph.SrcPort != 11111 {
+			t.Fatalf("expected src port 11111, got %d", ph.SrcPort)
+		}
+		t.Logf("Backend correctly received passthrough v1 header: src=%s:%d", ph.SrcAddr, ph.SrcPort)
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestIngressProfiles(t *testing.T) {
+	spectrum, err := parseIngressProfile("Spectrum")
+	if err != nil || spectrum == nil || !spectrum.v1 || spectrum.v2 {
+		t.Fatalf("spectrum = %+v, %v", spectrum, err)
+	}
+	if p, err := parseIngressProfile(ingressAuto); p != nil || err != nil {
+		t.Errorf("auto = %+v, %v; want the default detection", p, err)
+	}
+	if _, err := parseIngressProfile("haproxy"); err == nil || !strings.Contains(err.Error(), "tcpshield") {
+		t.Errorf("expected an error listing the profiles, got %v", err)
+	}
+	rt, err := parseRoute("name=edge;listen=:25570;backend=127.0.0.1:25567;ingress=infrared")
+	if err != nil || rt.Ingress == nil || rt.Ingress.name != "infrared" {
+		t.Fatalf("route ingress = %+v, %v", rt.Ingress, err)
+	}
+	if (Config{}).forRoute(rt).Ingress != rt.Ingress {
+		t.Error("route config doesn't use the route's ingress profile")
+	}
+
+	v2 := buildProxyV2Header(&net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 11111}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 25565})
+	for _, tc := range []struct {
+		name    string
+		send    []byte
+		proxied bool
+	}{
+		{"v1 header", []byte("PROXY TCP4 1.2.3.4 10.0.0.1 11111 25565\r\nMC_DATA"), true},
+		{"v2 header", append(v2, "MC_DATA"...), false},
+		{"no header", []byte("MC_DATA"), false},
+		{"health probe", []byte("PROXY UNKNOWN\r\n"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer backendLn.Close()
+			reached := make(chan struct{}, 1)
+			go func() {
+				conn, err := backendLn.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+				reached <- struct{}{}
+			}()
+			proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proxyLn.Close()
+			go func() {
+				conn, err := proxyLn.Accept()
+				if err != nil {
+					return
+				}
+				handleConnection(conn, Config{BackendAddr: backendLn.Addr().String(), Ingress: spectrum})
+			}()
+			client, err := net.DialTimeout("tcp", proxyLn.Addr().String(), 2*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.Write(tc.send)
+			client.(*net.TCPConn).CloseWrite()
+
+			select {
+			case <-reached:
+				if !tc.proxied {
+					t.Fatal("connection reached the backend")
+				}
+			case <-time.After(300 * time.Millisecond):
+				if tc.proxied {
+					t.Fatal("connection didn't reach the backend")
+				}
+			}
+		})
+	}
+}
+
+func TestTCPProxyUntrustedProxyHeader(t *testing.T) {
+	for _, policy := range []string{proxyHeaderRewrite, proxyHeaderReject} {
+		t.Run(policy, func(t *testing.T) {
+			backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer backendLn.Close()
+			backendGotHeader := make(chan *ProxyHeader, 1)
+			go func() {
+				conn, err := backendLn.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				ph, _ := detectProxyProtocol(bufio.NewReaderSize(conn, 512))
+				backendGotHeader <- ph
+			}()
+
+			proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proxyLn.Close()
+			trusted, _ := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+			cfg := Config{BackendAddr: backendLn.Addr().String(), TrustedProxies: trusted, UntrustedProxyHeader: policy}
+			go func() {
+				conn, err := proxyLn.Accept()
+				if err != nil {
+					return
+				}
+				handleConnection(conn, cfg)
+			}()
+
+			// 127.0.0.1 isn't trusted, so its claim to be 1.2.3.4 is a spoof
+			clientConn, err := net.DialTimeout("tcp", proxyLn.Addr().String(), 2*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clientConn.Close()
+			fmt.Fprintf(clientConn, "PROXY TCP4 1.2.3.4 10.0.0.1 11111 25565\r\n")
+			clientConn.Write([]byte("MC_DATA"))
+			clientConn.(*net.TCPConn).CloseWrite()
+
+			if policy == proxyHeaderReject {
+				clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+				if _, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+					t.Fatalf("expected the connection to be closed, got %v", err)
+				}
+				select {
+				case <-backendGotHeader:
+					t.Fatal("rejected connection reached the backend")
+				case <-time.After(100 * time.Millisecond):
+				}
+				return
+			}
+
+			select {
+			case ph := <-backendGotHeader:
+				if ph == nil || ph.SrcAddr.String() != "127.0.0.1" {
+					t.Fatalf("expected a header for the real peer 127.0.0.1, got %+v", ph)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("timeout")
+			}
+		})
+	}
+
+	if !isTrustedProxy([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, "[::ffff:10.1.2.3]:4000") {
+		t.Error("expected an IPv4-mapped address inside a trusted range to be trusted")
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/8,nonsense"); err == nil {
+		t.Error("expected an invalid entry to be rejected")
+	}
+}
+
+func TestRelayPreambleBetweenTiers(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	backendGotHeader := make(chan *ProxyHeader, 2)
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			ph, _ := detectProxyProtocol(bufio.NewReaderSize(conn, 512))
+			backendGotHeader <- ph
+			conn.Close()
+		}
+	}()
+
+	serve := func(cfg Config) net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go handleConnection(conn, cfg)
+			}
+		}()
+		return ln
+	}
+	origin := serve(Config{BackendAddr: backendLn.Addr().String(), RelayVerifier: newRelayVerifier([]byte("s3cret")), UntrustedProxyHeader: proxyHeaderReject})
+	defer origin.Close()
+	edge := serve(Config{BackendAddr: origin.Addr().String(), RelaySecret: []byte("s3cret")})
+	defer edge.Close()
+
+	connect := func(addr string) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "PROXY TCP4 1.2.3.4 10.0.0.1 11111 25565\r\nMC_DATA")
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		io.Copy(io.Discard, conn)
+	}
+
+	// Through the edge, the origin trusts the relayed header
+	connect(edge.Addr().String())
+	select {
+	case ph := <-backendGotHeader:
+		if ph == nil || ph.SrcAddr.String() != "1.2.3.4" {
+			t.Fatalf("expected the relayed header for 1.2.3.4, got %+v", ph)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the relayed connection")
+	}
+
+	// Straight to the origin, the connection is refused
+	connect(origin.Addr().String())
+	select {
+	case ph := <-backendGotHeader:
+		t.Fatalf("unsigned connection reached the backend with %+v", ph)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRelayVerifierRefusesTamperingAndReplays(t *testing.T) {
+	header := []byte("PROXY TCP4 1.2.3.4 10.0.0.1 11111 25565\r\n")
+	preamble := signRelayPreamble([]byte("s3cret"), header)
+	v := newRelayVerifier([]byte("s3cret"))
+
+	if err := newRelayVerifier([]byte("other")).verify(preamble, header); err == nil {
+		t.Error("expected a preamble signed with another secret to be refused")
+	}
+	if err := v.verify(preamble, []byte("PROXY TCP4 6.6.6.6 10.0.0.1 11111 25565\r\n")); err == nil {
+		t.Error("expected a preamble for another header to be refused")
+	}
+	if err := v.verify(preamble, header); err != nil {
+		t.Fatalf("expected a valid preamble to be accepted: %v", err)
+	}
+	if err := v.verify(preamble, header); err == nil {
+		t.Error("expected a replayed preamble to be refused")
+	}
+}
+
+func TestTCPProxyTransparentSendsNoHeader(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+
+	// Probe whether this environment allows IP_TRANSPARENT at all
+	probe, err := dialTransparent(backendLn.Addr().String(), &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Skipf("transparent dialing unavailable here: %v", err)
+	}
+	probe.Close()
+	if c, err := backendLn.Accept(); err == nil {
+		c.Close()
+	}
+
+	backendGot := make(chan []byte, 1)
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		backendGot <- data
+	}()
+
+	client, server := net.Pipe()
+	go handleConnection(server, Config{BackendAddr: backendLn.Addr().String(), Transparent: true})
+	client.Write([]byte("HELLO_MC"))
+	client.Close()
+
+	select {
+	case data := <-backendGot:
+		if !bytes.Equal(data, []byte("HELLO_MC")) {
+			t.Fatalf("backend got %q, expected raw data without a PROXY header", data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for backend data")
+	}
+}
+
+func TestHandshakeTimeoutClosesStalledClients(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	dialed := make(chan struct{}, 2)
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			dialed <- struct{}{}
+			conn.Close()
+		}
+	}()
+
+	cfg := Config{BackendAddr: backendLn.Addr().String(), HandshakeTimeout: 100 * time.Millisecond}
+	for name, partial := range map[string][]byte{
+		"partial PROXY header": []byte("PROXY TCP4 1.2"),
+		"partial handshake":    {0x10, 0x00, 0xFF},
+	} {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			handleConnection(server, cfg)
+			close(done)
+		}()
+		client.Write(partial)
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: connection still open after the handshake timeout", name)
+		}
+		client.Close()
+	}
+	select {
+	case <-dialed:
+		t.Fatal("a stalled client reached the backend")
+	default:
+	}
+}
+
+func TestAcceptLoopConnectionLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg := Config{BackendAddr: "127.0.0.1:1", ConnSlots: newConnSlots(1)}
+	go acceptLoop(ln, cfg)
+
+	// isOpen reports whether the proxy kept conn open rather than closing it
+	isOpen := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1))
+		var netErr net.Error
+		return errors.As(err, &netErr) && netErr.Timeout()
+	}
+
+	// The first connection stalls before its handshake and holds the only slot
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if !isOpen(first) {
+		t.Fatal("first connection was closed")
+	}
+
+	refusedBefore := tracker.refused.Load()
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if isOpen(second) {
+		t.Fatal("connection over the limit was kept open")
+	}
+	if tracker.refused.Load() == refusedBefore {
+		t.Fatal("connection over the limit wasn't counted as refused")
+	}
+
+	// Closing the first connection frees its slot
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for cfg.ConnSlots.inUse() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("slot not released after the connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	third, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if !isOpen(third) {
+		t.Fatal("connection was refused after a slot freed up")
+	}
+}
+
+func TestReputation(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Key") != "secret" {
+			http.Error(w, "bad key", http.StatusUnauthorized)
+			return
+		}
+		score := map[string]int{"203.0.113.9": 100, "198.51.100.1": 10}[r.URL.Query().Get("ipAddress")]
+		fmt.Fprintf(w, `{"data":{"ipAddress":%q,"abuseConfidenceScore":%d}}`, r.URL.Query().Get("ipAddress"), score)
+	}))
+	defer srv.Close()
+	defer func(u string) { abuseIPDBURL = u }(abuseIPDBURL)
+	abuseIPDBURL = srv.URL
+
+	r, err := parseReputation("abuseipdb", "secret", 75, "deny", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]int{"203.0.113.9:4000": 100, "198.51.100.1:4000": 10, "[::ffff:203.0.113.9]:5000": 100} {
+		if score, err := r.score(addr); score != want || err != nil {
+			t.Errorf("score(%s) = %d, %v, want %d", addr, score, err, want)
+		}
+	}
+	if requests.Load() != 2 || r.cacheHits.Load() != 1 {
+		t.Errorf("%d lookups, %d cache hits; want 2 and 1", requests.Load(), r.cacheHits.Load())
+	}
+	if score, _ := r.score("10.0.0.1:4000"); score != 0 || requests.Load() != 2 {
+		t.Error("private address looked up")
+	}
+
+	bad, _ := parseReputation("abuseipdb", "wrong", 75, "flag", time.Hour)
+	if _, err := bad.score("203.0.113.9"); err == nil {
+		t.Error("rejected API key not reported")
+	}
+
+	for _, args := range []struct {
+		source, key, action string
+		threshold           int
+	}{
+		{"abuseipdb", "", "deny", 75},
+		{"dnsbl:", "", "deny", 75},
+		{"spamhaus", "", "deny", 75},
+		{"dnsbl:bl.example.org", "", "kick", 75},
+		{"dnsbl:bl.example.org", "", "deny", 0},
+	} {
+		if _, err := parseReputation(args.source, args.key, args.threshold, args.action, time.Hour); err == nil {
+			t.Errorf("parseReputation(%+v) accepted", args)
+		}
+	}
+}
+
+func TestReputationSharesLookupsInFlight(t *testing.T) {
+	var lookups atomic.Int32
+	release := make(chan struct{})
+	r, err := parseReputation("dnsbl:bl.example.org", "", 75, "deny", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.lookup = func(ctx context.Context, ip netip.Addr) (int, error) {
+		lookups.Add(1)
+		<-release
+		return 90, nil
+	}
+
+	// A burst of logins from a new address makes a single lookup
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if score, err := r.score("203.0.113.9:4000"); score != 90 || err != nil {
+				t.Errorf("score = %d, %v, want 90", score, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("%d lookups for one address, want 1", n)
+	}
+
+	// Expired verdicts are swept on the short interval, not once per TTL
+	r.mu.Lock()
+	r.cache[netip.MustParseAddr("198.51.100.1")] = reputationEntry{expires: time.Now().Add(-time.Second)}
+	r.lastSweep = time.Now().Add(-reputationSweepInterval)
+	r.mu.Unlock()
+	r.score("198.51.100.2:4000")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cache[netip.MustParseAddr("198.51.100.1")]; ok {
+		t.Error("expired verdict was not swept")
+	}
+}
+
+type fakeDNSBL map[string]error
+
+func (f fakeDNSBL) LookupHost(_ context.Context, host string) ([]string, error) {
+	if err, ok := f[host]; ok {
+		return nil, err
+	}
+	return []string{"127.0.0.2"}, nil
+}
+
+func TestDNSBL(t *testing.T) {
+	if got := dnsblName(netip.MustParseAddr("203.0.113.9"), "bl.example.org"); got != "9.113.0.203.bl.example.org" {
+		t.Errorf("IPv4 name = %s", got)
+	}
+	want := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.bl.example.org"
+	if got := dnsblName(netip.MustParseAddr("2001:db8::1"), "bl.example.org"); got != want {
+		t.Errorf("IPv6 name = %s", got)
+	}
+
+	notFound := &net.DNSError{Err: "no such host", IsNotFound: true}
+	resolver := fakeDNSBL{
+		"9.113.0.203.a.example":  notFound,
+		"1.100.51.198.a.example": notFound,
+		"1.100.51.198.b.example": notFound,
+		"2.100.51.198.a.example": &net.DNSError{Err: "server misbehaving"},
+	}
+	zones := []string{"a.example", "b.example"}
+	for ip, want := range map[string]int{"203.0.113.9": 100, "198.51.100.1": 0} {
+		if score, err := dnsblScore(context.Background(), resolver, zones, netip.MustParseAddr(ip)); score != want || err != nil {
+			t.Errorf("dnsblScore(%s) = %d, %v, want %d", ip, score, err, want)
+		}
+	}
+	if _, err := dnsblScore(context.Background(), resolver, zones, netip.MustParseAddr("198.51.100.2")); err == nil {
+		t.Error("DNS failure taken for not listed")
+	}
+}
+
+func TestAddrRanges(t *testing.T) {
+	var prefixes []netip.Prefix
+	for _, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "192.0.2.0/25", "192.0.2.128/25", "203.0.113.7/32", "0.0.0.0/32", "2001:db8::/32", "::/128"} {
+		prefixes = append(prefixes, netip.MustParsePrefix(s))
+	}
+	set := newAddrRanges(prefixes)
+	for addr, want := range map[string]bool{
+		"10.0.0.0":        true,
+		"10.1.2.3":        true,
+		"10.255.255.255":  true,
+		"11.0.0.0":        false,
+		"9.255.255.255":   false,
+		"192.0.2.200":     true,
+		"192.0.3.0":       false,
+		"203.0.113.7":     true,
+		"203.0.113.8":     false,
+		"0.0.0.0":         true,
+		"0.0.0.1":         false,
+		"2001:db8:ffff::": true,
+		"2001:db9::":      false,
+		"::":              true,
+		"::1":             false,
+		"255.255.255.255": false,
+	} {
+		if got := set.contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if len(set.ranges) != 7 {
+		t.Errorf("expected 10.1.0.0/16 to be merged into 10.0.0.0/8, leaving 7 ranges, got %d", len(set.ranges))
+	}
+}
+
+func TestVPNDetector(t *testing.T) {
+	dir := t.TempDir()
+	vpnFile, dcFile := filepath.Join(dir, "vpn.txt"), filepath.Join(dir, "dc.txt")
+	os.WriteFile(vpnFile, []byte("# commercial VPNs\n203.0.113.0/24\n2001:db8::/32 # v6\n\n"), 0o644)
+	os.WriteFile(dcFile, []byte("127.0.0.1\n198.51.100.0/24\n"), 0o644)
+
+	d, err := parseVPNDetector([]string{vpnFile, "datacenter=" + dcFile}, vpnTag, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]string{
+		"203.0.113.9:4000":     "vpn",
+		"[2001:db8::5]:4000":   "vpn",
+		"198.51.100.20:4000":   "datacenter",
+		"[::ffff:127.0.0.1]:1": "datacenter",
+		"192.0.2.1:4000":       "",
+		"pipe":                 "",
+	} {
+		if got := d.detect(addr); got != want {
+			t.Errorf("detect(%s) = %q, want %q", addr, got, want)
+		}
+	}
+
+	// Lists are read again when they change
+	os.WriteFile(vpnFile, []byte("192.0.2.0/24\n"), 0o644)
+	os.Chtimes(vpnFile, time.Now(), time.Now().Add(time.Minute))
+	d.lists[0].checked.Store(0)
+	if d.detect("192.0.2.1") != "vpn" || d.detect("203.0.113.9") != "" {
+		t.Error("changed list not read again")
+	}
+	os.WriteFile(vpnFile, []byte("not an address\n"), 0o644)
+	os.Chtimes(vpnFile, time.Now(), time.Now().Add(2*time.Minute))
+	d.lists[0].checked.Store(0)
+	if d.detect("192.0.2.1") != "vpn" {
+		t.Error("broken list replaced the ranges read last")
+	}
+
+	for _, args := range []struct {
+		specs  []string
+		policy string
+	}{
+		{[]string{dcFile}, "kick"},
+		{[]string{dcFile}, vpnWhitelist},
+		{[]string{filepath.Join(dir, "missing.txt")}, vpnBlock},
+		{[]string{"=" + dcFile}, vpnBlock},
+		{[]string{vpnFile}, vpnBlock},
+	} {
+		if _, err := parseVPNDetector(args.specs, args.policy, nil); err == nil {
+			t.Errorf("parseVPNDetector(%q, %s) accepted", args.specs, args.policy)
+		}
+	}
+
+	// Tagged logins reach the backend with the label in a PROXY v2 TLV
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	headers := make(chan *ProxyHeader, 1)
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header, _ := detectProxyProtocol(bufio.NewReader(conn))
+		headers <- header
+	}()
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyLn.Close()
+	connect := func(cfg Config) net.Conn {
+		client, err := net.Dial("tcp", proxyLn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := proxyLn.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go handleConnection(server, cfg)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		hs := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: stateLogin}
+		client.Write(hs.encode())
+		return client
+	}
+	client := connect(Config{BackendAddr: backendLn.Addr().String(), VPN: d})
+	defer client.Close()
+	select {
+	case header := <-headers:
+		if header == nil || !bytes.Contains(header.RawBytes, []byte{proxyV2TypeNetwork, 0, 10, 'd', 'a', 't', 'a', 'c', 'e', 'n', 't', 'e', 'r'}) {
+			t.Errorf("backend got header %v without the network TLV", header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tagged login not forwarded")
+	}
+
+	// Blocked logins get a disconnect
+	d.policy = vpnBlock
+	client = connect(Config{BackendAddr: backendLn.Addr().String(), VPN: d})
+	defer client.Close()
+	packet, err := readPacket(bufio.NewReader(client), 1024)
+	if err != nil {
+		t.Fatalf("reading disconnect: %v", err)
+	}
+	if reason, _, _ := decodeString(packet[1:], 1024); !strings.Contains(reason, "VPN") {
+		t.Errorf("disconnect reason %q", reason)
+	}
+	if d.tagged.Load() != 1 || d.blocked.Load() != 1 {
+		t.Errorf("tagged %d, blocked %d", d.tagged.Load(), d.blocked.Load())
+	}
+}
+
+func TestLimbo(t *testing.T) {
+	l := &limbo{timeout: time.Minute}
+	hs := &Handshake{ProtocolVersion: 767, ServerAddress: "play.example.com\x00FML3\x00", ServerPort: 25565, NextState: stateLogin}
+	if !l.accepts(hs) || l.accepts(&Handshake{ProtocolVersion: 765, NextState: stateLogin}) || l.accepts(&Handshake{ProtocolVersion: 767, NextState: stateStatus}) {
+		t.Error("limbo must take 1.20.5+ logins only")
+	}
+	if (*limbo)(nil).accepts(hs) {
+		t.Error("disabled limbo took a login")
+	}
+
+	// join logs Steve in and returns the client's reader after Login Success
+	uuid := bytes.Repeat([]byte{0xAB}, 16)
+	join := func(l *limbo, back func() bool) (net.Conn, *bufio.Reader, chan struct{}) {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer server.Close()
+			l.hold(server, bufio.NewReader(server), hs, back, "Starting up…")
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		loginStart := append(appendString([]byte{0x00}, "Steve"), uuid...)
+		client.Write(appendVarInt(nil, int32(len(loginStart)), loginStart...))
+		br := bufio.NewReader(client)
+		packet, err := readPacket(br, 1024)
+		if err != nil {
+			t.Fatalf("reading Login Success: %v", err)
+		}
+		if want := encodeLoginSuccess(767, uuid, "Steve"); !bytes.Equal(appendVarInt(nil, int32(len(packet)), packet...), want) {
+			t.Fatalf("Login Success = %x, want %x", packet, want)
+		}
+		client.Write([]byte{1, loginAcknowledgedID})
+		// Client Information, as sent on entering the configuration phase
+		client.Write([]byte{3, 0x00, 1, 2})
+		return client, br, done
+	}
+
+	var back atomic.Bool
+	client, br, done := join(l, back.Load)
+	time.Sleep(50 * time.Millisecond)
+	if l.waiting.Load() != 1 {
+		t.Errorf("%d players waiting, want 1", l.waiting.Load())
+	}
+	back.Store(true)
+	packet, err := readPacket(br, 1024)
+	if err != nil {
+		t.Fatalf("reading Transfer: %v", err)
+	}
+	host, n, _ := decodeString(packet[1:], 255)
+	port, _, _ := decodeVarInt(packet[1+n:])
+	if packet[0] != configTransferID || host != "play.example.com" || port != 25565 {
+		t.Errorf("Transfer = %x (%s:%d)", packet, host, port)
+	}
+	client.Close()
+	<-done
+	if l.transferred.Load() != 1 || l.waiting.Load() != 0 {
+		t.Errorf("transferred %d, waiting %d", l.transferred.Load(), l.waiting.Load())
+	}
+
+	// Players who wait too long get the message
+	short := &limbo{timeout: 10 * time.Millisecond}
+	client, br, done = join(short, func() bool { return false })
+	defer client.Close()
+	packet, err = readPacket(br, 1024)
+	if err != nil {
+		t.Fatalf("reading Disconnect: %v", err)
+	}
+	if packet[0] != configDisconnectID || packet[1] != 0x08 || !bytes.Contains(packet, []byte("Starting up…")) {
+		t.Errorf("Disconnect = %x", packet)
+	}
+	<-done
+	if short.timedOut.Load() != 1 {
+		t.Error("timeout not counted")
+	}
+}
+
+func TestShapeClasses(t *testing.T) {
+	shaper, err := parseShapeClasses([]string{
+		"lan:unlimited=10.0.0.0/8",
+		"vpn:64KB/s=203.0.113.0/24, 2001:db8::/32",
+		"all:1MB=0.0.0.0/0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]string{
+		"10.1.2.3:5000":        "lan",
+		"203.0.113.9:5000":     "vpn",
+		"[2001:db8::1]:5000":   "vpn",
+		"[::ffff:10.0.0.1]:80": "lan",
+		"198.51.100.1":         "all",
+		"[2001:db9::1]:5000":   "",
+	} {
+		got := ""
+		if class := shaper.classFor(addr); class != nil {
+			got = class.name
+		}
+		if got != want {
+			t.Errorf("classFor(%s) = %q, want %q", addr, got, want)
+		}
+	}
+	if vpn := shaper.classFor("203.0.113.9"); vpn.rate != 64<<10 {
+		t.Errorf("vpn rate = %d", vpn.rate)
+	}
+	if s, err := parseShapeClasses(nil); s != nil || err != nil {
+		t.Errorf("no classes = %v, %v", s, err)
+	}
+	for _, bad := range [][]string{
+		{"vpn=203.0.113.0/24"},
+		{"vpn:fast=203.0.113.0/24"},
+		{"vpn:0=203.0.113.0/24"},
+		{"vpn:1MB=not-a-network"},
+		{"vpn:1MB="},
+		{"vpn:1MB=10.0.0.0/8", "vpn:2MB=10.0.0.0/8"},
+	} {
+		if _, err := parseShapeClasses(bad); err == nil {
+			t.Errorf("parseShapeClasses(%q) accepted", bad)
+		}
+	}
+
+	// A second's worth goes through at once, the rest waits for the rate
+	class := &shapeClass{name: "test", rate: 100 << 10}
+	var buf bytes.Buffer
+	w := class.writer(&buf)
+	start := time.Now()
+	if n, err := w.Write(make([]byte, 150<<10)); n != 150<<10 || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("150 KiB at 100 KiB/s took %s, want about 500ms", elapsed)
+	}
+	if class.bytes.Load() != 150<<10 || class.delayed.Load() == 0 || buf.Len() != 150<<10 {
+		t.Errorf("counted %d bytes, %d ns delay", class.bytes.Load(), class.delayed.Load())
+	}
+}
+
+func TestTrafficMirror(t *testing.T) {
+	shadow, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shadow.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := shadow.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("answers are discarded"))
+		b, _ := io.ReadAll(conn)
+		got <- b
+	}()
+
+	m := newTrafficMirror(shadow.Addr().String(), 0.5)
+	m.chance = func() float64 { return 0.7 }
+	if c := m.start("1.2.3.4:5", nil, nil); c != nil {
+		t.Fatal("mirrored a connection outside -mirror-rate")
+	}
+	m.chance = func() float64 { return 0.2 }
+	c := m.start("1.2.3.4:5", []byte("PROXY "), []byte("handshake "))
+	if c == nil {
+		t.Fatal("didn't mirror a connection within -mirror-rate")
+	}
+	if n, err := c.Write([]byte("play")); n != 4 || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	c.close()
+	select {
+	case b := <-got:
+		if string(b) != "PROXY handshake play" {
+			t.Errorf("shadow got %q", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow got nothing")
+	}
+	if m.mirrored.Load() != 1 || m.bytes.Load() != 20 {
+		t.Errorf("mirrored %d connections, %d bytes", m.mirrored.Load(), m.bytes.Load())
+	}
+
+	// A shadow that is down fails the copy, not the connection
+	shadow.Close()
+	c = m.start("1.2.3.4:5", nil, []byte("handshake"))
+	c.Write([]byte("play"))
+	c.close()
+	deadline := time.Now().Add(5 * time.Second)
+	for m.dialFailed.Load() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.dialFailed.Load() != 1 {
+		t.Error("unreachable shadow not counted")
+	}
+}
+
+func TestSpliceConn(t *testing.T) {
+	client, proxyIn, proxyOut, backend := relayTestConns(t)
+	var conn, total atomic.Int64
+	cw := &countingWriter{w: proxyOut, conn: &conn, total: &total}
+
+	// Bytes already buffered from the peek go first
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 40000)
+	go func() {
+		client.Write(payload)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	br := bufio.NewReaderSize(proxyIn, 64)
+	br.Peek(10)
+	done := make(chan int64)
+	go func() {
+		n, err := spliceConn(cw, proxyOut.(*net.TCPConn), proxyIn.(*net.TCPConn), br)
+		if err != nil {
+			t.Error(err)
+		}
+		proxyOut.(*net.TCPConn).CloseWrite()
+		done <- n
+	}()
+	got, err := io.ReadAll(backend)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("backend got %d of %d bytes intact, %v", len(got), len(payload), err)
+	}
+	if n := <-done; n != int64(len(payload)) || conn.Load() != n || total.Load() != n {
+		t.Errorf("relayed %d, counted %d and %d, want %d", n, conn.Load(), total.Load(), len(payload))
+	}
+
+	if spliceable(Config{Splice: true}, true, proxyIn, proxyOut) || spliceable(Config{}, false, proxyIn, proxyOut) {
+		t.Error("spliceable without -splice or while capturing")
+	}
+	if !spliceable(Config{Splice: true}, false, proxyIn, proxyOut) {
+		t.Error("TCP connections aren't spliceable")
+	}
+}
+
+func TestSockmapRelay(t *testing.T) {
+	m, err := newSockmap()
+	if err != nil {
+		t.Skipf("no sockmap on this system: %v", err)
+	}
+	defer m.kernel.close()
+	client, proxyIn, proxyOut, backend := relayTestConns(t)
+	clientTCP, backendTCP := proxyIn.(*net.TCPConn), proxyOut.(*net.TCPConn)
+	var inConn, outConn, total atomic.Int64
+	toBackend := &countingWriter{w: proxyOut, conn: &inConn, total: &total}
+	toClient := &countingWriter{w: proxyIn, conn: &outConn, total: &total}
+
+	// A handshake the proxy read before handing the connection over goes
+	// first, then both directions are forwarded by the kernel
+	client.Write([]byte("handshake"))
+	br := bufio.NewReaderSize(proxyIn, 64)
+	br.Peek(9)
+	pair := m.open(proxyIn, proxyOut)
+	if pair == nil {
+		t.Fatal("no room in a new sockmap")
+	}
+	relayed := make(chan int64, 2)
+	go func() {
+		pair.start()
+		n, err := pair.relay(toBackend, backendTCP, clientTCP, br, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		backendTCP.CloseWrite()
+		relayed <- n
+	}()
+	go func() {
+		n, err := pair.relay(toClient, clientTCP, backendTCP, nil, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		clientTCP.CloseWrite()
+		relayed <- n
+	}()
+	if m.active.Load() != 0 && !pair.ok {
+		t.Fatal("pair counted as active without being forwarded")
+	}
+
+	up := bytes.Repeat([]byte("0123456789abcdef"), 40000)
+	down := bytes.Repeat([]byte("fedcba9876543210"), 30000)
+	go func() {
+		client.Write(up)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	go func() {
+		backend.Write(down)
+		backend.(*net.TCPConn).CloseWrite()
+	}()
+	gotUp, err := io.ReadAll(backend)
+	if want := append([]byte("handshake"), up...); err != nil || !bytes.Equal(gotUp, want) {
+		t.Fatalf("backend got %d of %d bytes intact, %v", len(gotUp), len(want), err)
+	}
+	gotDown, err := io.ReadAll(client)
+	if err != nil || !bytes.Equal(gotDown, down) {
+		t.Fatalf("client got %d of %d bytes intact, %v", len(gotDown), len(down), err)
+	}
+	<-relayed
+	<-relayed
+	if !pair.ok {
+		t.Error("the kernel didn't take the connection")
+	}
+	if inConn.Load() != int64(9+len(up)) || outConn.Load() != int64(len(down)) {
+		t.Errorf("counted %d and %d bytes, want %d and %d", inConn.Load(), outConn.Load(), 9+len(up), len(down))
+	}
+	pair.close()
+	if m.active.Load() != 0 || len(m.free) != 1 {
+		t.Errorf("%d connections still active, %d free slots after close", m.active.Load(), len(m.free))
+	}
+}
+
+// relayTestConns returns the connections of a relay over loopback TCP: a
+// client connected to the proxy's proxyIn, and the proxy's proxyOut
+// connected to a backend.
+func relayTestConns(tb testing.TB) (client, proxyIn, proxyOut, backend net.Conn) {
+	tb.Helper()
+	pair := func() (net.Conn, net.Conn) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		defer ln.Close()
+		dialed, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			tb.Fatal(err)
+		}
+		accepted, err := ln.Accept()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { dialed.Close(); accepted.Close() })
+		return dialed, accepted
+	}
+	client, proxyIn = pair()
+	proxyOut, backend = pair()
+	return client, proxyIn, proxyOut, backend
+}
+
+// benchmarkRelay measures relaying 1 MiB writes from client to backend.
+func benchmarkRelay(b *testing.B, relay func(cw *countingWriter, dst, src *net.TCPConn)) {
+	client, proxyIn, proxyOut, backend := relayTestConns(b)
+	var conn, total, received atomic.Int64
+	go relay(&countingWriter{w: proxyOut, conn: &conn, total: &total}, proxyOut.(*net.TCPConn), proxyIn.(*net.TCPConn))
+	go func() {
+		buf := make([]byte, 1<<20)
+		for {
+			n, err := backend.Read(buf)
+			received.Add(int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	chunk := make([]byte, 1<<20)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for b.Loop() {
+		client.Write(chunk)
+	}
+	// Wait for everything to get through
+	for received.Load() < int64(b.N)*int64(len(chunk)) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func BenchmarkRelayCopy(b *testing.B) {
+	benchmarkRelay(b, func(cw *countingWriter, dst, src *net.TCPConn) { copyConn(cw, src, 32*1024) })
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	benchmarkRelay(b, func(cw *countingWriter, dst, src *net.TCPConn) { spliceConn(cw, dst, src, nil) })
+}
+
+func BenchmarkRelaySockmap(b *testing.B) {
+	m, err := newSockmap()
+	if err != nil {
+		b.Skipf("no sockmap here: %v", err)
+	}
+	b.Cleanup(m.kernel.close)
+	benchmarkRelay(b, func(cw *countingWriter, dst, src *net.TCPConn) {
+		pair := m.open(src, dst)
+		pair.start()
+		pair.relay(cw, dst, src, nil, 32*1024)
+	})
+}
+
+func TestListenFamilies(t *testing.T) {
+	cases := []struct {
+		spec, family string
+		want         []listenAddress
+	}{
+		{"0.0.0.0:25565", listenAuto, []listenAddress{{"tcp", "0.0.0.0:25565"}}},
+		{":25565", listenDual, []listenAddress{{"tcp4", "0.0.0.0:25565"}, {"tcp6", "[::]:25565"}}},
+		{"[::]:25565", listenIPv4, []listenAddress{{"tcp4", "0.0.0.0:25565"}}},
+		{"0.0.0.0:25565", listenIPv6, []listenAddress{{"tcp6", "[::]:25565"}}},
+		{"203.0.113.5:25565, [2001:db8::5]:25565", listenDual, []listenAddress{{"tcp4", "203.0.113.5:25565"}, {"tcp6", "[2001:db8::5]:25565"}}},
+		{"localhost:25565", listenIPv6, []listenAddress{{"tcp6", "localhost:25565"}}},
+	}
+	for _, c := range cases {
+		if got, err := parseListenAddrs(c.spec, c.family); err != nil || !slices.Equal(got, c.want) {
+			t.Errorf("parseListenAddrs(%q, %s) = %v, %v, want %v", c.spec, c.family, got, err, c.want)
+		}
+	}
+	for _, bad := range [][2]string{{"[2001:db8::5]:25565", listenIPv4}, {"203.0.113.5:25565", listenIPv6}, {":25565,0.0.0.0:25565", listenDual}, {"25565", listenAuto}, {":25565", "both"}, {" , ", listenAuto}} {
+		if _, err := parseListenAddrs(bad[0], bad[1]); err == nil {
+			t.Errorf("parseListenAddrs(%q, %s): expected an error", bad[0], bad[1])
+		}
+	}
+	if _, err := parseRoute("name=v6;listen=0.0.0.0:25570;family=ipv6;backend=127.0.0.1:25567"); err != nil {
+		t.Errorf("route with a family: %v", err)
+	}
+	if _, err := parseRoute("name=v6;listen=127.0.0.1:25570;family=ipv6;backend=127.0.0.1:25567"); err == nil {
+		t.Error("expected an error for an IPv4 address in an IPv6 route")
+	}
+
+	// The two halves of a dual wildcard share the port
+	addrs, _ := parseListenAddrs(":0", listenDual)
+	listeners, err := listenPlayers(addrs, 1)
+	if err != nil {
+		t.Skipf("no IPv6 here: %v", err)
+	}
+	for _, ln := range listeners {
+		defer ln.Close()
+	}
+	_, port4, _ := net.SplitHostPort(listeners[0].Addr().String())
+	if _, port6, _ := net.SplitHostPort(listeners[1].Addr().String()); port4 != port6 || listeners[1].Addr().(*net.TCPAddr).IP.To4() != nil {
+		t.Errorf("dual listeners on %s and %s", listeners[0].Addr(), listeners[1].Addr())
+	}
+
+	// IPv4 players seen through a dual-stack socket get an IPv4 header
+	mapped := func(s string) *net.TCPAddr { return &net.TCPAddr{IP: net.ParseIP("::ffff:" + s), Port: 25565} }
+	if header := buildProxyV2Header(mapped("203.0.113.7"), mapped("10.0.0.1")); header[13] != 0x11 {
+		t.Errorf("mapped addresses got family 0x%02x, want AF_INET", header[13])
+	}
+}
+
+func TestListenPlayersReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT listeners are Linux only")
+	}
+	listeners, err := listenPlayers([]listenAddress{{"tcp", "127.0.0.1:0"}}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listeners[0].Addr().String()
+	var accepted atomic.Int64
+	for _, ln := range listeners {
+		defer ln.Close()
+		if ln.Addr().String() != addr {
+			t.Fatalf("sockets listen on %s and %s", addr, ln.Addr())
+		}
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				accepted.Add(1)
+				conn.Close()
+			}
+		}()
+	}
+	if len(listeners) != 4 {
+		t.Fatalf("expected 4 sockets, got %d", len(listeners))
+	}
+
+	for range 20 {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for accepted.Load() != 20 {
+		if time.Now().After(deadline) {
+			t.Fatalf("accepted %d of 20 connections", accepted.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackendPool(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	nextBackendConn := func() net.Conn {
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(2 * time.Second):
+			t.Fatal("pool didn't dial the backend")
+			return nil
+		}
+	}
+
+	cfg := Config{BackendAddr: backendLn.Addr().String(), BackendPool: newBackendPool(1, 10*time.Second)}
+	go cfg.BackendPool.run(cfg)
+	pooled := nextBackendConn()
+	defer pooled.Close()
+	for cfg.BackendPool.idleCount() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A login goes out over the pre-dialed connection, PROXY header first
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConnection(server, cfg)
+	hs := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: stateLogin}
+	go client.Write(hs.encode())
+	pooled.SetReadDeadline(time.Now().Add(2 * time.Second))
+	header, err := detectProxyProtocol(bufio.NewReader(pooled))
+	if err != nil || header == nil {
+		t.Fatalf("expected a PROXY header on the pooled connection, got %v (%v)", header, err)
+	}
+	if cfg.BackendPool.hits.Load() != 1 || cfg.BackendPool.saved.Load() <= 0 {
+		t.Fatalf("expected a hit with saved dial time, got %d hits and %dns saved", cfg.BackendPool.hits.Load(), cfg.BackendPool.saved.Load())
+	}
+
+	// Taking a connection refills the pool; one the backend closed is skipped
+	refill := nextBackendConn()
+	for cfg.BackendPool.idleCount() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	refill.Close()
+	time.Sleep(10 * time.Millisecond)
+	if conn, _, ok := cfg.BackendPool.take(cfg.BackendAddr); ok {
+		conn.Close()
+		t.Fatal("took a connection the backend had closed")
+	}
+	if cfg.BackendPool.misses.Load() != 1 {
+		t.Fatalf("expected a miss, got %d", cfg.BackendPool.misses.Load())
+	}
+}
+
+func TestBackendDiscoveryConsul(t *testing.T) {
+	release := make(chan struct{})
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/minecraft" || r.URL.Query().Get("passing") == "" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.Query().Get("index") {
+		case "0":
+			w.Header().Set("X-Consul-Index", "5")
+			fmt.Fprint(w, `[{"Node":{"Address":"10.0.0.1"},"Service":{"Address":"","Port":25566}}]`)
+		case "5":
+			w.Header().Set("X-Consul-Index", "6")
+			fmt.Fprint(w, `[{"Node":{"Address":"10.0.0.1"},"Service":{"Address":"10.0.0.2","Port":25567}}]`)
+		default:
+			<-release
+		}
+	}))
+	defer consul.Close()
+	defer close(release) // before closing the server, which waits for handlers
+
+	d, err := parseDiscovery("consul://"+strings.TrimPrefix(consul.URL, "http://")+"/minecraft", "127.0.0.1:25566")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{BackendAddr: "127.0.0.1:25566", Discovery: d}
+	go d.run()
+	deadline := time.Now().Add(3 * time.Second)
+	for cfg.currentBackend() != "10.0.0.2:25567" {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend is %s, expected it to follow consul to 10.0.0.2:25567", cfg.currentBackend())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestBackendDiscoveryEtcd(t *testing.T) {
+	release := make(chan struct{})
+	key := base64.StdEncoding.EncodeToString([]byte("mc/backend"))
+	etcd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			if req["key"] != key {
+				t.Errorf("unexpected range request %v", req)
+			}
+			fmt.Fprintf(w, `{"header":{"revision":"7"},"kvs":[{"value":%q}]}`, base64.StdEncoding.EncodeToString([]byte("10.0.0.1:25566")))
+		case "/v3/watch":
+			if create, _ := req["create_request"].(map[string]any); create["start_revision"] != float64(8) {
+				t.Errorf("unexpected watch request %v", req)
+			}
+			fmt.Fprintf(w, `{"result":{"created":true}}`+"\n")
+			fmt.Fprintf(w, `{"result":{"events":[{"kv":{"value":%q}}]}}`+"\n", base64.StdEncoding.EncodeToString([]byte("10.0.0.3:25566\n")))
+			w.(http.Flusher).Flush()
+			<-release
+		}
+	}))
+	defer etcd.Close()
+	defer close(release) // before closing the server, which waits for handlers
+
+	d, err := parseDiscovery("etcd://"+strings.TrimPrefix(etcd.URL, "http://")+"/mc/backend", "127.0.0.1:25566")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.run()
+	deadline := time.Now().Add(3 * time.Second)
+	for d.current() != "10.0.0.3:25566" {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend is %s, expected it to follow etcd to 10.0.0.3:25566", d.current())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if _, err := parseDiscovery("zookeeper://127.0.0.1/x", ""); err == nil {
+		t.Error("expected an unknown scheme to be rejected")
+	}
+}
+
+func TestQueryDNSReadsTTL(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// Echo the ID and question, then answer with two A records
+		resp := append([]byte(nil), buf[:n]...)
+		resp[2], resp[3] = 0x81, 0x80
+		resp[7] = 2
+		for _, rr := range []struct {
+			ttl uint32
+			ip  [4]byte
+		}{{120, [4]byte{10, 0, 0, 2}}, {42, [4]byte{10, 0, 0, 1}}} {
+			resp = append(resp, 0xC0, 12, 0, 1, 0, 1)
+			resp = binary.BigEndian.AppendUint32(resp, rr.ttl)
+			resp = append(resp, 0, 4)
+			resp = append(resp, rr.ip[:]...)
+		}
+		pc.WriteTo(resp, addr)
+	}()
+
+	ips, ttl, err := queryDNS(pc.LocalAddr().String(), "mc.example.com", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || ips[0].String() != "10.0.0.2" || ips[1].String() != "10.0.0.1" {
+		t.Fatalf("unexpected addresses %v", ips)
+	}
+	if ttl != 42*time.Second {
+		t.Fatalf("expected the lowest TTL (42s), got %s", ttl)
+	}
+}
+
+func TestBackendBalancer(t *testing.T) {
+	if _, err := parseBackendList(" , "); err == nil {
+		t.Error("expected an error for an empty list")
+	}
+	if _, err := parseBackendList("a:1,b"); err == nil {
+		t.Error("expected an error for an address without port")
+	}
+
+	b := newBackendBalancer([]string{"eu:25566", "us:25566", "asia:25566"}, time.Minute)
+	if got := b.candidates(); !slices.Equal(got, []string{"eu:25566", "us:25566", "asia:25566"}) {
+		t.Fatalf("before probing: %v, want the configured order", got)
+	}
+	b.measured("us:25566", 20*time.Millisecond)
+	b.measured("asia:25566", 90*time.Millisecond)
+	b.measured("eu:25566", 40*time.Millisecond)
+	if got := b.candidates(); !slices.Equal(got, []string{"us:25566", "eu:25566", "asia:25566"}) {
+		t.Fatalf("by latency: %v", got)
+	}
+	// One slow probe doesn't reorder, a sustained change does
+	b.measured("us:25566", 80*time.Millisecond)
+	if got := b.candidates()[0]; got != "us:25566" {
+		t.Fatalf("one slow probe moved the nearest backend to %s", got)
+	}
+	for range 5 {
+		b.measured("us:25566", 80*time.Millisecond)
+	}
+	if got := b.candidates()[0]; got != "eu:25566" {
+		t.Fatalf("nearest = %s after us slowed down", got)
+	}
+	b.failed("eu:25566", errors.New("refused"))
+	if got := b.candidates(); !slices.Equal(got, []string{"us:25566", "asia:25566", "eu:25566"}) {
+		t.Fatalf("with eu down: %v", got)
+	}
+
+	// Connections fail over from a dead backend to a live one
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	accepted := make(chan struct{}, 2)
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+	b = newBackendBalancer([]string{deadAddr, backendLn.Addr().String()}, time.Minute)
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConnection(server, Config{BackendAddr: deadAddr, Balancer: b})
+	go client.Write((&Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: stateStatus}).encode())
+	select {
+	case <-accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the connection didn't fail over to the live backend")
+	}
+	if got := b.candidates()[1]; got != deadAddr {
+		t.Errorf("the failed backend wasn't moved last: %v", b.candidates())
+	}
+	// A probe measures the live one
+	b.probe()
+	if got := (Config{Balancer: b}).currentBackend(); got != backendLn.Addr().String() {
+		t.Errorf("currentBackend() = %s after probing", got)
+	}
+}
+
+func TestStickyBackends(t *testing.T) {
+	addrs := []string{"a:25566", "b:25566", "c:25566", "d:25566"}
+	b := newBackendBalancer(addrs, time.Minute)
+	b.sticky = stickyIP
+	// Latency doesn't matter once players are pinned
+	b.measured("d:25566", time.Millisecond)
+
+	assigned := make(map[string]string)
+	counts := make(map[string]int)
+	for i := range 200 {
+		ip := "10.0.0." + itoa(i)
+		first := b.candidatesFor(ip, "")[0]
+		if again := b.candidatesFor(ip, "")[0]; again != first {
+			t.Fatalf("%s moved from %s to %s", ip, first, again)
+		}
+		assigned[ip] = first
+		counts[first]++
+	}
+	for _, addr := range addrs {
+		if counts[addr] < 20 {
+			t.Errorf("%s got only %d of 200 players: %v", addr, counts[addr], counts)
+		}
+	}
+
+	// When a backend goes down only its players move
+	b.failed("b:25566", errors.New("down"))
+	for ip, was := range assigned {
+		order := b.candidatesFor(ip, "")
+		if was != "b:25566" && order[0] != was {
+			t.Fatalf("%s moved from %s to %s though its backend is up", ip, was, order[0])
+		}
+		if order[len(order)-1] != "b:25566" {
+			t.Fatalf("down backend not last for %s: %v", ip, order)
+		}
+	}
+	b.measured("b:25566", time.Millisecond)
+	for ip, was := range assigned {
+		if got := b.candidatesFor(ip, "")[0]; got != was {
+			t.Fatalf("%s didn't return to %s after it recovered", ip, was)
+		}
+	}
+
+	// By username, the name wins over the address, whatever its case
+	b.sticky = stickyUsername
+	want := b.candidatesFor("", "notch")[0]
+	for i := range 20 {
+		if got := b.candidatesFor("10.1.0."+itoa(i), "Notch")[0]; got != want {
+			t.Fatalf("Notch from another IP went to %s, want %s", got, want)
+		}
+	}
+}
+
+func TestRouteKeepalive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answering atomic.Bool
+	hosts := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			br := bufio.NewReader(conn)
+			if hs, _ := peekHandshake(br); hs != nil {
+				hosts <- hs.ServerAddress
+			}
+			if !answering.Load() {
+				conn.Close()
+				continue
+			}
+			_, n := peekHandshake(br)
+			br.Discard(n)
+			readPacket(br, 1024)
+			status := `{"version":{"name":"Paper 1.21","protocol":767},"players":{"max":20,"online":0},"description":"Hi"}`
+			conn.Write(appendVarInt(nil, int32(len(appendString([]byte{0x00}, status))), appendString([]byte{0x00}, status)...))
+			conn.Close()
+		}
+	}()
+	defer ln.Close()
+
+	evs, stop := events.subscribe()
+	defer stop()
+
+	k := newRouteKeepalive(ln.Addr().String(), time.Minute)
+	for range keepaliveFailAfter {
+		k.ping()
+	}
+	if host := <-hosts; host != "127.0.0.1" {
+		t.Errorf("handshake host = %q, want the target's", host)
+	}
+	answering.Store(true)
+	k.ping()
+	k.ping()
+
+	var types []string
+	for len(evs) > 0 {
+		if ev := <-evs; strings.HasPrefix(ev.Type, "keepalive.") {
+			types = append(types, ev.Type)
+		}
+	}
+	if !slices.Equal(types, []string{eventKeepaliveDown, eventKeepaliveUp}) {
+		t.Errorf("events = %v, want one down and one up", types)
+	}
+	if newRouteKeepalive("myserver.minehut.gg", time.Minute).target != "myserver.minehut.gg:25565" {
+		t.Error("the default port wasn't added")
+	}
+}
+
+func TestLatencyProbes(t *testing.T) {
+	defer func() { latencyProbes = &probeSet{series: make(map[[2]string]*probeSeries)} }()
+
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				// Probes say they are the proxy's own connections
+				if header, err := detectProxyProtocol(br); err != nil || header == nil || header.SrcAddr != nil {
+					return
+				}
+				readPacket(br, 1024)
+				readPacket(br, 1024)
+				status := `{"version":{"name":"Paper 1.21","protocol":767},"players":{"max":20,"online":0},"description":"Hi"}`
+				conn.Write(appendVarInt(nil, int32(len(appendString([]byte{0x00}, status))), appendString([]byte{0x00}, status)...))
+			}()
+		}
+	}()
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	cfg := Config{BackendAddr: backendLn.Addr().String(), Routes: []routeConfig{{Name: "lobby", BackendAddr: deadAddr}}}
+	probeLatency(cfg, true)
+	probeLatency(cfg, true)
+
+	stats := latencyProbes.snapshot()
+	if len(stats) != 4 {
+		t.Fatalf("got %d probe series, want connect and status for 2 backends: %+v", len(stats), stats)
+	}
+	for _, st := range stats {
+		switch st.Backend {
+		case cfg.BackendAddr:
+			if st.Samples != 2 || st.Failures != 0 || st.P50Ms <= 0 || st.P95Ms < st.P50Ms {
+				t.Errorf("live backend %s probe: %+v", st.Probe, st)
+			}
+		case deadAddr:
+			if st.Samples != 0 || st.Failures != 2 || st.LastError == "" {
+				t.Errorf("dead backend %s probe: %+v", st.Probe, st)
+			}
+		}
+	}
+
+	mux := newAdminMux(cfg)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	var health struct {
+		Ready         bool         `json:"ready"`
+		BackendProbes []probeStats `json:"backend_probes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil || len(health.BackendProbes) != 4 {
+		t.Fatalf("/health = %s", rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`mc_dual_proxy_backend_probe_seconds{backend="` + cfg.BackendAddr + `",probe="status",quantile="0.95"}`,
+		`mc_dual_proxy_backend_probe_failures_total{backend="` + deadAddr + `",probe="connect"} 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+
+	samples := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if p50, p95 := percentile(samples, 0.5), percentile(samples, 0.95); p50 != 5 || p95 != 10 {
+		t.Errorf("percentiles = %d, %d", p50, p95)
+	}
+}
+
+func TestBackendResolverRotates(t *testing.T) {
+	if r, err := newBackendResolver("127.0.0.1:25566"); r != nil || err != nil {
+		t.Fatalf("expected no resolver for an IP backend, got %v, %v", r, err)
+	}
+	r, err := newBackendResolver("mc.example.com:25566")
+	if err != nil || r == nil {
+		t.Fatalf("expected a resolver for a hostname backend, got %v, %v", r, err)
+	}
+	r.addrs = []string{"10.0.0.1:25566", "10.0.0.2:25566"}
+	r.expires = time.Now().Add(time.Hour)
+	for _, want := range []string{"10.0.0.1:25566 10.0.0.2:25566", "10.0.0.2:25566 10.0.0.1:25566", "10.0.0.1:25566 10.0.0.2:25566"} {
+		if got := strings.Join(r.candidates(), " "); got != want {
+			t.Fatalf("candidates = %s, want %s", got, want)
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	rt, err := parseRoute("name=creative; listen=0.0.0.0:25570; backend=127.0.0.1:25567; session-servers=https://a.example, https://b.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.Name != "creative" || rt.ListenAddr != "0.0.0.0:25570" || rt.BackendAddr != "127.0.0.1:25567" ||
+		len(rt.SessionServers) != 2 || rt.SessionServers[1] != "https://b.example" {
+		t.Fatalf("unexpected route %+v", rt)
+	}
+
+	base := Config{Route: defaultRouteName, ListenAddr: ":25565", BackendAddr: "127.0.0.1:25566", SessionServers: []string{"https://mojang.example"}, Routes: []routeConfig{rt}}
+	routeCfg := base.forRoute(routeConfig{Name: "survival", ListenAddr: ":25571", BackendAddr: "127.0.0.1:25568"})
+	if routeCfg.Route != "survival" || routeCfg.BackendAddr != "127.0.0.1:25568" || routeCfg.SessionServers[0] != "https://mojang.example" || routeCfg.Routes != nil {
+		t.Fatalf("unexpected route config %+v", routeCfg)
+	}
+
+	for _, bad := range []string{
+		"listen=:1;backend=:2",                // missing name
+		"name=default;listen=:1;backend=:2",   // reserved name
+		"name=a b;listen=:1;backend=:2",       // invalid name
+		"name=x;backend=:2",                   // missing listen
+		"name=x;listen=:1",                    // missing backend
+		"name=x;listen=:1;backend=:2;color=1", // unknown key
+	} {
+		if _, err := parseRoute(bad); err == nil {
+			t.Errorf("parseRoute(%q): expected error", bad)
+		}
+	}
+}
+
+func TestRouteListenerProxiesToItsBackend(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	headerCh := make(chan *ProxyHeader, 1)
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header, _ := detectProxyProtocol(bufio.NewReader(conn))
+		headerCh <- header
+	}()
+
+	// Find a free port for the route listener
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenAddr := ln.Addr().String()
+	ln.Close()
+
+	cfg := Config{Route: defaultRouteName, ListenAddr: "127.0.0.1:0", BackendAddr: "127.0.0.1:1"}
+	go serveTCP(cfg.forRoute(routeConfig{Name: "creative", ListenAddr: listenAddr, BackendAddr: backendLn.Addr().String()}))
+
+	var client net.Conn
+	for i := 0; i < 50; i++ {
+		if client, err = net.Dial("tcp", listenAddr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	hs := &Handshake{ProtocolVersion: 767, ServerAddress: "creative.example.com", ServerPort: 25570, NextState: stateLogin}
+	client.Write(hs.encode())
+
+	select {
+	case header := <-headerCh:
+		_, port, _ := net.SplitHostPort(listenAddr)
+		if header == nil || itoa(int(header.DstPort)) != port {
+			t.Fatalf("PROXY header %+v, expected destination port %s", header, port)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the route's backend")
+	}
+}
+
+// --- Admin Tests ---
+
+func TestAdminStatusReportsConnections(t *testing.T) {
+	tc := &trackedConn{ClientAddr: "127.0.0.1:5000", RealAddr: "1.2.3.4:5000", Source: "proxied", Started: time.Now()}
+	tracker.add(tc)
+	defer tracker.remove(tc)
+	tc.setBackend("127.0.0.1:25566")
+
+	activity.recordAuth(authEvent{Time: time.Now(), Username: "AdminPlayer", Result: "success", Upstream: "mojang"})
+
+	mux := newAdminMux(Config{ListenAddr: "0.0.0.0:25565", BackendAddr: "127.0.0.1:25566"})
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/status", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var status adminStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("failed to parse status: %v", err)
+	}
+
+	found := false
+	for _, c := range status.Connections {
+		if c.ID == tc.ID && c.RealAddr == "1.2.3.4:5000" && c.Backend == "127.0.0.1:25566" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("tracked connection missing from status: %+v", status.Connections)
+	}
+	if len(status.AuthFeed) == 0 || status.AuthFeed[len(status.AuthFeed)-1].Username != "AdminPlayer" {
+		t.Fatalf("auth event missing from feed: %+v", status.AuthFeed)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(rec.Body.String(), "mc-dual-proxy") {
+		t.Fatal("dashboard page not served")
+	}
+}
+
+func TestStatusReport(t *testing.T) {
+	var mu sync.Mutex
+	var reports []healthReport
+	var fail atomic.Bool
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var report healthReport
+		json.NewDecoder(r.Body).Decode(&report)
+		mu.Lock()
+		reports = append(reports, report)
+		mu.Unlock()
+	}))
+	defer api.Close()
+
+	s, err := newStatusReporter(api.URL+"/report?key=x", "secret", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.redactedURL(); got != api.URL+"/report" {
+		t.Errorf("redactedURL = %q", got)
+	}
+	// Nothing listens on the backend port, so it is reported offline
+	cfg := Config{BackendAddr: "127.0.0.1:1", Keepalive: newRouteKeepalive("myserver.minehut.gg", time.Minute)}
+	s.report(cfg)
+	mu.Lock()
+	if len(reports) != 1 {
+		mu.Unlock()
+		t.Fatalf("got %d reports, want 1", len(reports))
+	}
+	r := reports[0]
+	mu.Unlock()
+	if r.Ready || r.Reason == "" || r.Backend.Online || r.Version != version {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if r.Route == nil || r.Route.Target != "myserver.minehut.gg:25565" || !r.Route.Up {
+		t.Errorf("route = %+v", r.Route)
+	}
+
+	fail.Store(true)
+	s.report(cfg)
+	s.report(cfg)
+	var buf bytes.Buffer
+	p := &promWriter{w: bufio.NewWriter(&buf)}
+	s.write(p)
+	p.w.Flush()
+	if !strings.Contains(buf.String(), "mc_dual_proxy_status_report_failures 2") {
+		t.Errorf("failures not counted:\n%s", buf.String())
+	}
+	fail.Store(false)
+	s.report(cfg)
+	if s.failures != 0 {
+		t.Errorf("failures = %d after a successful report", s.failures)
+	}
+
+	if _, err := newStatusReporter("ftp://example.com", "", time.Minute); err == nil {
+		t.Error("expected an error for a non-HTTP URL")
+	}
+}
+
+func TestPortMappingNATPMP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	var mu sync.Mutex
+	leases := map[uint16]uint32{}
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			switch {
+			case n == 2 && buf[1] == 0:
+				pc.WriteTo([]byte{0, 128, 0, 0, 0, 0, 0, 1, 203, 0, 113, 7}, addr)
+			case n == 12 && buf[1] == 2:
+				port := binary.BigEndian.Uint16(buf[4:6])
+				mu.Lock()
+				leases[port] = binary.BigEndian.Uint32(buf[8:12])
+				mu.Unlock()
+				resp := make([]byte, 16)
+				resp[1] = 130
+				binary.BigEndian.PutUint16(resp[8:], port)
+				binary.BigEndian.PutUint16(resp[10:], port+10000)
+				copy(resp[12:], buf[8:12])
+				pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	m, err := newPortMapping(portMapNATPMP, pc.LocalAddr().String(), []string{"0.0.0.0:25565", ":25566", "[::]:25565"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.ports) != 2 {
+		t.Fatalf("ports = %v, want 25565 and 25566 once each", m.ports)
+	}
+	if err := m.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if m.mapped[25565] != 35565 || m.mapped[25566] != 35566 {
+		t.Errorf("mapped = %v", m.mapped)
+	}
+	mu.Lock()
+	if leases[25565] != uint32(portMapLifetime.Seconds()) {
+		t.Errorf("requested lease %ds", leases[25565])
+	}
+	mu.Unlock()
+	m.close()
+	mu.Lock()
+	if leases[25565] != 0 || leases[25566] != 0 {
+		t.Errorf("mappings not removed on close: %v", leases)
+	}
+	mu.Unlock()
+
+	if _, err := newPortMapping("pcp", "", []string{":25565"}); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+	if _, err := newPortMapping(portMapAuto, "", []string{":0"}); err == nil {
+		t.Error("expected an error for a listen address without a port")
+	}
+}
+
+func TestPortMappingUPnP(t *testing.T) {
+	var mu sync.Mutex
+	var actions []string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/desc.xml" {
+			fmt.Fprint(w, `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType><deviceList><device>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL></service></serviceList></device></deviceList></device></deviceList></device></root>`)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		action := r.Header.Get("SOAPAction")
+		mu.Lock()
+		actions = append(actions, action)
+		mu.Unlock()
+		switch {
+		case strings.HasSuffix(action, `#AddPortMapping"`) && strings.Contains(string(body), "<NewLeaseDuration>3600<"):
+			// Only permanent leases, like some older routers
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>725</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+		case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewExternalIPAddress>203.0.113.7</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		}
+	}))
+	defer srv.Close()
+
+	igd, err := newUPnPIGD(srv.URL + "/desc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if igd.controlURL != srv.URL+"/ctl/IPConn" || igd.localIP != "127.0.0.1" {
+		t.Fatalf("igd = %+v", igd)
+	}
+	if port, err := igd.addMapping(25565, portMapLifetime); err != nil || port != 25565 {
+		t.Fatalf("addMapping = %d, %v", port, err)
+	}
+	if ip, err := igd.externalIP(); err != nil || ip.String() != "203.0.113.7" {
+		t.Fatalf("externalIP = %v, %v", ip, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"AddPortMapping", "AddPortMapping", "GetExternalIPAddress"}
+	if len(actions) != len(want) {
+		t.Fatalf("actions = %v", actions)
+	}
+	for i, a := range want {
+		if actions[i] != `"urn:schemas-upnp-org:service:WANIPConnection:1#`+a+`"` {
+			t.Errorf("action %d = %s, want %s", i, actions[i], a)
+		}
+	}
+}
+
+func TestParseRouteTable(t *testing.T) {
+	table := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t0000A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+		"eth0\t00000000\t0100A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n"
+	ip, err := parseRouteTable(strings.NewReader(table))
+	if err != nil || ip.String() != "192.168.0.1" {
+		t.Fatalf("gateway = %v, %v", ip, err)
+	}
+	if _, err := parseRouteTable(strings.NewReader(table[:strings.LastIndex(table[:len(table)-1], "\n")+1])); err == nil {
+		t.Error("expected an error without a default route")
+	}
+}
+
+func TestPublicServerStatus(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	var pings atomic.Int32
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			pings.Add(1)
+			br := bufio.NewReader(conn)
+			detectProxyProtocol(br)
+			readPacket(br, 1024)
+			readPacket(br, 1024)
+			status := `{"version":{"name":"Paper 1.21","protocol":767},"players":{"max":100,"online":37},"description":"Hi"}`
+			conn.Write(appendVarInt(nil, int32(len(appendString([]byte{0x00}, status))), appendString([]byte{0x00}, status)...))
+			conn.Close()
+		}
+	}()
+
+	mux := newAdminMux(Config{BackendAddr: backendLn.Addr().String(), AdminToken: "secret"})
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+	rec := get("/api/server")
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("/api/server: %d %v", rec.Code, rec.Header())
+	}
+	var status publicStatus
+	json.Unmarshal(rec.Body.Bytes(), &status)
+	if want := (publicStatus{Online: true, Players: 37, MaxPlayers: 100, MOTD: "Hi", Version: "Paper 1.21"}); status != want {
+		t.Fatalf("status = %+v, want %+v", status, want)
+	}
+	var badge shieldsBadge
+	json.Unmarshal(get("/api/server/shields").Body.Bytes(), &badge)
+	if badge.SchemaVersion != 1 || badge.Message != "37/100" || badge.Color != "brightgreen" {
+		t.Fatalf("badge = %+v", badge)
+	}
+	if n := pings.Load(); n != 1 {
+		t.Errorf("backend pinged %d times, want once within the cache TTL", n)
+	}
+	if rec := get("/api/status"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("/api/status without token: %d", rec.Code)
+	}
+
+	if b := (publicStatus{}).badge(); b.Message != "offline" || b.Color != "red" {
+		t.Errorf("offline badge = %+v", b)
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "v1.4.0", "0123456789abcdef0123", "2024-05-01T12:00:00Z"
+
+	b := currentBuild()
+	if b.Version != "v1.4.0" || b.Commit != "0123456789abcdef0123" || b.BuildDate != "2024-05-01T12:00:00Z" {
+		t.Fatalf("ldflags values not used: %+v", b)
+	}
+	if s := b.String(); !strings.HasPrefix(s, "v1.4.0 (commit 0123456789ab") || !strings.Contains(s, "built 2024-05-01T12:00:00Z, go") {
+		t.Errorf("String() = %q", s)
+	}
+
+	mux := newAdminMux(Config{})
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/status", nil))
+	var status adminStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Build.Version != "v1.4.0" || status.Build.Commit != "0123456789abcdef0123" {
+		t.Errorf("/api/status build = %+v", status.Build)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `mc_dual_proxy_build_info{version="v1.4.0",commit="0123456789abcdef0123",go_version="` + runtime.Version() + `"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics missing %s", want)
+	}
+}
+
+func TestAdminMetricsPerRouteAndIP(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		tc := &trackedConn{ClientAddr: "127.0.0.1:5000", RealAddr: "9.9.9.9:" + itoa(6000+i), Source: "proxied", Route: "metrics", Started: time.Now()}
+		tracker.add(tc)
+		defer tracker.remove(tc)
+	}
+
+	cfg := Config{Routes: []routeConfig{{Name: "metrics"}, {Name: "idle"}}}
+	rec := httptest.NewRecorder()
+	newAdminMux(cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`mc_dual_proxy_connections{route="metrics"} 2`,
+		`mc_dual_proxy_connections{route="idle"} 0`,
+		`mc_dual_proxy_ip_connections{ip="9.9.9.9"} 2`,
+		"# TYPE mc_dual_proxy_connections_accepted_total counter",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestDialLatencyHistogram(t *testing.T) {
+	hv := newHistogramVec([]float64{0.01, 0.1}, "backend", "result")
+	hv.observe(0.005, "b:1", "success")
+	hv.observe(0.05, "b:1", "success")
+	hv.observe(3, "b:1", "success")
+	hv.observe(0.01, "b:1", dialResult(syscall.ECONNREFUSED))
+
+	var buf bytes.Buffer
+	p := &promWriter{w: bufio.NewWriter(&buf)}
+	hv.write(p, "dial_seconds", "test")
+	p.w.Flush()
+	out := buf.String()
+	for _, want := range []string{
+		`mc_dual_proxy_dial_seconds_bucket{backend="b:1",result="success",le="0.01"} 1`,
+		`mc_dual_proxy_dial_seconds_bucket{backend="b:1",result="success",le="0.1"} 2`,
+		`mc_dual_proxy_dial_seconds_bucket{backend="b:1",result="success",le="+Inf"} 3`,
+		`mc_dual_proxy_dial_seconds_count{backend="b:1",result="success"} 3`,
+		`mc_dual_proxy_dial_seconds_bucket{backend="b:1",result="refused",le="0.01"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("histogram output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestStatsdEmitter(t *testing.T) {
+	if _, err := newStatsdEmitter("127.0.0.1:8125", "", "influx", time.Second); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	receive := func() string {
+		pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, 65536)
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("reading StatsD packet: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	s, err := newStatsdEmitter(pc.LocalAddr().String(), "test.", statsdFormatDogStatsD, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &trackedConn{ClientAddr: "127.0.0.1:5000", RealAddr: "9.9.9.9:6000", Route: "statsd", Started: time.Now()}
+	tracker.add(tc)
+	defer tracker.remove(tc)
+	cfg := Config{Routes: []routeConfig{{Name: "statsd"}}}
+	s.flush(cfg)
+	packet := receive()
+	for _, want := range []string{"test.connections:1|g|#route:statsd", "test.ip_connections:1|g|#ip:9_9_9_9"} {
+		if !strings.Contains(packet, want) {
+			t.Errorf("packet missing %q:\n%s", want, packet)
+		}
+	}
+	if strings.Contains(packet, "backend_dial_seconds") {
+		t.Errorf("histogram buckets sent:\n%s", packet)
+	}
+
+	// Counters are sent as increments since the previous flush
+	tracker.refused.Add(2)
+	s.flush(cfg)
+	if packet := receive(); !strings.Contains(packet, "test.connections_refused_total:2|c") {
+		t.Errorf("expected a refused increment of 2:\n%s", packet)
+	}
+
+	plain, err := newStatsdEmitter(pc.LocalAddr().String(), "test.", statsdFormatPlain, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.timing("backend_dial", 12500*time.Microsecond, "backend", "127.0.0.1:25566", "result", "success")
+	if packet := receive(); packet != "test.backend_dial.127_0_0_1_25566.success:12.5|ms" {
+		t.Errorf("unexpected timer %q", packet)
+	}
+}
+
+func TestInfluxPusher(t *testing.T) {
+	if _, err := newInfluxPusher("influx:8086", "", time.Second); err == nil {
+		t.Error("expected an error for a URL without scheme")
+	}
+	got := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- r
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	tc := &trackedConn{ClientAddr: "127.0.0.1:5000", RealAddr: "9.9.9.9:6000", Route: "my route", Started: time.Now()}
+	tracker.add(tc)
+	defer tracker.remove(tc)
+
+	p, err := newInfluxPusher(server.URL+"/api/v2/write?org=o&bucket=b", "secret", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.push(Config{Routes: []routeConfig{{Name: "my route"}}}, time.Unix(1700000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	r, body := <-got, <-bodies
+	if r.Header.Get("Authorization") != "Token secret" || r.URL.Query().Get("bucket") != "b" {
+		t.Errorf("unexpected request %s %v", r.URL, r.Header)
+	}
+	for _, want := range []string{
+		`mc_dual_proxy_connections,route=my\ route value=1 1700000000000000000`,
+		"mc_dual_proxy_connections_accepted_total value=",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body missing %q:\n%s", want, body)
+		}
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bucket not found", http.StatusNotFound)
+	}))
+	defer failing.Close()
+	p, _ = newInfluxPusher(failing.URL, "", time.Second)
+	if err := p.push(Config{}, time.Now()); err == nil || !strings.Contains(err.Error(), "bucket not found") {
+		t.Errorf("expected the server's error, got %v", err)
+	}
+}
+
+func TestDebugConnectionsIncludesUsername(t *testing.T) {
+	tc := &trackedConn{ClientAddr: "127.0.0.1:5001", RealAddr: "5.6.7.8:41000", Source: "direct", Started: time.Now()}
+	tracker.add(tc)
+	defer tracker.remove(tc)
+	tc.setBackend("127.0.0.1:25566")
+
+	// A successful hasJoined carrying the player's IP names the connection
+	upstream := newProfileServer("debug-uuid", 0)
+	defer upstream.Close()
+	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=DebugPlayer&serverId=abc&ip=5.6.7.8", nil)
+	handleHasJoined(httptest.NewRecorder(), req, Config{SessionServers: []string{upstream.URL}})
+
+	rec := httptest.NewRecorder()
+	newAdminMux(Config{}).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/connections", nil))
+	var conns []connInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &conns); err != nil {
+		t.Fatalf("failed to parse connections: %v", err)
+	}
+	for _, c := range conns {
+		if c.ID == tc.ID {
+			if c.Username != "DebugPlayer" || c.RealAddr != "5.6.7.8:41000" || c.Source != "direct" || c.Backend != "127.0.0.1:25566" {
+				t.Fatalf("unexpected connection info %+v", c)
+			}
+			return
+		}
+	}
+	t.Fatalf("connection %d missing from %s", tc.ID, rec.Body.String())
+}
+
+func TestIsLoopbackListen(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8653": true,
+		"[::1]:8653":     true,
+		"localhost:8653": true,
+		":8653":          false,
+		"0.0.0.0:8653":   false,
+		"10.0.0.5:8653":  false,
+		"example.com:80": false,
+		"bogus":          false,
+	} {
+		if got := isLoopbackListen(addr); got != want {
+			t.Errorf("isLoopbackListen(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestAdminPlayers(t *testing.T) {
+	tc := &trackedConn{ClientAddr: "127.0.0.1:5003", RealAddr: "9.9.8.8:43000", Source: "direct", Route: defaultRouteName, Started: time.Now()}
+	tracker.add(tc)
+	defer tracker.remove(tc)
+	anonymous := &trackedConn{ClientAddr: "127.0.0.1:5004", RealAddr: "9.9.8.7:43001", Source: "direct", Started: time.Now()}
+	tracker.add(anonymous)
+	defer tracker.remove(anonymous)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":"0123456789abcdef0123456789abcdef","name":"ListedPlayer"}`)
+	}))
+	defer upstream.Close()
+	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=listedplayer&serverId=abc&ip=9.9.8.8", nil)
+	handleHasJoined(httptest.NewRecorder(), req, Config{SessionServers: []string{upstream.URL}})
+
+	rec := httptest.NewRecorder()
+	newAdminMux(Config{}).ServeHTTP(rec, httptest.NewRequest("GET", "/api/players", nil))
+	var resp struct {
+		Count   int
+		Players []onlinePlayer
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to parse players: %v", err)
+	}
+	var found *onlinePlayer
+	for i, p := range resp.Players {
+		if p.ConnectionID == anonymous.ID {
+			t.Fatalf("connection without a known player listed: %+v", p)
+		}
+		if p.ConnectionID == tc.ID {
+			found = &resp.Players[i]
+		}
+	}
+	if resp.Count != len(resp.Players) || found == nil {
+		t.Fatalf("player missing from %s", rec.Body.String())
+	}
+	if found.Username != "ListedPlayer" || found.UUID != "01234567-89ab-cdef-0123-456789abcdef" || found.AuthSource != upstream.URL || found.RealIP != "9.9.8.8" {
+		t.Fatalf("unexpected player %+v", *found)
+	}
+	if time.Since(found.ConnectedSince) > time.Minute {
+		t.Fatalf("unexpected connected_since %s", found.ConnectedSince)
+	}
+}
+
+func TestAdminKick(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	tc := &trackedConn{ClientAddr: "127.0.0.1:5002", RealAddr: "7.7.7.7:42000", Source: "direct", Started: time.Now(), client: server}
+	tracker.add(tc)
+	defer tracker.remove(tc)
+
+	mux := newAdminMux(Config{})
+	kick := func(body string) []uint64 {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/kick", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("kick %s: expected 200, got %d: %s", body, rec.Code, rec.Body.String())
+		}
+		var resp struct{ Kicked []uint64 }
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.Kicked
+	}
+
+	if kicked := kick(`{"ip":"8.8.8.8"}`); len(kicked) != 0 {
+		t.Fatalf("kicked %v, expected no match", kicked)
+	}
+	if kicked := kick(`{"ip":"7.7.7.7"}`); len(kicked) != 1 || kicked[0] != tc.ID {
+		t.Fatalf("kicked %v, expected [%d]", kicked, tc.ID)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the kicked connection to be closed, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/kick", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty kick, got %d", rec.Code)
+	}
+}
+
+func TestBackendBans(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string, mod time.Time) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mod, mod)
+	}
+	start := time.Now().Add(-time.Hour)
+	write("banned-ips.json", `[{"ip":"203.0.113.9","created":"2024-05-01 12:00:00 +0000","source":"Server","expires":"forever","reason":"Spam"}]`, start)
+
+	backend, err := loadBackendBans(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bans := newBanList()
+	bans.backend = backend
+	if b, ok := bans.checkIP("203.0.113.9:40000"); !ok || b.Reason != "Spam" || b.Source != "backend" {
+		t.Errorf("expected the backend's IP ban to apply, got %+v, %v", b, ok)
+	}
+	if _, ok := bans.checkUsername("Griefer"); ok {
+		t.Error("expected no player bans before banned-players.json exists")
+	}
+
+	// The server bans a player; an expired ban doesn't count
+	write("banned-players.json", `[
+		{"uuid":"069a79f4-44e9-4726-a5be-fca90e38aaf5","name":"Griefer","created":"2024-05-02 08:30:00 +0200","source":"Admin","expires":"forever","reason":"Griefing"},
+		{"uuid":"853c80ef-3c37-49fd-aa49-938b674adae6","name":"Former","created":"2024-01-01 00:00:00 +0000","source":"Admin","expires":"2024-01-02 00:00:00 +0000","reason":"Cooldown"}
+	]`, start.Add(time.Minute))
+	backend.checked = time.Time{}
+	if b, ok := bans.checkUsername("griefer"); !ok || b.Reason != "Griefing" || !b.Created.Equal(time.Date(2024, 5, 2, 6, 30, 0, 0, time.UTC)) {
+		t.Errorf("expected griefer to be banned, got %+v, %v", b, ok)
+	}
+	if _, ok := bans.checkUUID("069a79f444e94726a5befca90e38aaf5"); !ok {
+		t.Error("expected the ban to match the player's UUID under any name")
+	}
+	if _, ok := bans.checkUsername("Former"); ok {
+		t.Error("expected an expired ban not to apply")
+	}
+	if n := len(bans.list()); n != 2 {
+		t.Errorf("expected 2 active bans listed, got %d", n)
+	}
+
+	// Backend bans can't be lifted at the proxy
+	if _, err := bans.remove("Griefer"); !errors.Is(err, errBackendBan) {
+		t.Errorf("expected errBackendBan lifting a backend ban, got %v", err)
+	}
+
+	// A broken file keeps the bans read last
+	write("banned-ips.json", `[{"ip":`, start.Add(2*time.Minute))
+	backend.checked = time.Time{}
+	if _, ok := bans.checkIP("203.0.113.9"); !ok {
+		t.Error("expected the bans read last to be kept while the file is broken")
+	}
+}
+
+func TestBanListPersistsAndExpires(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	bans, err := loadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"203.0.113.7", "198.51.100.0/24", "Griefer"} {
+		if _, err := bans.add(target, "griefing", 0); err != nil {
+			t.Fatalf("add %s: %v", target, err)
+		}
+	}
+	if _, err := bans.add("10.0.0.1", "", time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bans.add("not a target!", "", 0); err == nil {
+		t.Fatal("expected an invalid target to be rejected")
+	}
+	time.Sleep(time.Millisecond)
+
+	// Reload from disk as after a restart
+	bans, err = loadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"203.0.113.7:51234", "[::ffff:198.51.100.99]:25565"} {
+		if _, ok := bans.checkIP(addr); !ok {
+			t.Errorf("expected %s to be banned", addr)
+		}
+	}
+	for _, addr := range []string{"203.0.113.8", "10.0.0.1"} {
+		if _, ok := bans.checkIP(addr); ok {
+			t.Errorf("expected %s not to be banned", addr)
+		}
+	}
+	if b, ok := bans.checkUsername("griefer"); !ok || b.Reason != "griefing" {
+		t.Errorf("expected griefer to be banned for griefing, got %+v, %v", b, ok)
+	}
+	if n := len(bans.list()); n != 3 {
+		t.Errorf("expected 3 active bans, got %d", n)
+	}
+
+	if removed, err := bans.remove("198.51.100.0/24"); !removed || err != nil {
+		t.Fatalf("remove: %v, %v", removed, err)
+	}
+	if _, ok := bans.checkIP("198.51.100.99"); ok {
+		t.Error("expected the CIDR ban to be lifted")
+	}
+}
+
+func TestAdminBanDisconnectsLogin(t *testing.T) {
+	cfg := Config{BackendAddr: "127.0.0.1:1", Bans: newBanList()}
+	mux := newAdminMux(cfg)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/bans", strings.NewReader(`{"target":"127.0.0.0/8","reason":"testing","duration":"1h"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ban: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			handleConnection(conn, cfg)
+		}
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	hs := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: stateLogin}
+	client.Write(hs.encode())
+	packet, err := readPacket(bufio.NewReader(client), 1024)
+	if err != nil {
+		t.Fatalf("reading disconnect: %v", err)
+	}
+	reason, _, err := decodeString(packet[1:], 1024)
+	if packet[0] != 0x00 || err != nil || !strings.Contains(reason, "testing") {
+		t.Fatalf("unexpected disconnect packet %q (err=%v)", packet, err)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/bans?target=127.0.0.0/8", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("unban: expected 204, got %d", rec.Code)
+	}
+	if _, ok := cfg.Bans.checkIP("127.0.0.1"); ok {
+		t.Fatal("expected the ban to be lifted")
+	}
+}
+
+func TestWhitelist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.json")
+	wl, err := loadWhitelist(path, "Not on the list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected a missing whitelist to be created: %v", err)
+	}
+
+	// Managed through the admin API, in vanilla's format
+	handler := handleWhitelist(wl)
+	for _, body := range []string{`{"name":"Alice","uuid":"0123abcd89abcdef0123456789abcdef"}`, `{"name":"Bob"}`} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("POST", "/api/whitelist", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("adding %s: %d %s", body, rec.Code, rec.Body.String())
+		}
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/api/whitelist", strings.NewReader(`{"name":"bad name"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid name to be refused, got %d", rec.Code)
+	}
+	var saved []whitelistEntry
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &saved); err != nil || len(saved) != 2 || saved[0].UUID != "0123abcd-89ab-cdef-0123-456789abcdef" {
+		t.Fatalf("unexpected saved whitelist %s", data)
+	}
+
+	// Logins: unlisted players are disconnected before the backend is dialed
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	accepted := make(chan struct{}, 4)
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+	cfg := Config{BackendAddr: backendLn.Addr().String(), Whitelist: wl}
+	login := func(name string) net.Conn {
+		client, server := net.Pipe()
+		go handleConnection(server, cfg)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		hs := &Handshake{ProtocolVersion: 767, ServerAddress: "mc.example.com", ServerPort: 25565, NextState: stateLogin}
+		body := appendString([]byte{0x00}, name)
+		body = append(body, make([]byte, 16)...)
+		go client.Write(append(hs.encode(), appendVarInt(nil, int32(len(body)), body...)...))
+		return client
+	}
+	client := login("Mallory")
+	packet, err := readPacket(bufio.NewReader(client), 1024)
+	client.Close()
+	if err != nil {
+		t.Fatalf("reading disconnect: %v", err)
+	}
+	if reason, _, _ := decodeString(packet[1:], 1024); packet[0] != 0x00 || !strings.Contains(reason, "Not on the list") {
+		t.Fatalf("unexpected disconnect packet %q", packet)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("a player not on the whitelist reached the backend")
+	default:
+	}
+	client = login("bob")
+	select {
+	case <-accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("a whitelisted player didn't reach the backend")
+	}
+	client.Close()
+
+	// Auth: unlisted names skip the fan-out, listed UUIDs must match
+	profileID := "0123abcd89abcdef0123456789abcdef"
+	var queries atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		fmt.Fprintf(w, `{"id":%q,"name":%q}`, profileID, r.URL.Query().Get("username"))
+	}))
+	defer upstream.Close()
+	authCfg := Config{SessionServers: []string{upstream.URL}, Whitelist: wl}
+	hasJoined := func(name string) int {
+		rec := httptest.NewRecorder()
+		handleHasJoined(rec, httptest.NewRequest("GET", "/session/minecraft/hasJoined?username="+name+"&serverId=x", nil), authCfg)
+		return rec.Code
+	}
+	if code := hasJoined("Mallory"); code != http.StatusNoContent || queries.Load() != 0 {
+		t.Fatalf("expected 204 without querying upstreams, got %d after %d queries", code, queries.Load())
+	}
+	if code := hasJoined("Alice"); code != http.StatusOK {
+		t.Fatalf("expected Alice with her UUID to pass, got %d", code)
+	}
+	profileID = "ffffffffffffffffffffffffffffffff"
+	if code := hasJoined("Alice"); code != http.StatusNoContent {
+		t.Fatalf("expected another account named Alice to be refused, got %d", code)
+	}
+	if code := hasJoined("Bob"); code != http.StatusOK {
+		t.Fatalf("expected Bob, listed without a UUID, to pass, got %d", code)
+	}
+
+	// Edits to the file are picked up
+	os.WriteFile(path, []byte(`[{"name":"Carol"}]`), 0o644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	if !wl.allowsName("carol") || wl.allowsName("Bob") {
+		t.Fatalf("file changes not picked up: %+v", wl.list())
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("DELETE", "/api/whitelist?name=Carol", nil))
+	if rec.Code != http.StatusNoContent || wl.allowsName("Carol") {
+		t.Fatalf("expected Carol to be removed, got %d", rec.Code)
+	}
+}
+
+func TestWhitelistURL(t *testing.T) {
+	var mu sync.Mutex
+	body, etag, fail := `[{"name":"Steve"}]`, `"v1"`, false
+	var notModified atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case fail:
+			http.Error(w, "down", http.StatusBadGateway)
+		case r.Header.Get("If-None-Match") == etag:
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", etag)
+			io.WriteString(w, body)
+		}
+	}))
+	defer srv.Close()
+
+	wl, err := loadWhitelist(srv.URL+"/whitelist.json", "Not on the list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wl.allowsName("steve") || wl.allowsName("Alex") {
+		t.Error("fetched whitelist not enforced")
+	}
+	if err := wl.fetch(); err != nil || notModified.Load() != 1 {
+		t.Errorf("unchanged fetch = %v, %d not-modified answers", err, notModified.Load())
+	}
+
+	mu.Lock()
+	body, etag = `[{"name":"Alex"}]`, `"v2"`
+	mu.Unlock()
+	if err := wl.fetch(); err != nil || !wl.allowsName("Alex") || wl.allowsName("Steve") {
+		t.Errorf("changed whitelist not picked up (err=%v)", err)
+	}
+
+	// A failed fetch keeps the list fetched last
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	if err := wl.fetch(); err == nil || !wl.allowsName("Alex") {
+		t.Errorf("failed fetch = %v, or dropped the list", err)
+	}
+
+	// The list can only be changed at its source
+	if _, err := wl.add(whitelistEntry{Name: "Notch"}); !errors.Is(err, errWhitelistReadOnly) {
+		t.Errorf("add = %v", err)
+	}
+	rec := httptest.NewRecorder()
+	handleWhitelist(wl)(rec, httptest.NewRequest(http.MethodDelete, "/api/whitelist?name=Alex", nil))
+	if rec.Code != http.StatusConflict || !wl.allowsName("Alex") {
+		t.Errorf("DELETE answered %d", rec.Code)
+	}
+
+	if _, err := loadWhitelist(srv.URL+"/whitelist.json", ""); err == nil {
+		t.Error("a whitelist URL that fails at startup was accepted")
+	}
+}
+
+func TestAgentCheck(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	cfg := Config{BackendAddr: backendLn.Addr().String(), ConnSlots: newConnSlots(4), Queue: newPlayerQueue(10, false)}
+
+	l := &lifecycle{}
+	if reply := l.agentCheckReply(cfg); reply != "down #player listener not up" {
+		t.Errorf("before the listeners are up: %q", reply)
+	}
+	l.tcpUp.Store(true)
+	l.authUp.Store(true)
+	if reply := l.agentCheckReply(cfg); reply != "up ready 100%" {
+		t.Errorf("idle: %q", reply)
+	}
+	cfg.ConnSlots.tryAcquire()
+	if reply := l.agentCheckReply(cfg); reply != "up ready 75%" {
+		t.Errorf("with 1 of 4 connections: %q", reply)
+	}
+	for range 4 {
+		cfg.ConnSlots.tryAcquire()
+	}
+	if reply := l.agentCheckReply(cfg); reply != "up ready 0%" {
+		t.Errorf("at the connection cap: %q", reply)
+	}
+	l.draining.Store(true)
+	if reply := l.agentCheckReply(cfg); reply != "drain" {
+		t.Errorf("draining: %q", reply)
+	}
+
+	// The listener answers with one line and closes
+	agentLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agentLn.Close()
+	go serveAgentCheck(agentLn, Config{BackendAddr: "127.0.0.1:1"})
+	conn, err := net.Dial("tcp", agentLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := io.ReadAll(conn)
+	if err != nil || !strings.HasPrefix(string(line), "down #") || !strings.HasSuffix(string(line), "\n") {
+		t.Errorf("agent check answered %q, %v", line, err)
+	}
+}
+
+func TestReadinessAndDrain(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{BackendAddr: backendLn.Addr().String()}
 
-	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=MinehutPlayer&serverId=def456", nil)
-	rec := httptest.NewRecorder()
+	l := &lifecycle{}
+	if ok, reason := l.ready(cfg); ok || reason != "player listener not up" {
+		t.Fatalf("expected not ready before the listeners are up, got %v %q", ok, reason)
+	}
+	playerLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer playerLn.Close()
+	l.playerListenerUp(playerLn, defaultRouteName)
+	l.authUp.Store(true)
+	if ok, reason := l.ready(cfg); !ok {
+		t.Fatalf("expected ready, got %q", reason)
+	}
 
-	handleHasJoined(rec, req, servers)
+	backendLn.Close()
+	if ok, reason := l.ready(cfg); ok || !strings.HasPrefix(reason, "backend unreachable") {
+		t.Fatalf("expected not ready with the backend down, got %v %q", ok, reason)
+	}
 
-	if rec.Code != http.StatusOK {
-		t.Fatalf("expected 200, got %d", rec.Code)
+	l.drain(100 * time.Millisecond)
+	if _, err := playerLn.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected the player listener to be closed, got %v", err)
+	}
+	if ok, reason := l.ready(cfg); ok || reason != "draining" {
+		t.Fatalf("expected not ready while draining, got %v %q", ok, reason)
 	}
 
-	var body map[string]interface{}
-	json.Unmarshal(rec.Body.Bytes(), &body)
-	if body["name"] != "MinehutPlayer" {
-		t.Fatalf("expected name MinehutPlayer, got %v", body["name"])
+	// Probes don't need the admin token
+	rec := httptest.NewRecorder()
+	newAdminMux(Config{AdminToken: "secret"}).ServeHTTP(rec, httptest.NewRequest("GET", "/livez", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected /livez to answer 200 without a token, got %d", rec.Code)
 	}
 }
 
-func TestMultiauthBothFail(t *testing.T) {
-	// Both servers return 204
-	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNoContent)
-	}))
-	defer server1.Close()
+func TestAdminEventStream(t *testing.T) {
+	srv := httptest.NewServer(newAdminMux(Config{}))
+	defer srv.Close()
 
-	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNoContent)
-	}))
-	defer server2.Close()
+	resp, err := http.Get(srv.URL + "/api/events?type=auth.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
 
-	servers := []string{server1.URL, server2.URL}
+	// The subscription is registered once the headers have been flushed
+	events.publish(eventConnOpen, nil)
+	events.publish(eventAuthFail, map[string]any{"username": "StreamPlayer"})
 
-	req := httptest.NewRequest("GET", "/session/minecraft/hasJoined?username=FakePlayer&serverId=xyz", nil)
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "event: auth.fail\n" {
+		t.Fatalf("expected filtered auth.fail event, got %q", line)
+	}
+	data, _ := br.ReadString('\n')
+	if !strings.Contains(data, "StreamPlayer") {
+		t.Fatalf("unexpected data line %q", data)
+	}
+}
+
+func TestAdminLogSettings(t *testing.T) {
+	defer setLogLevel(levelInfo)
+	defer connDebugging.setIPs(nil)
+
+	mux := newAdminMux(Config{AdminToken: "secret"})
+
+	// Without the token the API is closed
 	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/log", strings.NewReader(`{"level":"debug"}`)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", rec.Code)
+	}
 
-	handleHasJoined(rec, req, servers)
+	req := httptest.NewRequest("POST", "/api/log", strings.NewReader(`{"level":"debug","conn_debug_ips":["1.2.3.4"]}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if getLogLevel() != levelDebug {
+		t.Fatalf("log level not changed, got %s", getLogLevel())
+	}
+	if !connDebugging.enabled("1.2.3.4:5555") || connDebugging.enabled("5.6.7.8:5555") {
+		t.Fatal("per-connection debug not applied to the right IPs")
+	}
 
-	if rec.Code != http.StatusNoContent {
-		t.Fatalf("expected 204 when both fail, got %d", rec.Code)
+	req = httptest.NewRequest("POST", "/api/log?token=secret", strings.NewReader(`{"level":"verbose"}`))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown level, got %d", rec.Code)
 	}
 }
 
-// --- Integration Test: TCP proxy + backend ---
+func TestFormatSummary(t *testing.T) {
+	prev := summaryCounters{accepted: 10, refused: 1, bytesIn: 100, bytesOut: 1000, dialFailures: 2, authSuccesses: map[string]int64{"mojang": 5}}
+	cur := summaryCounters{accepted: 17, refused: 3, bytesIn: 100 + 2048, bytesOut: 1000 + 3<<20, dialFailures: 2, authSuccesses: map[string]int64{"mojang": 9, "ely.by": 1, "idle": 0}}
+	want := "2 active, 7 accepted, 2 refused, auth successes: ely.by=1 mojang=4, 0 backend dial failures, 2.0 KiB in, 3.0 MiB out"
+	if got := formatSummary(prev, cur, 2); got != want {
+		t.Errorf("formatSummary:\n got %q\nwant %q", got, want)
+	}
+	if got := formatSummary(cur, cur, 0); !strings.Contains(got, "auth successes: none") || !strings.Contains(got, "0 B in") {
+		t.Errorf("unexpected idle summary %q", got)
+	}
+}
 
-func TestTCPProxyDirectConnection(t *testing.T) {
-	// Start a mock "backend" that expects a PROXY protocol v2 header
-	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatal(err)
+func TestPrettyConsole(t *testing.T) {
+	var out bytes.Buffer
+	c := newPrettyConsole(&out)
+	c.now = func() time.Time { return time.Date(2024, 1, 1, 14, 2, 11, 0, time.UTC) }
+	logger := log.New(c, "", 0)
+
+	c.Send(Event{Type: eventAuthSuccess, Data: map[string]any{"username": "Notch", "upstream": "https://sessionserver.mojang.com"}})
+	c.Send(Event{Type: eventAuthFail, Data: map[string]any{"username": "Griefer"}})
+	c.Send(Event{Type: eventConnClose, Data: map[string]any{"real": "1.2.3.4:5", "username": "Notch", "duration": 438.2, "bytes_in": int64(2048), "bytes_out": int64(0)}})
+	c.Send(Event{Type: "unknown.type"})
+	logger.Print("[tcp] 127.0.0.1:5000: new connection (real=1.2.3.4:5)")
+	logger.Print("[auth]   https://sessionserver.mojang.com: SUCCESS (200, 10 bytes)")
+	logger.Print("WARN [tcp] 127.0.0.1:5000: failed to connect to backend")
+	logger.Print("[config] Reloaded")
+
+	// Strip colors to check the text
+	text := regexp.MustCompile("\x1b\\[[0-9;]*m").ReplaceAllString(out.String(), "")
+	want := "14:02:11 ✓ auth    Notch                  via mojang\n" +
+		"14:02:11 ✗ auth    Griefer                all session servers failed\n" +
+		"14:02:11 ← leave   Notch                  7m18s  ↑2.0 KiB ↓0 B\n" +
+		"14:02:11 ⚠ [tcp] 127.0.0.1:5000: failed to connect to backend\n" +
+		"14:02:11 [config] Reloaded\n"
+	if text != want {
+		t.Errorf("unexpected console output:\n%s\nwant:\n%s", text, want)
 	}
-	defer backendLn.Close()
+}
 
-	backendGotHeader := make(chan *ProxyHeader, 1)
-	backendGotData := make(chan []byte, 1)
+func TestLogDedup(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	logDedup.window.Store(int64(time.Minute))
+	defer logDedup.window.Store(0)
 
-	go func() {
-		conn, err := backendLn.Accept()
-		if err != nil {
-			return
-		}
-		defer conn.Close()
+	for i := range 8 {
+		warnf("[test] %d: dedup flood warning", i)
+		infof("[test] %d: dedup flood info", i)
+	}
+	out := logs.String()
+	if n := strings.Count(out, "dedup flood warning"); n != logDedupBurst {
+		t.Errorf("expected %d warnings before suppression, got %d:\n%s", logDedupBurst, n, out)
+	}
+	if n := strings.Count(out, "dedup flood info"); n != 8 {
+		t.Errorf("info messages were suppressed:\n%s", out)
+	}
 
-		br := bufio.NewReaderSize(conn, 512)
-		ph, _ := detectProxyProtocol(br)
-		backendGotHeader <- ph
+	logs.Reset()
+	logDedup.flush()
+	if want := "WARN [test] 7: dedup flood warning (3 more like this in the last 1m0s)"; !strings.Contains(logs.String(), want) {
+		t.Errorf("summary missing %q:\n%s", want, logs.String())
+	}
 
-		data, _ := io.ReadAll(br)
-		backendGotData <- data
+	// A new window logs the first ones again
+	logs.Reset()
+	warnf("[test] %d: dedup flood warning", 8)
+	if !strings.Contains(logs.String(), "8: dedup flood warning") {
+		t.Errorf("warning suppressed in a new window:\n%s", logs.String())
+	}
+}
 
-		conn.Write([]byte("RESPONSE"))
-	}()
+func TestSyslogWriter(t *testing.T) {
+	for _, target := range []string{"logs.example.com:514", "http://logs.example.com"} {
+		if _, err := newSyslogWriter(target, "daemon", "test"); err == nil {
+			t.Errorf("newSyslogWriter(%q): expected an error", target)
+		}
+	}
+	if _, err := newSyslogWriter("udp://127.0.0.1:514", "bogus", "test"); err == nil {
+		t.Error("expected an error for an unknown facility")
+	}
 
-	// Start the TCP proxy
-	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer proxyLn.Close()
+	defer pc.Close()
+	w, err := newSyslogWriter("udp://"+pc.LocalAddr().String(), "local3", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New(w, "", 0)
+	logger.Print("WARN [tcp] something odd")
+	pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// local3 (19) * 8 + warning (4)
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<156>1 ") || !strings.HasSuffix(msg, " test "+itoa(os.Getpid())+" - - [tcp] something odd") {
+		t.Errorf("unexpected message %q", msg)
+	}
 
+	// TCP: octet-counted frames
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
 	go func() {
-		conn, err := proxyLn.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			return
 		}
-		handleConnection(conn, backendLn.Addr().String())
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		length, _ := br.ReadString(' ')
+		size, _ := strconv.Atoi(strings.TrimSpace(length))
+		frame := make([]byte, size)
+		io.ReadFull(br, frame)
+		received <- string(frame)
 	}()
-
-	// Connect as a "direct player" (no PROXY protocol)
-	clientConn, err := net.DialTimeout("tcp", proxyLn.Addr().String(), 2*time.Second)
+	w, err = newSyslogWriter("tcp://"+ln.Addr().String(), "daemon", "test")
 	if err != nil {
-		t.Fatalf("failed to connect to proxy: %v", err)
+		t.Fatal(err)
 	}
-	defer clientConn.Close()
+	log.New(w, "", 0).Print("plain line")
+	select {
+	case msg := <-received:
+		// daemon (3) * 8 + info (6)
+		if !strings.HasPrefix(msg, "<30>1 ") || !strings.HasSuffix(msg, " - - plain line") {
+			t.Errorf("unexpected frame %q", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for TCP syslog frame")
+	}
+}
 
-	// Send some Minecraft-like data
-	clientConn.Write([]byte("HELLO_MC"))
-	clientConn.(*net.TCPConn).CloseWrite()
+func TestLogDiagnostics(t *testing.T) {
+	tc := &trackedConn{ClientAddr: "127.0.0.1:5003", RealAddr: "9.9.9.9:42000", Source: "direct", Route: "diag", Started: time.Now()}
+	tracker.add(tc)
+	defer tracker.remove(tc)
+	tc.setUsername("Stuck")
 
-	// Verify backend received a PROXY protocol header
-	select {
-	case ph := <-backendGotHeader:
-		if ph == nil {
-			t.Fatal("backend did not receive PROXY protocol header")
+	gate := newPingGate(time.Minute)
+	gate.markVerified("9.9.9.9")
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	logDiagnostics(Config{PingGate: gate})
+
+	for _, want := range []string{"[diag] goroutines=", `username="Stuck" route=diag`, "ping gate: 1 verified IPs"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("expected %q in the diagnostics dump, got:\n%s", want, logs.String())
 		}
-		if ph.Version != 2 {
-			t.Fatalf("expected v2 header, got v%d", ph.Version)
+	}
+}
+
+// --- Config Tests ---
+
+func TestRemoteConfigPolling(t *testing.T) {
+	var mu sync.Mutex
+	body := `{"backend": "127.0.0.1:25566", "session-servers": "https://a.example", "listen": ":25565"}`
+	version, notModified := 1, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		etag := fmt.Sprintf(`"v%d"`, version)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
 		}
-		t.Logf("Backend received v2 header: src=%s:%d", ph.SrcAddr, ph.SrcPort)
-	case <-time.After(3 * time.Second):
-		t.Fatal("timeout waiting for backend to receive header")
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+	setBody := func(s string) {
+		mu.Lock()
+		body = s
+		version++
+		mu.Unlock()
 	}
 
-	// Verify backend received the MC data
-	select {
-	case data := <-backendGotData:
-		if !bytes.Equal(data, []byte("HELLO_MC")) {
-			t.Fatalf("backend got %q, expected HELLO_MC", data)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	backend := fs.String("backend", "127.0.0.1:1", "")
+	sessionServers := fs.String("session-servers", "https://default.example", "")
+	listen := fs.String("listen", ":1", "")
+	fs.String("conflict-policy", conflictFirst, "")
+	var blocked stringList
+	fs.Var(&blocked, "block-username", "")
+	if err := fs.Parse([]string{"-listen", ":9999"}); err != nil {
+		t.Fatal(err)
+	}
+
+	src := newConfigSource(server.URL, fs)
+	if err := src.load(); err != nil {
+		t.Fatal(err)
+	}
+	// The command line wins over the config
+	if *backend != "127.0.0.1:25566" || *sessionServers != "https://a.example" || *listen != ":9999" {
+		t.Fatalf("flags after load: backend=%s session-servers=%s listen=%s", *backend, *sessionServers, *listen)
+	}
+
+	cfg := Config{Route: defaultRouteName, BackendAddr: *backend, SessionServers: []string{*sessionServers}, ConflictPolicy: conflictFirst}
+	liveConfig.Store(&cfg)
+	defer liveConfig.Store(nil)
+
+	// Unchanged: answered with 304
+	if err := src.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if notModified != 1 {
+		t.Fatalf("expected a conditional request answered with 304, got %d", notModified)
+	}
+
+	setBody(`{"backend": "127.0.0.1:25570", "session-servers": "https://a.example,https://b.example", "block-username": ["^bot_"]}`)
+	if err := src.reload(); err != nil {
+		t.Fatal(err)
+	}
+	got := cfg.reloaded()
+	if got.BackendAddr != "127.0.0.1:25570" || !slices.Equal(got.SessionServers, []string{"https://a.example", "https://b.example"}) {
+		t.Fatalf("unexpected reloaded config %+v", got)
+	}
+	if got.UsernameFilter.check("bot_1") != "blocked_username" {
+		t.Fatal("expected the username filter to be reloaded")
+	}
+	// Other routes keep their configuration
+	if other := (Config{Route: "survival", BackendAddr: "127.0.0.1:1"}).reloaded(); other.BackendAddr != "127.0.0.1:1" {
+		t.Fatalf("route config changed to %+v", other)
+	}
+
+	// An invalid config is refused as a whole
+	setBody(`{"backend": "127.0.0.1:25571", "conflict-policy": "random"}`)
+	if err := src.reload(); err == nil {
+		t.Fatal("expected an invalid conflict policy to be refused")
+	}
+	if got := cfg.reloaded(); got.BackendAddr != "127.0.0.1:25570" {
+		t.Fatalf("invalid config was partially applied: %s", got.BackendAddr)
+	}
+
+	for _, bad := range []string{`{"nope": 1}`, `{"backend": ["a:1", "b:2"]}`, `{"backend": {"host": "a"}}`, `{"config": "x.json"}`, `[1]`} {
+		if _, err := src.parse([]byte(bad)); err == nil {
+			t.Errorf("expected %s to be refused", bad)
 		}
-	case <-time.After(3 * time.Second):
-		t.Fatal("timeout waiting for backend data")
 	}
+}
 
-	// Verify client can read the response
-	clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
-	resp, _ := io.ReadAll(clientConn)
-	if !bytes.Equal(resp, []byte("RESPONSE")) {
-		t.Fatalf("client got %q, expected RESPONSE", resp)
+// --- Event Bus Tests ---
+
+// chanSink delivers events to a channel.
+type chanSink chan Event
+
+func (c chanSink) Send(ev Event) error {
+	c <- ev
+	return nil
+}
+
+func TestEventBusDeliversToSinks(t *testing.T) {
+	bus := &eventBus{}
+	a, b := make(chanSink, 1), make(chanSink, 1)
+	bus.addSink("a", a)
+	bus.addSink("b", b)
+
+	bus.publish(eventAuthSuccess, map[string]any{"username": "Player"})
+
+	for _, sink := range []chanSink{a, b} {
+		select {
+		case ev := <-sink:
+			if ev.Type != eventAuthSuccess || ev.Data["username"] != "Player" {
+				t.Fatalf("unexpected event: %+v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
 	}
 }
 
-func TestTCPProxyPassthroughProxyProtocol(t *testing.T) {
-	// Start a mock backend
-	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+func TestExecHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook commands here are sh syntax")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	hook, err := parseExecHook(`backend.*=echo "$MC_EVENT $MC_BACKEND $MC_FAILURES" >> ` + out)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer backendLn.Close()
+	for _, ev := range []Event{
+		{Type: eventAuthSuccess, Time: time.Now(), Data: map[string]any{"username": "Player"}},
+		{Type: eventBackendDown, Time: time.Now(), Data: map[string]any{"backend": "10.0.0.5:25565", "failures": 3}},
+	} {
+		if err := hook.Send(ev); err != nil {
+			t.Fatalf("%s: %v", ev.Type, err)
+		}
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "backend.down 10.0.0.5:25565 3\n"; got != want {
+		t.Errorf("expected only the backend event to run the hook, got %q, want %q", got, want)
+	}
 
-	backendGotHeader := make(chan *ProxyHeader, 1)
+	failing, _ := parseExecHook("*=echo oops; exit 2")
+	if err := failing.Send(Event{Type: eventAuthFail}); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("expected the failure with the command's output, got %v", err)
+	}
+	slow, _ := parseExecHook("*=sleep 5")
+	slow.timeout = 50 * time.Millisecond
+	if err := slow.Send(Event{Type: eventAuthFail}); err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("expected a command running too long to be killed, got %v", err)
+	}
 
-	go func() {
-		conn, err := backendLn.Accept()
-		if err != nil {
-			return
+	for _, spec := range []string{"auth.success", "=true", "back*end=true"} {
+		if _, err := parseExecHook(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
 		}
-		defer conn.Close()
-
-		br := bufio.NewReaderSize(conn, 512)
-		ph, _ := detectProxyProtocol(br)
-		backendGotHeader <- ph
-	}()
+	}
+	if name := execHookEnvName("bytes_in"); name != "BYTES_IN" {
+		t.Errorf("expected BYTES_IN, got %s", name)
+	}
+}
 
-	// Start the TCP proxy
-	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+func TestNATSSinkPublishes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer proxyLn.Close()
+	defer ln.Close()
 
+	got := make(chan string, 1)
 	go func() {
-		conn, err := proxyLn.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			return
 		}
-		handleConnection(conn, backendLn.Addr().String())
+		defer conn.Close()
+		fmt.Fprint(conn, "INFO {}\r\n")
+		br := bufio.NewReader(conn)
+		br.ReadString('\n') // CONNECT
+		pub, _ := br.ReadString('\n')
+		payload, _ := br.ReadString('\n')
+		got <- pub + payload
 	}()
 
-	// Connect and send a v1 PROXY protocol header (as Minehut would)
-	clientConn, err := net.DialTimeout("tcp", proxyLn.Addr().String(), 2*time.Second)
+	sink, err := newEventSink("nats://" + ln.Addr().String() + "/mc.events")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer clientConn.Close()
-
-	// Write a v1 header pretending to be from 1.2.3.4
-	fmt.Fprintf(clientConn, "PROXY TCP4 1.2.3.4 10.0.0.1 11111 25565\r\n")
-	clientConn.Write([]byte("MC_DATA"))
-	clientConn.(*net.TCPConn).CloseWrite()
+	if err := sink.Send(Event{Type: eventConnOpen}); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
 
-	// The backend should receive the same v1 header with the original IP
 	select {
-	case ph := <-backendGotHeader:
-		if ph == nil {
-			t.Fatal("backend did not receive PROXY protocol header")
-		}
-		if ph.Version != 1 {
-			t.Fatalf("expected v1 header passthrough, got v%d", ph.Version)
-		}
-		if ph.SrcAddr.String() != "1.2.3.4" {
-			t.Fatalf("expected src addr 1.2.3.4, got %s", ph.SrcAddr)
-		}
-		if ph.SrcPort != 11111 {
-			t.Fatalf("expected src port 11111, got %d", ph.SrcPort)
+	case msg := <-got:
+		if !strings.HasPrefix(msg, "PUB mc.events ") || !strings.Contains(msg, `"type":"connection.open"`) {
+			t.Fatalf("unexpected NATS message: %q", msg)
 		}
-		t.Logf("Backend correctly received passthrough v1 header: src=%s:%d", ph.SrcAddr, ph.SrcPort)
 	case <-time.After(3 * time.Second):
-		t.Fatal("timeout")
+		t.Fatal("timeout waiting for NATS publish")
+	}
+}
+
+func TestMQTTPacketRemainingLength(t *testing.T) {
+	pkt := mqttPacket(0x30, make([]byte, 200))
+	// 200 = 0xC8 → encoded as 0xC8 0x01
+	if pkt[0] != 0x30 || pkt[1] != 0xC8 || pkt[2] != 0x01 || len(pkt) != 203 {
+		t.Fatalf("bad framing: % x", pkt[:3])
 	}
 }
 
@@ -439,3 +6539,75 @@ func init() {
 }
 
 var _ = strings.Contains // suppress unused import warning
+
+// --- Load Test Tests ---
+
+func TestLoadTest(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var mu sync.Mutex
+	sources := map[string]bool{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				header, err := detectProxyProtocol(br)
+				if err != nil || header == nil {
+					return
+				}
+				mu.Lock()
+				sources[header.SrcAddr.String()] = true
+				mu.Unlock()
+				handshake, err := readPacket(br, 1024)
+				if err != nil {
+					return
+				}
+				hs, err := decodeHandshake(handshake)
+				if err != nil {
+					return
+				}
+				if hs.NextState == stateStatus {
+					serveStatus(conn, br, &ServerStatus{Description: jsonText("load")})
+					return
+				}
+				if loginStart, err := readPacket(br, 1024); err == nil && loginStart[0] == 0x00 {
+					conn.Write(encodeLoginDisconnect("bye"))
+				}
+			}()
+		}
+	}()
+
+	stats := loadTest(loadTestOptions{Target: ln.Addr().String(), Clients: 4, Duration: 200 * time.Millisecond, Mode: "mixed", ProxyHeader: "v2", StreamBytes: 64}, func(time.Duration, int, int) {})
+	if stats.ok < 8 || stats.failed() != 0 {
+		t.Fatalf("expected successful clients only, got %d ok and errors %v", stats.ok, stats.errors)
+	}
+	report := formatLoadTestReport(stats, 200*time.Millisecond)
+	if !strings.Contains(report, "Latency: p50") {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sources) < 2 {
+		t.Fatalf("expected fake PROXY headers from several addresses, got %v", sources)
+	}
+	for src := range sources {
+		if !loadTestSources.Contains(netip.MustParseAddr(src)) {
+			t.Fatalf("fake source %s outside %s", src, loadTestSources)
+		}
+	}
+
+	// Nothing listening: every client fails
+	ln.Close()
+	stats = loadTest(loadTestOptions{Target: ln.Addr().String(), Clients: 1, Duration: 50 * time.Millisecond, Mode: "status", ProxyHeader: "none"}, func(time.Duration, int, int) {})
+	if stats.ok != 0 || stats.failed() == 0 {
+		t.Fatalf("expected failures against a closed port, got %d ok", stats.ok)
+	}
+}
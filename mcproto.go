@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Handshake next-state values.
+const (
+	stateStatus   = 1
+	stateLogin    = 2
+	stateTransfer = 3
+)
+
+// maxHandshakeAddrLen is the longest server address accepted. Vanilla
+// allows 255 characters, but backends behind BungeeCord accept 32767 since
+// legacy forwarding appends the player's IP, UUID and properties; in practice
+// the address is bounded by -peek-buffer.
+const maxHandshakeAddrLen = 32767
+
+// maxLoginNameLen is the longest name accepted in Login Start
+// (16 characters, up to 4 bytes each in UTF-8).
+const maxLoginNameLen = 16 * 4
+
+var errVarIntTooLong = errors.New("varint is too long")
+
+// Handshake is the first packet of every modern Minecraft connection.
+type Handshake struct {
+	ProtocolVersion int32
+	ServerAddress   string
+	ServerPort      uint16
+	NextState       int32
+}
+
+// peekHandshake tries to parse a handshake packet at the start of br without
+// consuming it. It returns the handshake and the size of the whole packet
+// (including the length prefix). If the data does not look like a handshake,
+// it returns nil and 0 so the connection can be passed through untouched.
+func peekHandshake(br *bufio.Reader) (*Handshake, int) {
+	// A legacy ping never sends enough bytes to satisfy a length prefix
+	if isLegacyPing(br) {
+		return nil, 0
+	}
+
+	// The length prefix is at most 3 bytes for any packet that fits in the buffer
+	head, _ := br.Peek(3)
+	length, n, err := decodeVarInt(head)
+	if err != nil || length < 1 || n+int(length) > br.Size() {
+		return nil, 0
+	}
+
+	packet, err := br.Peek(n + int(length))
+	if err != nil {
+		return nil, 0
+	}
+	hs, err := decodeHandshake(packet[n:])
+	if err != nil {
+		return nil, 0
+	}
+	return hs, n + int(length)
+}
+
+// decodeHandshake parses the body of a handshake packet (without the length prefix).
+func decodeHandshake(b []byte) (*Handshake, error) {
+	id, n, err := decodeVarInt(b)
+	if err != nil {
+		return nil, err
+	}
+	if id != 0x00 {
+		return nil, fmt.Errorf("not a handshake (packet id 0x%02x)", id)
+	}
+	b = b[n:]
+
+	hs := &Handshake{}
+	if hs.ProtocolVersion, n, err = decodeVarInt(b); err != nil {
+		return nil, err
+	}
+	b = b[n:]
+
+	if hs.ServerAddress, n, err = decodeString(b, maxHandshakeAddrLen); err != nil {
+		return nil, err
+	}
+	b = b[n:]
+
+	if len(b) < 2 {
+		return nil, errors.New("truncated server port")
+	}
+	hs.ServerPort = binary.BigEndian.Uint16(b)
+	b = b[2:]
+
+	if hs.NextState, n, err = decodeVarInt(b); err != nil {
+		return nil, err
+	}
+	if n != len(b) {
+		return nil, errors.New("trailing data in handshake")
+	}
+	if hs.NextState < stateStatus || hs.NextState > stateTransfer {
+		return nil, fmt.Errorf("invalid next state %d", hs.NextState)
+	}
+	return hs, nil
+}
+
+// peekLoginStart returns the player name from the Login Start packet that
+// starts offset bytes into br, without consuming anything, or "" if the next
+// packet isn't a Login Start with a valid name. Only the start of the packet
+// is read: 1.19 clients follow the name with a signature that may not fit in
+// the buffer.
+func peekLoginStart(br *bufio.Reader, offset int) string {
+	head, _ := br.Peek(offset + 3)
+	if len(head) <= offset {
+		return ""
+	}
+	length, n, err := decodeVarInt(head[offset:])
+	if err != nil || length < 2 {
+		return ""
+	}
+	// Packet ID and name, the name's length prefix taking a single byte
+	want := min(offset+n+int(length), offset+n+2+maxLoginNameLen, br.Size())
+	packet, err := br.Peek(want)
+	if err != nil {
+		return ""
+	}
+	return decodeLoginStartName(packet[offset+n:])
+}
+
+// decodeLoginStartName returns the name from the start of a Login Start body
+// (without the length prefix), or "" if it isn't one or the name is invalid.
+func decodeLoginStartName(b []byte) string {
+	id, n, err := decodeVarInt(b)
+	if err != nil || id != 0x00 {
+		return ""
+	}
+	name, _, err := decodeString(b[n:], maxLoginNameLen)
+	if err != nil || !usernamePattern.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+// forgeMarkers are the markers Forge clients append to the handshake server
+// address (e.g. "mc.example.com\x00FML2\x00"), newest first.
+var forgeMarkers = []string{"FML3", "FML2", "FML"}
+
+// Hostname returns the server address without any NUL-separated suffix such
+// as Forge markers or forwarding data.
+func (hs *Handshake) Hostname() string {
+	host, _, _ := strings.Cut(hs.ServerAddress, "\x00")
+	return host
+}
+
+// ForgeMarker returns "FML", "FML2" or "FML3" if the handshake comes from a
+// Forge (modded) client, or "" for vanilla clients.
+func (hs *Handshake) ForgeMarker() string {
+	return forgeMarker(hs.ServerAddress)
+}
+
+// forgeMarker returns the Forge marker contained in a handshake address.
+func forgeMarker(addr string) string {
+	for _, marker := range forgeMarkers {
+		if strings.Contains(addr, "\x00"+marker+"\x00") {
+			return marker
+		}
+	}
+	return ""
+}
+
+// encode serializes the handshake as a complete, length-prefixed packet.
+func (hs *Handshake) encode() []byte {
+	body := appendVarInt(nil, 0x00)
+	body = appendVarInt(body, hs.ProtocolVersion)
+	body = appendString(body, hs.ServerAddress)
+	body = binary.BigEndian.AppendUint16(body, hs.ServerPort)
+	body = appendVarInt(body, hs.NextState)
+	return appendVarInt(nil, int32(len(body)), body...)
+}
+
+// encodeLoginDisconnect builds a Login-state Disconnect packet that shows
+// reason to the player.
+func encodeLoginDisconnect(reason string) []byte {
+	msg, _ := json.Marshal(map[string]string{"text": reason})
+	body := appendString([]byte{0x00}, string(msg))
+	return appendVarInt(nil, int32(len(body)), body...)
+}
+
+// decodeVarInt decodes a Minecraft VarInt, returning the value and the
+// number of bytes read.
+func decodeVarInt(b []byte) (int32, int, error) {
+	var value uint32
+	for i := 0; i < 5; i++ {
+		if i >= len(b) {
+			return 0, 0, errors.New("truncated varint")
+		}
+		value |= uint32(b[i]&0x7F) << (7 * i)
+		if b[i]&0x80 == 0 {
+			return int32(value), i + 1, nil
+		}
+	}
+	return 0, 0, errVarIntTooLong
+}
+
+// appendVarInt appends v as a VarInt, followed by any extra bytes.
+func appendVarInt(b []byte, v int32, extra ...byte) []byte {
+	u := uint32(v)
+	for u >= 0x80 {
+		b = append(b, byte(u)|0x80)
+		u >>= 7
+	}
+	b = append(b, byte(u))
+	return append(b, extra...)
+}
+
+// decodeString decodes a VarInt-prefixed UTF-8 string of at most maxLen bytes.
+func decodeString(b []byte, maxLen int) (string, int, error) {
+	length, n, err := decodeVarInt(b)
+	if err != nil {
+		return "", 0, err
+	}
+	if length < 0 || int(length) > maxLen {
+		return "", 0, fmt.Errorf("string length %d out of range", length)
+	}
+	if len(b) < n+int(length) {
+		return "", 0, errors.New("truncated string")
+	}
+	s := b[n : n+int(length)]
+	if !utf8.Valid(s) {
+		return "", 0, errors.New("string is not valid UTF-8")
+	}
+	return string(s), n + int(length), nil
+}
+
+// appendString appends s as a VarInt-prefixed string.
+func appendString(b []byte, s string) []byte {
+	b = appendVarInt(b, int32(len(s)))
+	return append(b, s...)
+}
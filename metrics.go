@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsPrefix namespaces every exported metric.
+const metricsPrefix = "mc_dual_proxy_"
+
+// topTalkerLimit bounds the per-IP connection gauge to the IPs with the most
+// concurrent connections, keeping label cardinality in check.
+const topTalkerLimit = 10
+
+// dialBuckets are the upper bounds (in seconds) of the backend dial latency
+// histogram buckets.
+var dialBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram holds the observations of one Prometheus histogram.
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a set of histograms keyed by label values.
+type histogramVec struct {
+	buckets []float64
+	labels  []string
+
+	mu    sync.Mutex
+	hists map[string]*histogram // key: label values joined by \x00
+}
+
+func newHistogramVec(buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{buckets: buckets, labels: labels, hists: make(map[string]*histogram)}
+}
+
+// observe records v for the given label values.
+func (hv *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	h, ok := hv.hists[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(hv.buckets)+1)}
+		hv.hists[key] = h
+	}
+	h.counts[sort.SearchFloat64s(hv.buckets, v)]++
+	h.sum += v
+	h.count++
+}
+
+// write outputs every histogram of the vec as one metric family.
+func (hv *histogramVec) write(p metricsSink, name, help string) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	p.family(name, "histogram", help)
+	for _, key := range sortedKeys(hv.hists) {
+		h := hv.hists[key]
+		var labels []string
+		for i, value := range strings.Split(key, "\x00") {
+			labels = append(labels, hv.labels[i], value)
+		}
+		var cumulative uint64
+		for i, bound := range hv.buckets {
+			cumulative += h.counts[i]
+			p.sample(name+"_bucket", float64(cumulative), append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+		}
+		p.sample(name+"_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+		p.sample(name+"_sum", h.sum, labels...)
+		p.sample(name+"_count", float64(h.count), labels...)
+	}
+}
+
+// dialLatency records how long backend dials take, by backend and result.
+var dialLatency = newHistogramVec(dialBuckets, "backend", "result")
+
+// observeDial records one backend dial in the dial latency histogram, and
+// as a StatsD timer when -statsd is set.
+func observeDial(backendAddr string, latency time.Duration, err error) {
+	dialLatency.observe(latency.Seconds(), backendAddr, dialResult(err))
+	if s := statsd.Load(); s != nil {
+		s.timing("backend_dial", latency, "backend", backendAddr, "result", dialResult(err))
+	}
+}
+
+// dialResult classifies a dial error as success, refused, timeout or error.
+func dialResult(err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return "success"
+	case isConnRefused(err):
+		return "refused"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// metricsSink receives the metrics written by writeMetrics: Prometheus on
+// /metrics, and the StatsD emitter.
+type metricsSink interface {
+	// family starts a metric family; typ is counter, gauge or histogram.
+	family(name, typ, help string)
+	// sample writes one sample. labels are alternating names and values.
+	sample(name string, value float64, labels ...string)
+}
+
+// promWriter writes metrics in the Prometheus text exposition format.
+type promWriter struct {
+	w *bufio.Writer
+}
+
+// family starts a metric family with its HELP and TYPE lines.
+func (p *promWriter) family(name, typ, help string) {
+	fmt.Fprintf(p.w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, typ)
+}
+
+// sample writes one sample. labels are alternating names and values.
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.w.WriteString(metricsPrefix + name)
+	if len(labels) > 0 {
+		p.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.w.WriteByte(',')
+			}
+			fmt.Fprintf(p.w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		p.w.WriteByte('}')
+	}
+	p.w.WriteByte(' ')
+	p.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	p.w.WriteByte('\n')
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// handleMetrics serves /metrics for Prometheus.
+func handleMetrics(cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		p := &promWriter{w: bufio.NewWriter(w)}
+		defer p.w.Flush()
+		writeMetrics(p, cfg)
+	}
+}
+
+func writeMetrics(p metricsSink, cfg Config) {
+	conns := tracker.snapshot()
+
+	build := currentBuild()
+	p.family("build_info", "gauge", "Always 1; the labels tell which build is running.")
+	p.sample("build_info", 1, "version", build.Version, "commit", build.Commit, "go_version", build.GoVersion)
+
+	p.family("connections_accepted_total", "counter", "Connections accepted since startup.")
+	p.sample("connections_accepted_total", float64(tracker.accepted.Load()))
+
+	p.family("connections_refused_total", "counter", "Connections turned away before reaching the backend (bans, rate limits, anti-bot, full server).")
+	p.sample("connections_refused_total", float64(tracker.refused.Load()))
+
+	p.family("connections_silent_total", "counter", "Connections closed without sending anything, by the client or -first-byte-timeout.")
+	p.sample("connections_silent_total", float64(tracker.silent.Load()))
+	writeHandlerMetrics(p)
+
+	p.family("bytes_total", "counter", "Bytes proxied since startup.")
+	p.sample("bytes_total", float64(tracker.bytesIn.Load()), "direction", "in")
+	p.sample("bytes_total", float64(tracker.bytesOut.Load()), "direction", "out")
+
+	// Concurrent connections per route, including idle routes
+	perRoute := map[string]int{defaultRouteName: 0}
+	for _, rt := range cfg.Routes {
+		perRoute[rt.Name] = 0
+	}
+	perIP := map[string]int{}
+	for _, c := range conns {
+		perRoute[c.Route]++
+		perIP[addrIP(c.RealAddr)]++
+	}
+	p.family("connections", "gauge", "Live connections per route.")
+	for _, name := range sortedKeys(perRoute) {
+		p.sample("connections", float64(perRoute[name]), "route", name)
+	}
+
+	// Top talkers: the IPs holding the most connections
+	ips := sortedKeys(perIP)
+	sort.SliceStable(ips, func(i, j int) bool { return perIP[ips[i]] > perIP[ips[j]] })
+	p.family("ip_connections", "gauge", fmt.Sprintf("Live connections of the %d IPs with the most connections.", topTalkerLimit))
+	for _, ip := range ips[:min(len(ips), topTalkerLimit)] {
+		p.sample("ip_connections", float64(perIP[ip]), "ip", ip)
+	}
+	p.family("connection_ips", "gauge", "Distinct IPs with live connections.")
+	p.sample("connection_ips", float64(len(perIP)))
+
+	if cfg.BackendPool != nil {
+		p.family("backend_pool_connections", "gauge", "Pre-dialed backend connections ready for logins.")
+		p.sample("backend_pool_connections", float64(cfg.BackendPool.idleCount()))
+		p.family("backend_pool_takes_total", "counter", "Logins that asked the backend pool for a connection, by result (hit, miss).")
+		p.sample("backend_pool_takes_total", float64(cfg.BackendPool.hits.Load()), "result", "hit")
+		p.sample("backend_pool_takes_total", float64(cfg.BackendPool.misses.Load()), "result", "miss")
+		p.family("backend_pool_saved_seconds_total", "counter", "Backend dial time logins skipped thanks to the pool.")
+		p.sample("backend_pool_saved_seconds_total", time.Duration(cfg.BackendPool.saved.Load()).Seconds())
+	}
+
+	if cfg.AllowedHosts != nil {
+		hostChecks.write(p)
+	}
+
+	latencyProbes.write(p)
+	if cfg.Keepalive != nil {
+		cfg.Keepalive.write(p)
+	}
+	if cfg.StatusReport != nil {
+		cfg.StatusReport.write(p)
+	}
+	if cfg.Chaos != nil {
+		cfg.Chaos.write(p)
+	}
+	if cfg.Mirror != nil {
+		cfg.Mirror.write(p)
+	}
+	if cfg.Shaper != nil {
+		cfg.Shaper.write(p)
+	}
+	if cfg.Reputation != nil {
+		cfg.Reputation.write(p)
+	}
+	if cfg.VPN != nil {
+		cfg.VPN.write(p)
+	}
+	if cfg.Limbo != nil {
+		cfg.Limbo.write(p)
+	}
+	dialLatency.write(p, "backend_dial_seconds", "Backend dial latency by result (success, refused, timeout, error).")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
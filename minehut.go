@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minehutAPI = "https://api.minehut.com"
+
+	// minehutResendInterval limits how often the start request is repeated
+	// while a hibernating server boots, which takes a minute or more.
+	minehutResendInterval = 30 * time.Second
+)
+
+// minehutWaker starts a hibernating Minehut server through the Minehut API,
+// the way the panel's Start button does.
+type minehutWaker struct {
+	api      string // API base URL
+	serverID string
+	token    string // Authorization header of a logged-in panel session
+	session  string // x-session-id of the same session; optional
+	client   *http.Client
+
+	mu       sync.Mutex
+	lastSent time.Time
+}
+
+func newMinehutWaker(api, serverID, token, session string) (*minehutWaker, error) {
+	if serverID == "" || token == "" {
+		return nil, errors.New("both a server ID and an API token are needed")
+	}
+	if strings.ContainsAny(serverID, "/?#") {
+		return nil, fmt.Errorf("invalid server ID %q", serverID)
+	}
+	if u, err := url.Parse(api); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid API URL %q", api)
+	}
+	return &minehutWaker{
+		api: strings.TrimSuffix(api, "/"), serverID: serverID, token: token, session: session,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// wake asks Minehut to start the server, unless it was asked recently.
+func (m *minehutWaker) wake() {
+	m.mu.Lock()
+	if time.Since(m.lastSent) < minehutResendInterval {
+		m.mu.Unlock()
+		return
+	}
+	m.lastSent = time.Now()
+	m.mu.Unlock()
+
+	if err := m.start(); err != nil {
+		warnf("[tcp] Minehut wake: %v", err)
+		return
+	}
+	infof("[tcp] asked Minehut to start server %s", m.serverID)
+}
+
+// start sends the start request. Minehut answers it the same way whether the
+// server was hibernating or already starting.
+func (m *minehutWaker) start() error {
+	req, err := http.NewRequest(http.MethodPost, m.api+"/server/"+m.serverID+"/start_service", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", m.token)
+	if m.session != "" {
+		req.Header.Set("x-session-id", m.session)
+	}
+	req.Header.Set("User-Agent", "mc-dual-proxy/"+version)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if msg := strings.TrimSpace(string(body)); msg != "" {
+			return fmt.Errorf("start request for server %s: %s: %s", m.serverID, resp.Status, msg)
+		}
+		return fmt.Errorf("start request for server %s: %s", m.serverID, resp.Status)
+	}
+	return nil
+}
+
+// holdText is shown to players held while the server starts.
+func (m *minehutWaker) holdText() string { return startingText }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// mirrorDialTimeout bounds dialing the shadow backend. Data waits in
+	// the queue meanwhile; the real connection doesn't.
+	mirrorDialTimeout = 2 * time.Second
+
+	// mirrorWriteTimeout is how long a write to the shadow backend may take
+	// before its copy of the connection is given up on.
+	mirrorWriteTimeout = 5 * time.Second
+
+	// mirrorQueueSize is how many writes may wait for a slow shadow backend
+	// before its copy of the connection is given up on.
+	mirrorQueueSize = 64
+)
+
+// trafficMirror copies the client→backend bytes of a sample of connections
+// to a shadow backend (-mirror) and throws its answers away, so a new server
+// build can be soak-tested with real traffic. The shadow never slows down
+// the real connection: a copy that falls behind is dropped.
+type trafficMirror struct {
+	addr   string
+	rate   float64        // share of connections mirrored, 0 to 1
+	chance func() float64 // uniform in [0, 1)
+
+	mirrored   atomic.Int64
+	dialFailed atomic.Int64
+	dropped    atomic.Int64
+	bytes      atomic.Int64
+}
+
+func newTrafficMirror(addr string, rate float64) *trafficMirror {
+	return &trafficMirror{addr: addr, rate: rate, chance: rand.Float64}
+}
+
+func (m *trafficMirror) String() string {
+	return fmt.Sprintf("copying %g%% of connections to %s", m.rate*100, m.addr)
+}
+
+// start mirrors this connection if it is picked, beginning with what the
+// real backend got before the relay: the PROXY header and a rewritten
+// handshake, either of which may be nil. It returns nil for connections
+// that aren't mirrored.
+func (m *trafficMirror) start(clientAddr string, header, handshake []byte) *mirrorConn {
+	if m == nil || m.chance() >= m.rate {
+		return nil
+	}
+	c := &mirrorConn{mirror: m, client: clientAddr, queue: make(chan []byte, mirrorQueueSize)}
+	go c.run()
+	for _, p := range [][]byte{header, handshake} {
+		if p != nil {
+			c.Write(p)
+		}
+	}
+	return c
+}
+
+// mirrorConn is a connection's copy to the shadow backend. Writes queue the
+// data and never block or fail. It is written by the client→backend relay
+// only, and not safe for concurrent use.
+type mirrorConn struct {
+	mirror *trafficMirror
+	client string
+	queue  chan []byte
+	closed bool
+}
+
+func (c *mirrorConn) Write(p []byte) (int, error) {
+	if c.closed {
+		return len(p), nil
+	}
+	select {
+	case c.queue <- append([]byte(nil), p...):
+	default:
+		c.mirror.dropped.Add(1)
+		debugf("[mirror] %s: the shadow backend fell behind, no longer mirroring", c.client)
+		c.close()
+	}
+	return len(p), nil
+}
+
+// run dials the shadow backend and sends it the queued data until the queue
+// is closed. If the dial or a write fails, the rest is discarded.
+func (c *mirrorConn) run() {
+	conn, err := net.DialTimeout("tcp", c.mirror.addr, mirrorDialTimeout)
+	if err != nil {
+		c.mirror.dialFailed.Add(1)
+		debugf("[mirror] %s: can't reach the shadow backend: %v", c.client, err)
+		for range c.queue {
+		}
+		return
+	}
+	defer conn.Close()
+	c.mirror.mirrored.Add(1)
+	debugf("[mirror] %s: mirroring to %s", c.client, c.mirror.addr)
+	// Answers are thrown away, so the shadow never blocks on them
+	go io.Copy(io.Discard, conn)
+
+	failed := false
+	for p := range c.queue {
+		if failed {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout))
+		n, err := conn.Write(p)
+		c.mirror.bytes.Add(int64(n))
+		failed = err != nil
+	}
+}
+
+// close ends the copy once the client is done writing.
+func (c *mirrorConn) close() {
+	if c == nil || c.closed {
+		return
+	}
+	c.closed = true
+	close(c.queue)
+}
+
+// write adds the mirroring counters to the metrics.
+func (m *trafficMirror) write(p metricsSink) {
+	p.family("mirror_connections_total", "counter", "Connections copied to the -mirror shadow backend, by result.")
+	p.sample("mirror_connections_total", float64(m.mirrored.Load()), "result", "mirrored")
+	p.sample("mirror_connections_total", float64(m.dialFailed.Load()), "result", "dial_failed")
+	p.sample("mirror_connections_total", float64(m.dropped.Load()), "result", "dropped")
+	p.family("mirror_bytes_total", "counter", "Bytes sent to the -mirror shadow backend.")
+	p.sample("mirror_bytes_total", float64(m.bytes.Load()))
+}
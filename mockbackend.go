@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// mockBackend stands in for the real server (mock-backend subcommand): it
+// reads the PROXY header like Velocity or Paper would, and tells whoever
+// connects what it saw, in the server list MOTD or as a login disconnect
+// message. Players reaching it through Minehut and the proxy see at a
+// glance whether their address made it through.
+type mockBackend struct {
+	motd          string
+	requireHeader bool // refuse connections without a PROXY header, like haproxy-protocol = true
+}
+
+// mockSighting is what the mock backend learned about a connection.
+type mockSighting struct {
+	peer   string // TCP peer, i.e. the proxy
+	source string // player address from the PROXY header, or the peer
+	header string // "PROXY v1", "PROXY v2" or "no PROXY header"
+}
+
+func (s mockSighting) String() string {
+	return fmt.Sprintf("%s (%s from %s)", s.source, s.header, s.peer)
+}
+
+func (m *mockBackend) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go m.handle(conn)
+	}
+}
+
+func (m *mockBackend) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	br := bufio.NewReader(conn)
+
+	seen := mockSighting{peer: conn.RemoteAddr().String(), source: conn.RemoteAddr().String(), header: "no PROXY header"}
+	header, err := detectProxyProtocol(br)
+	switch {
+	case err != nil:
+		log.Printf("[mock] %s: invalid PROXY header: %v", seen.peer, err)
+		return
+	case header != nil:
+		seen.header = fmt.Sprintf("PROXY v%d", header.Version)
+		if header.SrcAddr != nil {
+			seen.source = net.JoinHostPort(header.SrcAddr.String(), itoa(int(header.SrcPort)))
+		} else {
+			seen.source = "unknown"
+		}
+	case m.requireHeader:
+		log.Printf("[mock] %s: refusing connection without a PROXY header", seen.peer)
+		return
+	}
+
+	packet, err := readPacket(br, 1024)
+	if err != nil {
+		log.Printf("[mock] %s: no handshake: %v", seen, err)
+		return
+	}
+	handshake, err := decodeHandshake(packet)
+	if err != nil {
+		log.Printf("[mock] %s: invalid handshake: %v", seen, err)
+		return
+	}
+
+	switch handshake.NextState {
+	case stateStatus:
+		log.Printf("[mock] %s: status ping for %q", seen, handshake.ServerAddress)
+		status := &ServerStatus{Description: jsonText(m.motd + "\n§7" + seen.source + " via " + seen.header)}
+		status.Version.Name = "mock-backend"
+		status.Version.Protocol = int(handshake.ProtocolVersion)
+		serveStatus(conn, br, status)
+	case stateLogin:
+		name := peekLoginStart(br, 0)
+		log.Printf("[mock] %s: login as %q for %q", seen, name, handshake.ServerAddress)
+		disconnectLogin(conn, br, fmt.Sprintf("%s\n\nYou are %s at %s\nvia %s from %s\nconnecting to %s",
+			m.motd, name, seen.source, seen.header, seen.peer, handshake.ServerAddress))
+	}
+}
+
+// runMockBackend implements the mock-backend subcommand.
+func runMockBackend(args []string) error {
+	fs := flag.NewFlagSet("mock-backend", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mc-dual-proxy mock-backend [flags]")
+		fmt.Fprintln(fs.Output(), "Stands in for the backend and shows players the address and PROXY header it saw,")
+		fmt.Fprintln(fs.Output(), "to check the Minehut → proxy → backend path before pointing the proxy at the real server.")
+		fs.PrintDefaults()
+	}
+	listen := fs.String("listen", "127.0.0.1:25566", "Address to listen on (your -backend address)")
+	motd := fs.String("motd", "§amc-dual-proxy mock backend", "First line of the MOTD and the login message")
+	requireHeader := fs.Bool("require-proxy-header", false, "Refuse connections without a PROXY header, like a backend with PROXY protocol enabled")
+	fs.Parse(args)
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	log.Printf("[mock] Mock backend on %s; join or ping the server to see what reaches it", ln.Addr())
+	return (&mockBackend{motd: *motd, requireHeader: *requireHeader}).serve(ln)
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
 	"time"
 )
@@ -18,11 +22,23 @@ const (
 	upstreamTimeout = 10 * time.Second
 )
 
+// Policies for when more than one upstream returns 200 for the same request.
+const (
+	// conflictFirst answers with the first success (honoring -prefer).
+	conflictFirst = "first"
+	// conflictPriority answers with the success from the upstream listed
+	// earliest in -session-servers.
+	conflictPriority = "priority"
+	// conflictReject answers 204 if more than one upstream succeeds.
+	conflictReject = "reject"
+)
+
 // authResult holds the response from a single upstream session server.
 type authResult struct {
 	StatusCode int
 	Body       []byte
 	Server     string
+	Latency    time.Duration
 	Err        error
 }
 
@@ -31,47 +47,141 @@ func startMultiauth(cfg Config) {
 
 	// Handle the hasJoined endpoint
 	mux.HandleFunc(hasJoinedPath, func(w http.ResponseWriter, r *http.Request) {
-		handleHasJoined(w, r, cfg.SessionServers)
+		handleHasJoined(w, r, cfg.reloaded())
 	})
 
+	// Route-specific endpoints, using the route's session servers
+	for _, rt := range cfg.Routes {
+		routeCfg := cfg.forRoute(rt)
+		mux.HandleFunc(routePathPrefix+rt.Name+hasJoinedPath, func(w http.ResponseWriter, r *http.Request) {
+			handleHasJoined(w, r, routeCfg)
+		})
+	}
+
 	// Health check
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprint(w, "ok")
 	})
 
+	// Kubernetes probes
+	registerProbes(mux, cfg)
+
 	// Catch-all: return 404 with info
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// Some server software may hit slightly different paths,
 		// so if it looks like a hasJoined request, handle it
-		if strings.Contains(r.URL.Path, "hasJoined") {
-			handleHasJoined(w, r, cfg.SessionServers)
+		if strings.Contains(r.URL.Path, "hasJoined") && !strings.HasPrefix(r.URL.Path, routePathPrefix) {
+			handleHasJoined(w, r, cfg.reloaded())
 			return
 		}
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprint(w, "mc-dual-proxy multiauth server")
 	})
 
+	var handler http.Handler = mux
+	if cfg.AuthAccessLog != nil {
+		handler = cfg.AuthAccessLog.wrap(mux)
+	}
 	server := &http.Server{
-		Addr:         cfg.AuthListenAddr,
-		Handler:      mux,
+		Handler:      handler,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
 
-	log.Printf("[auth] Listening on %s", cfg.AuthListenAddr)
-	if err := server.ListenAndServe(); err != nil {
+	// Bind every address before serving any, so a typo fails startup as a whole
+	var listeners []net.Listener
+	for _, addr := range cfg.AuthListenAddrs {
+		ln, err := listenAuth(addr)
+		if err != nil {
+			log.Fatalf("[auth] Failed to start: %v", err)
+		}
+		infof("[auth] Listening on %s", addr)
+		listeners = append(listeners, ln)
+	}
+	readiness.authUp.Store(true)
+	for _, ln := range listeners[1:] {
+		go func() {
+			if err := server.Serve(ln); err != nil {
+				log.Fatalf("[auth] Failed to start: %v", err)
+			}
+		}()
+	}
+	if err := server.Serve(listeners[0]); err != nil {
 		log.Fatalf("[auth] Failed to start: %v", err)
 	}
 }
 
+// parseAuthListen parses a comma-separated list of -auth-listen addresses:
+// host:port, or unix:PATH for a Unix socket.
+func parseAuthListen(spec string) ([]string, error) {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range strings.Split(spec, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if path, isUnix := strings.CutPrefix(addr, "unix:"); isUnix {
+			if path == "" {
+				return nil, fmt.Errorf("missing socket path in %q", addr)
+			}
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid address %q: %v", addr, err)
+		}
+		if seen[addr] {
+			return nil, fmt.Errorf("duplicate address %q", addr)
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("expected at least one address, got %q", spec)
+	}
+	return addrs, nil
+}
+
+// listenAuth binds one -auth-listen address. A socket file left behind by a
+// previous run is replaced; any other file at the path is an error.
+func listenAuth(addr string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if !isUnix {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// authHTTPAddr returns the -auth-listen address backends reach over HTTP in
+// setup instructions: the first one that isn't a Unix socket. If all of them
+// are, it returns the first socket and false; Java backends can't use it
+// directly, only through a reverse proxy.
+func authHTTPAddr(addrs []string) (string, bool) {
+	for _, addr := range addrs {
+		if !strings.HasPrefix(addr, "unix:") {
+			return addr, true
+		}
+	}
+	return addrs[0], false
+}
+
 // handleHasJoined fans out the hasJoined request to all configured session
 // servers concurrently and returns the first successful (HTTP 200) response.
 //
 // The Minecraft login flow guarantees that only the "correct" session server
 // will return 200 for any given serverId hash, because the hash is derived
 // from the encryption handshake which is unique per connection path.
-func handleHasJoined(w http.ResponseWriter, r *http.Request, servers []string) {
+//
+// If a preferred upstream is configured, a success from any other upstream
+// that arrives within the preference window is held back until the preferred
+// upstream has answered or the window has elapsed.
+//
+// In the rare case that several upstreams succeed, the conflict is logged and
+// resolved according to cfg.ConflictPolicy. Upstream requests are not
+// cancelled when the response is written, so late successes are still seen.
+func handleHasJoined(w http.ResponseWriter, r *http.Request, cfg Config) {
+	servers := cfg.SessionServers
 	query := r.URL.RawQuery
 	username := r.URL.Query().Get("username")
 
@@ -80,72 +190,445 @@ func handleHasJoined(w http.ResponseWriter, r *http.Request, servers []string) {
 		return
 	}
 
-	log.Printf("[auth] hasJoined request: username=%s", username)
+	// Only the backends need the multiauth server; behind a reverse proxy,
+	// the requester is taken from X-Forwarded-For
+	requester := requesterIP(r, cfg.AuthTrustedProxies)
+	if cfg.AuthAllow != nil && !isTrustedProxy(cfg.AuthAllow, requester) {
+		warnf("[auth] hasJoined request from %s refused: not in -auth-allow", requester)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), upstreamTimeout)
-	defer cancel()
+	if cfg.Route != "" && cfg.Route != defaultRouteName {
+		infof("[auth] hasJoined request: username=%s from=%s (route %s)", username, requester, cfg.Route)
+	} else {
+		infof("[auth] hasJoined request: username=%s from=%s", username, requester)
+	}
+
+	// Hostnames may have session servers of their own and backends may
+	// accept only some upstreams; the player's live connection tells which
+	// hostname they connected with and where they are headed
+	var conn *trackedConn
+	var backend string
+	if cfg.HostAuth != nil || cfg.BackendUpstreams != nil || cfg.Companion != nil {
+		conn = tracker.loginConn(username, r.URL.Query().Get("ip"))
+		if conn == nil {
+			debugf("[auth]   no live connection for username=%s, using the default session servers", username)
+		} else {
+			backend, _ = conn.backend.Load().(string)
+			if hostServers, pattern := cfg.HostAuth.serversFor(conn.Host); hostServers != nil {
+				infof("[auth]   host=%s matches %s, using its %d session servers", conn.Host, pattern, len(hostServers))
+				servers = hostServers
+			}
+		}
+		if backend == "" && cfg.BackendUpstreams != nil {
+			// Without the connection, the route's backend is the best guess;
+			// backendUpstreams refuses every upstream if there is none
+			backend = cfg.currentBackend()
+		}
+	}
+
+	if cfg.AuthIPLimiter != nil && !cfg.AuthIPLimiter.allow(requester) {
+		infof("[auth]   %s exceeds %s, rejecting without querying upstreams", requester, cfg.AuthIPLimiter)
+		w.WriteHeader(http.StatusNoContent)
+		activity.recordAuth(authEvent{Time: time.Now(), Username: username, Result: "throttled"})
+		events.publish(eventRateLimitHit, map[string]any{"limit": "auth_ip", "username": username, "real": requester})
+		return
+	}
+
+	// Names no real account can have, or that the operator blocked, never
+	// reach the upstreams
+	if cfg.UsernameFilter != nil {
+		if reason := cfg.UsernameFilter.check(username); reason != "" {
+			infof("[auth]   username=%q refused (%s)", username, reason)
+			w.WriteHeader(http.StatusNoContent)
+			activity.recordAuth(authEvent{Time: time.Now(), Username: username, Result: "blocked"})
+			events.publish(eventLoginBlocked, map[string]any{"username": username, "reason": reason})
+			return
+		}
+	}
+
+	// Banned players fail authentication, which makes the backend kick them
+	if cfg.Bans != nil {
+		b, banned := cfg.Bans.checkUsername(username)
+		if ip := r.URL.Query().Get("ip"); !banned && ip != "" {
+			b, banned = cfg.Bans.checkIP(ip)
+		}
+		if banned {
+			infof("[auth]   username=%s is banned (ban on %s), rejecting", username, b.Target)
+			w.WriteHeader(http.StatusNoContent)
+			activity.recordAuth(authEvent{Time: time.Now(), Username: username, Result: "banned"})
+			events.publish(eventLoginBlocked, map[string]any{"username": username, "reason": "banned"})
+			return
+		}
+	}
+
+	// Players not on the whitelist aren't worth a fan-out
+	if cfg.Whitelist != nil && !cfg.Whitelist.allowsName(username) {
+		infof("[auth]   username=%s is not whitelisted, rejecting", username)
+		w.WriteHeader(http.StatusNoContent)
+		activity.recordAuth(authEvent{Time: time.Now(), Username: username, Result: "not_whitelisted"})
+		events.publish(eventLoginBlocked, map[string]any{"username": username, "reason": "not_whitelisted"})
+		return
+	}
+
+	// Bot waves rotate server IDs but reuse names; answer them without
+	// bothering the upstreams
+	if cfg.AuthLimiter != nil && !cfg.AuthLimiter.allow(strings.ToLower(username)) {
+		infof("[auth]   username=%s exceeds %s, rejecting without querying upstreams", username, cfg.AuthLimiter)
+		w.WriteHeader(http.StatusNoContent)
+		activity.recordAuth(authEvent{Time: time.Now(), Username: username, Result: "throttled"})
+		events.publish(eventRateLimitHit, map[string]any{"limit": "auth", "username": username})
+		return
+	}
+
+	// A serverId is unique to one login's encryption handshake: seeing it
+	// succeed again later is a captured exchange being replayed
+	serverID := canonicalQuery(r.URL.Query()).Get("serverId")
+	if cfg.ReplayGuard != nil && serverID != "" && !cfg.ReplayGuard.allow(serverID) {
+		warnf("[auth]   username=%s reused serverId %s after %s, rejecting as a replay", username, serverID, cfg.ReplayGuard.window)
+		w.WriteHeader(http.StatusNoContent)
+		activity.recordAuth(authEvent{Time: time.Now(), Username: username, Result: "replayed"})
+		events.publish(eventLoginBlocked, map[string]any{"username": username, "reason": "replayed_server_id"})
+		return
+	}
+
+	// Detached from the request so upstreams can finish after we respond
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), upstreamTimeout)
+
+	policy := cfg.ConflictPolicy
+	if policy == "" {
+		policy = conflictFirst
+	}
+
+	// Lower index = higher priority, used by the priority policy
+	priority := make(map[string]int, len(servers))
+	for i, server := range servers {
+		if _, ok := priority[upstreamName(server)]; !ok {
+			priority[upstreamName(server)] = i
+		}
+	}
 
 	// Fan out requests to all session servers concurrently
+	start := time.Now()
 	resultCh := make(chan authResult, len(servers))
+	client := cfg.UpstreamClient
+	if client == nil {
+		client = defaultUpstreamClient
+	}
 	for _, server := range servers {
-		go querySessionServer(ctx, server, query, resultCh)
+		go querySessionServer(ctx, client, server, query, dialectFor(cfg.Dialects, server), resultCh)
 	}
 
-	// Wait for a successful response or all failures
+	// Only wait for the preferred upstream if it is actually being queried
+	_, preferPending := priority[cfg.PreferUpstream]
+	preferPending = preferPending && policy == conflictFirst
+
+	// Wait for a winning response or all failures
 	var lastResult authResult
+	noContent := 0 // upstreams that answered 204
+	var successes []authResult
+	var held *authResult
+	var graceTimer <-chan time.Time
+	var unaccepted string // upstream that succeeded but backend doesn't accept
+	answered := make(map[string]bool, len(servers))
 	remaining := len(servers)
 
+	// respond writes the final answer and leaves any outstanding upstream
+	// requests running in the background to detect conflicts.
+	respond := func(winner *authResult) {
+		var uuidBan ban
+		uuidBanned := false
+		if winner != nil && cfg.Bans != nil {
+			uuidBan, uuidBanned = cfg.Bans.checkUUID(profileID(winner.Body))
+		}
+		if uuidBanned {
+			// Banned on the backend under a name they no longer have
+			infof("[auth]   username=%s authenticated as %s, which is banned (%s), rejecting", username, dashUUID(profileID(winner.Body)), uuidBan.Reason)
+			w.WriteHeader(http.StatusNoContent)
+			activity.recordAuth(authEvent{Time: time.Now(), Username: username, Result: "banned", Upstream: winner.Server})
+			events.publish(eventLoginBlocked, map[string]any{"username": username, "reason": "banned"})
+		} else if winner != nil && cfg.Whitelist != nil && !cfg.Whitelist.allowsProfile(username, profileID(winner.Body)) {
+			// The name is listed, but for another account
+			infof("[auth]   username=%s authenticated as %s, which the whitelist doesn't list, rejecting", username, dashUUID(profileID(winner.Body)))
+			w.WriteHeader(http.StatusNoContent)
+			activity.recordAuth(authEvent{Time: time.Now(), Username: username, Result: "not_whitelisted", Upstream: winner.Server})
+			events.publish(eventLoginBlocked, map[string]any{"username": username, "reason": "not_whitelisted"})
+		} else if winner != nil {
+			// Tells backend plugins which upstream vouched for the player,
+			// and what else the proxy knows about them
+			var extra []profileProperty
+			if cfg.AuthSourceProperty != "" {
+				extra = append(extra, profileProperty{Name: cfg.AuthSourceProperty, Value: upstreamName(winner.Server)})
+			}
+			if cfg.Companion != nil {
+				extra = append(extra, cfg.Companion.property(winner.Server, conn))
+			}
+			answer := *winner
+			for _, prop := range extra {
+				body, err := addProfileProperty(answer.Body, prop)
+				if err != nil {
+					warnf("[auth]   %s: can't add the %s property: %v", winner.Server, prop.Name, err)
+					break
+				}
+				answer.Body = body
+			}
+			writeAuthSuccess(w, answer)
+			activity.recordAuth(authEvent{Time: time.Now(), Username: username, Result: "success", Upstream: winner.Server})
+			events.publish(eventAuthSuccess, map[string]any{"username": username, "upstream": winner.Server})
+			sessions.record(username, winner.Server, winner.Body)
+			if cfg.ReplayGuard != nil && serverID != "" {
+				cfg.ReplayGuard.record(serverID)
+			}
+			// Backends with prevent-proxy-connections send the player's IP
+			if ip := r.URL.Query().Get("ip"); ip != "" {
+				tracker.tagUsername(ip, username)
+			}
+		} else if unaccepted != "" {
+			// The login is encrypted by now, so the backend's "failed to
+			// verify" is all the player sees; the reason goes to the logs
+			infof("[auth]   username=%s is only known to %s, which backend %s doesn't accept, rejecting", username, unaccepted, backend)
+			w.WriteHeader(http.StatusNoContent)
+			activity.recordAuth(authEvent{Time: time.Now(), Username: username, Result: "upstream_not_accepted", Upstream: unaccepted})
+			events.publish(eventLoginBlocked, map[string]any{"username": username, "reason": "upstream_not_accepted", "upstream": unaccepted, "backend": backend})
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+			activity.recordAuth(authEvent{Time: time.Now(), Username: username, Result: "failed"})
+			events.publish(eventAuthFail, map[string]any{"username": username})
+		}
+		if remaining > 0 && winner != nil {
+			go drainAuthResults(resultCh, remaining, username, *winner, cfg.SlowUpstream, cancel)
+		} else {
+			cancel()
+		}
+	}
+
+collect:
 	for remaining > 0 {
 		select {
 		case result := <-resultCh:
 			remaining--
+			answered[result.Server] = true
+			activity.recordUpstream(result)
+			logSlowUpstream(result, username, cfg.SlowUpstream)
+			if result.Server == cfg.PreferUpstream {
+				preferPending = false
+			}
 
+			accepted := isAuthSuccess(result) && cfg.BackendUpstreams.accepts(backend, result.Server)
 			if result.Err != nil {
-				log.Printf("[auth]   %s: error: %v", result.Server, result.Err)
+				warnf("[auth]   %s: error: %v", result.Server, result.Err)
+				lastResult = result
+			} else if isAuthSuccess(result) && !accepted {
+				infof("[auth]   %s: SUCCESS, but backend %s doesn't accept it", result.Server, backend)
+				unaccepted = result.Server
+				lastResult = result
+			} else if accepted {
+				infof("[auth]   %s: SUCCESS (200, %d bytes)", result.Server, len(result.Body))
+				successes = append(successes, result)
+				if len(successes) > 1 {
+					logAuthConflict(username, successes[0], result)
+				}
+			} else {
+				infof("[auth]   %s: no match (status=%d, body=%d bytes)", result.Server, result.StatusCode, len(result.Body))
 				lastResult = result
-				continue
+				if result.StatusCode == http.StatusNoContent {
+					noContent++
+				}
 			}
 
-			if result.StatusCode == http.StatusOK && len(result.Body) > 0 {
-				// Success! This is the correct session server for this connection.
-				log.Printf("[auth]   %s: SUCCESS (200, %d bytes)", result.Server, len(result.Body))
-				cancel() // Cancel remaining requests
+			switch policy {
+			case conflictReject:
+				if len(successes) > 1 {
+					warnf("[auth]   rejecting username=%s: %d upstreams succeeded", username, len(successes))
+					respond(nil)
+					return
+				}
 
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusOK)
-				w.Write(result.Body)
-				return
+			case conflictPriority:
+				// The best success wins once every higher-priority upstream has answered
+				if best := bestByPriority(successes, priority); best != nil {
+					decided := true
+					for i, server := range servers {
+						if i < priority[best.Server] && !answered[upstreamName(server)] {
+							decided = false
+						}
+					}
+					if decided {
+						respond(best)
+						return
+					}
+				}
+
+			default:
+				if held != nil {
+					if result.Server == cfg.PreferUpstream && accepted {
+						respond(&result)
+						return
+					}
+					if !preferPending {
+						// The preferred upstream did not succeed, so the held success stands
+						infof("[auth]   %s: using held response", held.Server)
+						respond(held)
+						return
+					}
+					continue
+				}
+				if accepted {
+					elapsed := time.Since(start)
+					if preferPending && elapsed < cfg.PreferWindow {
+						// Give the preferred upstream the rest of its window to answer
+						infof("[auth]   %s: holding for preferred upstream %s", result.Server, cfg.PreferUpstream)
+						held = &result
+						graceTimer = time.After(cfg.PreferWindow - elapsed)
+						continue
+					}
+
+					// Success! This is the correct session server for this connection.
+					respond(&result)
+					return
+				}
 			}
 
-			log.Printf("[auth]   %s: no match (status=%d, body=%d bytes)", result.Server, result.StatusCode, len(result.Body))
-			lastResult = result
+		case <-graceTimer:
+			infof("[auth]   preferred upstream %s did not answer within %s, using %s", cfg.PreferUpstream, cfg.PreferWindow, held.Server)
+			respond(held)
+			return
 
 		case <-ctx.Done():
-			log.Printf("[auth]   timeout waiting for session servers")
-			w.WriteHeader(http.StatusNoContent)
-			return
+			warnf("[auth]   timeout waiting for session servers")
+			break collect
 		}
 	}
 
-	// All servers responded but none returned 200
-	log.Printf("[auth]   all servers failed for username=%s (last status=%d)", username, lastResult.StatusCode)
+	// Every upstream has answered (or timed out) without an early decision
+	switch {
+	case held != nil:
+		respond(held)
+	case len(successes) == 1:
+		respond(&successes[0])
+	case len(successes) > 1 && policy == conflictPriority:
+		respond(bestByPriority(successes, priority))
+	case len(successes) > 1 && policy == conflictFirst:
+		respond(&successes[0])
+	case len(successes) > 1:
+		warnf("[auth]   rejecting username=%s: %d upstreams succeeded", username, len(successes))
+		respond(nil)
+	default:
+		// All servers responded but none returned 200
+		infof("[auth]   all servers failed for username=%s (last status=%d)", username, lastResult.StatusCode)
 
-	// Return 204 No Content (standard "auth failed" response for Minecraft)
-	w.WriteHeader(http.StatusNoContent)
+		// Only a clear "no" from every upstream lets a player in offline:
+		// an outage must not turn premium players into cracked ones
+		if cfg.OfflineFallback != nil && noContent == len(servers) {
+			host, ok := cfg.OfflineFallback.allows(username)
+			if ok {
+				warnf("[auth]   OFFLINE username=%s allowed without authentication (host=%q, uuid=%s)", username, host, dashUUID(offlineUUID(username)))
+				respond(&authResult{StatusCode: http.StatusOK, Body: offlineProfile(username), Server: offlineUpstream})
+				return
+			}
+			infof("[auth]   username=%s may not fall back to offline mode via host %q", username, host)
+		}
+
+		// Return 204 No Content (standard "auth failed" response for Minecraft)
+		respond(nil)
+	}
 }
 
-// querySessionServer makes a hasJoined request to a single upstream session server.
-func querySessionServer(ctx context.Context, serverBase, rawQuery string, resultCh chan<- authResult) {
-	// Build the full URL: base + /session/minecraft/hasJoined?query
-	url := strings.TrimRight(serverBase, "/") + hasJoinedPath + "?" + rawQuery
+// drainAuthResults collects the responses still outstanding after a winner
+// was chosen, logging any further success as a conflict.
+func drainAuthResults(resultCh <-chan authResult, remaining int, username string, winner authResult, slowThreshold time.Duration, cancel context.CancelFunc) {
+	defer cancel()
+	for ; remaining > 0; remaining-- {
+		result := <-resultCh
+		activity.recordUpstream(result)
+		logSlowUpstream(result, username, slowThreshold)
+		if isAuthSuccess(result) {
+			logAuthConflict(username, winner, result)
+		}
+	}
+}
 
-	// Identify the server for logging
-	serverName := serverBase
+// isAuthSuccess reports whether an upstream authenticated the player.
+func isAuthSuccess(result authResult) bool {
+	return result.Err == nil && result.StatusCode == http.StatusOK && len(result.Body) > 0
+}
+
+// bestByPriority returns the success from the highest-priority upstream.
+func bestByPriority(successes []authResult, priority map[string]int) *authResult {
+	var best *authResult
+	for i := range successes {
+		if best == nil || priority[successes[i].Server] < priority[best.Server] {
+			best = &successes[i]
+		}
+	}
+	return best
+}
+
+// logSlowUpstream warns when an upstream took longer than threshold to
+// answer, so a chronically slow provider stands out in the logs. A zero
+// threshold disables the warning.
+func logSlowUpstream(result authResult, username string, threshold time.Duration) {
+	if threshold <= 0 || result.Latency <= threshold {
+		return
+	}
+	warnf("[auth]   SLOW upstream=%s latency=%s threshold=%s status=%d username=%s",
+		result.Server, result.Latency.Round(time.Millisecond), threshold, result.StatusCode, username)
+}
+
+// logAuthConflict logs two upstreams that both returned 200 for one request.
+func logAuthConflict(username string, first, second authResult) {
+	warnf("[auth]   CONFLICT for username=%s: %s returned %s, %s returned %s",
+		username, first.Server, profileSummary(first.Body), second.Server, profileSummary(second.Body))
+}
+
+// profileSummary renders the identifying fields of a profile JSON for logs.
+func profileSummary(body []byte) string {
+	var profile struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(body, &profile); err != nil || profile.ID == "" {
+		if len(body) > 64 {
+			body = body[:64]
+		}
+		return fmt.Sprintf("%q", body)
+	}
+	return fmt.Sprintf("{id=%s name=%s}", profile.ID, profile.Name)
+}
+
+// writeAuthSuccess relays a successful upstream profile to the backend.
+func writeAuthSuccess(w http.ResponseWriter, result authResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result.Body)
+}
+
+// upstreamName returns a short, human-friendly name for a session server,
+// used in logs and for matching upstreams in flags like -prefer.
+func upstreamName(serverBase string) string {
 	if strings.Contains(serverBase, "mojang") {
-		serverName = "mojang"
+		return "mojang"
 	} else if strings.Contains(serverBase, "minehut") {
-		serverName = "minehut"
+		return "minehut"
 	}
+	return serverBase
+}
+
+// querySessionServer makes a hasJoined request to a single upstream session
+// server, adapting it to the server's dialect.
+func querySessionServer(ctx context.Context, client *http.Client, serverBase, rawQuery string, dialect upstreamDialect, resultCh chan<- authResult) {
+	if dialect.query != nil {
+		if q, err := url.ParseQuery(rawQuery); err == nil {
+			rawQuery = dialect.query(q).Encode()
+		}
+	}
+
+	// Build the full URL: base + /session/minecraft/hasJoined?query
+	url := strings.TrimRight(serverBase, "/") + hasJoinedPath + "?" + rawQuery
+
+	// Identify the server for logging
+	serverName := upstreamName(serverBase)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
@@ -153,17 +636,10 @@ func querySessionServer(ctx context.Context, serverBase, rawQuery string, result
 		return
 	}
 
-	// Use a client without following redirects for safety
-	client := &http.Client{
-		Timeout: upstreamTimeout,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
-		resultCh <- authResult{Server: serverName, Err: fmt.Errorf("request failed: %w", err)}
+		resultCh <- authResult{Server: serverName, Latency: time.Since(start), Err: fmt.Errorf("request failed: %w", err)}
 		return
 	}
 	defer resp.Body.Close()
@@ -171,13 +647,20 @@ func querySessionServer(ctx context.Context, serverBase, rawQuery string, result
 	// Read the response body (session server responses are small JSON objects)
 	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024)) // 64KB max
 	if err != nil {
-		resultCh <- authResult{Server: serverName, Err: fmt.Errorf("read body: %w", err)}
+		resultCh <- authResult{Server: serverName, Latency: time.Since(start), Err: fmt.Errorf("read body: %w", err)}
 		return
 	}
+	if resp.StatusCode == http.StatusOK && len(body) > 0 && dialect.normalize != nil {
+		if body, err = dialect.normalize(body); err != nil {
+			resultCh <- authResult{StatusCode: resp.StatusCode, Server: serverName, Latency: time.Since(start), Err: fmt.Errorf("%s response: %w", dialect.name, err)}
+			return
+		}
+	}
 
 	resultCh <- authResult{
 		StatusCode: resp.StatusCode,
 		Body:       body,
 		Server:     serverName,
+		Latency:    time.Since(start),
 	}
 }
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Port mapping modes (-port-mapping).
+const (
+	portMapAuto   = "auto"
+	portMapUPnP   = "upnp"
+	portMapNATPMP = "natpmp"
+)
+
+const (
+	// portMapLifetime is the lease requested from the router; mappings are
+	// renewed at half of it, so one lost renewal doesn't drop the port.
+	portMapLifetime = time.Hour
+
+	// portMapRetryInterval is the pause after a failed mapping attempt.
+	portMapRetryInterval = time.Minute
+
+	natPMPPort  = 5351
+	ssdpAddr    = "239.255.255.250:1900"
+	ssdpTimeout = 3 * time.Second
+	upnpTimeout = 5 * time.Second
+)
+
+// portMapper asks a router to forward a TCP port to this machine.
+type portMapper interface {
+	name() string
+	// addMapping forwards the router's port to the same local port for
+	// lifetime and returns the external port the router chose.
+	addMapping(port uint16, lifetime time.Duration) (uint16, error)
+	deleteMapping(port uint16) error
+	externalIP() (net.IP, error)
+}
+
+// portMapping keeps the proxy's listen ports forwarded on the local router
+// (-port-mapping), so players outside a home network can reach it without
+// configuring the router by hand.
+type portMapping struct {
+	mode    string
+	gateway string // NAT-PMP gateway; "" detects the default gateway
+	ports   []uint16
+
+	mu     sync.Mutex
+	mapper portMapper
+	mapped map[uint16]uint16 // local port → external port
+}
+
+func newPortMapping(mode, gateway string, listenAddrs []string) (*portMapping, error) {
+	switch mode {
+	case portMapAuto, portMapUPnP, portMapNATPMP:
+	default:
+		return nil, fmt.Errorf("unknown mode %q (expected auto, upnp or natpmp)", mode)
+	}
+	m := &portMapping{mode: mode, gateway: gateway, mapped: make(map[uint16]uint16)}
+	seen := make(map[uint16]bool)
+	for _, addr := range listenAddrs {
+		_, portStr, err := net.SplitHostPort(strings.TrimSpace(addr))
+		if err != nil {
+			return nil, fmt.Errorf("listen address %q: %w", addr, err)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("listen address %q has no fixed port to map", addr)
+		}
+		if !seen[uint16(port)] {
+			seen[uint16(port)] = true
+			m.ports = append(m.ports, uint16(port))
+		}
+	}
+	return m, nil
+}
+
+// run maps the ports and renews them until the process exits. It never
+// returns.
+func (m *portMapping) run() {
+	for {
+		if err := m.refresh(); err != nil {
+			warnf("[nat] port mapping failed, retrying in %s: %v", portMapRetryInterval, err)
+			time.Sleep(portMapRetryInterval)
+			continue
+		}
+		time.Sleep(portMapLifetime / 2)
+	}
+}
+
+// refresh finds the router if needed and (re)maps every port.
+func (m *portMapping) refresh() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mapper == nil {
+		mapper, err := m.discover()
+		if err != nil {
+			return err
+		}
+		m.mapper = mapper
+	}
+	for _, port := range m.ports {
+		external, err := m.mapper.addMapping(port, portMapLifetime)
+		if err != nil {
+			// The router may have changed; look for it again next time
+			m.mapper = nil
+			return fmt.Errorf("mapping TCP port %d: %w", port, err)
+		}
+		if previous, ok := m.mapped[port]; ok && previous == external {
+			debugf("[nat] renewed TCP port %d via %s", port, m.mapper.name())
+			continue
+		}
+		m.mapped[port] = external
+		public := strconv.Itoa(int(external))
+		if ip, err := m.mapper.externalIP(); err == nil {
+			public = net.JoinHostPort(ip.String(), public)
+		}
+		infof("[nat] router forwards %s to local TCP port %d (%s)", public, port, m.mapper.name())
+	}
+	return nil
+}
+
+// discover finds the router to ask. auto tries NAT-PMP first since it
+// answers quickly or not at all, then UPnP.
+func (m *portMapping) discover() (portMapper, error) {
+	var errs []error
+	if m.mode == portMapAuto || m.mode == portMapNATPMP {
+		gateway := m.gateway
+		if gateway == "" {
+			ip, err := defaultGateway()
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				gateway = ip.String()
+			}
+		}
+		if gateway != "" {
+			if _, _, err := net.SplitHostPort(gateway); err != nil {
+				gateway = net.JoinHostPort(gateway, strconv.Itoa(natPMPPort))
+			}
+			pmp := &natPMP{gateway: gateway}
+			_, err := pmp.externalIP()
+			if err == nil {
+				return pmp, nil
+			}
+			errs = append(errs, fmt.Errorf("NAT-PMP: %w", err))
+		}
+	}
+	if m.mode == portMapAuto || m.mode == portMapUPnP {
+		igd, err := discoverUPnP()
+		if err == nil {
+			return igd, nil
+		}
+		errs = append(errs, fmt.Errorf("UPnP: %w", err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// close removes the mappings, so the router doesn't forward to a proxy that
+// is gone until the leases run out.
+func (m *portMapping) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mapper == nil {
+		return
+	}
+	for port := range m.mapped {
+		if err := m.mapper.deleteMapping(port); err != nil {
+			debugf("[nat] removing the mapping of TCP port %d: %v", port, err)
+		}
+	}
+	m.mapped = make(map[uint16]uint16)
+}
+
+// natPMP speaks NAT-PMP (RFC 6886) to the gateway.
+type natPMP struct {
+	gateway string // host:port
+}
+
+func (n *natPMP) name() string { return "NAT-PMP" }
+
+// request sends req and waits for the matching answer, resending with the
+// RFC's doubling timeout from 250ms.
+func (n *natPMP) request(req []byte, size int) ([]byte, error) {
+	conn, err := net.Dial("udp", n.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 16)
+	timeout := 250 * time.Millisecond
+	for attempt := 0; attempt < 4; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			got, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if got < size || buf[0] != 0 || buf[1] != req[1]|0x80 {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(buf[2:4]); code != 0 {
+				return nil, fmt.Errorf("gateway refused with result code %d", code)
+			}
+			return buf[:size], nil
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("no answer from %s", n.gateway)
+}
+
+func (n *natPMP) addMapping(port uint16, lifetime time.Duration) (uint16, error) {
+	req := make([]byte, 12)
+	req[1] = 2 // map TCP
+	binary.BigEndian.PutUint16(req[4:], port)
+	binary.BigEndian.PutUint16(req[6:], port)
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime.Seconds()))
+	resp, err := n.request(req, 16)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(resp[10:12]), nil
+}
+
+func (n *natPMP) deleteMapping(port uint16) error {
+	_, err := n.addMapping(port, 0)
+	return err
+}
+
+func (n *natPMP) externalIP() (net.IP, error) {
+	resp, err := n.request([]byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(append([]byte(nil), resp[8:12]...)), nil
+}
+
+// defaultGateway reads the IPv4 default gateway from the Linux routing
+// table. Elsewhere, NAT-PMP needs -port-mapping-gateway.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, errors.New("can't detect the default gateway on this system, set -port-mapping-gateway")
+	}
+	defer f.Close()
+	return parseRouteTable(f)
+}
+
+// parseRouteTable finds the default route in /proc/net/route, whose
+// addresses are little-endian hex.
+func parseRouteTable(r io.Reader) (net.IP, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil || flags&0x2 == 0 { // RTF_GATEWAY
+			continue
+		}
+		gw, err := hex.DecodeString(fields[2])
+		if err != nil || len(gw) != 4 {
+			continue
+		}
+		return net.IPv4(gw[3], gw[2], gw[1], gw[0]), nil
+	}
+	return nil, errors.New("no default gateway in the routing table")
+}
+
+// upnpIGD is a UPnP Internet Gateway Device's WAN connection service.
+type upnpIGD struct {
+	controlURL  string
+	serviceType string
+	localIP     string // this machine's address as the router sees it
+	client      *http.Client
+}
+
+func (u *upnpIGD) name() string { return "UPnP" }
+
+// discoverUPnP searches the LAN for an Internet Gateway Device with SSDP.
+func discoverUPnP() (*upnpIGD, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range []string{"urn:schemas-upnp-org:device:InternetGatewayDevice:1", "urn:schemas-upnp-org:device:InternetGatewayDevice:2"} {
+		search := "M-SEARCH * HTTP/1.1\r\nHOST: " + ssdpAddr + "\r\nST: " + st + "\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n"
+		if _, err := conn.WriteTo([]byte(search), dst); err != nil {
+			return nil, err
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(ssdpTimeout))
+	buf := make([]byte, 2048)
+	tried := make(map[string]bool)
+	var lastErr error = errors.New("no Internet Gateway Device answered")
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, lastErr
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" || tried[location] {
+			continue
+		}
+		tried[location] = true
+		igd, err := newUPnPIGD(location)
+		if err == nil {
+			return igd, nil
+		}
+		lastErr = err
+	}
+}
+
+// upnpDevice is the part of a UPnP device description the proxy reads;
+// the WAN connection service sits a few embedded devices deep.
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// wanService returns the service type and control URL of the device's WAN
+// IP (or PPP) connection service.
+func (d *upnpDevice) wanService() (string, string, bool) {
+	for _, s := range d.Services {
+		if strings.Contains(s.ServiceType, ":WANIPConnection:") || strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+			return s.ServiceType, s.ControlURL, true
+		}
+	}
+	for i := range d.Devices {
+		if st, control, ok := d.Devices[i].wanService(); ok {
+			return st, control, true
+		}
+	}
+	return "", "", false
+}
+
+// newUPnPIGD reads the device description at location.
+func newUPnPIGD(location string) (*upnpIGD, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: upnpTimeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", location, resp.Status)
+	}
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", location, err)
+	}
+	serviceType, control, ok := root.Device.wanService()
+	if !ok {
+		return nil, fmt.Errorf("%s has no WAN connection service", location)
+	}
+	if root.URLBase != "" {
+		if u, err := url.Parse(root.URLBase); err == nil {
+			base = u
+		}
+	}
+	controlURL, err := base.Parse(control)
+	if err != nil {
+		return nil, err
+	}
+	// The local address towards the router is the one to forward to
+	probe, err := net.Dial("udp", controlURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer probe.Close()
+	localIP := probe.LocalAddr().(*net.UDPAddr).IP.String()
+	return &upnpIGD{controlURL: controlURL.String(), serviceType: serviceType, localIP: localIP, client: client}, nil
+}
+
+// soapResponse is the part of a SOAP answer the proxy reads.
+type soapResponse struct {
+	ExternalIP  string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	ErrorCode   int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+	Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+}
+
+// call invokes a SOAP action on the WAN connection service.
+func (u *upnpIGD) call(action string, args ...string) (*soapResponse, error) {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.serviceType)
+	for i := 0; i+1 < len(args); i += 2 {
+		body.WriteString("<" + args[i] + ">")
+		xml.EscapeText(&body, []byte(args[i+1]))
+		body.WriteString("</" + args[i] + ">")
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest(http.MethodPost, u.controlURL, strings.NewReader(body.String()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+u.serviceType+"#"+action+`"`)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result := &soapResponse{}
+	xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(result)
+	if resp.StatusCode != http.StatusOK {
+		if result.ErrorCode != 0 {
+			return result, fmt.Errorf("%s: UPnP error %d %s", action, result.ErrorCode, result.Description)
+		}
+		return result, fmt.Errorf("%s: %s", action, resp.Status)
+	}
+	return result, nil
+}
+
+func (u *upnpIGD) addMapping(port uint16, lifetime time.Duration) (uint16, error) {
+	p := strconv.Itoa(int(port))
+	add := func(lease int) (*soapResponse, error) {
+		return u.call("AddPortMapping",
+			"NewRemoteHost", "", "NewExternalPort", p, "NewProtocol", "TCP",
+			"NewInternalPort", p, "NewInternalClient", u.localIP, "NewEnabled", "1",
+			"NewPortMappingDescription", "mc-dual-proxy", "NewLeaseDuration", strconv.Itoa(lease))
+	}
+	result, err := add(int(lifetime.Seconds()))
+	if err != nil && result != nil && result.ErrorCode == 725 {
+		// OnlyPermanentLeasesSupported: older routers take no lease time
+		_, err = add(0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return port, nil
+}
+
+func (u *upnpIGD) deleteMapping(port uint16) error {
+	_, err := u.call("DeletePortMapping", "NewRemoteHost", "", "NewExternalPort", strconv.Itoa(int(port)), "NewProtocol", "TCP")
+	return err
+}
+
+func (u *upnpIGD) externalIP() (net.IP, error) {
+	result, err := u.call("GetExternalIPAddress")
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(result.ExternalIP)
+	if ip == nil {
+		return nil, fmt.Errorf("router reported external address %q", result.ExternalIP)
+	}
+	return ip, nil
+}
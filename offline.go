@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// offlineUpstream is the auth source reported for offline-mode logins.
+	offlineUpstream = "offline"
+
+	// offlineMarkerProperty is added to offline profiles so plugins can
+	// tell cracked players from authenticated ones.
+	offlineMarkerProperty = "mc-dual-proxy:offline"
+)
+
+// offlineFallback lets players that no session server authenticates in as
+// offline-mode players (-offline-fallback), for communities mixing premium
+// and cracked accounts. It can be limited to the hostnames players connect
+// with, e.g. a dedicated cracked.example.com address.
+type offlineFallback struct {
+	hosts []string // lowercased patterns; "*" allows every host
+}
+
+// parseOfflineFallback parses a comma-separated list of hostnames, which may
+// contain * wildcards; "*" alone allows all of them.
+func parseOfflineFallback(spec string) (*offlineFallback, error) {
+	f := &offlineFallback{}
+	for _, host := range strings.Split(spec, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("invalid hostname pattern %q", host)
+		}
+		f.hosts = append(f.hosts, host)
+	}
+	if len(f.hosts) == 0 {
+		return nil, fmt.Errorf("expected * or hostnames, got %q", spec)
+	}
+	return f, nil
+}
+
+// allows reports whether username may log in offline, and the hostname
+// their connection used. The hostname comes from the player's live
+// connection, so a login the proxy hasn't seen only passes with "*".
+func (f *offlineFallback) allows(username string) (string, bool) {
+	host := ""
+	for _, c := range tracker.snapshot() {
+		if strings.EqualFold(c.Username, username) {
+			host = strings.ToLower(strings.TrimSuffix(c.Host, "."))
+		}
+	}
+	for _, pattern := range f.hosts {
+		if pattern == "*" {
+			return host, true
+		}
+		if ok, _ := path.Match(pattern, host); ok && host != "" {
+			return host, true
+		}
+	}
+	return host, false
+}
+
+// String formats the hostnames the way parseOfflineFallback accepts them.
+func (f *offlineFallback) String() string {
+	return strings.Join(f.hosts, ",")
+}
+
+// offlineUUID returns the UUID an offline-mode server gives username,
+// undashed: a version 3 UUID of "OfflinePlayer:<name>", like Java's
+// UUID.nameUUIDFromBytes. Players keep their data when a server switches
+// between this proxy's fallback and plain offline mode.
+func offlineUUID(username string) string {
+	sum := md5.Sum([]byte("OfflinePlayer:" + username))
+	sum[6] = sum[6]&0x0f | 0x30 // version 3
+	sum[8] = sum[8]&0x3f | 0x80 // IETF variant
+	return hex.EncodeToString(sum[:])
+}
+
+// offlineProfile returns a hasJoined response for an offline player.
+func offlineProfile(username string) []byte {
+	body, _ := json.Marshal(map[string]any{
+		"id":             offlineUUID(username),
+		"name":           username,
+		"properties":     []profileProperty{{Name: offlineMarkerProperty, Value: "true"}},
+		"profileActions": []string{},
+	})
+	return body
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// networkPlayers counts the players logged in through any of the proxy's
+// listeners, whichever backend they were sent to.
+func networkPlayers() int {
+	seen := make(map[string]bool)
+	for _, c := range tracker.snapshot() {
+		if c.Username != "" {
+			seen[strings.ToLower(c.Username)] = true
+		}
+	}
+	return len(seen)
+}
+
+// setOnlinePlayers replaces players.online in a status response's JSON,
+// keeping every other field (favicon, sample, mod lists) as the backend
+// sent it.
+func setOnlinePlayers(body string, online int) (string, error) {
+	var status map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		return "", err
+	}
+	var players map[string]json.RawMessage
+	if raw, ok := status["players"]; ok {
+		if err := json.Unmarshal(raw, &players); err != nil {
+			return "", err
+		}
+	}
+	if players == nil {
+		players = make(map[string]json.RawMessage)
+	}
+	players["online"] = json.RawMessage(strconv.Itoa(online))
+	status["players"], _ = json.Marshal(players)
+	out, err := json.Marshal(status)
+	return string(out), err
+}
+
+// relayAggregatedStatus relays a backend's status-state output to dst with
+// the player count of its status response replaced by the network's
+// (-aggregate-players). The ping response after it is relayed unchanged, as
+// is everything if the response doesn't parse.
+func relayAggregatedStatus(dst io.Writer, backend io.Reader, size int) (int64, error) {
+	br := bufio.NewReader(backend)
+	packet, err := readPacket(br, maxStatusResponse)
+	if err != nil {
+		return 0, err
+	}
+	if id, n, err := decodeVarInt(packet); err == nil && id == 0x00 {
+		if body, _, err := decodeString(packet[n:], maxStatusResponse); err == nil {
+			if rewritten, err := setOnlinePlayers(body, networkPlayers()); err == nil {
+				packet = appendString([]byte{0x00}, rewritten)
+			} else {
+				debugf("[tcp] status response isn't JSON, relaying it unchanged: %v", err)
+			}
+		}
+	}
+	written, err := dst.Write(appendVarInt(nil, int32(len(packet)), packet...))
+	if err != nil {
+		return int64(written), err
+	}
+	n, err := copyConn(dst, br, size)
+	return int64(written) + n, err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionRetention is how long an authentication is remembered for a player
+// who has no live connection, e.g. while their client connects.
+const sessionRetention = 10 * time.Minute
+
+// playerSession is what a successful hasJoined told us about a player.
+type playerSession struct {
+	Username      string
+	UUID          string // dashed
+	AuthSource    string // upstream that authenticated the player
+	Authenticated time.Time
+}
+
+// sessionTracker remembers the latest authentication of each player, so
+// live connections can be reported with their UUID and auth source.
+type sessionTracker struct {
+	mu     sync.Mutex
+	byName map[string]playerSession // lowercased username → session
+}
+
+// sessions is the process-wide session table.
+var sessions = &sessionTracker{byName: make(map[string]playerSession)}
+
+// record stores a successful authentication from a hasJoined response body
+// and forgets stale sessions of players who are no longer connected.
+func (s *sessionTracker) record(username, upstream string, body []byte) {
+	var profile struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	json.Unmarshal(body, &profile)
+	name := profile.Name // as the player spells it
+	if name == "" {
+		name = username
+	}
+	online := make(map[string]bool)
+	for _, c := range tracker.snapshot() {
+		online[strings.ToLower(c.Username)] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, session := range s.byName {
+		if !online[key] && time.Since(session.Authenticated) > sessionRetention {
+			delete(s.byName, key)
+		}
+	}
+	s.byName[strings.ToLower(username)] = playerSession{
+		Username:      name,
+		UUID:          dashUUID(profile.ID),
+		AuthSource:    upstream,
+		Authenticated: time.Now(),
+	}
+}
+
+func (s *sessionTracker) lookup(username string) (playerSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.byName[strings.ToLower(username)]
+	return session, ok
+}
+
+func (s *sessionTracker) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.byName)
+}
+
+// dashUUID formats an undashed UUID from a session server the usual way;
+// anything else is returned as is.
+func dashUUID(id string) string {
+	if len(id) != 32 || strings.Contains(id, "-") {
+		return id
+	}
+	return id[:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:]
+}
+
+// onlinePlayer is an entry of /api/players. Its fields are a stable interface
+// for external tools: they may be added to, but not renamed or removed.
+type onlinePlayer struct {
+	Username       string    `json:"username"`
+	UUID           string    `json:"uuid,omitempty"`
+	AuthSource     string    `json:"auth_source,omitempty"`
+	RealIP         string    `json:"real_ip"`
+	Route          string    `json:"route,omitempty"`
+	ConnectionID   uint64    `json:"connection_id"`
+	ConnectedSince time.Time `json:"connected_since"`
+}
+
+// onlinePlayers lists the live connections whose player is known, with what
+// their authentication told us.
+func onlinePlayers() []onlinePlayer {
+	players := []onlinePlayer{}
+	for _, c := range tracker.snapshot() {
+		if c.Username == "" {
+			continue
+		}
+		p := onlinePlayer{
+			Username:       c.Username,
+			RealIP:         addrIP(c.RealAddr),
+			Route:          c.Route,
+			ConnectionID:   c.ID,
+			ConnectedSince: time.Now().Add(-time.Duration(c.AgeSeconds * float64(time.Second))).UTC().Truncate(time.Second),
+		}
+		if session, ok := sessions.lookup(c.Username); ok {
+			p.Username, p.UUID, p.AuthSource = session.Username, session.UUID, session.AuthSource
+		}
+		players = append(players, p)
+	}
+	return players
+}
+
+// handlePlayers serves the online player list for whitelist managers,
+// Discord bots and the like.
+func handlePlayers(w http.ResponseWriter, r *http.Request) {
+	players := onlinePlayers()
+	writeJSON(w, map[string]any{"count": len(players), "players": players})
+}
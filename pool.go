@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// poolRefillInterval is how often the pool is checked and topped up
+	// when no connection was taken.
+	poolRefillInterval = time.Second
+
+	// poolHealthTimeout is how long a pooled connection is read from to
+	// check that the backend hasn't closed it.
+	poolHealthTimeout = time.Millisecond
+)
+
+// backendPool keeps a few connections to the default backend dialed ahead
+// of time (-backend-pool), so logins don't wait for the dial. Nothing is
+// written to them until they are taken, so the PROXY header still comes
+// first. Backends close connections that stay silent too long (Velocity and
+// Paper after 30s), so pooled connections are replaced after maxAge.
+type backendPool struct {
+	size   int
+	maxAge time.Duration
+	wake   chan struct{} // a connection was taken
+
+	mu   sync.Mutex
+	idle []pooledConn
+
+	hits   atomic.Int64
+	misses atomic.Int64
+	saved  atomic.Int64 // nanoseconds of dialing skipped
+}
+
+type pooledConn struct {
+	conn    net.Conn
+	addr    string // backend address it was dialed for
+	dialed  time.Time
+	latency time.Duration // how long the dial took
+}
+
+func newBackendPool(size int, maxAge time.Duration) *backendPool {
+	return &backendPool{size: size, maxAge: maxAge, wake: make(chan struct{}, 1)}
+}
+
+// take returns a healthy pooled connection to backendAddr and the dial time
+// it saves, or ok=false if there is none.
+func (p *backendPool) take(backendAddr string) (conn net.Conn, saved time.Duration, ok bool) {
+	defer func() {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}()
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			p.misses.Add(1)
+			return nil, 0, false
+		}
+		// Newest first: the least likely to be closed by the backend
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if pc.addr == backendAddr && time.Since(pc.dialed) < p.maxAge && connAlive(pc.conn) {
+			p.hits.Add(1)
+			p.saved.Add(int64(pc.latency))
+			return pc.conn, pc.latency, true
+		}
+		pc.conn.Close()
+	}
+}
+
+// run keeps the pool filled with connections to cfg's backend, replacing
+// stale ones. It never returns.
+func (p *backendPool) run(cfg Config) {
+	ticker := time.NewTicker(poolRefillInterval)
+	defer ticker.Stop()
+	failing, prune := false, true
+	for {
+		if prune {
+			p.prune(cfg.currentBackend())
+		}
+		for p.idleCount() < p.size {
+			addr := cfg.currentBackend()
+			target := addr
+			if cfg.Resolver != nil {
+				target = cfg.Resolver.candidates()[0]
+			}
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", target, dialTimeout)
+			if err != nil {
+				// The backend may be down or asleep: players will see it on their own dial
+				if !failing {
+					debugf("[backend] pool: failed to dial %s: %v", target, err)
+				}
+				failing = true
+				break
+			}
+			failing = false
+			p.mu.Lock()
+			p.idle = append(p.idle, pooledConn{conn: conn, addr: addr, dialed: start, latency: time.Since(start)})
+			p.mu.Unlock()
+		}
+		select {
+		case <-ticker.C:
+			prune = true
+		case <-p.wake:
+			prune = false
+		}
+	}
+}
+
+// prune closes pooled connections that are too old, were dialed for another
+// backend address or were closed by the backend.
+func (p *backendPool) prune(backendAddr string) {
+	// Checked outside the lock, since each check waits a little
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	var keep []pooledConn
+	for _, pc := range idle {
+		// Leave a margin so a connection isn't taken just as it expires
+		if pc.addr == backendAddr && time.Since(pc.dialed) < p.maxAge-poolRefillInterval && connAlive(pc.conn) {
+			keep = append(keep, pc)
+		} else {
+			pc.conn.Close()
+		}
+	}
+
+	p.mu.Lock()
+	p.idle = append(keep, p.idle...)
+	p.mu.Unlock()
+}
+
+func (p *backendPool) idleCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// connAlive reports whether conn is still open and silent, as a connection
+// the client hasn't written to yet should be.
+func connAlive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(poolHealthTimeout))
+	_, err := conn.Read(make([]byte, 1))
+	conn.SetReadDeadline(time.Time{})
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
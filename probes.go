@@ -0,0 +1,197 @@
+package main
+
+import (
+	"cmp"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// probeWindow is how many recent samples probe percentiles cover.
+	probeWindow = 60
+
+	probeTimeout = 3 * time.Second
+)
+
+// Probe kinds: a TCP connect, and a full status ping (-latency-probe-status).
+const (
+	probeConnect = "connect"
+	probeStatus  = "status"
+)
+
+// probeStats summarizes the recent probes of one backend, as reported by
+// /health and /api/status.
+type probeStats struct {
+	Backend   string    `json:"backend"`
+	Probe     string    `json:"probe"`
+	P50Ms     float64   `json:"p50_ms"`
+	P95Ms     float64   `json:"p95_ms"`
+	Samples   int       `json:"samples"`
+	Failures  int64     `json:"failures"`
+	LastProbe time.Time `json:"last_probe"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type probeSeries struct {
+	samples   []time.Duration // successful probes, oldest first, at most probeWindow
+	failures  int64
+	lastProbe time.Time
+	lastErr   string
+}
+
+// probeSet keeps the recent latency probes of every backend, so "backend
+// slow" can be told apart from "proxy slow": the probes don't go through
+// the proxy's connection handling.
+type probeSet struct {
+	mu     sync.Mutex
+	series map[[2]string]*probeSeries // backend, kind
+}
+
+// latencyProbes is the process-wide probe set.
+var latencyProbes = &probeSet{series: make(map[[2]string]*probeSeries)}
+
+func (s *probeSet) record(backend, kind string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := [2]string{backend, kind}
+	ps, ok := s.series[key]
+	if !ok {
+		ps = &probeSeries{}
+		s.series[key] = ps
+	}
+	ps.lastProbe = time.Now()
+	ps.lastErr = ""
+	if err != nil {
+		ps.failures++
+		ps.lastErr = err.Error()
+		return
+	}
+	ps.samples = append(ps.samples, latency)
+	if len(ps.samples) > probeWindow {
+		ps.samples = ps.samples[len(ps.samples)-probeWindow:]
+	}
+}
+
+// snapshot returns the stats of every probed backend, sorted.
+func (s *probeSet) snapshot() []probeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := []probeStats{}
+	for key, ps := range s.series {
+		st := probeStats{Backend: key[0], Probe: key[1], Samples: len(ps.samples), Failures: ps.failures, LastProbe: ps.lastProbe, LastError: ps.lastErr}
+		if len(ps.samples) > 0 {
+			sorted := slices.Clone(ps.samples)
+			slices.Sort(sorted)
+			st.P50Ms = durationMs(percentile(sorted, 0.50))
+			st.P95Ms = durationMs(percentile(sorted, 0.95))
+		}
+		stats = append(stats, st)
+	}
+	slices.SortFunc(stats, func(a, b probeStats) int {
+		return cmp.Or(cmp.Compare(a.Backend, b.Backend), cmp.Compare(a.Probe, b.Probe))
+	})
+	return stats
+}
+
+// percentile returns the nearest-rank percentile p of sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p*float64(len(sorted))+0.999999) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// write outputs the percentiles and failure counts as metrics.
+func (s *probeSet) write(p metricsSink) {
+	stats := s.snapshot()
+	if len(stats) == 0 {
+		return
+	}
+	p.family("backend_probe_seconds", "gauge", "Backend latency measured by -latency-probe over the last 60 probes, by probe (connect, status) and quantile.")
+	for _, st := range stats {
+		if st.Samples == 0 {
+			continue
+		}
+		p.sample("backend_probe_seconds", st.P50Ms/1000, "backend", st.Backend, "probe", st.Probe, "quantile", "0.5")
+		p.sample("backend_probe_seconds", st.P95Ms/1000, "backend", st.Backend, "probe", st.Probe, "quantile", "0.95")
+	}
+	p.family("backend_probe_failures_total", "counter", "Latency probes that failed, by backend and probe.")
+	for _, st := range stats {
+		p.sample("backend_probe_failures_total", float64(st.Failures), "backend", st.Backend, "probe", st.Probe)
+	}
+}
+
+// probeBackends returns the backends -latency-probe measures: every default
+// backend and those of the routes.
+func probeBackends(cfg Config) []string {
+	var addrs []string
+	if cfg.Balancer != nil {
+		addrs = slices.Clone(cfg.Balancer.addrs)
+	} else {
+		addrs = []string{cfg.reloaded().currentBackend()}
+	}
+	for _, rt := range cfg.Routes {
+		if !slices.Contains(addrs, rt.BackendAddr) {
+			addrs = append(addrs, rt.BackendAddr)
+		}
+	}
+	return addrs
+}
+
+// runLatencyProbes probes every backend each interval. It never returns.
+func runLatencyProbes(cfg Config, interval time.Duration, withStatus bool) {
+	for {
+		probeLatency(cfg, withStatus)
+		time.Sleep(interval)
+	}
+}
+
+// probeLatency probes every backend once, concurrently.
+func probeLatency(cfg Config, withStatus bool) {
+	// Status pings carry a LOCAL PROXY header, which says the connection
+	// is the proxy's own
+	var header []byte
+	if !cfg.Transparent {
+		header = buildProxyV2Header(nil, nil)
+	}
+	if cfg.RelaySecret != nil {
+		header = append(signRelayPreamble(cfg.RelaySecret, header), header...)
+	}
+	var wg sync.WaitGroup
+	for _, addr := range probeBackends(cfg) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+			if err == nil {
+				conn.Close()
+			}
+			latencyProbes.record(addr, probeConnect, time.Since(start), err)
+			if withStatus {
+				start = time.Now()
+				_, err := queryBackendStatus(addr, header, "", 0, probeTimeout)
+				latencyProbes.record(addr, probeStatus, time.Since(start), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// handleHealth serves /health: readiness as /readyz reports it, with the
+// backend latency probes.
+func handleHealth(cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, reason := readiness.ready(cfg.reloaded())
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(w, map[string]any{"ready": ok, "reason": reason, "backend_probes": latencyProbes.snapshot()})
+	}
+}
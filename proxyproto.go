@@ -5,7 +5,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"net"
+	"net/netip"
+	"strconv"
 	"strings"
 )
 
@@ -15,6 +18,24 @@ var proxyV2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x
 // proxyV1Prefix is the ASCII prefix for PROXY protocol v1
 var proxyV1Prefix = []byte("PROXY ")
 
+// Policies for PROXY headers from peers outside -trusted-proxies.
+const (
+	proxyHeaderPassthrough = "passthrough" // forward them as if trusted
+	proxyHeaderRewrite     = "rewrite"     // replace them with a header for the peer
+	proxyHeaderReject      = "reject"      // close the connection
+)
+
+// Policies for PROXY headers that don't name the source (-proxy-unknown).
+const (
+	proxyUnknownPeer        = "peer"        // use the TCP peer's address instead
+	proxyUnknownPassthrough = "passthrough" // forward the header as it is
+	proxyUnknownReject      = "reject"      // close the connection
+)
+
+// proxyV2AddrLen is the minimum address block length per v2 address family
+// (UNSPEC, INET, INET6, UNIX).
+var proxyV2AddrLen = [4]int{0, 12, 36, 216}
+
 // ProxyHeader represents a parsed PROXY protocol header.
 type ProxyHeader struct {
 	Version  int    // 1 or 2
@@ -23,6 +44,9 @@ type ProxyHeader struct {
 	SrcPort  uint16
 	DstPort  uint16
 	RawBytes []byte // The complete raw header bytes (for passthrough)
+	// Unknown is set for relayed connections whose source the sender
+	// doesn't know: v1 UNKNOWN, or a v2 PROXY command with AF_UNSPEC
+	Unknown bool
 }
 
 // detectProxyProtocol peeks at the buffered reader to detect if a PROXY
@@ -30,6 +54,23 @@ type ProxyHeader struct {
 // the header bytes from the reader. If no header is detected, returns nil
 // and no bytes are consumed.
 func detectProxyProtocol(br *bufio.Reader) (*ProxyHeader, error) {
+	return detectProxyHeader(br, false)
+}
+
+// detectProxyHeader is detectProxyProtocol with a choice of strictness. In
+// strict mode (-strict-proxy-protocol), headers that common senders never
+// produce but the lenient parser tolerates are refused too: v1 addresses or
+// ports in non-canonical notation, v2 datagram transports, malformed TLVs and
+// TLV checksums that don't match.
+func detectProxyHeader(br *bufio.Reader, strict bool) (*ProxyHeader, error) {
+	// Both signatures have a distinctive first byte. Checking it first avoids
+	// blocking on clients whose first packet is shorter than a v2 header,
+	// such as a legacy 0xFE ping.
+	first, err := br.Peek(1)
+	if err != nil || (first[0] != proxyV2Sig[0] && first[0] != proxyV1Prefix[0]) {
+		return nil, nil
+	}
+
 	// We need at least 16 bytes to detect v2, or 6 bytes to detect v1.
 	// Peek at 16 bytes (the v2 minimum header size).
 	peek, err := br.Peek(16)
@@ -43,24 +84,36 @@ func detectProxyProtocol(br *bufio.Reader) (*ProxyHeader, error) {
 
 	// Check for v2 signature (need at least 16 bytes)
 	if len(peek) >= 16 && bytes.Equal(peek[:12], proxyV2Sig) {
-		return parseProxyV2(br)
+		return parseProxyV2(br, strict)
 	}
 
 	// Check for v1 prefix
 	if len(peek) >= 6 && bytes.Equal(peek[:6], proxyV1Prefix) {
-		return parseProxyV1(br)
+		return parseProxyV1(br, strict)
 	}
 
 	return nil, nil
 }
 
+// proxyV1MaxLen is the longest valid v1 header, including the CRLF
+// ("PROXY TCP6" with two full-length IPv6 addresses and ports).
+const proxyV1MaxLen = 107
+
 // parseProxyV1 parses a PROXY protocol v1 header from the reader.
 // Format: "PROXY TCP4 <src> <dst> <srcport> <dstport>\r\n"
-func parseProxyV1(br *bufio.Reader) (*ProxyHeader, error) {
-	// Read until \r\n (the v1 header is a single line)
-	line, err := br.ReadBytes('\n')
-	if err != nil {
-		return nil, fmt.Errorf("proxy v1: failed to read header line: %w", err)
+func parseProxyV1(br *bufio.Reader, strict bool) (*ProxyHeader, error) {
+	// Read until \n (the v1 header is a single line), but no further than
+	// the longest valid header
+	line := make([]byte, 0, proxyV1MaxLen)
+	for len(line) == 0 || line[len(line)-1] != '\n' {
+		if len(line) == proxyV1MaxLen {
+			return nil, fmt.Errorf("proxy v1: header line exceeds %d bytes", proxyV1MaxLen)
+		}
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxy v1: failed to read header line: %w", err)
+		}
+		line = append(line, b)
 	}
 
 	// Must end with \r\n
@@ -77,33 +130,77 @@ func parseProxyV1(br *bufio.Reader) (*ProxyHeader, error) {
 	str := strings.TrimRight(string(line), "\r\n")
 	parts := strings.Split(str, " ")
 
-	if len(parts) == 2 && parts[1] == "UNKNOWN" {
-		// PROXY UNKNOWN\r\n - no address info
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		// PROXY UNKNOWN\r\n - no address info. Senders may add addresses
+		// anyway, which the spec says to ignore
+		header.Unknown = true
 		return header, nil
 	}
 
 	if len(parts) != 6 {
 		return nil, fmt.Errorf("proxy v1: expected 6 fields, got %d", len(parts))
 	}
+	if parts[1] != "TCP4" && parts[1] != "TCP6" {
+		return nil, fmt.Errorf("proxy v1: unknown protocol %q", parts[1])
+	}
 
 	header.SrcAddr = net.ParseIP(parts[2])
 	header.DstAddr = net.ParseIP(parts[3])
+	// TCP4 takes IPv4 addresses; TCP6 takes IPv6 notation, including
+	// IPv4-mapped addresses like ::ffff:192.0.2.1
+	for i, ip := range []net.IP{header.SrcAddr, header.DstAddr} {
+		valid := ip != nil && ip.To4() != nil
+		if parts[1] == "TCP6" {
+			valid = ip != nil && strings.Contains(parts[2+i], ":")
+		}
+		if !valid {
+			return nil, fmt.Errorf("proxy v1: invalid %s addresses %q, %q", parts[1], parts[2], parts[3])
+		}
+	}
 
-	srcPort := 0
-	dstPort := 0
-	fmt.Sscanf(parts[4], "%d", &srcPort)
-	fmt.Sscanf(parts[5], "%d", &dstPort)
+	if strict {
+		if err := checkV1Strict(parts); err != nil {
+			return nil, err
+		}
+	}
+
+	srcPort, err := strconv.ParseUint(parts[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy v1: invalid source port %q", parts[4])
+	}
+	dstPort, err := strconv.ParseUint(parts[5], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy v1: invalid destination port %q", parts[5])
+	}
 	header.SrcPort = uint16(srcPort)
 	header.DstPort = uint16(dstPort)
 
 	return header, nil
 }
 
-// parseProxyV2 parses a PROXY protocol v2 header from the reader.
-func parseProxyV2(br *bufio.Reader) (*ProxyHeader, error) {
-	// Read the fixed 16-byte header
-	fixedHeader := make([]byte, 16)
-	if _, err := readFull(br, fixedHeader); err != nil {
+// checkV1Strict checks the fields of a TCP4/TCP6 v1 line against the spec's
+// notation: addresses as written by inet_ntop for their family, and ports
+// without leading zeros.
+func checkV1Strict(parts []string) error {
+	for _, addr := range parts[2:4] {
+		if strings.Contains(addr, ":") != (parts[1] == "TCP6") {
+			return fmt.Errorf("proxy v1: %s address %q not in %s notation", parts[1], addr, parts[1])
+		}
+	}
+	for _, port := range parts[4:6] {
+		if len(port) > 1 && port[0] == '0' {
+			return fmt.Errorf("proxy v1: port %q has leading zeros", port)
+		}
+	}
+	return nil
+}
+
+// parseProxyV2 parses a PROXY protocol v2 header from the reader. The whole
+// header has to fit in br's buffer.
+func parseProxyV2(br *bufio.Reader, strict bool) (*ProxyHeader, error) {
+	// Validate the fixed 16-byte header before consuming anything
+	fixedHeader, err := br.Peek(16)
+	if err != nil {
 		return nil, fmt.Errorf("proxy v2: failed to read fixed header: %w", err)
 	}
 
@@ -113,54 +210,146 @@ func parseProxyV2(br *bufio.Reader) (*ProxyHeader, error) {
 	if ver != 2 {
 		return nil, fmt.Errorf("proxy v2: unexpected version %d", ver)
 	}
+	if cmd := verCmd & 0x0F; cmd > 0x1 {
+		return nil, fmt.Errorf("proxy v2: unknown command 0x%x", cmd)
+	}
 
 	// Byte 13: address family (upper nibble) | transport protocol (lower nibble)
 	famProto := fixedHeader[13]
 	addrFamily := famProto >> 4
-	// transport := famProto & 0x0F
+	if addrFamily > 0x3 {
+		return nil, fmt.Errorf("proxy v2: unknown address family 0x%x", addrFamily)
+	}
 
 	// Bytes 14-15: length of the address section (big-endian)
 	addrLen := binary.BigEndian.Uint16(fixedHeader[14:16])
+	if transport := famProto & 0x0F; strict && addrFamily != 0 && transport != 0x1 {
+		return nil, fmt.Errorf("proxy v2: transport 0x%x isn't a stream", transport)
+	}
+	if minLen := proxyV2AddrLen[addrFamily]; int(addrLen) < minLen {
+		return nil, fmt.Errorf("proxy v2: address block of %d bytes is too short for family 0x%x (need %d)", addrLen, addrFamily, minLen)
+	}
+	if 16+int(addrLen) > br.Size() {
+		return nil, fmt.Errorf("proxy v2: %d byte header exceeds the %d byte buffer", 16+int(addrLen), br.Size())
+	}
 
-	// Read the address block
-	addrBlock := make([]byte, addrLen)
-	if addrLen > 0 {
-		if _, err := readFull(br, addrBlock); err != nil {
-			return nil, fmt.Errorf("proxy v2: failed to read address block: %w", err)
+	// Read the whole header; it is consumed only once it is complete
+	raw, err := br.Peek(16 + int(addrLen))
+	if err != nil {
+		return nil, fmt.Errorf("proxy v2: failed to read address block: %w", err)
+	}
+	// Copy out of the reader's buffer before consuming it
+	rawBytes := append([]byte(nil), raw...)
+	addrBlock := rawBytes[16:]
+	if strict {
+		if err := checkV2TLVs(rawBytes, proxyV2AddrLen[addrFamily]); err != nil {
+			return nil, err
 		}
 	}
-
-	// Combine into raw bytes
-	rawBytes := make([]byte, 0, 16+int(addrLen))
-	rawBytes = append(rawBytes, fixedHeader...)
-	rawBytes = append(rawBytes, addrBlock...)
+	br.Discard(len(raw))
 
 	header := &ProxyHeader{
 		Version:  2,
 		RawBytes: rawBytes,
+		Unknown:  verCmd&0x0F == 0x1 && addrFamily == 0,
 	}
 
 	// Parse addresses based on family
 	switch addrFamily {
 	case 0x1: // AF_INET (IPv4): 4+4+2+2 = 12 bytes
-		if addrLen >= 12 {
-			header.SrcAddr = net.IP(addrBlock[0:4])
-			header.DstAddr = net.IP(addrBlock[4:8])
-			header.SrcPort = binary.BigEndian.Uint16(addrBlock[8:10])
-			header.DstPort = binary.BigEndian.Uint16(addrBlock[10:12])
-		}
+		header.SrcAddr = net.IP(addrBlock[0:4])
+		header.DstAddr = net.IP(addrBlock[4:8])
+		header.SrcPort = binary.BigEndian.Uint16(addrBlock[8:10])
+		header.DstPort = binary.BigEndian.Uint16(addrBlock[10:12])
 	case 0x2: // AF_INET6: 16+16+2+2 = 36 bytes
-		if addrLen >= 36 {
-			header.SrcAddr = net.IP(addrBlock[0:16])
-			header.DstAddr = net.IP(addrBlock[16:32])
-			header.SrcPort = binary.BigEndian.Uint16(addrBlock[32:34])
-			header.DstPort = binary.BigEndian.Uint16(addrBlock[34:36])
-		}
+		header.SrcAddr = net.IP(addrBlock[0:16])
+		header.DstAddr = net.IP(addrBlock[16:32])
+		header.SrcPort = binary.BigEndian.Uint16(addrBlock[32:34])
+		header.DstPort = binary.BigEndian.Uint16(addrBlock[34:36])
 	}
 
 	return header, nil
 }
 
+// proxyV2TypeCRC32C is the TLV carrying a CRC32c of the whole header.
+const proxyV2TypeCRC32C = 0x03
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checkV2TLVs checks that the bytes after the addresses of a v2 header are a
+// sequence of complete TLVs, and verifies the CRC32c TLV if there is one.
+func checkV2TLVs(raw []byte, addrLen int) error {
+	tlvs := raw[16+addrLen:]
+	for off := 0; off < len(tlvs); {
+		if len(tlvs)-off < 3 {
+			return fmt.Errorf("proxy v2: truncated TLV at offset %d", off)
+		}
+		typ, n := tlvs[off], int(binary.BigEndian.Uint16(tlvs[off+1:off+3]))
+		value := off + 3
+		if len(tlvs)-value < n {
+			return fmt.Errorf("proxy v2: TLV 0x%02x of %d bytes overruns the header", typ, n)
+		}
+		if typ == proxyV2TypeCRC32C {
+			if n != 4 {
+				return fmt.Errorf("proxy v2: CRC32c TLV of %d bytes", n)
+			}
+			// The checksum covers the header with its own value zeroed
+			want := binary.BigEndian.Uint32(tlvs[value:])
+			zeroed := append([]byte(nil), raw...)
+			clear(zeroed[16+addrLen+value : 16+addrLen+value+4])
+			if got := crc32.Checksum(zeroed, castagnoli); got != want {
+				return fmt.Errorf("proxy v2: CRC32c mismatch (header says %08x, computed %08x)", want, got)
+			}
+		}
+		off = value + n
+	}
+	return nil
+}
+
+const (
+	// proxyV2TypeAuthority is the TLV carrying the hostname the client used,
+	// like TLS SNI.
+	proxyV2TypeAuthority = 0x02
+
+	// proxyV2TypeNetwork is a custom TLV (from the range PROXY v2 reserves
+	// for applications) naming the kind of network the player connects
+	// from, as detected with -vpn-ranges, e.g. "vpn" or "datacenter".
+	proxyV2TypeNetwork = 0xE0
+)
+
+// withTLV returns a copy of the v2 header raw carrying value in a TLV of
+// type typ, replacing one it already had. A CRC32c TLV is recomputed to
+// cover the change. Headers whose TLVs don't parse are returned as is.
+func withTLV(raw []byte, typ byte, value string) []byte {
+	addrLen := proxyV2AddrLen[raw[13]>>4&0x3]
+	if len(raw) < 16+addrLen || len(value) > 0xFFFF || checkV2TLVs(raw, addrLen) != nil {
+		return raw
+	}
+	out := append([]byte(nil), raw[:16+addrLen]...)
+	hasCRC := false
+	for off, tlvs := 0, raw[16+addrLen:]; off < len(tlvs); {
+		t, n := tlvs[off], int(binary.BigEndian.Uint16(tlvs[off+1:off+3]))
+		switch t {
+		case typ:
+		case proxyV2TypeCRC32C:
+			hasCRC = true
+		default:
+			out = append(out, tlvs[off:off+3+n]...)
+		}
+		off += 3 + n
+	}
+	out = append(out, typ, byte(len(value)>>8), byte(len(value)))
+	out = append(out, value...)
+	if hasCRC {
+		out = append(out, proxyV2TypeCRC32C, 0, 4, 0, 0, 0, 0)
+	}
+	binary.BigEndian.PutUint16(out[14:16], uint16(len(out)-16))
+	if hasCRC {
+		binary.BigEndian.PutUint32(out[len(out)-4:], crc32.Checksum(out, castagnoli))
+	}
+	return out
+}
+
 // buildProxyV2Header generates a PROXY protocol v2 header for a TCP connection.
 // This is used for direct connections that don't come with a PROXY protocol header.
 func buildProxyV2Header(srcAddr, dstAddr net.Addr) []byte {
@@ -220,15 +409,40 @@ func buildProxyV2Header(srcAddr, dstAddr net.Addr) []byte {
 	return header
 }
 
-// readFull reads exactly len(buf) bytes from the reader.
-func readFull(br *bufio.Reader, buf []byte) (int, error) {
-	n := 0
-	for n < len(buf) {
-		nn, err := br.Read(buf[n:])
-		n += nn
+// parseTrustedProxies parses a comma-separated list of IPs and CIDR ranges.
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(field); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
 		if err != nil {
-			return n, err
+			return nil, fmt.Errorf("%q is neither an IP nor a CIDR range", field)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// isTrustedProxy reports whether addr (host or host:port) is within one of
+// the trusted prefixes.
+func isTrustedProxy(trusted []netip.Prefix, addr string) bool {
+	ip, err := netip.ParseAddr(addrIP(addr))
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
 		}
 	}
-	return n, nil
+	return false
 }
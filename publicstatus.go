@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// publicStatusTTL is how long /api/server reuses a backend status, so
+	// websites and bots polling it don't ping the backend every time.
+	publicStatusTTL = 10 * time.Second
+
+	publicStatusTimeout = 3 * time.Second
+)
+
+// publicStatus is the payload of /api/server. Like /api/players, its fields
+// are a stable interface for websites and bots.
+type publicStatus struct {
+	Online     bool   `json:"online"` // the backend answered a status ping
+	Players    int    `json:"players"`
+	MaxPlayers int    `json:"max_players"`
+	MOTD       string `json:"motd,omitempty"`
+	Version    string `json:"version,omitempty"`
+}
+
+// shieldsBadge is the Shields.io endpoint badge schema
+// (https://shields.io/badges/endpoint-badge).
+type shieldsBadge struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Label         string `json:"label"`
+	Message       string `json:"message"`
+	Color         string `json:"color"`
+}
+
+// statusCache remembers the backend's last status for publicStatusTTL.
+type statusCache struct {
+	mu     sync.Mutex
+	at     time.Time
+	status publicStatus
+}
+
+// get returns the cached status, pinging the backend if it is stale.
+func (c *statusCache) get(cfg Config) publicStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.at) < publicStatusTTL {
+		return c.status
+	}
+	// A LOCAL PROXY header tells the backend the ping is the proxy's own
+	var header []byte
+	if !cfg.Transparent {
+		header = buildProxyV2Header(nil, nil)
+	}
+	if cfg.RelaySecret != nil {
+		header = append(signRelayPreamble(cfg.RelaySecret, header), header...)
+	}
+	c.status = publicStatus{}
+	if status, err := queryBackendStatus(cfg.currentBackend(), header, "", 0, publicStatusTimeout); err != nil {
+		debugf("[admin] Backend status for /api/server unavailable: %v", err)
+	} else {
+		c.status = publicStatus{
+			Online:     true,
+			Players:    status.Players.Online,
+			MaxPlayers: status.Players.Max,
+			MOTD:       status.MOTD(),
+			Version:    status.Version.Name,
+		}
+	}
+	if cfg.AggregatePlayers {
+		c.status.Players = networkPlayers()
+	}
+	c.at = time.Now()
+	return c.status
+}
+
+// registerPublicStatus adds /api/server and its Shields.io badge variant to
+// mux. They are public and allow cross-origin requests, so a website can
+// fetch them from the browser.
+func registerPublicStatus(mux *http.ServeMux, cfg Config) {
+	cache := &statusCache{}
+	mux.HandleFunc("/api/server", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(publicStatusTTL.Seconds())))
+		writeJSON(w, cache.get(cfg))
+	})
+	mux.HandleFunc("/api/server/shields", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(publicStatusTTL.Seconds())))
+		writeJSON(w, cache.get(cfg).badge())
+	})
+}
+
+// badge renders the status as "37/100" in green, or "offline" in red.
+func (s publicStatus) badge() shieldsBadge {
+	b := shieldsBadge{SchemaVersion: 1, Label: "players", Message: "offline", Color: "red"}
+	if s.Online {
+		b.Message, b.Color = fmt.Sprintf("%d/%d", s.Players, s.MaxPlayers), "brightgreen"
+	}
+	return b
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// queueHoldTime is how long a queued login is held open waiting for a
+	// slot. Clients give up on a silent login after about 30 seconds, so it is
+	// released before that with a message showing the queue position.
+	queueHoldTime = 20 * time.Second
+
+	// queueReserveTime is how long a queue position is kept for a player
+	// who was released and is expected to reconnect.
+	queueReserveTime = 2 * time.Minute
+)
+
+// playerQueue caps the number of players on the backend and, optionally,
+// queues logins beyond the cap.
+//
+// Logins in the Minecraft protocol can't display messages until the player
+// has joined, so a queued player is held at "Logging in…" for up to
+// queueHoldTime and then disconnected with their position. Reconnecting
+// within queueReserveTime keeps the position; each reconnect shows the
+// updated one. Positions are keyed by IP, since the username isn't known when
+// the handshake is read.
+type playerQueue struct {
+	maxPlayers int
+	queueing   bool // false: reject logins beyond the cap outright
+
+	mu      sync.Mutex
+	active  int
+	waiting []*queueEntry // oldest first
+	changed chan struct{} // closed and replaced whenever a slot may have freed up
+}
+
+type queueEntry struct {
+	ip       string
+	lastSeen time.Time // last time the player was held; reserved until lastSeen+queueReserveTime
+	holding  int       // connections currently held for this entry
+}
+
+// queueStats is the queue section of /api/status.
+type queueStats struct {
+	MaxPlayers int `json:"max_players"`
+	Active     int `json:"active"`
+	Waiting    int `json:"waiting"`
+}
+
+func newPlayerQueue(maxPlayers int, queueing bool) *playerQueue {
+	return &playerQueue{maxPlayers: maxPlayers, queueing: queueing, changed: make(chan struct{})}
+}
+
+// acquire claims a player slot for a login from ip, waiting up to wait for
+// one if queueing is enabled. It returns a release func for the slot, or nil
+// and the player's 1-based queue position (0 if queueing is disabled).
+func (q *playerQueue) acquire(ip string, wait time.Duration) (release func(), position int) {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var entry *queueEntry
+	for {
+		q.prune()
+		index := q.indexOf(ip)
+		// Slots go to the head of the queue first; players not in the queue
+		// only get in while nobody is waiting
+		ahead := index
+		if index < 0 {
+			ahead = len(q.waiting)
+		}
+		if q.active+ahead < q.maxPlayers {
+			if index >= 0 {
+				q.waiting = append(q.waiting[:index], q.waiting[index+1:]...)
+			}
+			q.active++
+			return q.releaseFunc(), 0
+		}
+		if !q.queueing {
+			return nil, 0
+		}
+
+		if entry == nil {
+			if index < 0 {
+				q.waiting = append(q.waiting, &queueEntry{ip: ip})
+				index = len(q.waiting) - 1
+			}
+			entry = q.waiting[index]
+			entry.holding++
+			defer func() {
+				entry.holding--
+				entry.lastSeen = time.Now()
+			}()
+		}
+
+		changed := q.changed
+		q.mu.Unlock()
+		select {
+		case <-changed:
+			q.mu.Lock()
+		case <-deadline.C:
+			q.mu.Lock()
+			if i := q.indexOf(ip); i >= 0 {
+				return nil, i + 1
+			}
+			return nil, len(q.waiting) + 1
+		}
+	}
+}
+
+func (q *playerQueue) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			q.active--
+			q.broadcast()
+			q.mu.Unlock()
+		})
+	}
+}
+
+// broadcast wakes every held login so it can re-check its position. Must be
+// called with q.mu held.
+func (q *playerQueue) broadcast() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// prune drops positions whose player didn't come back in time. Must be called
+// with q.mu held.
+func (q *playerQueue) prune() {
+	cutoff := time.Now().Add(-queueReserveTime)
+	kept := q.waiting[:0]
+	for _, e := range q.waiting {
+		if e.holding > 0 || e.lastSeen.After(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) != len(q.waiting) {
+		clear(q.waiting[len(kept):])
+		q.waiting = kept
+		// Players behind the dropped entries moved up
+		q.broadcast()
+	}
+}
+
+func (q *playerQueue) indexOf(ip string) int {
+	for i, e := range q.waiting {
+		if e.ip == ip {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *playerQueue) stats() queueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+	return queueStats{MaxPlayers: q.maxPlayers, Active: q.active, Waiting: len(q.waiting)}
+}
+
+// queueMessage is the disconnect message for a player who didn't get a slot.
+func queueMessage(position int) string {
+	if position == 0 {
+		return "The server is full. Please try again later."
+	}
+	return fmt.Sprintf("The server is full. You are #%d in the queue.\nReconnect within %d minutes to keep your place.", position, int(queueReserveTime.Minutes()))
+}
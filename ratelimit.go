@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginThrottledMessage is shown to players who exceed -login-rate.
+const loginThrottledMessage = "Too many login attempts from your address. Please wait a few seconds and try again."
+
+// rateLimiter allows up to limit events per key within a sliding window.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu        sync.Mutex
+	hits      map[string][]time.Time // key → times of admitted events, oldest first
+	lastSweep time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, hits: make(map[string][]time.Time), lastSweep: time.Now()}
+}
+
+// allow records an event for key and reports whether it is within the limit.
+// Refused events are not recorded, so a client that backs off for a window
+// gets through again.
+func (l *rateLimiter) allow(key string) bool {
+	now := time.Now()
+	cutoff := now.Add(-l.window)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= l.window {
+		for k, times := range l.hits {
+			if times[len(times)-1].Before(cutoff) {
+				delete(l.hits, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	times := l.hits[key]
+	for len(times) > 0 && times[0].Before(cutoff) {
+		times = times[1:]
+	}
+	if len(times) >= l.limit {
+		l.hits[key] = times
+		return false
+	}
+	l.hits[key] = append(times, now)
+	return true
+}
+
+// String formats the limit the way parseRateLimit accepts it.
+func (l *rateLimiter) String() string {
+	return fmt.Sprintf("%d/%s", l.limit, l.window)
+}
+
+// size returns the number of keys currently tracked.
+func (l *rateLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.hits)
+}
+
+// parseRateLimit parses a rate limit of the form "COUNT/WINDOW", e.g. "3/10s".
+func parseRateLimit(s string) (*rateLimiter, error) {
+	count, window, ok := strings.Cut(s, "/")
+	if !ok {
+		return nil, fmt.Errorf("expected count/window, got %q", s)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("count must be a positive integer, got %q", count)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(window))
+	if err != nil {
+		return nil, fmt.Errorf("invalid window: %w", err)
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("window must be positive, got %s", d)
+	}
+	return newRateLimiter(n, d), nil
+}
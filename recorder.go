@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// recorderMaxFiles bounds the capture directory, so a flood of failing
+	// bots can't fill the disk; the oldest captures are deleted first.
+	recorderMaxFiles = 100
+	captureSuffix    = ".capture.txt"
+)
+
+// Directions of captured traffic.
+const (
+	captureToBackend = "client→backend"
+	captureToClient  = "backend→client"
+)
+
+// trafficRecorder saves the start of failed logins (-record-dir): the first
+// limit bytes each way, as hex dumps with timestamps, to attach to bug
+// reports. A login failed if the backend couldn't be reached, or if the
+// connection ended before the backend sent limit bytes, which a backend
+// that let the player in always does.
+type trafficRecorder struct {
+	dir   string
+	limit int
+	now   func() time.Time
+
+	mu sync.Mutex // serializes saving and pruning
+}
+
+func newTrafficRecorder(dir string, limit int) (*trafficRecorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &trafficRecorder{dir: dir, limit: limit, now: time.Now}, nil
+}
+
+func (r *trafficRecorder) String() string {
+	return fmt.Sprintf("failed logins to %s (first %s each way)", r.dir, formatBytes(int64(r.limit)))
+}
+
+// captureChunk is one write in one direction.
+type captureChunk struct {
+	offset time.Duration
+	dir    string
+	data   []byte
+}
+
+// trafficCapture collects one connection's traffic until it is saved.
+type trafficCapture struct {
+	rec     *trafficRecorder
+	started time.Time
+	client  string
+	real    string
+	host    string
+
+	mu     sync.Mutex
+	chunks []captureChunk
+	sizes  map[string]int // bytes captured per direction
+}
+
+// start begins a capture, or returns nil (on which every method is a
+// no-op) if recording is off.
+func (r *trafficRecorder) start(client, real, host string) *trafficCapture {
+	if r == nil {
+		return nil
+	}
+	return &trafficCapture{rec: r, started: r.now(), client: client, real: real, host: host, sizes: make(map[string]int)}
+}
+
+// record keeps as much of data as still fits under the limit for dir.
+func (c *trafficCapture) record(dir string, data []byte) {
+	if c == nil || len(data) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	room := c.rec.limit - c.sizes[dir]
+	if room <= 0 {
+		return
+	}
+	data = data[:min(len(data), room)]
+	c.sizes[dir] += len(data)
+	c.chunks = append(c.chunks, captureChunk{offset: c.rec.now().Sub(c.started), dir: dir, data: append([]byte(nil), data...)})
+}
+
+// writer returns w with everything written through it recorded as dir.
+func (c *trafficCapture) writer(w io.Writer, dir string) io.Writer {
+	if c == nil {
+		return w
+	}
+	return &captureWriter{w: w, capture: c, dir: dir}
+}
+
+type captureWriter struct {
+	w       io.Writer
+	capture *trafficCapture
+	dir     string
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.capture.record(cw.dir, p[:n])
+	return n, err
+}
+
+// failedLogin reports whether a login that sent backendBytes to the client
+// ended before getting into the game.
+func (c *trafficCapture) failedLogin(backendBytes int64) bool {
+	return c != nil && backendBytes < int64(c.rec.limit)
+}
+
+// save writes the capture with the reason it was kept and returns the
+// file's path.
+func (c *trafficCapture) save(username, reason string) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	c.mu.Lock()
+	chunks := c.chunks
+	c.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# mc-dual-proxy %s capture of a failed login\n", version)
+	fmt.Fprintf(&b, "# started:  %s\n", c.started.UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(&b, "# client:   %s (real %s)\n", c.client, c.real)
+	fmt.Fprintf(&b, "# host:     %q\n", c.host)
+	if username != "" {
+		fmt.Fprintf(&b, "# username: %s\n", username)
+	}
+	fmt.Fprintf(&b, "# reason:   %s\n", reason)
+	fmt.Fprintf(&b, "# limit:    first %d bytes each way\n", c.rec.limit)
+	for _, chunk := range chunks {
+		fmt.Fprintf(&b, "\n+%.3fs %s %d bytes\n%s", chunk.offset.Seconds(), chunk.dir, len(chunk.data), hex.Dump(chunk.data))
+	}
+
+	name := c.started.UTC().Format("20060102-150405.000") + "-" + sanitizeFileName(addrIP(c.real))
+	if username != "" {
+		name += "-" + sanitizeFileName(username)
+	}
+	path := filepath.Join(c.rec.dir, name+captureSuffix)
+
+	c.rec.mu.Lock()
+	defer c.rec.mu.Unlock()
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		return "", err
+	}
+	c.rec.prune()
+	return path, nil
+}
+
+// keep saves the capture and logs where it went.
+func (c *trafficCapture) keep(username, reason string) {
+	if c == nil {
+		return
+	}
+	path, err := c.save(username, reason)
+	if err != nil {
+		warnf("[record] %s: saving capture: %v", c.client, err)
+		return
+	}
+	infof("[record] %s: saved capture of a failed login (%s) to %s", c.client, reason, path)
+}
+
+// prune deletes the oldest captures beyond recorderMaxFiles. The names
+// start with their UTC time, so they sort oldest first.
+func (r *trafficRecorder) prune() {
+	matches, _ := filepath.Glob(filepath.Join(r.dir, "*"+captureSuffix))
+	if len(matches) <= recorderMaxFiles {
+		return
+	}
+	sort.Strings(matches)
+	for _, path := range matches[:len(matches)-recorderMaxFiles] {
+		os.Remove(path)
+	}
+}
+
+// sanitizeFileName keeps letters, digits, dots, dashes and underscores;
+// IPv6 colons and anything else become underscores.
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// When instances are chained (e.g. edge nodes relaying to an origin), the
+// relaying instance prefixes every backend connection with a preamble signed
+// with a shared secret, and the receiving instance refuses connections
+// without a valid one. The signature covers the PROXY header that follows,
+// so the player address can't be altered, and a nonce prevents replays.
+//
+// Preamble layout: magic (5) | unix time (8) | nonce (16) | HMAC-SHA256 (32).
+const (
+	relayMagic       = "MCDP\x01"
+	relayNonceLen    = 16
+	relayPreambleLen = len(relayMagic) + 8 + relayNonceLen + sha256.Size
+
+	// relayMaxSkew is how far a preamble's timestamp may be from our clock.
+	relayMaxSkew = 30 * time.Second
+)
+
+// signRelayPreamble returns a preamble for a connection whose PROXY header
+// (possibly empty) is header.
+func signRelayPreamble(secret, header []byte) []byte {
+	preamble := make([]byte, relayPreambleLen)
+	copy(preamble, relayMagic)
+	binary.BigEndian.PutUint64(preamble[len(relayMagic):], uint64(time.Now().Unix()))
+	rand.Read(preamble[len(relayMagic)+8 : len(relayMagic)+8+relayNonceLen])
+	copy(preamble[relayPreambleLen-sha256.Size:], relayMAC(secret, preamble[:relayPreambleLen-sha256.Size], header))
+	return preamble
+}
+
+func relayMAC(secret, signed, header []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signed)
+	mac.Write(header)
+	return mac.Sum(nil)
+}
+
+// readRelayPreamble consumes a preamble from the start of br.
+func readRelayPreamble(br *bufio.Reader) ([]byte, error) {
+	preamble := make([]byte, relayPreambleLen)
+	if _, err := io.ReadFull(br, preamble); err != nil {
+		return nil, fmt.Errorf("read preamble: %w", err)
+	}
+	if !bytes.HasPrefix(preamble, []byte(relayMagic)) {
+		return nil, errors.New("no relay preamble")
+	}
+	return preamble, nil
+}
+
+// relayVerifier checks preambles signed with secret and remembers recent
+// nonces to refuse replays.
+type relayVerifier struct {
+	secret []byte
+
+	mu        sync.Mutex
+	seen      map[[relayNonceLen]byte]time.Time // nonce → when it can be forgotten
+	lastSweep time.Time
+}
+
+func newRelayVerifier(secret []byte) *relayVerifier {
+	return &relayVerifier{secret: secret, seen: make(map[[relayNonceLen]byte]time.Time), lastSweep: time.Now()}
+}
+
+// verify checks that preamble was signed with our secret for header, is
+// recent and hasn't been seen before.
+func (v *relayVerifier) verify(preamble, header []byte) error {
+	signed := preamble[:relayPreambleLen-sha256.Size]
+	if !hmac.Equal(preamble[len(signed):], relayMAC(v.secret, signed, header)) {
+		return errors.New("bad signature")
+	}
+	now := time.Now()
+	sent := time.Unix(int64(binary.BigEndian.Uint64(preamble[len(relayMagic):])), 0)
+	if skew := now.Sub(sent); skew > relayMaxSkew || skew < -relayMaxSkew {
+		return fmt.Errorf("timestamp %s is too far from our clock", sent.UTC().Format(time.RFC3339))
+	}
+
+	var nonce [relayNonceLen]byte
+	copy(nonce[:], preamble[len(relayMagic)+8:])
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, replayed := v.seen[nonce]; replayed {
+		return errors.New("replayed preamble")
+	}
+	// A nonce only needs remembering while its timestamp would be accepted
+	v.seen[nonce] = sent.Add(relayMaxSkew)
+	if now.Sub(v.lastSweep) >= relayMaxSkew {
+		for k, expiry := range v.seen {
+			if now.After(expiry) {
+				delete(v.seen, k)
+			}
+		}
+		v.lastSweep = now
+	}
+	return nil
+}
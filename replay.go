@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// replayRetention is how long a serverId that authenticated a player is
+// remembered. Session servers forget a join within a minute, so a serverId
+// captured and replayed later than this is refused upstream anyway; the rest
+// is margin for upstreams that keep joins longer.
+const replayRetention = 5 * time.Minute
+
+// replayGuard remembers the serverIds that produced a successful hasJoined
+// (-replay-window). Each login derives a fresh serverId from its encryption
+// handshake, so seeing one again after the window means someone is replaying
+// a captured auth exchange. Reuse within the window is allowed: backends may
+// retry a hasJoined that timed out on their side.
+type replayGuard struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // serverId → first success
+	lastSweep time.Time
+}
+
+func newReplayGuard(window time.Duration) *replayGuard {
+	return &replayGuard{window: window, seen: make(map[string]time.Time), lastSweep: time.Now()}
+}
+
+// allow reports whether serverId may be authenticated: it hasn't succeeded
+// before, or did so within the window.
+func (g *replayGuard) allow(serverID string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	first, ok := g.seen[serverID]
+	return !ok || time.Since(first) <= g.window
+}
+
+// record remembers that serverId authenticated a player, keeping the time of
+// its first success.
+func (g *replayGuard) record(serverID string) {
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if now.Sub(g.lastSweep) >= time.Hour {
+		for id, first := range g.seen {
+			if now.Sub(first) > replayRetention {
+				delete(g.seen, id)
+			}
+		}
+		g.lastSweep = now
+	}
+	if _, ok := g.seen[serverID]; !ok {
+		g.seen[serverID] = now
+	}
+}
+
+// size returns the number of serverIds currently remembered.
+func (g *replayGuard) size() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.seen)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// reputationTimeout bounds one lookup, and so how long a login from a
+	// new address may wait for its verdict.
+	reputationTimeout = 2 * time.Second
+
+	// reputationErrorTTL is how long a failed lookup is remembered, so an
+	// unreachable source isn't asked again on every login.
+	reputationErrorTTL = time.Minute
+
+	// reputationSweepInterval is how often expired verdicts are dropped from
+	// the cache.
+	reputationSweepInterval = time.Minute
+
+	// reputationCacheLimit bounds the cache during a flood of new addresses;
+	// beyond it, verdicts are dropped before they expire.
+	reputationCacheLimit = 100_000
+
+	// reputationBlockedMessage is shown to players refused for the
+	// reputation of their address.
+	reputationBlockedMessage = "Connections from your network are not allowed here. If you think this is a mistake, contact the server staff."
+)
+
+// abuseIPDBURL is the AbuseIPDB check endpoint; a variable for tests.
+var abuseIPDBURL = "https://api.abuseipdb.com/api/v2/check"
+
+// reputationCheck scores the addresses logins come from with a reputation
+// source (-reputation) and refuses or flags those at or above a threshold,
+// to keep bots from well-known abusive ranges out. Verdicts are cached per
+// address, and logins from an address that is being looked up wait for that
+// lookup instead of starting another. Lookups that fail let the login in: a
+// reputation source being down shouldn't lock players out.
+type reputationCheck struct {
+	source    string
+	lookup    func(ctx context.Context, ip netip.Addr) (int, error) // score 0–100
+	threshold int
+	deny      bool // refuse logins at the threshold, rather than only flag them
+	ttl       time.Duration
+
+	mu        sync.Mutex
+	cache     map[netip.Addr]reputationEntry
+	pending   map[netip.Addr]*reputationLookup
+	lastSweep time.Time
+
+	clean, flagged, denied, failed, cacheHits atomic.Int64
+}
+
+type reputationEntry struct {
+	score   int
+	err     error
+	expires time.Time
+}
+
+// reputationLookup is a lookup in flight; entry is set when done is closed.
+type reputationLookup struct {
+	done  chan struct{}
+	entry reputationEntry
+}
+
+// parseReputation sets up -reputation: "abuseipdb" (with an API key) or
+// "dnsbl:ZONE,ZONE", DNS blocklists such as a local rbldnsd, where being
+// listed in any zone scores 100. action is "deny" or "flag".
+func parseReputation(source, key string, threshold int, action string, ttl time.Duration) (*reputationCheck, error) {
+	r := &reputationCheck{source: source, threshold: threshold, ttl: ttl, cache: make(map[netip.Addr]reputationEntry), pending: make(map[netip.Addr]*reputationLookup), lastSweep: time.Now()}
+	switch action {
+	case "deny":
+		r.deny = true
+	case "flag":
+	default:
+		return nil, fmt.Errorf("unknown action %q (expected deny or flag)", action)
+	}
+	if threshold < 1 || threshold > 100 {
+		return nil, fmt.Errorf("threshold must be between 1 and 100, got %d", threshold)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("cache duration must be positive, got %s", ttl)
+	}
+	switch kind, zones, _ := strings.Cut(source, ":"); kind {
+	case "abuseipdb":
+		if key == "" {
+			return nil, errors.New("abuseipdb needs an API key (-reputation-key)")
+		}
+		client := &http.Client{Timeout: reputationTimeout}
+		r.lookup = func(ctx context.Context, ip netip.Addr) (int, error) {
+			return abuseIPDBScore(ctx, client, key, ip)
+		}
+	case "dnsbl":
+		var list []string
+		for _, zone := range strings.Split(zones, ",") {
+			if zone = strings.Trim(strings.TrimSpace(zone), "."); zone != "" {
+				list = append(list, zone)
+			}
+		}
+		if len(list) == 0 {
+			return nil, errors.New("dnsbl needs at least one zone, e.g. dnsbl:rbl.example.org")
+		}
+		r.lookup = func(ctx context.Context, ip netip.Addr) (int, error) {
+			return dnsblScore(ctx, net.DefaultResolver, list, ip)
+		}
+	default:
+		return nil, fmt.Errorf("unknown source %q (expected abuseipdb or dnsbl:ZONE)", source)
+	}
+	return r, nil
+}
+
+// score returns the reputation of the address of addr (host or host:port),
+// from the cache if it was looked up recently. Private and loopback
+// addresses are never looked up and score 0.
+func (r *reputationCheck) score(addr string) (int, error) {
+	ip, err := netip.ParseAddr(addrIP(addr))
+	if err != nil {
+		return 0, nil
+	}
+	ip = ip.Unmap()
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return 0, nil
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	if entry, ok := r.cache[ip]; ok && now.Before(entry.expires) {
+		r.mu.Unlock()
+		r.cacheHits.Add(1)
+		return entry.score, entry.err
+	}
+	if inflight, ok := r.pending[ip]; ok {
+		r.mu.Unlock()
+		<-inflight.done
+		r.cacheHits.Add(1)
+		return inflight.entry.score, inflight.entry.err
+	}
+	inflight := &reputationLookup{done: make(chan struct{})}
+	r.pending[ip] = inflight
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), reputationTimeout)
+	defer cancel()
+	score, err := r.lookup(ctx, ip)
+	entry := reputationEntry{score: score, err: err, expires: now.Add(r.ttl)}
+	if err != nil {
+		entry.expires = now.Add(min(r.ttl, reputationErrorTTL))
+	}
+
+	r.mu.Lock()
+	r.cache[ip] = entry
+	delete(r.pending, ip)
+	r.sweepLocked(now)
+	r.mu.Unlock()
+	inflight.entry = entry
+	close(inflight.done)
+	return score, err
+}
+
+// sweepLocked drops expired verdicts now and then, and verdicts beyond
+// reputationCacheLimit, so the cache doesn't grow forever. Must be called
+// with r.mu held.
+func (r *reputationCheck) sweepLocked(now time.Time) {
+	if now.Sub(r.lastSweep) >= reputationSweepInterval {
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		r.lastSweep = now
+	}
+	for k := range r.cache {
+		if len(r.cache) <= reputationCacheLimit {
+			break
+		}
+		delete(r.cache, k)
+	}
+}
+
+// abuseIPDBScore asks AbuseIPDB for the abuse confidence score of ip.
+func abuseIPDBScore(ctx context.Context, client *http.Client, key string, ip netip.Addr) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, abuseIPDBURL+"?"+url.Values{"ipAddress": {ip.String()}, "maxAgeInDays": {"90"}}.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Key", key)
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return 0, fmt.Errorf("abuseipdb answered %s", resp.Status)
+	}
+	var result struct {
+		Data struct {
+			AbuseConfidenceScore *int `json:"abuseConfidenceScore"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("abuseipdb: %w", err)
+	}
+	if result.Data.AbuseConfidenceScore == nil {
+		return 0, errors.New("abuseipdb: no abuseConfidenceScore in the answer")
+	}
+	return *result.Data.AbuseConfidenceScore, nil
+}
+
+// dnsblResolver is the part of net.Resolver DNS blocklists need.
+type dnsblResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// dnsblScore returns 100 if ip is listed in any of zones and 0 otherwise.
+// A name that doesn't exist means not listed; other DNS errors are errors.
+func dnsblScore(ctx context.Context, resolver dnsblResolver, zones []string, ip netip.Addr) (int, error) {
+	for _, zone := range zones {
+		_, err := resolver.LookupHost(ctx, dnsblName(ip, zone))
+		var dnsErr *net.DNSError
+		switch {
+		case err == nil:
+			return 100, nil
+		case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		default:
+			return 0, fmt.Errorf("dnsbl %s: %w", zone, err)
+		}
+	}
+	return 0, nil
+}
+
+// dnsblName returns the name to look up for ip in zone: the octets of an
+// IPv4 address, or the nibbles of an IPv6 address, in reverse order.
+func dnsblName(ip netip.Addr, zone string) string {
+	var labels []string
+	if ip.Is4() {
+		b := ip.As4()
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(b[i]))
+		}
+	} else {
+		b := ip.As16()
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%x", b[i]&0xf), fmt.Sprintf("%x", b[i]>>4))
+		}
+	}
+	return strings.Join(labels, ".") + "." + zone
+}
+
+func (r *reputationCheck) String() string {
+	action := "flagging"
+	if r.deny {
+		action = "refusing"
+	}
+	return fmt.Sprintf("%s logins scoring %d+ on %s", action, r.threshold, r.source)
+}
+
+// write adds the verdict counters to the metrics.
+func (r *reputationCheck) write(p metricsSink) {
+	p.family("reputation_checks_total", "counter", "Logins checked against the -reputation source, by verdict.")
+	p.sample("reputation_checks_total", float64(r.clean.Load()), "verdict", "clean")
+	p.sample("reputation_checks_total", float64(r.flagged.Load()), "verdict", "flagged")
+	p.sample("reputation_checks_total", float64(r.denied.Load()), "verdict", "denied")
+	p.sample("reputation_checks_total", float64(r.failed.Load()), "verdict", "error")
+	p.family("reputation_cache_hits_total", "counter", "Reputation verdicts answered from the cache.")
+	p.sample("reputation_cache_hits_total", float64(r.cacheHits.Load()))
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DNS record lifetimes are clamped to this range, so a TTL of 0 doesn't
+	// mean a lookup per connection and a huge TTL doesn't pin a stale address.
+	minResolveTTL = 5 * time.Second
+	maxResolveTTL = time.Hour
+
+	// fallbackResolveTTL is used when the TTL is unknown, i.e. when the
+	// system resolver answered instead of our own DNS query.
+	fallbackResolveTTL = 30 * time.Second
+
+	// dnsQueryTimeout bounds each DNS query.
+	dnsQueryTimeout = 2 * time.Second
+)
+
+// backendResolver keeps the addresses of a backend given by hostname fresh:
+// it re-resolves the name when its DNS records expire, spreads connections
+// over all the records, and logs when the set of addresses changes.
+type backendResolver struct {
+	host, port string
+
+	mu         sync.Mutex
+	addrs      []string // host:port, sorted
+	next       int      // rotation index
+	expires    time.Time
+	refreshing bool
+}
+
+// newBackendResolver returns a resolver for backendAddr, or nil if its host
+// is an IP address and there is nothing to resolve.
+func newBackendResolver(backendAddr string) (*backendResolver, error) {
+	host, port, err := net.SplitHostPort(backendAddr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil, nil
+	}
+	return &backendResolver{host: host, port: port}, nil
+}
+
+// candidates returns the addresses to dial, in order: every resolved
+// address, starting with the next one in the rotation. The first call
+// resolves synchronously; later ones refresh expired records in the
+// background and use the previous set meanwhile.
+func (r *backendResolver) candidates() []string {
+	r.mu.Lock()
+	if r.addrs == nil {
+		r.mu.Unlock()
+		r.refresh()
+		r.mu.Lock()
+	} else if time.Now().After(r.expires) && !r.refreshing {
+		r.refreshing = true
+		go r.refresh()
+	}
+	defer r.mu.Unlock()
+
+	if len(r.addrs) == 0 {
+		// Let the dial fail (or succeed) with the system resolver
+		return []string{net.JoinHostPort(r.host, r.port)}
+	}
+	start := r.next % len(r.addrs)
+	r.next++
+	return append(slices.Clone(r.addrs[start:]), r.addrs[:start]...)
+}
+
+// refresh resolves the host again and logs changes to the address set.
+func (r *backendResolver) refresh() {
+	ips, ttl, err := resolveWithTTL(r.host)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refreshing = false
+	if err != nil {
+		// Keep using the last known addresses and try again soon
+		warnf("[backend] failed to resolve %s: %v", r.host, err)
+		r.expires = time.Now().Add(minResolveTTL)
+		if r.addrs == nil {
+			r.addrs = []string{}
+		}
+		return
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), r.port)
+	}
+	slices.Sort(addrs)
+	addrs = slices.Compact(addrs)
+	if !slices.Equal(addrs, r.addrs) {
+		infof("[backend] %s resolves to %s (ttl %s)", r.host, strings.Join(addrs, ", "), ttl)
+	}
+	r.addrs = addrs
+	r.expires = time.Now().Add(ttl)
+}
+
+// resolveWithTTL looks up the A and AAAA records of host and how long they
+// may be cached. The system resolver doesn't report TTLs, so the records are
+// queried directly from the first nameserver in /etc/resolv.conf, falling
+// back to the system resolver (e.g. for names in /etc/hosts, or on Windows)
+// with a fixed TTL.
+func resolveWithTTL(host string) ([]netip.Addr, time.Duration, error) {
+	if server, err := systemNameserver(); err == nil {
+		var ips []netip.Addr
+		ttl := maxResolveTTL
+		var errs []error
+		for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			found, recordTTL, err := queryDNS(server, host, qtype)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if len(found) > 0 {
+				ips = append(ips, found...)
+				ttl = min(ttl, recordTTL)
+			}
+		}
+		if len(ips) > 0 {
+			return ips, max(ttl, minResolveTTL), nil
+		}
+		debugf("[backend] direct DNS lookup of %s found nothing (%v), using the system resolver", host, errors.Join(errs...))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*dnsQueryTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, ip := range ips {
+		ips[i] = ip.Unmap()
+	}
+	return ips, fallbackResolveTTL, nil
+}
+
+// systemNameserver returns the first nameserver in /etc/resolv.conf.
+func systemNameserver() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf")
+}
+
+// DNS record types we query.
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypeAAAA uint16 = 28
+)
+
+// queryDNS sends one recursive query for host's records of qtype to server
+// over UDP and returns the addresses found and their lowest TTL.
+func queryDNS(server, host string, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	query, id, err := encodeDNSQuery(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, err := net.DialTimeout("udp", server, dnsQueryTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Ignore stray responses to other queries
+		if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+			return decodeDNSResponse(buf[:n], qtype)
+		}
+	}
+}
+
+// encodeDNSQuery builds a query message with a random ID.
+func encodeDNSQuery(host string, qtype uint16) ([]byte, uint16, error) {
+	var idBytes [2]byte
+	rand.Read(idBytes[:])
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0x00) // recursion desired
+	msg = append(msg, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid hostname %q", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // class IN
+	return msg, id, nil
+}
+
+// decodeDNSResponse extracts the records of qtype from a response. CNAMEs
+// aren't followed: a recursive resolver already includes the records they
+// point to.
+func decodeDNSResponse(msg []byte, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	if len(msg) < 12 {
+		return nil, 0, errors.New("short DNS response")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	switch {
+	case flags&0x8000 == 0:
+		return nil, 0, errors.New("not a DNS response")
+	case flags&0x0200 != 0:
+		return nil, 0, errors.New("truncated DNS response")
+	case flags&0x000F == 3:
+		return nil, 0, errors.New("no such host")
+	case flags&0x000F != 0:
+		return nil, 0, fmt.Errorf("DNS error code %d", flags&0x000F)
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for range questions {
+		end, err := skipDNSName(msg, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		off = end + 4
+	}
+
+	var ips []netip.Addr
+	ttl := maxResolveTTL
+	for range answers {
+		end, err := skipDNSName(msg, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		if end+10 > len(msg) {
+			return nil, 0, errors.New("truncated DNS record")
+		}
+		rtype := binary.BigEndian.Uint16(msg[end:])
+		recordTTL := time.Duration(binary.BigEndian.Uint32(msg[end+4:])) * time.Second
+		rdlen := int(binary.BigEndian.Uint16(msg[end+8:]))
+		rdata := msg[end+10:]
+		if rdlen > len(rdata) {
+			return nil, 0, errors.New("truncated DNS record")
+		}
+		rdata = rdata[:rdlen]
+		off = end + 10 + rdlen
+
+		if rtype != qtype {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(rdata)
+		if !ok || (qtype == dnsTypeA) != ip.Is4() {
+			return nil, 0, errors.New("malformed address record")
+		}
+		ips = append(ips, ip)
+		ttl = min(ttl, recordTTL)
+	}
+	return ips, ttl, nil
+}
+
+// skipDNSName returns the offset just past the (possibly compressed) name
+// starting at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errors.New("truncated DNS name")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xC0 == 0xC0:
+			// A pointer ends the name
+			return off + 2, nil
+		case length&0xC0 != 0:
+			return 0, errors.New("invalid DNS label")
+		}
+		off += 1 + length
+	}
+}
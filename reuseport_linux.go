@@ -0,0 +1,32 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT from <asm-generic/socket.h>, which the syscall
+// package does not define (alpha, mips, parisc and sparc use other values,
+// but Go doesn't run on most of them and they are rare servers).
+const soReusePort = 0xf
+
+// listenReusePort listens on addr with SO_REUSEPORT, so several sockets can
+// share the address and the kernel spreads new connections over them.
+func listenReusePort(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.Listen(context.Background(), network, addr)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// listenReusePort is only implemented on Linux, whose SO_REUSEPORT balances
+// connections across sockets.
+func listenReusePort(network, addr string) (net.Listener, error) {
+	return nil, errors.New("SO_REUSEPORT listeners are only supported on Linux")
+}
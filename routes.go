@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultRouteName is the route made of -listen, -backend and -session-servers.
+const defaultRouteName = "default"
+
+// routePathPrefix is where route-specific hasJoined endpoints live on the
+// multiauth server: /route/NAME/session/minecraft/hasJoined.
+const routePathPrefix = "/route/"
+
+var routeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// routeConfig is an additional listener with its own backend and, optionally,
+// its own session servers, configured with -route.
+type routeConfig struct {
+	Name           string
+	ListenAddr     string
+	ListenFamily   string // auto, dual, ipv4 or ipv6; "" is auto
+	BackendAddr    string
+	SessionServers []string // empty = same as the default route
+	Ingress        *ingressProfile
+}
+
+// parseRoute parses a -route value of semicolon-separated key=value pairs:
+//
+//	name=creative;listen=0.0.0.0:25570;backend=127.0.0.1:25567;session-servers=https://sessionserver.mojang.com
+//
+// name, listen and backend are required; session-servers is a comma-separated
+// list and defaults to -session-servers, ingress names the route's ingress
+// profile (auto by default, whatever -ingress is), and family is the
+// listener's address family like -listen-family.
+func parseRoute(s string) (routeConfig, error) {
+	var rt routeConfig
+	for _, field := range strings.Split(s, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return rt, fmt.Errorf("expected key=value, got %q", field)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "name":
+			rt.Name = value
+		case "listen":
+			rt.ListenAddr = value
+		case "family":
+			rt.ListenFamily = value
+		case "backend":
+			rt.BackendAddr = value
+		case "session-servers":
+			for _, server := range strings.Split(value, ",") {
+				if server = strings.TrimSpace(server); server != "" {
+					rt.SessionServers = append(rt.SessionServers, server)
+				}
+			}
+		case "ingress":
+			profile, err := parseIngressProfile(value)
+			if err != nil {
+				return rt, err
+			}
+			rt.Ingress = profile
+		default:
+			return rt, fmt.Errorf("unknown key %q (expected name, listen, family, backend, session-servers or ingress)", key)
+		}
+	}
+
+	switch {
+	case !routeNamePattern.MatchString(rt.Name):
+		return rt, fmt.Errorf("route name %q must be letters, digits, '-' or '_'", rt.Name)
+	case rt.Name == defaultRouteName:
+		return rt, fmt.Errorf("route name %q is reserved", rt.Name)
+	case rt.ListenAddr == "":
+		return rt, fmt.Errorf("route %s: listen is required", rt.Name)
+	case rt.BackendAddr == "":
+		return rt, fmt.Errorf("route %s: backend is required", rt.Name)
+	}
+	if _, err := parseListenAddrs(rt.ListenAddr, rt.ListenFamily); err != nil {
+		return rt, fmt.Errorf("route %s: %w", rt.Name, err)
+	}
+	return rt, nil
+}
+
+// forRoute returns the configuration connections and auth requests of rt
+// are handled with. Backend lifecycle features (supervision, Wake-on-LAN)
+// only manage the default backend; the startup hold is kept per route.
+func (cfg Config) forRoute(rt routeConfig) Config {
+	routeCfg := cfg
+	routeCfg.Route = rt.Name
+	routeCfg.ListenAddr = rt.ListenAddr
+	routeCfg.ListenFamily = rt.ListenFamily
+	routeCfg.BackendAddr = rt.BackendAddr
+	routeCfg.Ingress = rt.Ingress
+	if len(rt.SessionServers) > 0 {
+		routeCfg.SessionServers = rt.SessionServers
+	}
+	routeCfg.Routes = nil
+	routeCfg.Discovery = nil
+	routeCfg.BackendPool = nil
+	routeCfg.UserRouter = nil
+	routeCfg.Resolver, _ = newBackendResolver(rt.BackendAddr)
+	routeCfg.Supervisor = nil
+	routeCfg.Waker = nil
+	if cfg.Startup != nil {
+		routeCfg.Startup = newStartupHold(cfg.Startup.expected)
+	}
+	return routeCfg
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// selfTestTimeout bounds each connection the self-test makes.
+const selfTestTimeout = 5 * time.Second
+
+// selfTestCheck is one line of the selftest report.
+type selfTestCheck struct {
+	Name   string
+	OK     bool
+	Detail string
+}
+
+// selfTestEnv is the mock setup the checks run against: a mock backend, the
+// proxy's connection handler on a loopback listener, and two session
+// servers, one knowing the test player and one not.
+type selfTestEnv struct {
+	cfg     Config // the configuration under test, pointed at the mocks
+	host    string // server address put in handshakes
+	proxy   string // address of the proxy listener
+	known   string // session server that authenticates selfTestPlayer
+	unknown string // session server that knows nobody
+	closers []io.Closer
+}
+
+// selfTestPlayer is the username the auth checks log in with.
+const selfTestPlayer = "SelfTest"
+
+// runSelfTest checks the connection paths and the auth fan-out of cfg
+// against mocks, through the same code the proxy runs.
+func runSelfTest(cfg Config, host string) ([]selfTestCheck, error) {
+	env, err := newSelfTestEnv(cfg, host)
+	if err != nil {
+		return nil, err
+	}
+	defer env.close()
+	return []selfTestCheck{
+		env.checkPath("Direct status ping", false),
+		env.checkPath("Proxied status ping", true),
+		env.checkAuth(),
+		env.checkAuthRejected(),
+	}, nil
+}
+
+func newSelfTestEnv(cfg Config, host string) (*selfTestEnv, error) {
+	env := &selfTestEnv{host: host}
+	listen := func() (net.Listener, error) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			env.closers = append(env.closers, ln)
+		}
+		return ln, err
+	}
+
+	backendLn, err := listen()
+	if err != nil {
+		env.close()
+		return nil, err
+	}
+	go (&mockBackend{motd: "selftest", requireHeader: true}).serve(backendLn)
+
+	// The proxy under test, with everything that leads away from the
+	// mock backend turned off
+	cfg.BackendAddr = backendLn.Addr().String()
+	cfg.Transparent = false
+	cfg.Resolver, cfg.Balancer, cfg.UserRouter, cfg.Discovery = nil, nil, nil, nil
+	cfg.BackendPool, cfg.Waker, cfg.Startup, cfg.Supervisor = nil, nil, nil, nil
+	cfg.RelayVerifier, cfg.RelaySecret, cfg.Chaos, cfg.Recorder, cfg.Mirror = nil, nil, nil, nil, nil
+	proxyLn, err := listen()
+	if err != nil {
+		env.close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := proxyLn.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn, cfg)
+		}
+	}()
+	env.proxy = proxyLn.Addr().String()
+
+	for _, handler := range []http.Handler{
+		&devSessionServer{skin: devSkinURL, reject: map[string]bool{}, now: time.Now},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }),
+	} {
+		ln, err := listen()
+		if err != nil {
+			env.close()
+			return nil, err
+		}
+		go http.Serve(ln, handler)
+		url := "http://" + ln.Addr().String()
+		if env.known == "" {
+			env.known = url
+		} else {
+			env.unknown = url
+		}
+	}
+	cfg.Dialects, cfg.UpstreamClient = nil, nil
+	env.cfg = cfg
+	return env, nil
+}
+
+func (env *selfTestEnv) close() {
+	for _, c := range env.closers {
+		c.Close()
+	}
+}
+
+// expectedSource returns the player address the mock backend should see
+// for a status ping, "127.0.0.1" for the loopback test client itself, or ""
+// if the proxy should refuse it.
+func (env *selfTestEnv) expectedSource(header *ProxyHeader) string {
+	cfg := env.cfg
+	if cfg.Ingress != nil && cfg.Ingress.check(header) != "" {
+		return ""
+	}
+	if header == nil {
+		return "127.0.0.1"
+	}
+	if !isTrustedProxy(cfg.TrustedProxies, "127.0.0.1:0") {
+		switch cfg.UntrustedProxyHeader {
+		case proxyHeaderReject:
+			return ""
+		case proxyHeaderRewrite:
+			return "127.0.0.1"
+		}
+	}
+	return header.SrcAddr.String()
+}
+
+// checkPath pings the proxy, directly or with a PROXY v2 header claiming a
+// player address, and compares what the mock backend saw with what cfg
+// should make of it. The proxy always sends the backend a v2 header.
+func (env *selfTestEnv) checkPath(name string, proxied bool) selfTestCheck {
+	var raw []byte
+	var header *ProxyHeader
+	if proxied {
+		raw = fakeProxyHeader("v2", nil)
+		header, _ = detectProxyProtocol(bufio.NewReader(bytes.NewReader(raw)))
+	}
+	want := env.expectedSource(header)
+
+	start := time.Now()
+	status, err := queryBackendStatus(env.proxy, raw, env.host, 25565, selfTestTimeout)
+	took := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		if want == "" {
+			return selfTestCheck{name, true, "refused, as configured"}
+		}
+		return selfTestCheck{name, false, fmt.Sprintf("no answer: %v", err)}
+	}
+	if want == "" {
+		return selfTestCheck{name, false, "answered, but the configuration should refuse it"}
+	}
+	// The mock backend's MOTD ends with "ADDRESS:PORT via HEADER"
+	lines := strings.Split(status.MOTD(), "\n")
+	seen := strings.TrimPrefix(lines[len(lines)-1], "§7")
+	source, kind, ok := strings.Cut(seen, " via ")
+	switch {
+	case !ok:
+		return selfTestCheck{name, false, fmt.Sprintf("answered by something other than the backend: %q", status.MOTD())}
+	case addrIP(source) != want || kind != "PROXY v2":
+		return selfTestCheck{name, false, fmt.Sprintf("backend saw %s, expected %s via PROXY v2", seen, want)}
+	}
+	return selfTestCheck{name, true, fmt.Sprintf("backend saw %s (%s)", seen, took)}
+}
+
+// checkAuth runs a login through the fan-out, which the known session
+// server should win.
+func (env *selfTestEnv) checkAuth() selfTestCheck {
+	const name = "Auth fan-out"
+	cfg := env.cfg
+	cfg.SessionServers = []string{env.unknown, env.known}
+	status, body, traces := testAuth(cfg, selfTestPlayer, randomServerID(), "")
+	if status != http.StatusOK {
+		return selfTestCheck{name, false, fmt.Sprintf("answered %d, expected 200 from %s", status, env.known)}
+	}
+	var profile struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &profile); err != nil || profile.ID != offlineUUID(selfTestPlayer) {
+		return selfTestCheck{name, false, fmt.Sprintf("unexpected profile %s", body)}
+	}
+	return selfTestCheck{name, true, fmt.Sprintf("%s authenticated via %d session servers", selfTestPlayer, len(traces))}
+}
+
+// checkAuthRejected runs a login no session server knows, which must fail
+// unless -offline-fallback lets it in.
+func (env *selfTestEnv) checkAuthRejected() selfTestCheck {
+	const name = "Auth rejection"
+	cfg := env.cfg
+	cfg.SessionServers = []string{env.unknown, env.unknown}
+	status, _, _ := testAuth(cfg, selfTestPlayer, randomServerID(), "")
+	switch {
+	case status == http.StatusNoContent:
+		return selfTestCheck{name, true, "unknown login refused"}
+	case status == http.StatusOK && cfg.OfflineFallback != nil:
+		return selfTestCheck{name, true, "unknown login let in by -offline-fallback"}
+	}
+	return selfTestCheck{name, false, fmt.Sprintf("answered %d, expected 204", status)}
+}
+
+func randomServerID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// printSelfTest writes the report and returns the number of failed checks.
+func printSelfTest(w io.Writer, checks []selfTestCheck) int {
+	failed := 0
+	for _, c := range checks {
+		mark := "✓"
+		if !c.OK {
+			mark = "✗"
+			failed++
+		}
+		fmt.Fprintf(w, "%s %-20s %s\n", mark, c.Name, c.Detail)
+	}
+	if failed == 0 {
+		fmt.Fprintf(w, "\nAll %d checks passed\n", len(checks))
+	} else {
+		fmt.Fprintf(w, "\n%d of %d checks failed\n", failed, len(checks))
+	}
+	return failed
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// setupOptions configure generate-setup beyond the proxy's own flags.
+type setupOptions struct {
+	Dir        string   // where the files are written
+	AuthDomain string   // public name of the multiauth server behind Caddy; "" if backends reach it directly
+	Binary     string   // absolute path of this executable, for the systemd unit
+	Args       []string // the proxy's flags, for the systemd unit
+}
+
+// setupFile is one file generate-setup writes.
+type setupFile struct {
+	Name    string
+	Content string
+}
+
+// setupFiles templates the backend and deployment files for cfg.
+func setupFiles(cfg Config, opts setupOptions) ([]setupFile, error) {
+	authAddr, tcp := authHTTPAddr(cfg.AuthListenAddrs)
+	authBase := "http://" + authAddr
+	if opts.AuthDomain != "" {
+		authBase = "https://" + opts.AuthDomain
+	} else if !tcp {
+		return nil, fmt.Errorf("-auth-listen has only Unix sockets (%s), which backends can't reach; add a TCP address or serve it on -auth-domain", authAddr)
+	}
+	files := []setupFile{
+		{"velocity.jvmflags", velocityFlags(authBase)},
+		{"velocity.patch.toml", velocityPatch(cfg.BackendAddr, !cfg.Transparent)},
+		{"paper.jvmflags", paperFlags(authBase)},
+		{"paper-global.patch.yml", paperPatch(cfg.BackendAddr, !cfg.Transparent)},
+	}
+	// Backends behind other routes authenticate through their route's path
+	for _, rt := range cfg.Routes {
+		routeBase := authBase + routePathPrefix + rt.Name
+		files = append(files,
+			setupFile{"velocity-" + rt.Name + ".jvmflags", velocityFlags(routeBase)},
+			setupFile{"velocity-" + rt.Name + ".patch.toml", velocityPatch(rt.BackendAddr, !cfg.Transparent)},
+			setupFile{"paper-" + rt.Name + ".jvmflags", paperFlags(routeBase)},
+			setupFile{"paper-global-" + rt.Name + ".patch.yml", paperPatch(rt.BackendAddr, !cfg.Transparent)},
+		)
+	}
+	if opts.AuthDomain != "" {
+		upstream := authAddr
+		if path, ok := strings.CutPrefix(authAddr, "unix:"); ok {
+			upstream = "unix/" + path // Caddy's name for a socket
+		}
+		files = append(files, setupFile{"Caddyfile", fmt.Sprintf("%s {\n\treverse_proxy %s\n}\n", opts.AuthDomain, upstream)})
+	}
+	files = append(files, setupFile{"mc-dual-proxy.service", systemdUnit(cfg, opts)})
+	return files, nil
+}
+
+// writeSetupFiles writes the files for cfg to opts.Dir and returns their
+// paths.
+func writeSetupFiles(cfg Config, opts setupOptions) ([]string, error) {
+	files, err := setupFiles(cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, f := range files {
+		path := filepath.Join(opts.Dir, f.Name)
+		if err := os.WriteFile(path, []byte(f.Content), 0o644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// velocityFlags is a java argument file (java @velocity.jvmflags -jar ...)
+// pointing Velocity at the multiauth server.
+func velocityFlags(authBase string) string {
+	return "-Dmojang.sessionserver=" + authBase + hasJoinedPath + "\n"
+}
+
+// paperFlags is the argument file for a standalone Paper server. Paper
+// ignores the hosts unless all of them are set, so the others point at
+// Mojang.
+func paperFlags(authBase string) string {
+	return "-Dminecraft.api.auth.host=https://authserver.mojang.com/\n" +
+		"-Dminecraft.api.account.host=https://api.mojang.com/\n" +
+		"-Dminecraft.api.services.host=https://api.minecraftservices.com/\n" +
+		"-Dminecraft.api.profiles.host=https://api.mojang.com/\n" +
+		"-Dminecraft.api.session.host=" + authBase + "\n"
+}
+
+func velocityPatch(backendAddr string, proxyProtocol bool) string {
+	return fmt.Sprintf("# Merge into velocity.toml\nbind = %q\n\n[advanced]\nhaproxy-protocol = %t\n", backendAddr, proxyProtocol)
+}
+
+func paperPatch(backendAddr string, proxyProtocol bool) string {
+	_, port, _ := net.SplitHostPort(backendAddr)
+	return fmt.Sprintf("# Merge into config/paper-global.yml, and set server-port=%s\n"+
+		"# and enforce-secure-profile=false in server.properties\nproxies:\n  proxy-protocol: %t\n", port, proxyProtocol)
+}
+
+// systemdUnit runs the proxy with the flags generate-setup was given.
+func systemdUnit(cfg Config, opts setupOptions) string {
+	args := []string{systemdQuote(opts.Binary)}
+	for _, arg := range opts.Args {
+		args = append(args, systemdQuote(arg))
+	}
+	var b strings.Builder
+	b.WriteString("[Unit]\nDescription=mc-dual-proxy\nWants=network-online.target\nAfter=network-online.target\n\n")
+	b.WriteString("[Service]\nExecStart=" + strings.Join(args, " ") + "\n")
+	b.WriteString("ExecReload=/bin/kill -HUP $MAINPID\nRestart=on-failure\nRestartSec=5s\nLimitNOFILE=65536\n")
+	if cfg.DrainTimeout > 0 {
+		fmt.Fprintf(&b, "TimeoutStopSec=%d\n", int((cfg.DrainTimeout).Seconds())+10)
+	}
+	if cfg.Transparent {
+		b.WriteString("AmbientCapabilities=CAP_NET_ADMIN CAP_NET_BIND_SERVICE\n")
+	} else {
+		b.WriteString("AmbientCapabilities=CAP_NET_BIND_SERVICE\n")
+	}
+	b.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// systemdQuote quotes arg for an ExecStart line: specifiers and variables
+// are escaped, and arguments with spaces or quotes are double-quoted.
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
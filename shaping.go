@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// trafficShaper assigns connections to bandwidth classes by the network of
+// the player (-shape-class), e.g. known VPN ranges to a slow class and the
+// LAN to an unlimited one. Classes are checked in order and the first one
+// listing the player's address wins; other players aren't shaped.
+type trafficShaper struct {
+	classes []*shapeClass
+}
+
+// shapeClass is a bandwidth limit and the networks it applies to.
+type shapeClass struct {
+	name     string
+	rate     int64 // bytes per second for each connection and direction, 0 for unlimited
+	networks []netip.Prefix
+
+	connections atomic.Int64
+	bytes       atomic.Int64
+	delayed     atomic.Int64 // nanoseconds writes waited for the limit
+}
+
+// parseShapeClasses parses -shape-class rules of the form
+// NAME:RATE=CIDRS, where RATE is bytes per second with an optional KB, MB
+// or GB suffix (powers of 1024) and an optional /s, or "unlimited", and
+// CIDRS a comma-separated list of IPs and CIDR ranges.
+func parseShapeClasses(specs []string) (*trafficShaper, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	shaper := &trafficShaper{}
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		head, networks, ok := strings.Cut(spec, "=")
+		name, rate, hasRate := strings.Cut(head, ":")
+		name, rate = strings.TrimSpace(name), strings.TrimSpace(rate)
+		if !ok || !hasRate || name == "" || strings.TrimSpace(networks) == "" {
+			return nil, fmt.Errorf("expected NAME:RATE=CIDRS, got %q", spec)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("class %s is defined twice", name)
+		}
+		seen[name] = true
+		class := &shapeClass{name: name}
+		var err error
+		if class.rate, err = parseByteRate(rate); err != nil {
+			return nil, fmt.Errorf("class %s: %w", name, err)
+		}
+		if class.networks, err = parseTrustedProxies(networks); err != nil {
+			return nil, fmt.Errorf("class %s: %w", name, err)
+		}
+		shaper.classes = append(shaper.classes, class)
+	}
+	return shaper, nil
+}
+
+// parseByteRate parses a bandwidth such as "256KB/s", "2MB" or "unlimited"
+// into bytes per second, 0 meaning unlimited.
+func parseByteRate(s string) (int64, error) {
+	if strings.EqualFold(s, "unlimited") {
+		return 0, nil
+	}
+	v := strings.TrimSuffix(strings.ToUpper(s), "/S")
+	scale := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		scale  int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if trimmed, ok := strings.CutSuffix(v, unit.suffix); ok {
+			v, scale = trimmed, unit.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q (expected e.g. 256KB/s or unlimited)", s)
+	}
+	return n * scale, nil
+}
+
+// classFor returns the class of a player at addr (host or host:port), or nil.
+func (s *trafficShaper) classFor(addr string) *shapeClass {
+	if s == nil {
+		return nil
+	}
+	ip, err := netip.ParseAddr(addrIP(addr))
+	if err != nil {
+		return nil
+	}
+	ip = ip.Unmap()
+	for _, class := range s.classes {
+		for _, prefix := range class.networks {
+			if prefix.Contains(ip) {
+				return class
+			}
+		}
+	}
+	return nil
+}
+
+// writer returns w limited to the class's rate and counted in its metrics,
+// for one direction of a connection; w itself if the class is nil.
+func (c *shapeClass) writer(w io.Writer) io.Writer {
+	if c == nil {
+		return w
+	}
+	return &shapedWriter{class: c, w: w, tokens: float64(c.rate), last: time.Now()}
+}
+
+// shapedWriter is a token bucket in front of a writer: it holds up to a
+// second's worth of bytes, and writes wait until enough have accumulated.
+// It is used by one relay goroutine and not safe for concurrent use.
+type shapedWriter struct {
+	class  *shapeClass
+	w      io.Writer
+	tokens float64
+	last   time.Time
+}
+
+func (s *shapedWriter) Write(p []byte) (int, error) {
+	rate := s.class.rate
+	if rate == 0 {
+		n, err := s.w.Write(p)
+		s.class.bytes.Add(int64(n))
+		return n, err
+	}
+	written := 0
+	for written < len(p) {
+		chunk := min(len(p)-written, int(rate))
+		now := time.Now()
+		s.tokens = min(s.tokens+now.Sub(s.last).Seconds()*float64(rate), float64(rate))
+		s.last = now
+		if missing := float64(chunk) - s.tokens; missing > 0 {
+			wait := time.Duration(missing / float64(rate) * float64(time.Second))
+			time.Sleep(wait)
+			s.class.delayed.Add(int64(wait))
+			s.tokens += missing
+			s.last = s.last.Add(wait)
+		}
+		s.tokens -= float64(chunk)
+		n, err := s.w.Write(p[written : written+chunk])
+		written += n
+		s.class.bytes.Add(int64(n))
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (s *trafficShaper) String() string {
+	var parts []string
+	for _, class := range s.classes {
+		rate := "unlimited"
+		if class.rate > 0 {
+			rate = formatBytes(class.rate) + "/s"
+		}
+		parts = append(parts, fmt.Sprintf("%s %s (%d networks)", class.name, rate, len(class.networks)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// write adds the per-class counters to the metrics.
+func (s *trafficShaper) write(p metricsSink) {
+	p.family("shape_connections_total", "counter", "Connections assigned to each -shape-class.")
+	for _, class := range s.classes {
+		p.sample("shape_connections_total", float64(class.connections.Load()), "class", class.name)
+	}
+	p.family("shape_bytes_total", "counter", "Bytes relayed for connections of each -shape-class, both directions.")
+	for _, class := range s.classes {
+		p.sample("shape_bytes_total", float64(class.bytes.Load()), "class", class.name)
+	}
+	p.family("shape_delay_seconds_total", "counter", "Time relayed writes of each -shape-class waited for its rate.")
+	for _, class := range s.classes {
+		p.sample("shape_delay_seconds_total", time.Duration(class.delayed.Load()).Seconds(), "class", class.name)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sockmapConnections is how many connections the sockmap forwards at
+	// once; connections beyond that are relayed by the proxy as usual.
+	sockmapConnections = 32768
+
+	// sockmapDrainTimeout bounds how long a direction whose source has ended
+	// waits for the kernel to send the destination the last bytes it
+	// redirected, before half-closing it.
+	sockmapDrainTimeout = 10 * time.Second
+)
+
+// sockmap forwards established connections in the kernel (-sockmap): both
+// sockets of a connection are put into an eBPF sockmap, and a program that
+// runs for every segment they receive redirects its bytes straight to the
+// other socket. The proxy only sets connections up; relayed bytes never wake
+// it. Connection i occupies slots 2i (client) and 2i+1 (backend) of the map.
+type sockmap struct {
+	mode string // how the program is attached, for the startup banner
+
+	mu   sync.Mutex
+	free []uint32 // connection indexes released for reuse
+	next uint32   // lowest index never used
+
+	active atomic.Int64 // connections forwarded right now
+	full   atomic.Int64 // connections relayed by the proxy since the map was full
+	kernel sockmapKernel
+}
+
+// sockmapPair is one connection handed to the kernel. Its client→backend
+// relay calls start once the proxy is done looking at the client's bytes;
+// both relays then wait for the kernel to forward the connection and
+// return when their source ends.
+type sockmapPair struct {
+	m               *sockmap
+	index           uint32
+	client, backend *net.TCPConn
+	cookies         [2]uint64 // socket cookies of client and backend
+	written         [2]int64  // bytes the sockets had sent when forwarding started
+
+	ready chan struct{} // closed once start has run
+	ok    bool          // whether the kernel forwards the connection
+}
+
+// open reserves a place in the map for the connection between client and
+// backend. It returns nil if there is no sockmap, it is full, or either
+// connection isn't plain TCP.
+func (m *sockmap) open(client, backend net.Conn) *sockmapPair {
+	clientTCP, clientOK := client.(*net.TCPConn)
+	backendTCP, backendOK := backend.(*net.TCPConn)
+	if m == nil || !clientOK || !backendOK {
+		return nil
+	}
+	m.mu.Lock()
+	var index uint32
+	switch {
+	case len(m.free) > 0:
+		index = m.free[len(m.free)-1]
+		m.free = m.free[:len(m.free)-1]
+	case m.next < sockmapConnections:
+		index = m.next
+		m.next++
+	default:
+		m.mu.Unlock()
+		if m.full.Add(1) == 1 {
+			warnf("[relay] The sockmap holds %d connections; relaying further ones in the proxy", sockmapConnections)
+		}
+		return nil
+	}
+	m.mu.Unlock()
+	return &sockmapPair{m: m, index: index, client: clientTCP, backend: backendTCP, ready: make(chan struct{})}
+}
+
+// start hands the connection to the kernel. Bytes the sockets received
+// before are still read and relayed by the proxy. If the kernel refuses, the
+// proxy relays the connection itself.
+func (p *sockmapPair) start() {
+	if err := p.m.kernel.insert(p); err != nil {
+		debugf("[relay] %s: relaying in the proxy, the sockmap refused the connection: %v", p.client.RemoteAddr(), err)
+		p.m.kernel.remove(p)
+	} else {
+		p.ok = true
+		p.m.active.Add(1)
+	}
+	close(p.ready)
+}
+
+// relay relays src to dst like copyConn until src ends. Once the kernel
+// forwards the connection, only bytes that reached src before are copied;
+// the rest is added to the counters of cw, whose writer must be dst, when
+// src ends. Bytes already read into buffered are sent first; buffered may be
+// nil.
+func (p *sockmapPair) relay(cw *countingWriter, dst, src *net.TCPConn, buffered *bufio.Reader, size int) (int64, error) {
+	<-p.ready
+	var r io.Reader = src
+	if buffered != nil {
+		r = buffered
+	}
+	n, err := copyConn(cw, r, size)
+	if !p.ok {
+		return n, err
+	}
+
+	from, to := 0, 1
+	if src == p.backend {
+		from, to = 1, 0
+	}
+	redirected := p.m.kernel.redirected(p.cookies[from])
+	cw.conn.Add(redirected)
+	cw.total.Add(redirected)
+
+	// The kernel sends redirected bytes from a work queue, so some may not
+	// have reached dst yet; half-closing it now would lose them
+	want := p.written[to] + n + redirected
+	deadline := time.Now().Add(sockmapDrainTimeout)
+	for {
+		written, werr := tcpWritten(dst)
+		if werr != nil || written >= want {
+			break
+		}
+		if time.Now().After(deadline) {
+			debugf("[relay] %s: %d redirected bytes still unsent after %s", p.client.RemoteAddr(), want-written, sockmapDrainTimeout)
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return n + redirected, err
+}
+
+// close takes the connection out of the map once both relays returned.
+func (p *sockmapPair) close() {
+	if p == nil {
+		return
+	}
+	if p.ok {
+		p.m.kernel.remove(p)
+		p.m.active.Add(-1)
+	}
+	p.m.mu.Lock()
+	p.m.free = append(p.m.free, p.index)
+	p.m.mu.Unlock()
+}
+
+func (m *sockmap) String() string {
+	return "eBPF sockmap (" + m.mode + ")"
+}
@@ -0,0 +1,397 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// bpf(2) commands, map and program types and attach types from
+// <linux/bpf.h>, which the syscall package does not define.
+const (
+	bpfMapCreate     = 0
+	bpfMapLookupElem = 1
+	bpfMapUpdateElem = 2
+	bpfMapDeleteElem = 3
+	bpfProgLoad      = 5
+	bpfProgAttach    = 8
+
+	bpfMapTypeHash    = 1
+	bpfMapTypeSockmap = 15
+	bpfProgTypeSkSkb  = 14
+
+	bpfSkSkbStreamParser  = 4
+	bpfSkSkbStreamVerdict = 5
+	bpfSkSkbVerdict       = 38 // Linux 5.13+, needs no stream parser
+
+	bpfFuncMapLookupElem   = 1
+	bpfFuncGetSocketCookie = 46
+	bpfFuncSkRedirectMap   = 52
+
+	skDrop = 0
+	skPass = 1
+
+	soCookie = 57     // SO_COOKIE
+	siocOutq = 0x5411 // SIOCOUTQ
+
+	// tcpInfoBytesAcked is the offset of tcpi_bytes_acked in struct tcp_info.
+	tcpInfoBytesAcked = 120
+)
+
+// bpfInsn is one eBPF instruction. regs holds the destination register in
+// its low and the source register in its high four bits (on little-endian
+// machines, the only ones this file is built for).
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+func insn(code, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm}
+}
+
+// ldMapFD loads the map with the file descriptor fd into register dst; it
+// takes two instruction slots.
+func ldMapFD(dst uint8, fd int) []bpfInsn {
+	const pseudoMapFD = 1
+	return []bpfInsn{insn(0x18, dst, pseudoMapFD, 0, int32(fd)), {}}
+}
+
+// sockmapVerdictProgram returns the program that decides about each segment
+// a socket in the sockmap receives. It looks the socket up by its cookie in
+// peers, whose values are struct { u32 peer; u32 pad; u64 bytes }, counts
+// the segment's bytes, and redirects it to the peer's slot in the sockmap for
+// sending. Sockets without an entry keep their bytes for the proxy to read.
+// Empty segments, bare FINs, are dropped: TCP has already noted the FIN, so
+// the proxy's read still ends, but queued for sending like data the kernel
+// would fail to send nothing and break the pipe.
+//
+//	r6 = r1                                   // the __sk_buff
+//	r7 = r6->len
+//	if r7 == 0 goto drop
+//	*(u64 *)(r10 - 8) = bpf_get_socket_cookie(r6)
+//	r0 = bpf_map_lookup_elem(peers, r10 - 8)
+//	if r0 == 0 goto pass
+//	lock *(u64 *)(r0 + 8) += r7
+//	return bpf_sk_redirect_map(r6, sockmap, *(u32 *)r0, 0)
+//	pass: return SK_PASS
+//	drop: return SK_DROP
+func sockmapVerdictProgram(sockmapFD, peersFD int) []bpfInsn {
+	prog := []bpfInsn{
+		insn(0xbf, 6, 1, 0, 0),                      // r6 = r1
+		insn(0x61, 7, 6, 0, 0),                      // r7 = *(u32 *)(r6 + 0), the length
+		insn(0x15, 7, 0, 18, 0),                     // if r7 == 0 goto drop
+		insn(0x85, 0, 0, 0, bpfFuncGetSocketCookie), // call bpf_get_socket_cookie
+		insn(0x7b, 10, 0, -8, 0),                    // *(u64 *)(r10 - 8) = r0
+		insn(0xbf, 2, 10, 0, 0),                     // r2 = r10
+		insn(0x07, 2, 0, 0, -8),                     // r2 += -8
+	}
+	prog = append(prog, ldMapFD(1, peersFD)...) // r1 = peers
+	prog = append(prog,
+		insn(0x85, 0, 0, 0, bpfFuncMapLookupElem), // call bpf_map_lookup_elem
+		insn(0x15, 0, 0, 8, 0),                    // if r0 == 0 goto pass
+		insn(0xdb, 0, 7, 8, 0),                    // lock *(u64 *)(r0 + 8) += r7
+		insn(0x61, 3, 0, 0, 0),                    // r3 = *(u32 *)(r0 + 0), the peer
+		insn(0xbf, 1, 6, 0, 0),                    // r1 = r6
+	)
+	prog = append(prog, ldMapFD(2, sockmapFD)...) // r2 = sockmap
+	return append(prog,
+		insn(0xb7, 4, 0, 0, 0),                    // r4 = 0
+		insn(0x85, 0, 0, 0, bpfFuncSkRedirectMap), // call bpf_sk_redirect_map
+		insn(0x95, 0, 0, 0, 0),                    // exit
+		insn(0xb7, 0, 0, 0, skPass),               // pass: r0 = SK_PASS
+		insn(0x95, 0, 0, 0, 0),                    // exit
+		insn(0xb7, 0, 0, 0, skDrop),               // drop: r0 = SK_DROP
+		insn(0x95, 0, 0, 0, 0),                    // exit
+	)
+}
+
+// sockmapParserProgram returns the stream parser that kernels before 5.13
+// need next to the verdict program. It passes every segment on whole.
+func sockmapParserProgram() []bpfInsn {
+	return []bpfInsn{
+		insn(0x61, 0, 1, 0, 0), // r0 = *(u32 *)(r1 + 0), the length
+		insn(0x95, 0, 0, 0, 0), // exit
+	}
+}
+
+// sockmapKernel holds the file descriptors of the sockmap and of the peers
+// map next to it.
+type sockmapKernel struct {
+	sockmapFD, peersFD int
+}
+
+// sockmapPeer is a value of the peers map.
+type sockmapPeer struct {
+	peer  uint32
+	_     uint32
+	bytes uint64
+}
+
+// newSockmap creates the maps and loads and attaches the programs. It needs
+// CAP_BPF and CAP_NET_ADMIN (or root).
+func newSockmap() (*sockmap, error) {
+	sockmapFD, err := bpfCreateMap(bpfMapTypeSockmap, 4, 4, 2*sockmapConnections)
+	if err != nil {
+		return nil, fmt.Errorf("create sockmap: %w", err)
+	}
+	peersFD, err := bpfCreateMap(bpfMapTypeHash, 8, uint32(unsafe.Sizeof(sockmapPeer{})), 2*sockmapConnections)
+	if err != nil {
+		syscall.Close(sockmapFD)
+		return nil, fmt.Errorf("create peers map: %w", err)
+	}
+	m := &sockmap{kernel: sockmapKernel{sockmapFD: sockmapFD, peersFD: peersFD}}
+	if err := m.kernel.attach(m); err != nil {
+		syscall.Close(sockmapFD)
+		syscall.Close(peersFD)
+		return nil, err
+	}
+	return m, nil
+}
+
+// attach attaches the verdict program to the sockmap, with a stream parser
+// on kernels too old to go without. The sockmap keeps the programs; their
+// file descriptors are closed, since they'd keep the maps alive.
+func (k *sockmapKernel) attach(m *sockmap) error {
+	verdict, err := bpfLoadProgram(sockmapVerdictProgram(k.sockmapFD, k.peersFD))
+	if err != nil {
+		return fmt.Errorf("load verdict program: %w", err)
+	}
+	defer syscall.Close(verdict)
+	if bpfAttach(k.sockmapFD, verdict, bpfSkSkbVerdict) == nil {
+		m.mode = "verdict"
+		return nil
+	}
+	parser, err := bpfLoadProgram(sockmapParserProgram())
+	if err != nil {
+		return fmt.Errorf("load parser program: %w", err)
+	}
+	defer syscall.Close(parser)
+	if err := bpfAttach(k.sockmapFD, parser, bpfSkSkbStreamParser); err != nil {
+		return fmt.Errorf("attach parser program: %w", err)
+	}
+	if err := bpfAttach(k.sockmapFD, verdict, bpfSkSkbStreamVerdict); err != nil {
+		return fmt.Errorf("attach verdict program: %w", err)
+	}
+	m.mode = "stream parser"
+	return nil
+}
+
+// insert puts the sockets of p into the sockmap and then links them as
+// each other's peers, so neither redirects to a socket not in the map yet.
+func (k *sockmapKernel) insert(p *sockmapPair) error {
+	conns := [2]*net.TCPConn{p.client, p.backend}
+	for i, c := range conns {
+		cookie, err := socketCookie(c)
+		if err != nil {
+			return fmt.Errorf("socket cookie: %w", err)
+		}
+		p.cookies[i] = cookie
+		if p.written[i], err = tcpWritten(c); err != nil {
+			return fmt.Errorf("TCP_INFO: %w", err)
+		}
+	}
+	for i, c := range conns {
+		slot := 2*p.index + uint32(i)
+		var updateErr error
+		err := rawControl(c, func(fd int) {
+			value := uint32(fd)
+			updateErr = bpfUpdateElem(k.sockmapFD, unsafe.Pointer(&slot), unsafe.Pointer(&value))
+		})
+		if err == nil {
+			err = updateErr
+		}
+		if err != nil {
+			return fmt.Errorf("add socket to sockmap: %w", err)
+		}
+	}
+	for i := range conns {
+		peer := sockmapPeer{peer: 2*p.index + uint32(1-i)}
+		if err := bpfUpdateElem(k.peersFD, unsafe.Pointer(&p.cookies[i]), unsafe.Pointer(&peer)); err != nil {
+			return fmt.Errorf("add socket to peers map: %w", err)
+		}
+	}
+	return nil
+}
+
+// remove unlinks the sockets of p and takes them out of the sockmap. Closed
+// sockets leave the sockmap by themselves.
+func (k *sockmapKernel) remove(p *sockmapPair) {
+	for i := range p.cookies {
+		if p.cookies[i] != 0 {
+			bpfDeleteElem(k.peersFD, unsafe.Pointer(&p.cookies[i]))
+		}
+		slot := 2*p.index + uint32(i)
+		bpfDeleteElem(k.sockmapFD, unsafe.Pointer(&slot))
+	}
+}
+
+// close releases the maps, and with them the programs.
+func (k *sockmapKernel) close() {
+	syscall.Close(k.sockmapFD)
+	syscall.Close(k.peersFD)
+}
+
+// redirected returns how many bytes the socket with cookie has redirected
+// to its peer.
+func (k *sockmapKernel) redirected(cookie uint64) int64 {
+	var peer sockmapPeer
+	if bpfLookupElem(k.peersFD, unsafe.Pointer(&cookie), unsafe.Pointer(&peer)) != nil {
+		return 0
+	}
+	return int64(peer.bytes)
+}
+
+// sysBPF is the number of bpf(2), which the syscall package lacks on amd64.
+func sysBPF() uintptr {
+	if runtime.GOARCH == "arm64" {
+		return 280
+	}
+	return 321
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := syscall.Syscall(sysBPF(), uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+func bpfCreateMap(mapType, keySize, valueSize, maxEntries uint32) (int, error) {
+	attr := struct{ mapType, keySize, valueSize, maxEntries, mapFlags uint32 }{mapType, keySize, valueSize, maxEntries, 0}
+	return bpf(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// bpfLoadProgram loads an SK_SKB program. If the verifier rejects it, the
+// error includes the verifier's log.
+func bpfLoadProgram(prog []bpfInsn) (int, error) {
+	license := []byte("Dual MIT/GPL\x00")
+	type progLoadAttr struct {
+		progType, insnCnt uint32
+		insns, license    uint64
+		logLevel, logSize uint32
+		logBuf            uint64
+	}
+	attr := progLoadAttr{
+		progType: bpfProgTypeSkSkb,
+		insnCnt:  uint32(len(prog)),
+		insns:    uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	fd, err := bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil || !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.EACCES) {
+		runtime.KeepAlive(prog)
+		runtime.KeepAlive(license)
+		return fd, err
+	}
+	log := make([]byte, 64<<10)
+	attr.logLevel, attr.logSize, attr.logBuf = 1, uint32(len(log)), uint64(uintptr(unsafe.Pointer(&log[0])))
+	fd, err = bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(prog)
+	runtime.KeepAlive(license)
+	if err != nil {
+		if n := bytes.IndexByte(log, 0); n > 0 {
+			return 0, fmt.Errorf("%w: %s", err, log[:n])
+		}
+	}
+	return fd, err
+}
+
+func bpfAttach(mapFD, progFD int, attachType uint32) error {
+	attr := struct{ targetFD, attachBPFFD, attachType, attachFlags uint32 }{uint32(mapFD), uint32(progFD), attachType, 0}
+	_, err := bpf(bpfProgAttach, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// bpfElemAttr is the bpf(2) attribute of map element commands.
+type bpfElemAttr struct {
+	mapFD             uint32
+	_                 uint32
+	key, value, flags uint64
+}
+
+func bpfUpdateElem(mapFD int, key, value unsafe.Pointer) error {
+	attr := bpfElemAttr{mapFD: uint32(mapFD), key: uint64(uintptr(key)), value: uint64(uintptr(value))}
+	_, err := bpf(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func bpfLookupElem(mapFD int, key, value unsafe.Pointer) error {
+	attr := bpfElemAttr{mapFD: uint32(mapFD), key: uint64(uintptr(key)), value: uint64(uintptr(value))}
+	_, err := bpf(bpfMapLookupElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func bpfDeleteElem(mapFD int, key unsafe.Pointer) error {
+	attr := bpfElemAttr{mapFD: uint32(mapFD), key: uint64(uintptr(key))}
+	_, err := bpf(bpfMapDeleteElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// rawControl runs f with the file descriptor of c.
+func rawControl(c *net.TCPConn, f func(fd int)) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return raw.Control(func(fd uintptr) { f(int(fd)) })
+}
+
+// socketCookie returns the kernel's unique ID for the socket of c, by which
+// the verdict program finds its peer.
+func socketCookie(c *net.TCPConn) (uint64, error) {
+	var cookie uint64
+	var sockErr error
+	err := rawControl(c, func(fd int) {
+		size := uint32(unsafe.Sizeof(cookie))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.SOL_SOCKET, soCookie, uintptr(unsafe.Pointer(&cookie)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return cookie, sockErr
+}
+
+// tcpWritten returns how many bytes have been written to the socket of c,
+// whether the proxy or the kernel wrote them: those the peer acknowledged
+// plus those still in the send queue.
+func tcpWritten(c *net.TCPConn) (int64, error) {
+	var written int64
+	var sockErr error
+	err := rawControl(c, func(fd int) {
+		var info [256]byte
+		size := uint32(len(info))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.IPPROTO_TCP, syscall.TCP_INFO, uintptr(unsafe.Pointer(&info[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+			return
+		}
+		if size < tcpInfoBytesAcked+8 {
+			sockErr = errors.New("tcp_info without tcpi_bytes_acked")
+			return
+		}
+		var queued int32
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocOutq, uintptr(unsafe.Pointer(&queued))); errno != 0 {
+			sockErr = errno
+			return
+		}
+		written = int64(binary.LittleEndian.Uint64(info[tcpInfoBytesAcked:])) + int64(queued)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return written, sockErr
+}
@@ -0,0 +1,29 @@
+//go:build !linux || !(amd64 || arm64)
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// sockmapKernel is only implemented on Linux on amd64 and arm64.
+type sockmapKernel struct{}
+
+func newSockmap() (*sockmap, error) {
+	return nil, errors.New("eBPF sockmaps are only supported on Linux (amd64 and arm64)")
+}
+
+func (k *sockmapKernel) insert(p *sockmapPair) error {
+	return errors.New("eBPF sockmaps are not supported on this system")
+}
+
+func (k *sockmapKernel) remove(p *sockmapPair) {}
+
+func (k *sockmapKernel) close() {}
+
+func (k *sockmapKernel) redirected(cookie uint64) int64 { return 0 }
+
+func tcpWritten(c *net.TCPConn) (int64, error) {
+	return 0, errors.New("not supported on this system")
+}
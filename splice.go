@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+)
+
+// spliceChunk is how many bytes a spliced relay moves between updates of
+// the byte counters.
+const spliceChunk = 256 << 10
+
+// spliceable reports whether the relay between client and backend can be
+// spliced (-splice): both are plain TCP connections and nothing needs to see
+// the bytes on the way (tapped), as capturing a failed login or mirroring
+// does.
+func spliceable(cfg Config, tapped bool, client, backend net.Conn) bool {
+	_, clientTCP := client.(*net.TCPConn)
+	_, backendTCP := backend.(*net.TCPConn)
+	return cfg.Splice && !tapped && clientTCP && backendTCP
+}
+
+// spliceConn relays src to dst like copyConn, but lets the kernel move the
+// bytes: on Linux, TCPConn.ReadFrom splices from a TCP source through a pipe,
+// so relayed data never enters the process. It reads in chunks to keep the
+// counters of cw, whose writer must be dst, current. Bytes already read into
+// buffered are sent first; buffered may be nil.
+func spliceConn(cw *countingWriter, dst, src *net.TCPConn, buffered *bufio.Reader) (int64, error) {
+	var total int64
+	if buffered != nil && buffered.Buffered() > 0 {
+		p, _ := buffered.Peek(buffered.Buffered())
+		n, err := cw.Write(p)
+		buffered.Discard(n)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	for {
+		chunk := &io.LimitedReader{R: src, N: spliceChunk}
+		n, err := dst.ReadFrom(chunk)
+		cw.conn.Add(n)
+		cw.total.Add(n)
+		total += n
+		if err != nil || chunk.N > 0 {
+			// A short chunk is the end of src
+			return total, err
+		}
+	}
+}
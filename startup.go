@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// startupPollInterval is how often a backend that refused connections is
+	// dialed to see whether it has finished starting.
+	startupPollInterval = 2 * time.Second
+
+	// defaultStartupTime is the expected startup time for on-demand and
+	// Wake-on-LAN backends when -startup-hold isn't set.
+	defaultStartupTime = 60 * time.Second
+)
+
+// startupHold answers players itself while the backend is unavailable, e.g.
+// because it is (re)starting: status pings get a "Starting up…" status with a
+// countdown and logins are disconnected with the same message. The backend is
+// polled in the background until it accepts connections again.
+type startupHold struct {
+	expected time.Duration // typical startup time, used for the countdown
+
+	mu    sync.Mutex
+	since time.Time // when the backend became unavailable; zero when not holding
+	text  string    // what players are told, without the countdown
+}
+
+func newStartupHold(expected time.Duration) *startupHold {
+	return &startupHold{expected: expected}
+}
+
+// enter starts holding after a dial to backendAddr failed, unless already
+// holding. text is what players are told, e.g. "Starting up…".
+func (h *startupHold) enter(backendAddr, text string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.since.IsZero() {
+		return
+	}
+	h.since = time.Now()
+	h.text = text
+	infof("[tcp] backend %s is unavailable, answering players with %q until it is back", backendAddr, text)
+	go h.poll(backendAddr)
+}
+
+// poll dials backendAddr until it accepts a connection, then stops holding.
+func (h *startupHold) poll(backendAddr string) {
+	ticker := time.NewTicker(startupPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", backendAddr, startupPollInterval)
+		if err != nil {
+			debugf("[tcp] backend %s still unavailable: %v", backendAddr, err)
+			continue
+		}
+		conn.Close()
+		activity.recordDial(backendAddr, time.Since(start), nil)
+
+		h.mu.Lock()
+		infof("[tcp] backend %s is accepting connections again after %s", backendAddr, time.Since(h.since).Round(time.Second))
+		h.since = time.Time{}
+		h.mu.Unlock()
+		return
+	}
+}
+
+// holding reports whether players are being answered while the backend is
+// unavailable.
+func (h *startupHold) holding() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.since.IsZero()
+}
+
+// message returns the text shown to players, or false if not holding.
+func (h *startupHold) message() (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.since.IsZero() {
+		return "", false
+	}
+	remaining := (h.expected - time.Since(h.since)).Round(time.Second)
+	if remaining <= 0 {
+		return h.text + " (any moment now)", true
+	}
+	return fmt.Sprintf("%s (%ds)", h.text, int(remaining.Seconds())), true
+}
+
+// answer replies to a client whose handshake has already been consumed from
+// br: status pings get a status showing message, logins are disconnected
+// with it.
+func (h *startupHold) answer(clientConn net.Conn, br *bufio.Reader, hs *Handshake, message string) {
+	if hs.NextState != stateStatus {
+		disconnectLogin(clientConn, br, message)
+		return
+	}
+	// An incompatible protocol makes the client show the version name in
+	// place of the player count
+	status := &ServerStatus{}
+	status.Version.Name = "Starting"
+	status.Version.Protocol = -1
+	status.Description = jsonText(message)
+	serveStatus(clientConn, br, status)
+}
+
+// Texts shown while holding, before the countdown.
+const (
+	startingText = "Starting up…"
+	wakingText   = "Waking up the server…"
+)
+
+// isConnRefused reports whether a dial failed because nothing is listening.
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
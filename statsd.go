@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// statsdFormatDogStatsD sends labels as DogStatsD tags (Datadog, Telegraf).
+	statsdFormatDogStatsD = "dogstatsd"
+	// statsdFormatPlain folds label values into the metric name, for StatsD
+	// servers without tag support.
+	statsdFormatPlain = "plain"
+
+	// statsdMaxPacket keeps datagrams below a typical MTU.
+	statsdMaxPacket = 1432
+)
+
+// statsd is the process-wide StatsD emitter; nil unless -statsd is set.
+var statsd atomic.Pointer[statsdEmitter]
+
+// statsdEmitter sends the metrics served on /metrics to a StatsD server
+// over UDP (-statsd): counters as increments and gauges as values every
+// interval, and backend dials as timers when they happen. Histograms aren't
+// sent as buckets; their timers carry the same observations.
+type statsdEmitter struct {
+	conn     net.Conn
+	prefix   string
+	format   string
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]float64 // counter key → value at the previous flush
+}
+
+func newStatsdEmitter(addr, prefix, format string, interval time.Duration) (*statsdEmitter, error) {
+	if format != statsdFormatDogStatsD && format != statsdFormatPlain {
+		return nil, fmt.Errorf("unknown format %q (expected %s or %s)", format, statsdFormatDogStatsD, statsdFormatPlain)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive, got %s", interval)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdEmitter{conn: conn, prefix: prefix, format: format, interval: interval, last: make(map[string]float64)}, nil
+}
+
+// run flushes the metrics every interval.
+func (s *statsdEmitter) run(cfg Config) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.flush(cfg.reloaded())
+	}
+}
+
+// flush sends the current metrics.
+func (s *statsdEmitter) flush(cfg Config) {
+	w := &statsdWriter{s: s}
+	s.mu.Lock()
+	writeMetrics(w, cfg)
+	s.mu.Unlock()
+	w.send()
+}
+
+// timing sends one timer observation right away.
+func (s *statsdEmitter) timing(name string, d time.Duration, labels ...string) {
+	line := s.line(name, strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', -1, 64), "ms", labels)
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		debugf("[statsd] Failed to send timer: %v", err)
+	}
+}
+
+// line formats one StatsD line, without the trailing newline.
+func (s *statsdEmitter) line(name, value, typ string, labels []string) string {
+	var b strings.Builder
+	b.WriteString(s.prefix)
+	b.WriteString(name)
+	if s.format == statsdFormatPlain {
+		for i := 1; i < len(labels); i += 2 {
+			b.WriteByte('.')
+			b.WriteString(statsdSanitize(labels[i]))
+		}
+	}
+	b.WriteString(":" + value + "|" + typ)
+	if s.format == statsdFormatDogStatsD && len(labels) > 0 {
+		b.WriteString("|#")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i] + ":" + statsdSanitize(labels[i+1]))
+		}
+	}
+	return b.String()
+}
+
+// statsdSanitize replaces the characters StatsD uses as separators, and the
+// dots plain metric names use between components.
+func statsdSanitize(s string) string {
+	return strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", ".", "_", " ", "_", "\n", "_").Replace(s)
+}
+
+// statsdWriter collects one flush of writeMetrics as StatsD lines. Must be
+// used with s.mu held.
+type statsdWriter struct {
+	s       *statsdEmitter
+	typ     string // of the current family
+	packets [][]byte
+	buf     bytes.Buffer
+}
+
+func (w *statsdWriter) family(name, typ, help string) {
+	w.typ = typ
+}
+
+func (w *statsdWriter) sample(name string, value float64, labels ...string) {
+	var line string
+	switch w.typ {
+	case "counter":
+		key := name + "\x00" + strings.Join(labels, "\x00")
+		delta := value - w.s.last[key]
+		w.s.last[key] = value
+		if delta <= 0 {
+			return
+		}
+		line = w.s.line(name, strconv.FormatFloat(delta, 'f', -1, 64), "c", labels)
+	case "gauge":
+		line = w.s.line(name, strconv.FormatFloat(value, 'f', -1, 64), "g", labels)
+	default:
+		return
+	}
+	if w.buf.Len() > 0 && w.buf.Len()+1+len(line) > statsdMaxPacket {
+		w.packets = append(w.packets, bytes.Clone(w.buf.Bytes()))
+		w.buf.Reset()
+	}
+	if w.buf.Len() > 0 {
+		w.buf.WriteByte('\n')
+	}
+	w.buf.WriteString(line)
+}
+
+// send writes the collected lines, several per datagram.
+func (w *statsdWriter) send() {
+	if w.buf.Len() > 0 {
+		w.packets = append(w.packets, w.buf.Bytes())
+	}
+	for _, packet := range w.packets {
+		if _, err := w.s.conn.Write(packet); err != nil {
+			debugf("[statsd] Failed to send metrics: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxStatusResponse bounds the status JSON we accept from a backend (favicons
+// are base64 PNGs, so this is generous).
+const maxStatusResponse = 1 << 20
+
+// ServerStatus is the subset of the status response JSON we care about.
+type ServerStatus struct {
+	Version struct {
+		Name     string `json:"name"`
+		Protocol int    `json:"protocol"`
+	} `json:"version"`
+	Players struct {
+		Max    int `json:"max"`
+		Online int `json:"online"`
+	} `json:"players"`
+	Description json.RawMessage `json:"description"`
+}
+
+// MOTD returns the description as plain text, flattening chat components.
+func (s *ServerStatus) MOTD() string {
+	var text string
+	if err := json.Unmarshal(s.Description, &text); err == nil {
+		return text
+	}
+	var component chatComponent
+	if err := json.Unmarshal(s.Description, &component); err != nil {
+		return ""
+	}
+	return component.plain()
+}
+
+// chatComponent is a Minecraft text component, reduced to its text content.
+type chatComponent struct {
+	Text  string            `json:"text"`
+	Extra []json.RawMessage `json:"extra"`
+}
+
+func (c *chatComponent) plain() string {
+	var sb strings.Builder
+	sb.WriteString(c.Text)
+	for _, raw := range c.Extra {
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			sb.WriteString(s)
+			continue
+		}
+		var child chatComponent
+		if json.Unmarshal(raw, &child) == nil {
+			sb.WriteString(child.plain())
+		}
+	}
+	return sb.String()
+}
+
+// queryBackendStatus performs a modern server list ping against a backend.
+// proxyHeader, if non-nil, is sent first (backends expecting PROXY protocol
+// reject connections without one). host and port are put in the handshake.
+func queryBackendStatus(backendAddr string, proxyHeader []byte, host string, port uint16, timeout time.Duration) (*ServerStatus, error) {
+	body, err := fetchBackendStatus(backendAddr, proxyHeader, host, port, timeout)
+	if err != nil {
+		return nil, err
+	}
+	status := &ServerStatus{}
+	if err := json.Unmarshal([]byte(body), status); err != nil {
+		return nil, fmt.Errorf("parse status JSON: %w", err)
+	}
+	return status, nil
+}
+
+// fetchBackendStatus performs the ping of queryBackendStatus and returns the
+// status JSON as sent.
+func fetchBackendStatus(backendAddr string, proxyHeader []byte, host string, port uint16, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("tcp", backendAddr, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if host == "" {
+		host, port = splitHostPortDefault(backendAddr)
+	}
+
+	var out []byte
+	out = append(out, proxyHeader...)
+	hs := &Handshake{ProtocolVersion: -1, ServerAddress: host, ServerPort: port, NextState: stateStatus}
+	out = append(out, hs.encode()...)
+	out = append(out, 0x01, 0x00) // Status Request: length 1, packet id 0x00
+	if _, err := conn.Write(out); err != nil {
+		return "", fmt.Errorf("write status request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	packet, err := readPacket(br, maxStatusResponse)
+	if err != nil {
+		return "", fmt.Errorf("read status response: %w", err)
+	}
+	id, n, err := decodeVarInt(packet)
+	if err != nil || id != 0x00 {
+		return "", fmt.Errorf("unexpected status response packet 0x%02x", id)
+	}
+	body, _, err := decodeString(packet[n:], maxStatusResponse)
+	if err != nil {
+		return "", fmt.Errorf("decode status JSON: %w", err)
+	}
+	return body, nil
+}
+
+// serveStatus answers a status-state client (whose handshake has already
+// been read) with status, then echoes its ping so the client shows latency.
+func serveStatus(clientConn net.Conn, br *bufio.Reader, status *ServerStatus) {
+	clientConn.SetDeadline(time.Now().Add(disconnectTimeout))
+
+	if packet, err := readPacket(br, 16); err != nil || packet[0] != 0x00 {
+		return
+	}
+	body, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	response := appendString([]byte{0x00}, string(body))
+	if _, err := clientConn.Write(appendVarInt(nil, int32(len(response)), response...)); err != nil {
+		return
+	}
+
+	// Ping Request (0x01) carries a payload the client expects back
+	ping, err := readPacket(br, 16)
+	if err != nil || ping[0] != 0x01 {
+		return
+	}
+	clientConn.Write(appendVarInt(nil, int32(len(ping)), ping...))
+}
+
+// jsonText encodes s as a JSON string, the simplest form of a text component.
+func jsonText(s string) json.RawMessage {
+	b, _ := json.Marshal(s)
+	return b
+}
+
+// readPacket reads one length-prefixed packet and returns its body (packet
+// id and payload).
+func readPacket(br *bufio.Reader, maxLen int) ([]byte, error) {
+	var length int32
+	for i := 0; ; i++ {
+		if i == 5 {
+			return nil, errVarIntTooLong
+		}
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length < 1 || int(length) > maxLen {
+		return nil, fmt.Errorf("packet length %d out of range", length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(br, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// splitHostPortDefault splits addr, defaulting to port 25565.
+func splitHostPortDefault(addr string) (string, uint16) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 25565
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return host, 25565
+	}
+	return host, uint16(port)
+}
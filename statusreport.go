@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const statusReportTimeout = 10 * time.Second
+
+// healthReport is the JSON body -status-report-url receives. Like
+// /api/server, its fields are a stable interface.
+type healthReport struct {
+	Time    time.Time    `json:"time"`
+	Version string       `json:"version"`
+	Ready   bool         `json:"ready"`  // the proxy takes players, as /readyz
+	Reason  string       `json:"reason"` // why not, or "ok"
+	Backend publicStatus `json:"backend"`
+	Route   *routeHealth `json:"route,omitempty"` // with -keepalive
+}
+
+// routeHealth is the state of the -keepalive route in a healthReport.
+type routeHealth struct {
+	Target  string  `json:"target"`
+	Up      bool    `json:"up"`
+	Seconds float64 `json:"seconds"` // last answered ping
+}
+
+// statusReporter posts a healthReport to a status API every interval, so a
+// server listing or status page shows what the proxy sees instead of
+// guessing from failed connections.
+type statusReporter struct {
+	url      string
+	token    string // sent as a bearer token; optional
+	interval time.Duration
+	client   *http.Client
+	cache    statusCache
+
+	mu          sync.Mutex
+	failures    int // in a row
+	lastSuccess time.Time
+}
+
+func newStatusReporter(target, token string, interval time.Duration) (*statusReporter, error) {
+	if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", target)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval %s must be positive", interval)
+	}
+	return &statusReporter{url: target, token: token, interval: interval, client: &http.Client{Timeout: statusReportTimeout}}, nil
+}
+
+// run reports right away and then every interval. It never returns.
+func (s *statusReporter) run(cfg Config) {
+	for {
+		s.report(cfg)
+		time.Sleep(s.interval)
+	}
+}
+
+// build assembles the current report.
+func (s *statusReporter) build(cfg Config) healthReport {
+	ready, reason := readiness.ready(cfg)
+	r := healthReport{
+		Time:    time.Now().UTC(),
+		Version: version,
+		Ready:   ready,
+		Reason:  reason,
+		Backend: s.cache.get(cfg),
+	}
+	if cfg.Keepalive != nil {
+		up, latency := cfg.Keepalive.state()
+		r.Route = &routeHealth{Target: cfg.Keepalive.target, Up: up, Seconds: latency.Seconds()}
+	}
+	return r
+}
+
+// report sends one report, logging when reports start or stop failing.
+func (s *statusReporter) report(cfg Config) {
+	err := s.post(s.build(cfg))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		if s.failures > 0 {
+			infof("[status] reports to %s go through again after %d failures", s.redactedURL(), s.failures)
+		}
+		s.failures, s.lastSuccess = 0, time.Now()
+		return
+	}
+	s.failures++
+	if s.failures == 1 {
+		warnf("[status] reporting to %s failed: %v", s.redactedURL(), err)
+	} else {
+		debugf("[status] report %d to %s failed: %v", s.failures, s.redactedURL(), err)
+	}
+}
+
+func (s *statusReporter) post(r healthReport) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mc-dual-proxy/"+version)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// write outputs the reporter's state as metrics.
+func (s *statusReporter) write(p metricsSink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.family("status_report_failures", "gauge", "Status reports in a row -status-report-url didn't accept.")
+	p.sample("status_report_failures", float64(s.failures))
+	if !s.lastSuccess.IsZero() {
+		p.family("status_report_last_success_timestamp_seconds", "gauge", "Unix time of the last status report -status-report-url accepted.")
+		p.sample("status_report_last_success_timestamp_seconds", float64(s.lastSuccess.Unix()))
+	}
+}
+
+// redactedURL is the report URL for logs, without credentials or query.
+func (s *statusReporter) redactedURL() string {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return s.url
+	}
+	u.User, u.RawQuery = nil, ""
+	return strings.TrimSuffix(u.String(), "?")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// summaryCounters are the cumulative totals a summary line reports the
+// change of.
+type summaryCounters struct {
+	accepted      int64
+	refused       int64
+	bytesIn       int64
+	bytesOut      int64
+	dialFailures  int64
+	authSuccesses map[string]int64 // per upstream
+}
+
+// takeSummary reads the current totals from the tracker and activity log.
+func takeSummary() summaryCounters {
+	c := summaryCounters{
+		accepted:      tracker.accepted.Load(),
+		refused:       tracker.refused.Load(),
+		bytesIn:       tracker.bytesIn.Load(),
+		bytesOut:      tracker.bytesOut.Load(),
+		authSuccesses: make(map[string]int64),
+	}
+	snap := activity.snapshot()
+	for _, u := range snap.Upstreams {
+		c.authSuccesses[u.Name] = u.Successes
+	}
+	for _, b := range snap.Backends {
+		c.dialFailures += b.DialsFailed
+	}
+	return c
+}
+
+// logSummaries logs a one-line summary of what happened every interval, so
+// trends show up in plain logs without a metrics stack. It never returns.
+func logSummaries(interval time.Duration) {
+	last := takeSummary()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cur := takeSummary()
+		infof("[summary] last %s: %s", interval, formatSummary(last, cur, tracker.count()))
+		last = cur
+	}
+}
+
+// formatSummary describes the change from prev to cur, plus the number of
+// active connections.
+func formatSummary(prev, cur summaryCounters, active int) string {
+	var auth []string
+	for _, name := range sortedKeys(cur.authSuccesses) {
+		if n := cur.authSuccesses[name] - prev.authSuccesses[name]; n > 0 {
+			auth = append(auth, fmt.Sprintf("%s=%d", name, n))
+		}
+	}
+	authText := "none"
+	if len(auth) > 0 {
+		authText = strings.Join(auth, " ")
+	}
+	return fmt.Sprintf("%d active, %d accepted, %d refused, auth successes: %s, %d backend dial failures, %s in, %s out",
+		active,
+		cur.accepted-prev.accepted,
+		cur.refused-prev.refused,
+		authText,
+		cur.dialFailures-prev.dialFailures,
+		formatBytes(cur.bytesIn-prev.bytesIn),
+		formatBytes(cur.bytesOut-prev.bytesOut))
+}
+
+// formatBytes formats n with a binary unit, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
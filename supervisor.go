@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// backendStopTimeout is how long a started backend gets to exit after an
+	// interrupt before it is killed.
+	backendStopTimeout = 60 * time.Second
+
+	// backendMaxBackoff caps the delay between restarts of a crashing backend.
+	backendMaxBackoff = time.Minute
+
+	// backendStableTime is how long a backend has to run before a crash no
+	// longer counts towards the restart backoff.
+	backendStableTime = 5 * time.Minute
+
+	// maxLoggedLine is the longest backend output line buffered for logging.
+	maxLoggedLine = 64 << 10
+)
+
+// backendSupervisor runs the backend as a child process. It either keeps it
+// running from startup (-backend-command) or starts it on demand when a
+// player logs in and stops it again once nobody has been online for idleStop
+// (-start-command). A backend that crashes is restarted with backoff, and its
+// output goes to our log.
+//
+// The command is expected to stay in the foreground (e.g. "java -jar
+// paper.jar") and is stopped with an interrupt. With a stop command, the
+// start command may instead return right away (e.g. "systemctl start mc"),
+// and the stop command is run to shut the backend down; such backends are
+// not restarted by us.
+type backendSupervisor struct {
+	startCommand string
+	stopCommand  string
+	idleStop     time.Duration // 0 = never stop
+	backendAddr  string
+	hold         *startupHold // answers players while the backend boots; may be nil
+
+	mu        sync.Mutex
+	started   bool            // the backend should be running
+	proc      *backendProcess // running start command, if it is still in the foreground
+	crashes   int             // consecutive crashes, for the restart backoff
+	players   int
+	idleTimer *time.Timer
+}
+
+// backendProcess is one run of the start command.
+type backendProcess struct {
+	cmd      *exec.Cmd
+	launched time.Time
+	exited   chan struct{}
+}
+
+func newBackendSupervisor(startCommand, stopCommand string, idleStop time.Duration, backendAddr string, hold *startupHold) *backendSupervisor {
+	return &backendSupervisor{startCommand: startCommand, stopCommand: stopCommand, idleStop: idleStop, backendAddr: backendAddr, hold: hold}
+}
+
+// ensureStarted starts the backend unless it is already running.
+func (s *backendSupervisor) ensureStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	s.launch()
+	s.resetIdleTimer()
+}
+
+// running reports whether the backend is supposed to be running.
+func (s *backendSupervisor) running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.started
+}
+
+// launch runs the start command. Must be called with s.mu held.
+func (s *backendSupervisor) launch() {
+	out := &lineLogger{prefix: "[backend] "}
+	cmd := shellCommand(s.startCommand)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	// Don't hang on output pipes inherited by grandchildren
+	cmd.WaitDelay = 5 * time.Second
+	if err := cmd.Start(); err != nil {
+		errorf("[backend] failed to run start command: %v", err)
+		s.started = false
+		return
+	}
+	infof("[backend] starting backend (pid %d)", cmd.Process.Pid)
+	if s.hold != nil {
+		s.hold.enter(s.backendAddr, startingText)
+	}
+
+	proc := &backendProcess{cmd: cmd, launched: time.Now(), exited: make(chan struct{})}
+	s.proc = proc
+	go s.wait(proc)
+}
+
+// wait reaps proc and restarts the backend if it exited on its own.
+func (s *backendSupervisor) wait(proc *backendProcess) {
+	err := proc.cmd.Wait()
+	close(proc.exited)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.proc != proc {
+		// Stopped on purpose
+		return
+	}
+	s.proc = nil
+	if s.stopCommand != "" {
+		// The start command only kicked off a backend managed elsewhere
+		if err != nil {
+			warnf("[backend] start command failed: %v", err)
+		}
+		return
+	}
+
+	if time.Since(proc.launched) >= backendStableTime {
+		s.crashes = 0
+	}
+	delay := restartDelay(s.crashes)
+	s.crashes++
+	warnf("[backend] backend exited unexpectedly (%v), restarting in %s", err, delay)
+	time.AfterFunc(delay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.started && s.proc == nil {
+			s.launch()
+		}
+	})
+}
+
+// restartDelay returns how long to wait before restarting a backend that
+// crashed after crashes earlier crashes in a row: doubling from a second up
+// to backendMaxBackoff. The exponent is capped so the shift can't overflow.
+func restartDelay(crashes int) time.Duration {
+	return min(time.Second<<min(crashes, 30), backendMaxBackoff)
+}
+
+// playerJoined records a player connected to the backend and returns a func
+// to call when they leave.
+func (s *backendSupervisor) playerJoined() (left func()) {
+	s.mu.Lock()
+	s.players++
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.players--
+			if s.players == 0 {
+				s.resetIdleTimer()
+			}
+		})
+	}
+}
+
+// resetIdleTimer (re)starts the countdown to stopping an empty backend. Must
+// be called with s.mu held.
+func (s *backendSupervisor) resetIdleTimer() {
+	if s.idleStop <= 0 {
+		return
+	}
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	s.idleTimer = time.AfterFunc(s.idleStop, s.stopIfIdle)
+}
+
+// stopIfIdle stops the backend if it is still running with nobody online.
+func (s *backendSupervisor) stopIfIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started || s.players > 0 {
+		return
+	}
+	infof("[backend] no players for %s, stopping backend", s.idleStop)
+	s.stop()
+}
+
+// stop stops the backend and returns the process to wait for, if any. Must
+// be called with s.mu held.
+func (s *backendSupervisor) stop() *backendProcess {
+	s.started = false
+	if s.stopCommand != "" {
+		if out, err := shellCommand(s.stopCommand).CombinedOutput(); err != nil {
+			errorf("[backend] stop command failed: %v: %s", err, out)
+		}
+		return nil
+	}
+	proc := s.proc
+	s.proc = nil
+	if proc != nil {
+		stopProcess(proc.cmd.Process)
+	}
+	return proc
+}
+
+// shutdown stops the backend when the proxy exits and waits for it to exit.
+func (s *backendSupervisor) shutdown() {
+	s.mu.Lock()
+	if !s.started {
+		s.mu.Unlock()
+		return
+	}
+	infof("[backend] stopping backend")
+	proc := s.stop()
+	s.mu.Unlock()
+
+	if proc != nil {
+		<-proc.exited
+	}
+}
+
+// stopProcess interrupts p and kills it if it hasn't exited after
+// backendStopTimeout.
+func stopProcess(p *os.Process) {
+	if runtime.GOOS == "windows" || p.Signal(os.Interrupt) != nil {
+		p.Kill()
+		return
+	}
+	time.AfterFunc(backendStopTimeout, func() {
+		// Fails harmlessly if the process is already gone
+		p.Kill()
+	})
+}
+
+// shellCommand runs command through the platform shell.
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// lineLogger is an io.Writer that logs each complete line written to it.
+type lineLogger struct {
+	prefix string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimRight(l.buf[:i], "\r")
+		infof("%s%s", l.prefix, line)
+		l.buf = l.buf[i+1:]
+	}
+	// Don't buffer endless output without newlines
+	if len(l.buf) > maxLoggedLine {
+		infof("%s%s", l.prefix, l.buf)
+		l.buf = nil
+	}
+	return len(p), nil
+}
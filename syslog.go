@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslogLocalSockets are tried in order for -syslog local.
+var syslogLocalSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// syslogFacilities maps facility names to their RFC 5424 codes.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities maps the level tags logf puts in front of messages to
+// RFC 5424 severities; untagged messages are info.
+var syslogSeverities = map[string]int{"DEBUG": 7, "WARN": 4, "ERROR": 3}
+
+const syslogSeverityInfo = 6
+
+// syslogWriter sends log output to a syslog daemon (-syslog) as RFC 5424
+// messages, one per log line. The standard library's log/syslog only speaks
+// the older BSD format and doesn't exist on Windows, hence this.
+//
+// Stream connections use octet-counting framing (RFC 6587) and are redialed
+// once when a write fails; lines that can't be sent go to stderr instead of
+// being lost.
+type syslogWriter struct {
+	network, addr string
+	facility      int
+	tag           string
+	hostname      string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// newSyslogWriter connects to target: local (the system's syslog socket),
+// unix:PATH, udp://HOST:PORT or tcp://HOST:PORT.
+func newSyslogWriter(target, facility, tag string) (*syslogWriter, error) {
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility %q", facility)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	w := &syslogWriter{facility: code, tag: tag, hostname: hostname}
+	switch {
+	case target == "local":
+		for _, path := range syslogLocalSockets {
+			if _, err := os.Stat(path); err == nil {
+				w.network, w.addr = "unixgram", path
+				break
+			}
+		}
+		if w.addr == "" {
+			return nil, fmt.Errorf("no local syslog socket found (tried %s)", strings.Join(syslogLocalSockets, ", "))
+		}
+	case strings.HasPrefix(target, "unix:"):
+		w.network, w.addr = "unixgram", strings.TrimPrefix(target, "unix:")
+	case strings.HasPrefix(target, "udp://"):
+		w.network, w.addr = "udp", strings.TrimPrefix(target, "udp://")
+	case strings.HasPrefix(target, "tcp://"):
+		w.network, w.addr = "tcp", strings.TrimPrefix(target, "tcp://")
+	default:
+		return nil, fmt.Errorf("expected local, unix:PATH, udp://HOST:PORT or tcp://HOST:PORT, got %q", target)
+	}
+	if err := w.dial(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) dial() error {
+	conn, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// Write sends one log line; it is called by the log package once per line.
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := w.format(strings.TrimRight(string(p), "\n"), time.Now())
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.send(msg); err != nil {
+		w.conn.Close()
+		if err = w.dial(); err == nil {
+			err = w.send(msg)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "syslog unavailable (%v): %s", err, p)
+		}
+	}
+	return len(p), nil
+}
+
+func (w *syslogWriter) send(msg string) error {
+	if w.network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	_, err := w.conn.Write([]byte(msg))
+	return err
+}
+
+// format renders line as an RFC 5424 message, taking its severity from the
+// level tag logf added and dropping the tag.
+func (w *syslogWriter) format(line string, now time.Time) string {
+	severity := syslogSeverityInfo
+	if tag, rest, ok := strings.Cut(line, " "); ok {
+		if s, known := syslogSeverities[tag]; known {
+			severity, line = s, rest
+		}
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		w.facility*8+severity, now.Format("2006-01-02T15:04:05.000000Z07:00"), w.hostname, w.tag, os.Getpid(), line)
+}
+
+// String describes where messages go, for the startup banner.
+func (w *syslogWriter) String() string {
+	return w.network + ":" + w.addr
+}
@@ -2,54 +2,235 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"log"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	// peekBufferSize is large enough to detect and buffer the PROXY protocol
-	// header without reading into the actual Minecraft protocol data.
+	// peekBufferSize is the default size of the buffer the PROXY header and
+	// handshake are peeked from (-peek-buffer); both must fit in it.
 	peekBufferSize = 512
 
+	// Bounds for -peek-buffer: the largest address block of a v2 header
+	// must fit, and more than a few KiB only pays off for large TLVs.
+	minPeekBufferSize = 256
+	maxPeekBufferSize = 64 * 1024
+
+	// Bounds for -copy-buffer, the buffer each direction of a connection is
+	// relayed with (io.Copy's 32 KiB by default).
+	minCopyBufferSize = 1024
+	maxCopyBufferSize = 4 * 1024 * 1024
+
 	// dialTimeout is how long we wait to connect to the backend.
 	dialTimeout = 10 * time.Second
+
+	// disconnectTimeout bounds sending a disconnect message to a client.
+	disconnectTimeout = 2 * time.Second
 )
 
 func startTCPProxy(cfg Config) {
-	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	for _, rt := range cfg.Routes {
+		go serveTCP(cfg.forRoute(rt))
+	}
+	serveTCP(cfg)
+}
+
+// serveTCP accepts players on cfg.ListenAddr and proxies them to cfg.BackendAddr.
+func serveTCP(cfg Config) {
+	addrs, err := parseListenAddrs(cfg.ListenAddr, cfg.ListenFamily)
+	if err != nil {
+		log.Fatalf("[tcp] Invalid listen address %s: %v", cfg.ListenAddr, err)
+	}
+	listeners, err := listenPlayers(addrs, cfg.ListenSockets)
 	if err != nil {
 		log.Fatalf("[tcp] Failed to listen on %s: %v", cfg.ListenAddr, err)
 	}
-	log.Printf("[tcp] Listening on %s", cfg.ListenAddr)
+	var bound []string
+	for _, a := range addrs {
+		bound = append(bound, a.String())
+	}
+	if len(listeners) > len(addrs) {
+		infof("[tcp] Listening on %s with %d sockets (route %s)", strings.Join(bound, ", "), len(listeners), cfg.Route)
+	} else {
+		infof("[tcp] Listening on %s (route %s)", strings.Join(bound, ", "), cfg.Route)
+	}
+	for _, ln := range listeners {
+		readiness.playerListenerUp(ln, cfg.Route)
+	}
+	for _, ln := range listeners[1:] {
+		go acceptLoop(ln, cfg)
+	}
+	acceptLoop(listeners[0], cfg)
+}
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Printf("[tcp] Accept error: %v", err)
+// listenPlayers opens the player listener on each of addrs, or with
+// sockets > 1, that many SO_REUSEPORT sockets per address with an accept
+// loop each, so accepting spreads over several cores.
+func listenPlayers(addrs []listenAddress, sockets int) ([]net.Listener, error) {
+	var listeners []net.Listener
+	fail := func(err error) ([]net.Listener, error) {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+	for i, a := range addrs {
+		addr := a.addr
+		// The IPv6 half of a dual wildcard on port 0 takes the port the
+		// IPv4 half got
+		if host, port, _ := net.SplitHostPort(addr); port == "0" && i > 0 && a.network == "tcp6" && addrs[i-1] == (listenAddress{"tcp4", "0.0.0.0:0"}) && host == "::" {
+			_, got, _ := net.SplitHostPort(listeners[len(listeners)-1].Addr().String())
+			addr = net.JoinHostPort(host, got)
+		}
+		if sockets <= 1 {
+			ln, err := net.Listen(a.network, addr)
+			if err != nil {
+				return fail(err)
+			}
+			listeners = append(listeners, ln)
 			continue
 		}
-		go handleConnection(conn, cfg.BackendAddr)
+		for range sockets {
+			ln, err := listenReusePort(a.network, addr)
+			if err != nil {
+				return fail(err)
+			}
+			listeners = append(listeners, ln)
+			// With port 0, the other sockets join the port the first one got
+			addr = ln.Addr().String()
+		}
 	}
+	return listeners, nil
 }
 
-func handleConnection(clientConn net.Conn, backendAddr string) {
+// checksHandshakes reports whether a gate that needs the parsed handshake is
+// configured. Connections whose handshake can't be parsed are then refused
+// instead of being relayed past the gates.
+func (cfg Config) checksHandshakes() bool {
+	return cfg.AllowedHosts != nil || cfg.LoginLimiter != nil || cfg.StatusLimiter != nil || cfg.PingGate != nil ||
+		cfg.Reputation != nil || cfg.VPN != nil || cfg.Whitelist != nil
+}
+
+func handleConnection(clientConn net.Conn, cfg Config) {
 	defer clientConn.Close()
+	handler := handlers.open(clientConn)
+	defer handlers.close(handler)
 
+	backendAddr := cfg.currentBackend()
 	clientAddr := clientConn.RemoteAddr().String()
 
 	// Wrap in a buffered reader so we can peek without consuming bytes
-	br := bufio.NewReaderSize(clientConn, peekBufferSize)
+	peekSize := cfg.PeekBufferSize
+	if peekSize == 0 {
+		peekSize = peekBufferSize
+	}
+	br := bufio.NewReaderSize(clientConn, peekSize)
+
+	// Don't let clients that stall before finishing their handshake (slowloris)
+	// hold a goroutine and socket forever
+	var handshakeDeadline time.Time
+	if cfg.HandshakeTimeout > 0 {
+		handshakeDeadline = time.Now().Add(cfg.HandshakeTimeout)
+		clientConn.SetReadDeadline(handshakeDeadline)
+	}
+
+	// Scanners connect and never send anything; don't wait the whole
+	// handshake timeout for them, or forever if it is disabled
+	if cfg.FirstByteTimeout > 0 {
+		firstByteDeadline := time.Now().Add(cfg.FirstByteTimeout)
+		if handshakeDeadline.IsZero() || firstByteDeadline.Before(handshakeDeadline) {
+			clientConn.SetReadDeadline(firstByteDeadline)
+		}
+		if _, err := br.Peek(1); err != nil {
+			tracker.silent.Add(1)
+			debugf("[tcp] %s: closed without sending anything: %v", clientAddr, err)
+			return
+		}
+		clientConn.SetReadDeadline(handshakeDeadline)
+	}
+
+	// Paired tiers: only accept connections relayed by our own instances
+	var relayPreamble []byte
+	if cfg.RelayVerifier != nil {
+		preamble, err := readRelayPreamble(br)
+		if err != nil {
+			warnf("[tcp] %s: rejecting connection without a relay preamble: %v", clientAddr, err)
+			tracker.refused.Add(1)
+			return
+		}
+		relayPreamble = preamble
+	}
 
 	// Detect PROXY protocol header
-	proxyHeader, err := detectProxyProtocol(br)
+	proxyHeader, err := detectProxyHeader(br, cfg.StrictProxyProtocol)
 	if err != nil {
-		log.Printf("[tcp] %s: error detecting proxy protocol: %v", clientAddr, err)
+		warnf("[tcp] %s: error detecting proxy protocol: %v", clientAddr, err)
 		return
 	}
+	if relayPreamble != nil {
+		var rawHeader []byte
+		if proxyHeader != nil {
+			rawHeader = proxyHeader.RawBytes
+		}
+		if err := cfg.RelayVerifier.verify(relayPreamble, rawHeader); err != nil {
+			warnf("[tcp] %s: rejecting connection with an invalid relay preamble: %v", clientAddr, err)
+			tracker.refused.Add(1)
+			return
+		}
+	}
+
+	// Front-ends with a known PROXY behavior only send some headers, and
+	// check their backends with headers that carry no address
+	if cfg.Ingress != nil {
+		if reason := cfg.Ingress.check(proxyHeader); reason != "" {
+			warnf("[tcp] %s: refusing connection with %s on a %s listener", clientAddr, reason, cfg.Ingress.name)
+			tracker.refused.Add(1)
+			events.publish(eventLoginBlocked, map[string]any{"real": clientAddr, "reason": "ingress_profile", "detail": reason})
+			return
+		}
+		if cfg.Ingress.probes && proxyHeader != nil && proxyHeader.SrcAddr == nil {
+			if _, err := br.Peek(1); err != nil {
+				debugf("[tcp] %s: %s health probe", clientAddr, cfg.Ingress.name)
+				return
+			}
+		}
+	}
+
+	// Only trusted peers may tell us who the player is; a verified relay
+	// preamble vouches for the header
+	if proxyHeader != nil && relayPreamble == nil && cfg.UntrustedProxyHeader != "" && cfg.UntrustedProxyHeader != proxyHeaderPassthrough && !isTrustedProxy(cfg.TrustedProxies, clientAddr) {
+		claimed := "unknown"
+		if proxyHeader.SrcAddr != nil {
+			claimed = net.JoinHostPort(proxyHeader.SrcAddr.String(), itoa(int(proxyHeader.SrcPort)))
+		}
+		if cfg.UntrustedProxyHeader == proxyHeaderReject {
+			warnf("[tcp] %s: rejecting PROXY header from untrusted peer (claimed source %s)", clientAddr, claimed)
+			tracker.refused.Add(1)
+			events.publish(eventLoginBlocked, map[string]any{"real": clientAddr, "reason": "untrusted_proxy_header", "claimed": claimed})
+			return
+		}
+		warnf("[tcp] %s: ignoring PROXY header from untrusted peer (claimed source %s)", clientAddr, claimed)
+		proxyHeader = nil
+	}
+
+	// A relay that doesn't know the source sends UNKNOWN (v1) or AF_UNSPEC
+	// (v2); the player is then best identified by the relay itself
+	if proxyHeader != nil && proxyHeader.Unknown && cfg.ProxyUnknown != "" && cfg.ProxyUnknown != proxyUnknownPassthrough {
+		if cfg.ProxyUnknown == proxyUnknownReject {
+			warnf("[tcp] %s: rejecting PROXY header without a source address", clientAddr)
+			tracker.refused.Add(1)
+			events.publish(eventLoginBlocked, map[string]any{"real": clientAddr, "reason": "proxy_unknown"})
+			return
+		}
+		debugf("[tcp] %s: PROXY header without a source address, using the peer address", clientAddr)
+		proxyHeader = nil
+	}
 
 	// Determine the real source address for logging
 	realAddr := clientAddr
@@ -59,60 +240,504 @@ func handleConnection(clientConn net.Conn, backendAddr string) {
 			realAddr = net.JoinHostPort(proxyHeader.SrcAddr.String(), itoa(int(proxyHeader.SrcPort)))
 		}
 		source = "proxied"
+		connDebugf(realAddr, "[tcp] %s: PROXY v%d header (%d bytes): %x", clientAddr, proxyHeader.Version, len(proxyHeader.RawBytes), proxyHeader.RawBytes)
+	}
+
+	// Pre-1.7 clients and server scanners send a 0xFE legacy ping instead of
+	// a handshake. It's answered after the ban and status rate checks, like
+	// any other status ping.
+	legacy := isLegacyPing(br)
+
+	// Parse the Minecraft handshake so its server address can be inspected
+	// and rewritten; anything else is passed through untouched
+	handshake, handshakeLen := peekHandshake(br)
+	if handshake == nil && !handshakeDeadline.IsZero() && time.Now().After(handshakeDeadline) {
+		debugf("[tcp] %s: no complete handshake within %s, closing", clientAddr, cfg.HandshakeTimeout)
+		return
+	}
+	// A handshake padded past -peek-buffer, or otherwise malformed, would
+	// skip every check below
+	if handshake == nil && !legacy && cfg.checksHandshakes() {
+		infof("[tcp] %s: refusing connection from %s without a handshake the proxy can read (larger than -peek-buffer %d?)", clientAddr, realAddr, br.Size())
+		events.publish(eventLoginBlocked, map[string]any{"real": realAddr, "reason": "invalid_handshake"})
+		tracker.refused.Add(1)
+		return
+	}
+	clientConn.SetReadDeadline(time.Time{})
+	host, modded := "", ""
+	var rewrittenHandshake []byte
+	if handshake != nil {
+		host = handshake.Hostname()
+		modded = handshake.ForgeMarker()
+		newAddr := handshake.ServerAddress
+		if cfg.HostRewriter != nil {
+			if newAddr = cfg.HostRewriter.rewrite(newAddr); newAddr != handshake.ServerAddress {
+				connDebugf(realAddr, "[tcp] %s: rewriting handshake host %q → %q", clientAddr, handshake.ServerAddress, newAddr)
+			}
+		}
+		if cfg.BungeeGuardToken != "" {
+			// Only forwarding data from trusted proxies gets the token; one
+			// sent by anyone else is removed
+			token := ""
+			if relayPreamble != nil || isTrustedProxy(cfg.TrustedProxies, clientAddr) {
+				token = cfg.BungeeGuardToken
+			}
+			if guarded, ok := setBungeeGuardToken(newAddr, token); ok {
+				if token != "" {
+					connDebugf(realAddr, "[tcp] %s: adding BungeeGuard token to forwarding data", clientAddr)
+				} else {
+					debugf("[tcp] %s: forwarding data from untrusted peer, not adding BungeeGuard token", clientAddr)
+				}
+				newAddr = guarded
+			}
+		}
+		if newAddr != handshake.ServerAddress {
+			rewritten := *handshake
+			rewritten.ServerAddress = newAddr
+			rewrittenHandshake = rewritten.encode()
+			br.Discard(handshakeLen)
+			handshakeLen = 0 // nothing left to skip in br
+		}
+	}
+
+	// Handshakes for hostnames that aren't ours come from scanners or players
+	// using a leaked IP; logins are told which address to use
+	if cfg.AllowedHosts != nil && handshake != nil {
+		pattern := cfg.AllowedHosts.match(host)
+		hostChecks.record(pattern, pattern != "")
+		if pattern == "" {
+			infof("[tcp] %s: refusing handshake for host %q from %s", clientAddr, host, realAddr)
+			events.publish(eventLoginBlocked, map[string]any{"real": realAddr, "host": host, "reason": "host_not_allowed"})
+			tracker.refused.Add(1)
+			if handshake.NextState != stateStatus {
+				disconnectLogin(clientConn, br, hostNotAllowedMessage)
+			}
+			return
+		}
+	}
+
+	// Banned IPs get a disconnect message on login and nothing otherwise
+	if cfg.Bans != nil {
+		if b, ok := cfg.Bans.checkIP(realAddr); ok {
+			infof("[tcp] %s: refusing banned address %s (ban on %s)", clientAddr, realAddr, b.Target)
+			events.publish(eventLoginBlocked, map[string]any{"real": realAddr, "reason": "banned"})
+			tracker.refused.Add(1)
+			if handshake != nil && handshake.NextState != stateStatus {
+				disconnectLogin(clientConn, br, b.message())
+			}
+			return
+		}
+	}
+
+	// Throttle login attempts per IP; bots tend to cycle usernames from few IPs
+	if cfg.LoginLimiter != nil && handshake != nil && handshake.NextState != stateStatus {
+		if !cfg.LoginLimiter.allow(addrIP(realAddr)) {
+			infof("[tcp] %s: login attempts from %s exceed %s, disconnecting", clientAddr, realAddr, cfg.LoginLimiter)
+			events.publish(eventRateLimitHit, map[string]any{"limit": "login", "real": realAddr})
+			tracker.refused.Add(1)
+			disconnectLogin(clientConn, br, loginThrottledMessage)
+			return
+		}
+	}
+
+	// Status pings have their own budget, so server-list refreshers can't
+	// use up the logins' and the other way round. Throttled pings are
+	// closed, which clients show as an unreachable server.
+	if cfg.StatusLimiter != nil && (legacy || handshake != nil && handshake.NextState == stateStatus) {
+		if !cfg.StatusLimiter.allow(addrIP(realAddr)) {
+			debugf("[tcp] %s: status pings from %s exceed %s, closing", clientAddr, realAddr, cfg.StatusLimiter)
+			events.publish(eventRateLimitHit, map[string]any{"limit": "status", "real": realAddr})
+			tracker.refused.Add(1)
+			return
+		}
+	}
+
+	if legacy && cfg.LegacyPing != "" && cfg.LegacyPing != legacyPingPassthrough {
+		handleLegacyPing(clientConn, br, cfg, backendProxyHeader(cfg, clientConn, proxyHeader, "", ""), realAddr)
+		return
+	}
+
+	// Anti-bot gate: logins must come from an IP that recently pinged us
+	if cfg.PingGate != nil && handshake != nil {
+		ip := addrIP(realAddr)
+		switch handshake.NextState {
+		case stateStatus:
+			cfg.PingGate.markVerified(ip)
+		default: // logins and transfers
+			if !cfg.PingGate.isVerified(ip) {
+				infof("[tcp] %s: refusing login from %s without a prior status ping", clientAddr, realAddr)
+				events.publish(eventLoginBlocked, map[string]any{"real": realAddr, "reason": "unverified"})
+				tracker.refused.Add(1)
+				disconnectLogin(clientConn, br, unverifiedLoginMessage)
+				return
+			}
+			cfg.PingGate.markVerified(ip)
+		}
+	}
+
+	// Logins from addresses with a bad reputation are refused or flagged;
+	// lookups that fail let them in
+	if cfg.Reputation != nil && handshake != nil && handshake.NextState != stateStatus {
+		score, err := cfg.Reputation.score(realAddr)
+		switch {
+		case err != nil:
+			cfg.Reputation.failed.Add(1)
+			warnf("[reputation] %s: lookup failed, letting the login in: %v", realAddr, err)
+		case score < cfg.Reputation.threshold:
+			cfg.Reputation.clean.Add(1)
+			debugf("[reputation] %s: score %d", realAddr, score)
+		case cfg.Reputation.deny:
+			cfg.Reputation.denied.Add(1)
+			infof("[reputation] %s: refusing login, score %d on %s", realAddr, score, cfg.Reputation.source)
+			events.publish(eventLoginBlocked, map[string]any{"real": realAddr, "reason": "reputation", "score": score})
+			tracker.refused.Add(1)
+			disconnectLogin(clientConn, br, reputationBlockedMessage)
+			return
+		default:
+			cfg.Reputation.flagged.Add(1)
+			infof("[reputation] %s: flagged, score %d on %s", realAddr, score, cfg.Reputation.source)
+			events.publish(eventLoginFlagged, map[string]any{"real": realAddr, "reason": "reputation", "score": score})
+		}
+	}
+
+	// Logins from VPNs and hosting providers get -vpn-policy; blocking them
+	// needs nothing but the address
+	var network string
+	if cfg.VPN != nil && handshake != nil && handshake.NextState != stateStatus {
+		network = cfg.VPN.detect(realAddr)
+		if network != "" && cfg.VPN.policy == vpnBlock {
+			cfg.VPN.blocked.Add(1)
+			infof("[vpn] %s: refusing login from a %s network", realAddr, network)
+			events.publish(eventLoginBlocked, map[string]any{"real": realAddr, "reason": "vpn", "network": network})
+			tracker.refused.Add(1)
+			disconnectLogin(clientConn, br, vpnBlockedMessage)
+			return
+		}
+	}
+	vpnWhitelisted := network != "" && cfg.VPN.policy == vpnWhitelist
+
+	// The whitelist, username routing and sticky backends need the name
+	// before going on
+	isLogin := handshake != nil && handshake.NextState != stateStatus
+	var loginName string
+	namePeeked := false
+	stickyName := cfg.Balancer != nil && cfg.Balancer.sticky == stickyUsername
+	if (cfg.Whitelist != nil || cfg.UserRouter != nil || stickyName || vpnWhitelisted) && isLogin {
+		clientConn.SetReadDeadline(time.Now().Add(loginStartTimeout))
+		loginName, namePeeked = peekLoginStart(br, handshakeLen), true
+		clientConn.SetReadDeadline(time.Time{})
+	}
+
+	// Players not on the whitelist never reach the backend
+	if cfg.Whitelist != nil && isLogin && !cfg.Whitelist.allowsName(loginName) {
+		infof("[tcp] %s: %q from %s is not whitelisted, disconnecting", clientAddr, loginName, realAddr)
+		events.publish(eventLoginBlocked, map[string]any{"real": realAddr, "username": loginName, "reason": "not_whitelisted"})
+		tracker.refused.Add(1)
+		disconnectLogin(clientConn, br, cfg.Whitelist.message)
+		return
+	}
+
+	// Players from listed networks must be on -vpn-whitelist
+	if vpnWhitelisted {
+		if !cfg.VPN.allow.allowsName(loginName) {
+			cfg.VPN.blocked.Add(1)
+			infof("[vpn] %s: refusing %q from a %s network, not on -vpn-whitelist", realAddr, loginName, network)
+			events.publish(eventLoginBlocked, map[string]any{"real": realAddr, "username": loginName, "reason": "vpn", "network": network})
+			tracker.refused.Add(1)
+			disconnectLogin(clientConn, br, vpnBlockedMessage)
+			return
+		}
+		cfg.VPN.allowed.Add(1)
+		infof("[vpn] %s: letting %q in from a %s network", realAddr, loginName, network)
 	}
 
-	log.Printf("[tcp] %s: new connection (real=%s, source=%s)", clientAddr, realAddr, source)
+	// Start the backend on demand when a player logs in
+	if cfg.Supervisor != nil && isLogin {
+		cfg.Supervisor.ensureStarted()
+	}
+
+	// While the backend is starting, answer players ourselves; logins that
+	// can wait in limbo do. With a waker, logins go on to wait for the
+	// backend instead.
+	answerHeld := func(message string) {
+		br.Discard(handshakeLen)
+		if cfg.Limbo.accepts(handshake) {
+			handler.enter(phaseLimbo)
+			cfg.Limbo.hold(clientConn, br, handshake, func() bool { return !cfg.Startup.holding() }, message)
+			return
+		}
+		cfg.Startup.answer(clientConn, br, handshake, message)
+	}
+	if cfg.Startup != nil && handshake != nil && (!isLogin || cfg.Waker == nil) {
+		if message, ok := cfg.Startup.message(); ok {
+			answerHeld(message)
+			return
+		}
+	}
+
+	// Enforce the player cap, holding queued logins until a slot frees up
+	if cfg.Queue != nil && isLogin {
+		release, position := cfg.Queue.acquire(addrIP(realAddr), queueHoldTime)
+		if release == nil {
+			if position > 0 {
+				infof("[tcp] %s: server full, %s is #%d in the queue", clientAddr, realAddr, position)
+			} else {
+				infof("[tcp] %s: server full, disconnecting %s", clientAddr, realAddr)
+			}
+			tracker.refused.Add(1)
+			disconnectLogin(clientConn, br, queueMessage(position))
+			return
+		}
+		defer release()
+	}
+
+	// Count players so an on-demand backend can be stopped when empty
+	if cfg.Supervisor != nil && isLogin {
+		defer cfg.Supervisor.playerJoined()()
+	}
+
+	if modded != "" {
+		infof("[tcp] %s: new connection (real=%s, source=%s, host=%q, modded=%s)", clientAddr, realAddr, source, host, modded)
+	} else {
+		infof("[tcp] %s: new connection (real=%s, source=%s, host=%q)", clientAddr, realAddr, source, host)
+	}
+
+	tracked := &trackedConn{ClientAddr: clientAddr, RealAddr: realAddr, Source: source, Host: host, Modded: modded, Route: cfg.Route, Started: time.Now(), client: clientConn}
+	tracker.add(tracked)
+	events.publish(eventConnOpen, map[string]any{"id": tracked.ID, "client": clientAddr, "real": realAddr, "source": source, "host": host, "modded": modded, "route": cfg.Route})
+	defer func() {
+		tracker.remove(tracked)
+		name, _ := tracked.username.Load().(string)
+		events.publish(eventConnClose, map[string]any{
+			"id":        tracked.ID,
+			"real":      realAddr,
+			"username":  name,
+			"bytes_in":  tracked.bytesIn.Load(),
+			"bytes_out": tracked.bytesOut.Load(),
+			"duration":  time.Since(tracked.Started).Seconds(),
+		})
+	}()
+
+	// Failed logins are saved for bug reports with -record-dir
+	var capture *trafficCapture
+	if isLogin {
+		capture = cfg.Recorder.start(clientAddr, realAddr, host)
+	}
 
 	// Connect to backend
-	backendConn, err := net.DialTimeout("tcp", backendAddr, dialTimeout)
+	candidates := []string{backendAddr}
+	if cfg.Resolver != nil {
+		candidates = cfg.Resolver.candidates()
+	}
+	if cfg.Balancer != nil {
+		candidates = cfg.Balancer.candidatesFor(addrIP(realAddr), loginName)
+		backendAddr = candidates[0]
+	}
+	if rule := cfg.UserRouter.route(loginName); rule != nil {
+		infof("[tcp] %s: routing %s to %s", clientAddr, loginName, rule.backend)
+		backendAddr, candidates = rule.backend, rule.candidates()
+		// Pre-dialing, waking, startup holds and balancing are for the
+		// default backend
+		cfg.BackendPool, cfg.Waker, cfg.Startup, cfg.Balancer = nil, nil, nil, nil
+	}
+	var dialed string // the candidate that answered
+	dial := func() (conn net.Conn, err error) {
+		// Fail over between the addresses the backend hostname resolves to,
+		// or between balanced backends
+		for _, addr := range candidates {
+			if cfg.Transparent {
+				// Spoof the player's address so the backend sees it without PROXY protocol
+				conn, err = dialTransparent(addr, realSourceAddr(clientConn, proxyHeader))
+			} else {
+				conn, err = net.DialTimeout("tcp", addr, dialTimeout)
+			}
+			if err == nil {
+				dialed = addr
+				return conn, nil
+			}
+			if cfg.Balancer != nil {
+				cfg.Balancer.failed(addr, err)
+			}
+			if len(candidates) > 1 {
+				debugf("[tcp] %s: backend address %s failed: %v", clientAddr, addr, err)
+			}
+		}
+		return nil, err
+	}
+	// Logins skip the dial when a pre-dialed connection is ready
+	var backendConn net.Conn
+	var pooled bool
+	if cfg.BackendPool != nil && isLogin {
+		var saved time.Duration
+		if backendConn, saved, pooled = cfg.BackendPool.take(backendAddr); pooled {
+			connDebugf(realAddr, "[tcp] %s: using a pre-dialed backend connection (saved %s)", clientAddr, saved)
+		}
+	}
+	handler.enter(phaseDialing)
+	cfg.Chaos.delayDial()
+	dialStart := time.Now()
+	if !pooled {
+		backendConn, err = dial()
+		if err != nil && cfg.Waker != nil && isLogin {
+			// The backend may be asleep: wake it and hold the player meanwhile
+			infof("[tcp] %s: backend %s unavailable (%v), waking it", clientAddr, backendAddr, err)
+			backendConn, err = wakeAndDial(cfg.Waker, dial)
+		}
+		if err == nil {
+			backendAddr = dialed
+		}
+		activity.recordDial(backendAddr, time.Since(dialStart), err)
+		observeDial(backendAddr, time.Since(dialStart), err)
+	}
 	if err != nil {
-		log.Printf("[tcp] %s: failed to connect to backend %s: %v", clientAddr, backendAddr, err)
+		warnf("[tcp] %s: failed to connect to backend %s: %v", clientAddr, backendAddr, err)
+		if capture != nil {
+			pending, _ := br.Peek(br.Buffered())
+			capture.record(captureToBackend, pending)
+			capture.keep(loginName, "backend error: "+err.Error())
+		}
+		if cfg.Startup != nil && handshake != nil && (cfg.Waker != nil || isConnRefused(err)) {
+			if cfg.Waker != nil {
+				cfg.Waker.wake()
+				cfg.Startup.enter(backendAddr, cfg.Waker.holdText())
+			} else {
+				cfg.Startup.enter(backendAddr, startingText)
+			}
+			message, _ := cfg.Startup.message()
+			answerHeld(message)
+		}
 		return
 	}
 	defer backendConn.Close()
+	// After failover, so -backend-upstreams sees where the player really went
+	tracked.setBackend(backendAddr)
+	connDebugf(realAddr, "[tcp] %s: connected to backend %s in %s", clientAddr, backendAddr, time.Since(dialStart))
 
 	// Send PROXY protocol header to backend
-	if proxyHeader != nil {
-		// Minehut (or other proxy) connection: forward the original header as-is
-		if _, err := backendConn.Write(proxyHeader.RawBytes); err != nil {
-			log.Printf("[tcp] %s: failed to write proxy header to backend: %v", clientAddr, err)
+	var networkTag string
+	if network != "" && cfg.VPN.policy == vpnTag {
+		networkTag = network
+		cfg.VPN.tagged.Add(1)
+		debugf("[vpn] %s: tagging login from a %s network", realAddr, network)
+	}
+	header := backendProxyHeader(cfg, clientConn, proxyHeader, host, networkTag)
+	if header != nil {
+		if truncated := cfg.Chaos.truncateHeader(header); truncated != nil {
+			warnf("[chaos] %s: sending the backend %d of %d PROXY header bytes", clientAddr, len(truncated), len(header))
+			backendConn.Write(truncated)
 			return
 		}
-	} else {
-		// Direct connection: generate a v2 header from the real TCP addresses
-		header := buildProxyV2Header(clientConn.RemoteAddr(), clientConn.LocalAddr())
+		capture.record(captureToBackend, header)
 		if _, err := backendConn.Write(header); err != nil {
-			log.Printf("[tcp] %s: failed to write generated proxy header to backend: %v", clientAddr, err)
+			warnf("[tcp] %s: failed to write proxy header to backend: %v", clientAddr, err)
+			return
+		}
+	}
+
+	// Forward the rewritten handshake in place of the original
+	if rewrittenHandshake != nil {
+		capture.record(captureToBackend, rewrittenHandshake)
+		if _, err := backendConn.Write(rewrittenHandshake); err != nil {
+			warnf("[tcp] %s: failed to write handshake to backend: %v", clientAddr, err)
 			return
 		}
 	}
 
+	handler.enter(phaseRelaying)
+	defer cfg.Chaos.scheduleReset(clientConn)()
+
+	// A sample of connections is copied to the shadow backend from here on
+	mirror := cfg.Mirror.start(clientAddr, header, rewrittenHandshake)
+
 	// Bidirectional pipe: client ↔ backend
 	// The buffered reader may still have unread data from the peek,
 	// so we use it as the client reader instead of the raw conn.
 	var wg sync.WaitGroup
 	wg.Add(2)
+	shape := cfg.Shaper.classFor(realAddr)
+	if shape != nil {
+		shape.connections.Add(1)
+		connDebugf(realAddr, "[tcp] %s: shaping class %s", clientAddr, shape.name)
+	}
+	tapped := capture != nil || mirror != nil || shape != nil
+	splice := spliceable(cfg, tapped, clientConn, backendConn)
+	aggregate := cfg.AggregatePlayers && handshake != nil && handshake.NextState == stateStatus
+
+	// With -sockmap, the kernel relays connections the proxy has no more
+	// use for, from right after the handshake and Login Start
+	var offload *sockmapPair
+	if !tapped && !aggregate {
+		offload = cfg.Sockmap.open(clientConn, backendConn)
+	}
+	defer offload.close()
 
 	// Client → Backend
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(backendConn, br)
+		var w io.Writer = capture.writer(backendConn, captureToBackend)
+		if mirror != nil {
+			w = io.MultiWriter(w, mirror)
+		}
+		toBackend := &countingWriter{w: shape.writer(w), conn: &tracked.bytesIn, total: &tracker.bytesIn}
+		// Logins name their player in Login Start, right after the
+		// handshake. It is peeked here so waiting for it never delays the
+		// backend, which gets the handshake first; it is forwarded like
+		// everything else.
+		if handshake != nil && isLogin {
+			name := loginName
+			if !namePeeked {
+				if handshakeLen > 0 {
+					packet, _ := br.Peek(handshakeLen)
+					toBackend.Write(packet)
+					br.Discard(handshakeLen)
+				}
+				name = peekLoginStart(br, 0)
+			}
+			if name != "" {
+				tracked.setUsername(name)
+				infof("[tcp] %s: logging in as %s", clientAddr, name)
+			}
+		}
+		var n int64
+		var err error
+		if offload != nil {
+			offload.start()
+			n, err = offload.relay(toBackend, backendConn.(*net.TCPConn), clientConn.(*net.TCPConn), br, cfg.CopyBufferSize)
+		} else if splice {
+			n, err = spliceConn(toBackend, backendConn.(*net.TCPConn), clientConn.(*net.TCPConn), br)
+		} else {
+			n, err = copyConn(toBackend, br, cfg.CopyBufferSize)
+		}
 		if err != nil {
 			logPipeError("client→backend", clientAddr, err)
 		}
+		connDebugf(realAddr, "[tcp] %s: client→backend finished after %d bytes (err=%v)", clientAddr, n, err)
 		// Signal to backend that client is done writing
 		if tc, ok := backendConn.(*net.TCPConn); ok {
 			tc.CloseWrite()
 		}
+		mirror.close()
 	}()
 
 	// Backend → Client
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(clientConn, backendConn)
+		toClient := &countingWriter{w: shape.writer(capture.writer(clientConn, captureToClient)), conn: &tracked.bytesOut, total: &tracker.bytesOut}
+		var n int64
+		var err error
+		if aggregate {
+			n, err = relayAggregatedStatus(toClient, backendConn, cfg.CopyBufferSize)
+		} else if offload != nil {
+			n, err = offload.relay(toClient, clientConn.(*net.TCPConn), backendConn.(*net.TCPConn), nil, cfg.CopyBufferSize)
+		} else if splice {
+			n, err = spliceConn(toClient, clientConn.(*net.TCPConn), backendConn.(*net.TCPConn), nil)
+		} else {
+			n, err = copyConn(toClient, backendConn, cfg.CopyBufferSize)
+		}
 		if err != nil {
 			logPipeError("backend→client", clientAddr, err)
 		}
+		connDebugf(realAddr, "[tcp] %s: backend→client finished after %d bytes (err=%v)", clientAddr, n, err)
 		// Signal to client that backend is done writing
 		if tc, ok := clientConn.(*net.TCPConn); ok {
 			tc.CloseWrite()
@@ -120,7 +745,86 @@ func handleConnection(clientConn net.Conn, backendAddr string) {
 	}()
 
 	wg.Wait()
-	log.Printf("[tcp] %s: connection closed", clientAddr)
+	if out := tracked.bytesOut.Load(); capture.failedLogin(out) {
+		name, _ := tracked.username.Load().(string)
+		capture.keep(name, "connection ended after the backend sent "+itoa(int(out))+" bytes")
+	}
+	if name, _ := tracked.username.Load().(string); name != "" {
+		infof("[tcp] %s: connection closed (username=%s)", clientAddr, name)
+	} else {
+		infof("[tcp] %s: connection closed", clientAddr)
+	}
+}
+
+// copyConn relays src to dst with a buffer of size bytes, or io.Copy's
+// default if size is 0.
+func copyConn(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size == 0 {
+		return io.Copy(dst, src)
+	}
+	// Hide src's WriteTo, which would bring its own buffer
+	return io.CopyBuffer(dst, struct{ io.Reader }{src}, make([]byte, size))
+}
+
+// disconnectLogin sends a Login-state Disconnect packet and closes the
+// connection gracefully. The rest of the client's login data is drained
+// first: closing a socket with unread data resets it, and the client would
+// never see the message.
+func disconnectLogin(clientConn net.Conn, br *bufio.Reader, reason string) {
+	clientConn.SetWriteDeadline(time.Now().Add(disconnectTimeout))
+	if _, err := clientConn.Write(encodeLoginDisconnect(reason)); err != nil {
+		return
+	}
+	if tc, ok := clientConn.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+	clientConn.SetReadDeadline(time.Now().Add(disconnectTimeout))
+	io.Copy(io.Discard, br)
+}
+
+// backendProxyHeader returns the PROXY protocol header to send to the backend:
+// Minehut (or other proxy) connections forward the original header as-is,
+// direct connections get a v2 header generated from the real TCP addresses.
+// In transparent mode no header is sent, since the backend sees the real
+// address as the TCP peer. With -relay-secret, the header is preceded by a
+// signed relay preamble for the next tier. With -host-tlv, v2 headers carry
+// host, the hostname from the player's handshake, and with -vpn-policy tag
+// they carry network, the kind of network the player was detected in;
+// forwarded v1 headers are turned into v2 ones for either.
+func backendProxyHeader(cfg Config, clientConn net.Conn, proxyHeader *ProxyHeader, host, network string) []byte {
+	var header []byte
+	tagHost := cfg.HostTLV && host != ""
+	switch {
+	case cfg.Transparent:
+	case proxyHeader != nil && proxyHeader.Version == 1 && (tagHost || network != "") && proxyHeader.SrcAddr != nil:
+		header = buildProxyV2Header(realSourceAddr(clientConn, proxyHeader), &net.TCPAddr{IP: proxyHeader.DstAddr, Port: int(proxyHeader.DstPort)})
+	case proxyHeader != nil:
+		header = proxyHeader.RawBytes
+	default:
+		header = buildProxyV2Header(clientConn.RemoteAddr(), clientConn.LocalAddr())
+	}
+	if len(header) > 16 && bytes.HasPrefix(header, proxyV2Sig) {
+		if tagHost {
+			header = withTLV(header, proxyV2TypeAuthority, host)
+		}
+		if network != "" {
+			header = withTLV(header, proxyV2TypeNetwork, network)
+		}
+	}
+	if cfg.RelaySecret != nil {
+		return append(signRelayPreamble(cfg.RelaySecret, header), header...)
+	}
+	return header
+}
+
+// realSourceAddr returns the player's address: the PROXY header source if
+// present, otherwise the TCP peer.
+func realSourceAddr(clientConn net.Conn, proxyHeader *ProxyHeader) *net.TCPAddr {
+	if proxyHeader != nil && proxyHeader.SrcAddr != nil {
+		return &net.TCPAddr{IP: proxyHeader.SrcAddr, Port: int(proxyHeader.SrcPort)}
+	}
+	addr, _ := clientConn.RemoteAddr().(*net.TCPAddr)
+	return addr
 }
 
 func logPipeError(direction, clientAddr string, err error) {
@@ -133,7 +837,7 @@ func logPipeError(direction, clientAddr string, err error) {
 			return
 		}
 	}
-	log.Printf("[tcp] %s: pipe %s error: %v", clientAddr, direction, err)
+	warnf("[tcp] %s: pipe %s error: %v", clientAddr, direction, err)
 }
 
 func itoa(i int) string {
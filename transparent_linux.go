@@ -0,0 +1,42 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// ipv6Transparent is IPV6_TRANSPARENT from <linux/in6.h>, which the syscall
+// package does not define.
+const ipv6Transparent = 75
+
+// dialTransparent connects to the backend from the player's own address by
+// setting IP_TRANSPARENT on the socket before binding. This requires
+// CAP_NET_ADMIN and policy routing that delivers the backend's replies for
+// foreign addresses back to this host (see README).
+func dialTransparent(backendAddr string, src *net.TCPAddr) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: dialTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if src != nil && src.IP.To4() == nil {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				} else {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	if src != nil {
+		// Keep the player's IP but let the kernel pick the port, so two
+		// connections from the same player can't collide
+		dialer.LocalAddr = &net.TCPAddr{IP: src.IP}
+	}
+	return dialer.Dial("tcp", backendAddr)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// dialTransparent is only implemented on Linux, which provides IP_TRANSPARENT.
+func dialTransparent(backendAddr string, src *net.TCPAddr) (net.Conn, error) {
+	return nil, errors.New("transparent proxying is only supported on Linux")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	updateRepo      = "SKevo18/mc-dual-proxy"
+	updateAPI       = "https://api.github.com"
+	updateChecksums = "SHA256SUMS"
+	// updateMaxSize caps downloads so a broken release can't fill the disk.
+	updateMaxSize = 256 << 20
+)
+
+// updatePublicKey is the base64 ed25519 key release checksum files are
+// signed with (SHA256SUMS.sig). Empty means releases aren't signed yet and
+// only the checksum is verified, unless -public-key is given.
+var updatePublicKey = ""
+
+// release is the part of a GitHub release the updater reads.
+type release struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r *release) assetURL(name string) string {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+// updater fetches and verifies release binaries.
+type updater struct {
+	api, repo    string
+	goos, goarch string
+	publicKey    ed25519.PublicKey // nil: checksum only
+	client       *http.Client
+}
+
+// assetName is the release binary for the updater's platform, e.g.
+// mc-dual-proxy_linux_amd64.
+func (u *updater) assetName() string {
+	name := "mc-dual-proxy_" + u.goos + "_" + u.goarch
+	if u.goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func (u *updater) get(url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "mc-dual-proxy/"+version)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("GET %s: larger than %s", url, formatBytes(limit))
+	}
+	return data, nil
+}
+
+// latest looks up the newest release.
+func (u *updater) latest() (*release, error) {
+	data, err := u.get(u.api+"/repos/"+u.repo+"/releases/latest", 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	rel := &release{}
+	if err := json.Unmarshal(data, rel); err != nil {
+		return nil, fmt.Errorf("parsing release: %w", err)
+	}
+	return rel, nil
+}
+
+// download fetches the platform's binary from rel and checks it against the
+// release's SHA256SUMS, whose signature is verified first if the updater
+// has a public key.
+func (u *updater) download(rel *release) ([]byte, error) {
+	name := u.assetName()
+	binURL, sumsURL := rel.assetURL(name), rel.assetURL(updateChecksums)
+	if binURL == "" {
+		return nil, fmt.Errorf("release %s has no %s", rel.Tag, name)
+	}
+	if sumsURL == "" {
+		return nil, fmt.Errorf("release %s has no %s to verify the download with", rel.Tag, updateChecksums)
+	}
+	sums, err := u.get(sumsURL, 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	if u.publicKey != nil {
+		sigURL := rel.assetURL(updateChecksums + ".sig")
+		if sigURL == "" {
+			return nil, fmt.Errorf("release %s has no %s.sig", rel.Tag, updateChecksums)
+		}
+		encoded, err := u.get(sigURL, 4096)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || !ed25519.Verify(u.publicKey, sums, sig) {
+			return nil, fmt.Errorf("%s signature doesn't verify", updateChecksums)
+		}
+	}
+	want, ok := findChecksum(sums, name)
+	if !ok {
+		return nil, fmt.Errorf("%s has no entry for %s", updateChecksums, name)
+	}
+	data, err := u.get(binURL, updateMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != want {
+		return nil, fmt.Errorf("checksum mismatch for %s: got %x, want %s", name, sum, want)
+	}
+	return data, nil
+}
+
+// findChecksum looks name up in sha256sum output ("HASH  NAME" lines, with a
+// * before the name in binary mode).
+func findChecksum(sums []byte, name string) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), true
+		}
+	}
+	return "", false
+}
+
+// replaceExecutable swaps the binary at exe for data: it is written next to
+// exe and renamed over it, so a crash halfway leaves the old binary in
+// place. Windows can't replace a running executable but can rename it, so
+// there the old one is moved aside to exe.old first.
+func replaceExecutable(exe string, data []byte) error {
+	mode := os.FileMode(0o755)
+	if info, err := os.Stat(exe); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".mc-dual-proxy-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), exe); err != nil {
+			os.Rename(old, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+// compareVersions orders release tags like v1.2.3 numerically; tags that
+// aren't numeric compare as strings.
+func compareVersions(a, b string) int {
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var sa, sb string
+		if i < len(pa) {
+			sa = pa[i]
+		}
+		if i < len(pb) {
+			sb = pb[i]
+		}
+		na, errA := strconv.Atoi(sa)
+		nb, errB := strconv.Atoi(sb)
+		switch {
+		case sa == sb:
+			continue
+		case errA == nil && errB == nil && na != nb:
+			if na < nb {
+				return -1
+			}
+			return 1
+		case sa < sb:
+			return -1
+		default:
+			return 1
+		}
+	}
+	return 0
+}
+
+// runUpdate implements the update subcommand.
+func runUpdate(args []string) error {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mc-dual-proxy update [flags]")
+		fmt.Fprintln(fs.Output(), "Replaces this binary with the latest release for this platform, after verifying its checksum.")
+		fmt.Fprintln(fs.Output(), "The running proxy keeps the old binary until it is restarted.")
+		fs.PrintDefaults()
+	}
+	check := fs.Bool("check", false, "Only report whether a newer release exists")
+	force := fs.Bool("force", false, "Install the latest release even if it isn't newer (or this is a source build)")
+	repo := fs.String("repo", updateRepo, "GitHub repository releases are taken from")
+	api := fs.String("api", updateAPI, "GitHub API base URL, for mirrors and GitHub Enterprise")
+	publicKey := fs.String("public-key", updatePublicKey, "Base64 ed25519 key SHA256SUMS.sig must verify with (empty: checksum only)")
+	fs.Parse(args)
+
+	u := &updater{
+		api: strings.TrimSuffix(*api, "/"), repo: *repo,
+		goos: runtime.GOOS, goarch: runtime.GOARCH,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+	if *publicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(*publicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("invalid -public-key (expected a base64 ed25519 public key)")
+		}
+		u.publicKey = key
+	}
+
+	rel, err := u.latest()
+	if err != nil {
+		return fmt.Errorf("checking for updates: %w", err)
+	}
+	fmt.Printf("Running %s, latest release is %s\n", version, rel.Tag)
+	switch {
+	case *force:
+	case version == "dev":
+		if *check {
+			return nil
+		}
+		return errors.New("this is a source build; use -force to replace it with the release anyway")
+	case compareVersions(version, rel.Tag) >= 0:
+		fmt.Println("Already up to date")
+		return nil
+	}
+	if *check {
+		fmt.Printf("Run mc-dual-proxy update to install %s\n", rel.Tag)
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	fmt.Printf("Downloading %s...\n", u.assetName())
+	data, err := u.download(rel)
+	if err != nil {
+		return err
+	}
+	if u.publicKey != nil {
+		fmt.Println("Signature and checksum verified")
+	} else {
+		fmt.Println("Checksum verified")
+	}
+	if err := replaceExecutable(exe, data); err != nil {
+		return fmt.Errorf("replacing %s: %w", exe, err)
+	}
+	fmt.Printf("Installed %s to %s; restart the proxy to run it\n", rel.Tag, exe)
+	return nil
+}
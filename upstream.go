@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// upstreamTransport tunes the connection pool to the session servers. The
+// net/http defaults keep only 2 idle connections per host, so a burst of
+// logins to the same two upstreams opens (and TLS-handshakes) a new
+// connection for most requests.
+type upstreamTransport struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	TLSHandshakeTimeout time.Duration
+	KeepAlive           time.Duration // TCP keep-alive probe interval; negative disables
+}
+
+// defaultUpstreamTransport matches the -upstream-* flag defaults.
+var defaultUpstreamTransport = upstreamTransport{
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 32,
+	IdleConnTimeout:     90 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	KeepAlive:           30 * time.Second,
+}
+
+// defaultUpstreamClient is used when Config.UpstreamClient is nil.
+var defaultUpstreamClient = newUpstreamClient(defaultUpstreamTransport)
+
+// newUpstreamClient returns the client hasJoined requests are made with.
+// Redirects are not followed, for safety.
+func newUpstreamClient(t upstreamTransport) *http.Client {
+	return &http.Client{
+		Timeout: upstreamTimeout,
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: t.KeepAlive}).DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          t.MaxIdleConns,
+			MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+			IdleConnTimeout:       t.IdleConnTimeout,
+			TLSHandshakeTimeout:   t.TLSHandshakeTimeout,
+			ExpectContinueTimeout: time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
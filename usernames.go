@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// usernamePattern matches valid Minecraft usernames.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,16}$`)
+
+// usernameFilter refuses hasJoined requests for names that can't be valid
+// Minecraft usernames or that match an operator-defined block pattern
+// (-block-username), e.g. slurs or impersonations of staff names.
+type usernameFilter struct {
+	blocked []*regexp.Regexp
+}
+
+// newUsernameFilter compiles the block patterns, which match anywhere in the
+// name and ignore case.
+func newUsernameFilter(patterns []string) (*usernameFilter, error) {
+	f := &usernameFilter{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("block pattern %q: %w", pattern, err)
+		}
+		f.blocked = append(f.blocked, re)
+	}
+	return f, nil
+}
+
+// check returns why username is refused ("invalid_username" or
+// "blocked_username"), or "" if it is allowed.
+func (f *usernameFilter) check(username string) string {
+	if !usernamePattern.MatchString(username) {
+		return "invalid_username"
+	}
+	for _, re := range f.blocked {
+		if re.MatchString(username) {
+			return "blocked_username"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginStartTimeout is how long a login may take to send Login Start when
+// the name is needed before the backend is dialed.
+const loginStartTimeout = 5 * time.Second
+
+// userRouter sends logins of given players to other backends (-user-route),
+// e.g. staff to a staging server or a streamer to a dedicated one. Rules are
+// checked in order and the first listing the player wins; everyone else goes
+// to the default backend.
+type userRouter struct {
+	rules []*userRoute
+}
+
+// userRoute lists players, inline or in a file, and the backend they use.
+type userRoute struct {
+	backend  string
+	resolver *backendResolver // nil if backend is an IP address
+	file     string           // "" for inline names
+
+	mu      sync.Mutex
+	names   map[string]bool // lowercased
+	modTime time.Time       // of file when last read
+}
+
+// parseUserRoutes parses -user-route rules of the form NAMES=BACKEND, where
+// NAMES is a comma-separated list of usernames or @FILE, a file with one
+// username per line (# starts a comment).
+func parseUserRoutes(specs []string) (*userRouter, error) {
+	router := &userRouter{}
+	for _, spec := range specs {
+		names, backend, ok := strings.Cut(spec, "=")
+		names, backend = strings.TrimSpace(names), strings.TrimSpace(backend)
+		if !ok || names == "" || backend == "" {
+			return nil, fmt.Errorf("expected NAMES=BACKEND, got %q", spec)
+		}
+		resolver, err := newBackendResolver(backend)
+		if err != nil {
+			return nil, fmt.Errorf("backend %q: %w", backend, err)
+		}
+		rule := &userRoute{backend: backend, resolver: resolver}
+		if file, isFile := strings.CutPrefix(names, "@"); isFile {
+			rule.file = file
+			if err := rule.load(); err != nil {
+				return nil, err
+			}
+		} else {
+			rule.names = make(map[string]bool)
+			for _, name := range strings.Split(names, ",") {
+				if name = strings.TrimSpace(name); !usernamePattern.MatchString(name) {
+					return nil, fmt.Errorf("invalid username %q", name)
+				}
+				rule.names[strings.ToLower(name)] = true
+			}
+		}
+		router.rules = append(router.rules, rule)
+	}
+	return router, nil
+}
+
+// load reads the rule's file if it changed since the last read.
+func (r *userRoute) load() error {
+	info, err := os.Stat(r.file)
+	if err != nil {
+		return err
+	}
+	if r.names != nil && info.ModTime().Equal(r.modTime) {
+		return nil
+	}
+	f, err := os.Open(r.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		name, _, _ := strings.Cut(scanner.Text(), "#")
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !usernamePattern.MatchString(name) {
+			return fmt.Errorf("%s:%d: invalid username %q", r.file, line, name)
+		}
+		names[strings.ToLower(name)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	r.names, r.modTime = names, info.ModTime()
+	return nil
+}
+
+// lists reports whether the rule applies to username. A file that changed
+// is read again first; if that fails, the names read last are kept.
+func (r *userRoute) lists(username string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != "" {
+		if err := r.load(); err != nil {
+			warnf("[tcp] Failed to reload user route file: %v", err)
+		}
+	}
+	return r.names[strings.ToLower(username)]
+}
+
+// route returns the rule that applies to username, or nil.
+func (u *userRouter) route(username string) *userRoute {
+	if u == nil || username == "" {
+		return nil
+	}
+	for _, rule := range u.rules {
+		if rule.lists(username) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// candidates returns the addresses to dial for the rule's backend.
+func (r *userRoute) candidates() []string {
+	if r.resolver != nil {
+		return r.resolver.candidates()
+	}
+	return []string{r.backend}
+}
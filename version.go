@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build details, set at release time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Source builds say dev and take the commit and date from the VCS stamp go
+// build embeds, if any.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo is what -version prints and /api/status reports.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Modified  bool   `json:"modified,omitempty"` // built from a dirty tree
+}
+
+// currentBuild returns the build details of this binary.
+func currentBuild() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if b.Commit == "" {
+					b.Commit = s.Value
+				}
+			case "vcs.time":
+				if b.BuildDate == "" {
+					b.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				b.Modified = s.Value == "true"
+			}
+		}
+	}
+	return b
+}
+
+// String formats the details on one line, e.g. "v1.2.3 (commit 0123abcd,
+// built 2024-05-01T12:00:00Z, go1.22.3)".
+func (b buildInfo) String() string {
+	s := b.Version + " ("
+	if b.Commit != "" {
+		c := b.Commit
+		if len(c) > 12 {
+			c = c[:12]
+		}
+		if b.Modified {
+			c += "-dirty"
+		}
+		s += "commit " + c + ", "
+	}
+	if b.BuildDate != "" {
+		s += "built " + b.BuildDate + ", "
+	}
+	return s + fmt.Sprintf("%s %s/%s)", b.GoVersion, runtime.GOOS, runtime.GOARCH)
+}
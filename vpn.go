@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// vpnCheckInterval is how often at most a -vpn-ranges file is checked for
+// changes, so logins don't stat every list.
+const vpnCheckInterval = time.Second
+
+// vpnBlockedMessage is shown to players refused for connecting from a VPN
+// or hosting provider.
+const vpnBlockedMessage = "Connections from VPNs and hosting providers are not allowed here. Please join from your home connection."
+
+// What -vpn-policy does with logins from a listed network.
+const (
+	vpnBlock     = "block"     // refuse them
+	vpnWhitelist = "whitelist" // only let in players on -vpn-whitelist
+	vpnTag       = "tag"       // let them in, naming the network in a PROXY v2 TLV
+)
+
+// vpnDetector recognizes players connecting from VPNs, proxies and hosting
+// providers by offline lists of their address ranges (-vpn-ranges), such as
+// the published VPN and datacenter lists, and applies -vpn-policy to their
+// logins. Lists are read again when they change on disk, so a cron job can
+// keep them current.
+type vpnDetector struct {
+	policy string
+	lists  []*vpnRangeList
+	allow  *whitelist // players let in from listed networks, for vpnWhitelist
+
+	blocked, allowed, tagged atomic.Int64
+}
+
+// vpnRangeList is one -vpn-ranges file and the label its networks get.
+// Lookups use the ranges read last without locking; one of them at a time
+// checks the file for changes (mu) now and then.
+type vpnRangeList struct {
+	label string
+	file  string
+
+	ranges  atomic.Pointer[addrRanges]
+	checked atomic.Int64 // UnixNano of the last check for changes
+
+	mu      sync.Mutex
+	modTime time.Time // of file when last read
+	failing bool
+
+	detected atomic.Int64
+}
+
+// parseVPNDetector sets up -vpn-ranges lists of the form [LABEL=]FILE, the
+// label defaulting to "vpn", for policy. allow is required for
+// vpnWhitelist and ignored otherwise.
+func parseVPNDetector(specs []string, policy string, allow *whitelist) (*vpnDetector, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	switch policy {
+	case vpnBlock, vpnTag:
+	case vpnWhitelist:
+		if allow == nil {
+			return nil, fmt.Errorf("policy %s needs -vpn-whitelist", policy)
+		}
+	default:
+		return nil, fmt.Errorf("unknown policy %q (expected block, whitelist or tag)", policy)
+	}
+	d := &vpnDetector{policy: policy, allow: allow}
+	for _, spec := range specs {
+		label, file, ok := strings.Cut(spec, "=")
+		if !ok {
+			label, file = "vpn", spec
+		}
+		label, file = strings.TrimSpace(label), strings.TrimSpace(file)
+		if label == "" || file == "" {
+			return nil, fmt.Errorf("expected [LABEL=]FILE, got %q", spec)
+		}
+		list := &vpnRangeList{label: label, file: file}
+		if err := list.load(); err != nil {
+			return nil, err
+		}
+		d.lists = append(d.lists, list)
+	}
+	return d, nil
+}
+
+// load reads the list's file if it changed since the last read: one IP or
+// CIDR range per line, # starting a comment.
+func (l *vpnRangeList) load() error {
+	info, err := os.Stat(l.file)
+	if err != nil {
+		return err
+	}
+	if l.ranges.Load() != nil && info.ModTime().Equal(l.modTime) {
+		return nil
+	}
+	f, err := os.Open(l.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	prefixes := []netip.Prefix{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry, _, _ := strings.Cut(scanner.Text(), "#")
+		parsed, err := parseTrustedProxies(entry)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", l.file, line, err)
+		}
+		prefixes = append(prefixes, parsed...)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	l.ranges.Store(newAddrRanges(prefixes))
+	l.modTime = info.ModTime()
+	l.checked.Store(time.Now().UnixNano())
+	return nil
+}
+
+// contains reports whether ip is in one of the list's networks. A file that
+// changed is read again first; if that fails, the ranges read last are kept.
+func (l *vpnRangeList) contains(ip netip.Addr) bool {
+	l.refresh()
+	return l.ranges.Load().contains(ip)
+}
+
+// refresh reads the file again if it changed, at most every
+// vpnCheckInterval. Logins arriving while another one does that go on with
+// the ranges read last.
+func (l *vpnRangeList) refresh() {
+	now := time.Now()
+	if now.Sub(time.Unix(0, l.checked.Load())) < vpnCheckInterval || !l.mu.TryLock() {
+		return
+	}
+	defer l.mu.Unlock()
+	l.checked.Store(now.UnixNano())
+	err := l.load()
+	if err != nil && !l.failing {
+		warnf("[vpn] Failed to reload %s: %v", l.file, err)
+	} else if err == nil && l.failing {
+		infof("[vpn] Reading %s works again", l.file)
+	}
+	l.failing = err != nil
+}
+
+// addrRanges is a set of networks as sorted, non-overlapping address
+// ranges, so looking up an address is a binary search however long the
+// list is.
+type addrRanges struct {
+	ranges   []addrRange
+	prefixes int // networks the set was built from
+}
+
+type addrRange struct {
+	first, last netip.Addr
+}
+
+func newAddrRanges(prefixes []netip.Prefix) *addrRanges {
+	set := &addrRanges{prefixes: len(prefixes)}
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+		set.ranges = append(set.ranges, addrRange{prefix.Addr(), lastAddr(prefix)})
+	}
+	sort.Slice(set.ranges, func(i, j int) bool { return set.ranges[i].first.Less(set.ranges[j].first) })
+	// Merge overlapping ranges so at most one can contain an address
+	merged := set.ranges[:0]
+	for _, r := range set.ranges {
+		if n := len(merged); n > 0 && r.first.BitLen() == merged[n-1].first.BitLen() && r.first.Compare(merged[n-1].last) <= 0 {
+			if r.last.Compare(merged[n-1].last) > 0 {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	set.ranges = merged
+	return set
+}
+
+// lastAddr returns the last address of prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// contains reports whether ip is in one of the set's networks.
+func (s *addrRanges) contains(ip netip.Addr) bool {
+	if s == nil {
+		return false
+	}
+	// The last range starting at or before ip is the only candidate
+	i := sort.Search(len(s.ranges), func(i int) bool { return ip.Less(s.ranges[i].first) })
+	return i > 0 && s.ranges[i-1].first.BitLen() == ip.BitLen() && s.ranges[i-1].last.Compare(ip) >= 0
+}
+
+// detect returns the label of the first list containing the address of
+// addr (host or host:port), or "" if none does.
+func (d *vpnDetector) detect(addr string) string {
+	if d == nil {
+		return ""
+	}
+	ip, err := netip.ParseAddr(addrIP(addr))
+	if err != nil {
+		return ""
+	}
+	ip = ip.Unmap()
+	for _, list := range d.lists {
+		if list.contains(ip) {
+			list.detected.Add(1)
+			return list.label
+		}
+	}
+	return ""
+}
+
+// size returns how many ranges the lists hold.
+func (d *vpnDetector) size() int {
+	n := 0
+	for _, list := range d.lists {
+		if ranges := list.ranges.Load(); ranges != nil {
+			n += ranges.prefixes
+		}
+	}
+	return n
+}
+
+func (d *vpnDetector) String() string {
+	var labels []string
+	for _, list := range d.lists {
+		labels = append(labels, list.label)
+	}
+	return fmt.Sprintf("%s logins from %d ranges (%s)", d.policy, d.size(), strings.Join(labels, ", "))
+}
+
+// write adds the detection counters to the metrics.
+func (d *vpnDetector) write(p metricsSink) {
+	p.family("vpn_detected_total", "counter", "Logins from a network in each -vpn-ranges list.")
+	for _, list := range d.lists {
+		p.sample("vpn_detected_total", float64(list.detected.Load()), "list", list.label)
+	}
+	p.family("vpn_logins_total", "counter", "What -vpn-policy did with logins from listed networks.")
+	p.sample("vpn_logins_total", float64(d.blocked.Load()), "action", "blocked")
+	p.sample("vpn_logins_total", float64(d.allowed.Load()), "action", "whitelisted")
+	p.sample("vpn_logins_total", float64(d.tagged.Load()), "action", "tagged")
+	p.family("vpn_ranges", "gauge", "Address ranges in the -vpn-ranges lists.")
+	p.sample("vpn_ranges", float64(d.size()))
+}
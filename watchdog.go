@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Phases a connection handler goes through. A handler that stays in one far
+// longer than it should is a leak waiting to happen: a timeout that isn't
+// set, or a dial or read nothing will ever interrupt.
+const (
+	phaseHeader   = "header"   // reading the PROXY header and handshake
+	phaseDialing  = "dialing"  // connecting to (or waking) the backend
+	phaseRelaying = "relaying" // copying bytes both ways
+	phaseLimbo    = "limbo"    // holding the player until the backend is back
+)
+
+var handlerPhases = []string{phaseHeader, phaseDialing, phaseRelaying, phaseLimbo}
+
+// connHandler is one running handleConnection.
+type connHandler struct {
+	id         uint64
+	conn       net.Conn
+	clientAddr string
+	started    time.Time
+
+	mu      sync.Mutex
+	phase   string
+	since   time.Time // when phase was entered
+	flagged bool      // reported stuck in this phase already
+}
+
+// enter moves the handler to a new phase.
+func (h *connHandler) enter(phase string) {
+	h.mu.Lock()
+	h.phase, h.since, h.flagged = phase, time.Now(), false
+	h.mu.Unlock()
+}
+
+// handlerRegistry tracks every connection handler from accept to return,
+// unlike the tracker, which only sees connections that reached the backend.
+type handlerRegistry struct {
+	mu       sync.Mutex
+	nextID   uint64
+	handlers map[uint64]*connHandler
+
+	stuck  atomic.Int64 // handlers the watchdog reported
+	killed atomic.Int64 // handlers whose connection the watchdog closed
+}
+
+// handlers is the process-wide handler registry.
+var handlers = &handlerRegistry{handlers: make(map[uint64]*connHandler)}
+
+// open registers a handler for conn, starting in the header phase.
+func (r *handlerRegistry) open(conn net.Conn) *connHandler {
+	now := time.Now()
+	h := &connHandler{conn: conn, clientAddr: conn.RemoteAddr().String(), started: now, phase: phaseHeader, since: now}
+	r.mu.Lock()
+	r.nextID++
+	h.id = r.nextID
+	r.handlers[h.id] = h
+	r.mu.Unlock()
+	return h
+}
+
+func (r *handlerRegistry) close(h *connHandler) {
+	r.mu.Lock()
+	delete(r.handlers, h.id)
+	r.mu.Unlock()
+}
+
+// byPhase counts the running handlers in each phase.
+func (r *handlerRegistry) byPhase() map[string]int {
+	counts := make(map[string]int, len(handlerPhases))
+	for _, phase := range handlerPhases {
+		counts[phase] = 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, h := range r.handlers {
+		h.mu.Lock()
+		counts[h.phase]++
+		h.mu.Unlock()
+	}
+	return counts
+}
+
+// writeHandlerMetrics adds the registry's gauges and the watchdog counters.
+func writeHandlerMetrics(p metricsSink) {
+	counts := handlers.byPhase()
+	p.family("handlers", "gauge", "Running connection handlers by phase (header, dialing, relaying, limbo).")
+	for _, phase := range handlerPhases {
+		p.sample("handlers", float64(counts[phase]), "phase", phase)
+	}
+	p.family("watchdog_stuck_total", "counter", "Connection handlers the watchdog found stuck in a phase.")
+	p.sample("watchdog_stuck_total", float64(handlers.stuck.Load()))
+	p.family("watchdog_killed_total", "counter", "Stuck connection handlers whose connection the watchdog closed.")
+	p.sample("watchdog_killed_total", float64(handlers.killed.Load()))
+}
+
+// connWatchdog checks the handler registry for handlers that have been in
+// a phase longer than its limit (-watchdog), and with kill set closes their
+// connection, which ends any read or write they are blocked in.
+type connWatchdog struct {
+	limits   map[string]time.Duration
+	kill     bool
+	interval time.Duration
+	registry *handlerRegistry
+}
+
+// parseWatchdog parses PHASE=DURATION pairs, e.g. "header=30s,dialing=2m".
+func parseWatchdog(spec string, kill bool) (*connWatchdog, error) {
+	w := &connWatchdog{limits: make(map[string]time.Duration), kill: kill, registry: handlers}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		phase, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not PHASE=DURATION", part)
+		}
+		phase = strings.ToLower(strings.TrimSpace(phase))
+		known := false
+		for _, p := range handlerPhases {
+			known = known || p == phase
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown phase %q (expected %s)", phase, strings.Join(handlerPhases, ", "))
+		}
+		limit, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid duration %q for %s", value, phase)
+		}
+		w.limits[phase] = limit
+	}
+	if len(w.limits) == 0 {
+		return nil, fmt.Errorf("no phase limits in %q", spec)
+	}
+	// Check often enough that nothing overstays its limit by much
+	w.interval = time.Minute
+	for _, limit := range w.limits {
+		w.interval = min(w.interval, max(limit/4, time.Second))
+	}
+	return w, nil
+}
+
+func (w *connWatchdog) String() string {
+	var parts []string
+	for _, phase := range handlerPhases {
+		if limit, ok := w.limits[phase]; ok {
+			parts = append(parts, phase+" "+limit.String())
+		}
+	}
+	s := strings.Join(parts, ", ")
+	if w.kill {
+		s += ", closing stuck connections"
+	}
+	return s
+}
+
+func (w *connWatchdog) run() {
+	for range time.Tick(w.interval) {
+		w.check(time.Now())
+	}
+}
+
+// check reports each handler over its phase limit once per phase, and
+// returns the IDs of the ones it found.
+func (w *connWatchdog) check(now time.Time) []uint64 {
+	w.registry.mu.Lock()
+	running := make([]*connHandler, 0, len(w.registry.handlers))
+	for _, h := range w.registry.handlers {
+		running = append(running, h)
+	}
+	w.registry.mu.Unlock()
+	sort.Slice(running, func(i, j int) bool { return running[i].id < running[j].id })
+
+	var stuck []uint64
+	for _, h := range running {
+		h.mu.Lock()
+		phase, since := h.phase, h.since
+		limit, ok := w.limits[phase]
+		over := ok && !h.flagged && now.Sub(since) > limit
+		if over {
+			h.flagged = true
+		}
+		h.mu.Unlock()
+		if !over {
+			continue
+		}
+		stuck = append(stuck, h.id)
+		w.registry.stuck.Add(1)
+		action := "leaving it"
+		if w.kill {
+			h.conn.Close()
+			w.registry.killed.Add(1)
+			action = "closing it"
+		}
+		warnf("[watchdog] %s: handler stuck in %s for %s (limit %s), %s", h.clientAddr, phase, now.Sub(since).Round(time.Second), limit, action)
+		events.publish(eventConnStuck, map[string]any{
+			"client":  h.clientAddr,
+			"phase":   phase,
+			"seconds": now.Sub(since).Seconds(),
+			"killed":  w.kill,
+		})
+	}
+	return stuck
+}
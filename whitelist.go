@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultWhitelistMessage is shown to players who aren't whitelisted.
+const defaultWhitelistMessage = "You are not whitelisted on this server."
+
+const (
+	// whitelistPollInterval is how often a whitelist read from a URL is
+	// fetched again.
+	whitelistPollInterval = 30 * time.Second
+
+	// whitelistFetchTimeout bounds fetching a whitelist URL.
+	whitelistFetchTimeout = 10 * time.Second
+)
+
+// errWhitelistReadOnly is returned for changes to a whitelist read from a
+// URL, which has to be edited at its source.
+var errWhitelistReadOnly = errors.New("the whitelist is read from a URL; edit it there")
+
+var whitelistClient = &http.Client{Timeout: whitelistFetchTimeout}
+
+// whitelistEntry is one player on the whitelist, in the format of vanilla's
+// whitelist.json, so that file can be used as is.
+type whitelistEntry struct {
+	UUID string `json:"uuid,omitempty"` // dashed; empty until known
+	Name string `json:"name"`
+}
+
+// whitelist lets only listed players in (-whitelist). Names are checked on
+// Login Start, before the backend is dialed, and at auth time, before any
+// session server is queried. Entries with a UUID are also checked against
+// the authenticated profile, so a name that changed hands isn't let in.
+//
+// The file is persisted on every change made through the admin API and read
+// again when it changes on disk, e.g. when the backend's whitelist.json is
+// shared. A whitelist read from a URL instead, such as the backend's file
+// served over HTTP, is fetched every whitelistPollInterval and can't be
+// changed through the proxy.
+type whitelist struct {
+	path    string // file or http(s) URL
+	message string
+
+	mu      sync.RWMutex
+	byName  map[string]whitelistEntry // lowercased name → entry
+	modTime time.Time                 // of path when last read or written
+	etag    string                    // of the URL when last fetched
+	fetched []byte                    // body of the URL when last fetched
+	failing bool                      // the last fetch of the URL failed
+}
+
+// loadWhitelist reads the whitelist from path, creating an empty one if it
+// doesn't exist yet. A URL has to be fetched successfully and is then
+// polled for changes.
+func loadWhitelist(path, message string) (*whitelist, error) {
+	wl := &whitelist{path: path, message: message, byName: make(map[string]whitelistEntry)}
+	if wl.isURL() {
+		if err := wl.fetch(); err != nil {
+			return nil, err
+		}
+		go wl.poll(whitelistPollInterval)
+		return wl, nil
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return wl, wl.saveLocked()
+	}
+	if err := wl.reloadLocked(); err != nil {
+		return nil, err
+	}
+	return wl, nil
+}
+
+// reloadLocked reads the file if it changed since the last read or write.
+// Must be called with wl.mu held for writing (or before wl is shared).
+func (wl *whitelist) reloadLocked() error {
+	info, err := os.Stat(wl.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(wl.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(wl.path)
+	if err != nil {
+		return err
+	}
+	byName, err := parseWhitelist(data, wl.path)
+	if err != nil {
+		return err
+	}
+	wl.byName, wl.modTime = byName, info.ModTime()
+	return nil
+}
+
+// parseWhitelist parses the contents of a whitelist.json read from source.
+func parseWhitelist(data []byte, source string) (map[string]whitelistEntry, error) {
+	var entries []whitelistEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", source, err)
+	}
+	byName := make(map[string]whitelistEntry, len(entries))
+	for _, e := range entries {
+		e, err := normalizeWhitelistEntry(e)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		byName[strings.ToLower(e.Name)] = e
+	}
+	return byName, nil
+}
+
+func (wl *whitelist) isURL() bool {
+	return strings.HasPrefix(wl.path, "http://") || strings.HasPrefix(wl.path, "https://")
+}
+
+// fetch reads the whitelist from its URL. It is requested with the last
+// ETag, so an unchanged list costs a 304.
+func (wl *whitelist) fetch() error {
+	req, err := http.NewRequest(http.MethodGet, wl.path, nil)
+	if err != nil {
+		return err
+	}
+	wl.mu.RLock()
+	etag := wl.etag
+	wl.mu.RUnlock()
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := whitelistClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("%s returned %s", wl.path, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	if wl.fetched != nil && bytes.Equal(data, wl.fetched) {
+		return nil
+	}
+	byName, err := parseWhitelist(data, wl.path)
+	if err != nil {
+		return err
+	}
+	if wl.fetched != nil {
+		infof("[config] Reloaded whitelist %s (%d players)", wl.path, len(byName))
+	}
+	wl.byName, wl.etag, wl.fetched = byName, resp.Header.Get("ETag"), data
+	return nil
+}
+
+// poll fetches the whitelist URL every interval. On failure the entries
+// fetched last stay in effect; failures are logged when they start and when
+// fetches work again, not on every attempt.
+func (wl *whitelist) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := wl.fetch()
+		switch {
+		case err != nil && !wl.failing:
+			warnf("[config] Failed to fetch whitelist, keeping the last one: %v", err)
+		case err == nil && wl.failing:
+			infof("[config] Fetched whitelist %s again", wl.path)
+		}
+		wl.failing = err != nil
+	}
+}
+
+// refresh picks up changes made to the file by others. On failure the
+// entries read last stay in effect.
+func (wl *whitelist) refresh() {
+	if wl.isURL() {
+		return
+	}
+	wl.mu.RLock()
+	info, err := os.Stat(wl.path)
+	unchanged := err == nil && info.ModTime().Equal(wl.modTime)
+	wl.mu.RUnlock()
+	if unchanged {
+		return
+	}
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	if err := wl.reloadLocked(); err != nil {
+		warnf("[config] Failed to reload whitelist: %v", err)
+		// Warn once per change, not on every login
+		if info, err := os.Stat(wl.path); err == nil {
+			wl.modTime = info.ModTime()
+		}
+		return
+	}
+	infof("[config] Reloaded whitelist %s (%d players)", wl.path, len(wl.byName))
+}
+
+// normalizeWhitelistEntry validates e and dashes its UUID.
+func normalizeWhitelistEntry(e whitelistEntry) (whitelistEntry, error) {
+	e.Name = strings.TrimSpace(e.Name)
+	if !usernamePattern.MatchString(e.Name) {
+		return whitelistEntry{}, fmt.Errorf("invalid username %q", e.Name)
+	}
+	if e.UUID != "" {
+		id := strings.ToLower(strings.ReplaceAll(e.UUID, "-", ""))
+		if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+			return whitelistEntry{}, fmt.Errorf("invalid UUID %q", e.UUID)
+		}
+		e.UUID = dashUUID(id)
+	}
+	return e, nil
+}
+
+// allowsName reports whether username is on the whitelist.
+func (wl *whitelist) allowsName(username string) bool {
+	wl.refresh()
+	wl.mu.RLock()
+	defer wl.mu.RUnlock()
+	_, ok := wl.byName[strings.ToLower(username)]
+	return ok
+}
+
+// allowsProfile reports whether an authenticated player is on the whitelist:
+// their name is listed, with their UUID if the entry has one.
+func (wl *whitelist) allowsProfile(username, uuid string) bool {
+	wl.mu.RLock()
+	defer wl.mu.RUnlock()
+	e, ok := wl.byName[strings.ToLower(username)]
+	return ok && (e.UUID == "" || uuid == "" || strings.EqualFold(e.UUID, dashUUID(uuid)))
+}
+
+// profileID returns the id of a hasJoined profile, or "" if there is none.
+func profileID(body []byte) string {
+	var profile struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(body, &profile)
+	return profile.ID
+}
+
+// add puts a player on the whitelist, replacing any entry with their name,
+// and saves the list.
+func (wl *whitelist) add(e whitelistEntry) (whitelistEntry, error) {
+	if wl.isURL() {
+		return whitelistEntry{}, errWhitelistReadOnly
+	}
+	e, err := normalizeWhitelistEntry(e)
+	if err != nil {
+		return whitelistEntry{}, err
+	}
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	wl.byName[strings.ToLower(e.Name)] = e
+	return e, wl.saveLocked()
+}
+
+// remove takes a player off the whitelist and saves the list. It reports
+// whether they were on it.
+func (wl *whitelist) remove(username string) (bool, error) {
+	if wl.isURL() {
+		return false, errWhitelistReadOnly
+	}
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	key := strings.ToLower(strings.TrimSpace(username))
+	if _, ok := wl.byName[key]; !ok {
+		return false, nil
+	}
+	delete(wl.byName, key)
+	return true, wl.saveLocked()
+}
+
+// list returns the whitelist sorted by name.
+func (wl *whitelist) list() []whitelistEntry {
+	wl.refresh()
+	wl.mu.RLock()
+	defer wl.mu.RUnlock()
+	return wl.sortedLocked()
+}
+
+// sortedLocked returns the entries sorted by name. Must be called with wl.mu
+// held.
+func (wl *whitelist) sortedLocked() []whitelistEntry {
+	entries := make([]whitelistEntry, 0, len(wl.byName))
+	for _, e := range wl.byName {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return strings.ToLower(entries[i].Name) < strings.ToLower(entries[j].Name) })
+	return entries
+}
+
+// saveLocked writes the whitelist to disk atomically. Must be called with
+// wl.mu held for writing.
+func (wl *whitelist) saveLocked() error {
+	data, err := json.MarshalIndent(wl.sortedLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(wl.path), ".whitelist-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), wl.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(wl.path); err == nil {
+		wl.modTime = info.ModTime()
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// wakeResendInterval limits how often magic packets are sent while the
+	// backend host is waking up.
+	wakeResendInterval = 10 * time.Second
+
+	// wakeHoldTime is how long a login is held open while waiting for a
+	// woken backend host. Clients give up on a silent login after about 30
+	// seconds, and a dial may take up to dialTimeout on top of this.
+	wakeHoldTime = 15 * time.Second
+
+	// wakeRetryInterval is the pause between dials to a waking backend.
+	wakeRetryInterval = time.Second
+)
+
+// wakeOnLAN wakes a sleeping backend machine with a magic packet.
+type wakeOnLAN struct {
+	mac       net.HardwareAddr
+	broadcast string // UDP address the magic packet is sent to
+
+	mu       sync.Mutex
+	lastSent time.Time
+}
+
+func newWakeOnLAN(mac, broadcast string) (*wakeOnLAN, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	if len(hw) != 6 {
+		return nil, fmt.Errorf("expected a 6-byte MAC address, got %q", mac)
+	}
+	if _, _, err := net.SplitHostPort(broadcast); err != nil {
+		return nil, fmt.Errorf("invalid broadcast address %q: %w", broadcast, err)
+	}
+	return &wakeOnLAN{mac: hw, broadcast: broadcast}, nil
+}
+
+// wake sends a magic packet, unless one was sent recently.
+func (w *wakeOnLAN) wake() {
+	w.mu.Lock()
+	if time.Since(w.lastSent) < wakeResendInterval {
+		w.mu.Unlock()
+		return
+	}
+	w.lastSent = time.Now()
+	w.mu.Unlock()
+
+	conn, err := net.Dial("udp", w.broadcast)
+	if err != nil {
+		warnf("[tcp] Wake-on-LAN: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write(magicPacket(w.mac)); err != nil {
+		warnf("[tcp] Wake-on-LAN: %v", err)
+		return
+	}
+	infof("[tcp] sent Wake-on-LAN packet for %s to %s", w.mac, w.broadcast)
+}
+
+// holdText is shown to players held while the backend host wakes up.
+func (w *wakeOnLAN) holdText() string { return wakingText }
+
+// backendWaker brings up a backend that is asleep: a machine woken with
+// Wake-on-LAN, or a hibernating Minehut server started through its API.
+type backendWaker interface {
+	// wake asks for the backend to come up, unless it was asked recently.
+	wake()
+	// holdText is what held players see before the countdown.
+	holdText() string
+}
+
+// wakeAndDial wakes the backend and retries dial until it succeeds or
+// wakeHoldTime elapses, repeating the wake-up call as needed.
+func wakeAndDial(w backendWaker, dial func() (net.Conn, error)) (net.Conn, error) {
+	deadline := time.Now().Add(wakeHoldTime)
+	for {
+		w.wake()
+		conn, err := dial()
+		if err == nil || time.Now().After(deadline) {
+			return conn, err
+		}
+		time.Sleep(wakeRetryInterval)
+	}
+}
+
+// magicPacket builds a Wake-on-LAN magic packet: six 0xFF bytes followed by
+// the MAC address repeated 16 times.
+func magicPacket(mac net.HardwareAddr) []byte {
+	return append(bytes.Repeat([]byte{0xFF}, 6), bytes.Repeat(mac, 16)...)
+}